@@ -0,0 +1,134 @@
+package imageservice
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/mistifyio/mistify-image-service/metadata"
+	log "github.com/sirupsen/logrus"
+)
+
+// RegisterAdminRoutes registers the administrative routes and handlers
+func RegisterAdminRoutes(prefix string, router *mux.Router) {
+	sub := router.PathPrefix(prefix).Subrouter()
+	sub.HandleFunc("/check", checkHandler).Methods("POST")
+	sub.HandleFunc("/backup", backupHandler).Methods("GET")
+	sub.HandleFunc("/relocate", startRelocateHandler).Methods("POST")
+	sub.HandleFunc("/relocate", relocateStatusHandler).Methods("GET")
+	sub.HandleFunc("/replication", replicationStatusHandler).Methods("GET")
+	sub.HandleFunc("/replication/{peer}/sync", syncPeerHandler).Methods("POST")
+	sub.HandleFunc("/tokens", listTokensHandler).Methods("GET")
+	sub.HandleFunc("/tokens", createTokenHandler).Methods("POST")
+	sub.HandleFunc("/tokens/{tokenID}", revokeTokenHandler).Methods("DELETE")
+}
+
+// checkHandler runs a consistency check between the metadata and image stores.
+// The optional request body contains the CheckOptions.
+func checkHandler(w http.ResponseWriter, r *http.Request) {
+	hr := HTTPResponse{w}
+	ctx := GetContext(r)
+
+	options := &CheckOptions{}
+	if err := json.NewDecoder(r.Body).Decode(options); err != nil && err != io.EOF {
+		hr.JSONMsg(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	report, err := Check(ctx, options)
+	if err != nil {
+		hr.JSONError(http.StatusInternalServerError, err)
+		return
+	}
+	hr.JSON(http.StatusOK, report)
+}
+
+// backupHandler streams a consistent snapshot of the metadata store, if the
+// store supports online backups
+func backupHandler(w http.ResponseWriter, r *http.Request) {
+	hr := HTTPResponse{w}
+	ctx := GetContext(r)
+
+	backuper, ok := ctx.MetadataStore.(metadata.Backuper)
+	if !ok {
+		hr.JSONMsg(http.StatusNotImplemented, "metadata store does not support backups")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="metadata.backup"`)
+	// Once streaming has started the status can no longer be changed, so a
+	// failure is only logged and the client sees a truncated body
+	if err := backuper.Backup(w); err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Error("failed to write metadata backup")
+	}
+}
+
+// startRelocateHandler starts moving image data to another image store in the
+// background. The request body contains the RelocateRequest.
+func startRelocateHandler(w http.ResponseWriter, r *http.Request) {
+	hr := HTTPResponse{w}
+	ctx := GetContext(r)
+
+	req := &RelocateRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		hr.JSONMsg(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	status, err := ctx.Relocator.Start(req)
+	if err != nil {
+		code := http.StatusInternalServerError
+		switch err {
+		case ErrUnknownImageStore:
+			code = http.StatusBadRequest
+		case ErrRelocationRunning:
+			code = http.StatusConflict
+		}
+		hr.JSONError(code, err)
+		return
+	}
+	hr.JSON(http.StatusAccepted, status)
+}
+
+// relocateStatusHandler reports the progress of the current or most recent
+// relocation
+func relocateStatusHandler(w http.ResponseWriter, r *http.Request) {
+	hr := HTTPResponse{w}
+	ctx := GetContext(r)
+
+	status := ctx.Relocator.Status()
+	if status == nil {
+		hr.JSONMsg(http.StatusNotFound, "no relocation has run")
+		return
+	}
+	hr.JSON(http.StatusOK, status)
+}
+
+// replicationStatusHandler reports the replication status of each peer
+func replicationStatusHandler(w http.ResponseWriter, r *http.Request) {
+	hr := HTTPResponse{w}
+	ctx := GetContext(r)
+
+	hr.JSON(http.StatusOK, ctx.Replicator.Status())
+}
+
+// syncPeerHandler starts a sync with a peer in the background
+func syncPeerHandler(w http.ResponseWriter, r *http.Request) {
+	hr := HTTPResponse{w}
+	ctx := GetContext(r)
+
+	status, err := ctx.Replicator.Trigger(mux.Vars(r)["peer"])
+	if err != nil {
+		code := http.StatusInternalServerError
+		if err == ErrUnknownPeer {
+			code = http.StatusNotFound
+		}
+		hr.JSONError(code, err)
+		return
+	}
+	hr.JSON(http.StatusAccepted, status)
+}
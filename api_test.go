@@ -2,6 +2,8 @@ package imageservice_test
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -10,15 +12,17 @@ import (
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
-	log "github.com/Sirupsen/logrus"
 	"github.com/mistifyio/mistify-image-service"
 	"github.com/mistifyio/mistify-image-service/images"
 	"github.com/mistifyio/mistify-image-service/metadata"
 	logx "github.com/mistifyio/mistify-logrus-ext"
 	"github.com/pborman/uuid"
+	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 	"github.com/stretchr/testify/suite"
 	"github.com/tylerb/graceful"
@@ -26,7 +30,9 @@ import (
 
 type APITestSuite struct {
 	suite.Suite
-	Port        int
+	Port int
+	// Memory runs the suite with the memory stores instead of fs and kvite
+	Memory      bool
 	StoreDir    string
 	ImageData   []byte
 	APIServer   *graceful.Server
@@ -44,6 +50,14 @@ func (s *APITestSuite) SetupSuite() {
 			http.NotFound(w, r)
 			return
 		}
+		if strings.HasPrefix(r.URL.Path, "/stalled") {
+			// Send part of the image, then wait for the client to give up
+			w.Header().Set("Content-Length", strconv.Itoa(len(s.ImageData)))
+			_, _ = w.Write(s.ImageData[:len(s.ImageData)/2])
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+			return
+		}
 		if _, err := w.Write(s.ImageData); err != nil {
 			log.WithField("error", err).Error("Failed to write mock image data to response")
 		}
@@ -58,21 +72,28 @@ func (s *APITestSuite) SetupTest() {
 	// approaching a real in-memory Store. Might as well use actual stores
 	// (which are tested themselves in their respective packages)
 
-	s.StoreDir, _ = ioutil.TempDir("", "fetcherTest-"+uuid.New())
-	// Images Store Setup
-	imageStoreConfig := &images.FSConfig{
-		Dir: s.StoreDir,
-	}
-	viper.Set("imageStoreType", "fs")
-	viper.Set("imageStoreConfig", imageStoreConfig)
+	if s.Memory {
+		viper.Set("imageStoreType", "memory")
+		viper.Set("imageStoreConfig", &images.MemoryConfig{})
+		viper.Set("metadataStoreType", "memory")
+		viper.Set("metadataStoreConfig", &metadata.MemoryConfig{})
+	} else {
+		s.StoreDir, _ = ioutil.TempDir("", "fetcherTest-"+uuid.New())
+		// Images Store Setup
+		imageStoreConfig := &images.FSConfig{
+			Dir: s.StoreDir,
+		}
+		viper.Set("imageStoreType", "fs")
+		viper.Set("imageStoreConfig", imageStoreConfig)
 
-	// Metadata Store Setup
-	metadataStoreConfig := &metadata.KViteConfig{
-		Filename: filepath.Join(s.StoreDir, "kvite.db"),
-		Table:    "test",
+		// Metadata Store Setup
+		metadataStoreConfig := &metadata.KViteConfig{
+			Filename: filepath.Join(s.StoreDir, "kvite.db"),
+			Table:    "test",
+		}
+		viper.Set("metadataStoreType", "kvite")
+		viper.Set("metadataStoreConfig", metadataStoreConfig)
 	}
-	viper.Set("metadataStoreType", "kvite")
-	viper.Set("metadataStoreConfig", metadataStoreConfig)
 
 	// Set up context
 	ctx, err := imageservice.NewContext()
@@ -90,7 +111,9 @@ func (s *APITestSuite) TearDownTest() {
 	<-stopChan
 
 	// Cleanup store
-	s.NoError(os.RemoveAll(s.StoreDir))
+	if s.StoreDir != "" {
+		s.NoError(os.RemoveAll(s.StoreDir))
+	}
 }
 
 func (s *APITestSuite) TearDownSuite() {
@@ -101,6 +124,10 @@ func TestAPITestSuite(t *testing.T) {
 	suite.Run(t, new(APITestSuite))
 }
 
+func TestAPIMemoryTestSuite(t *testing.T) {
+	suite.Run(t, &APITestSuite{Memory: true})
+}
+
 func (s *APITestSuite) TestReceiveImage() {
 	tests := []struct {
 		description        string
@@ -132,6 +159,31 @@ func (s *APITestSuite) TestReceiveImage() {
 	}
 }
 
+func (s *APITestSuite) TestReceiveImageChecksum() {
+	tests := []struct {
+		description        string
+		checksumType       string
+		checksum           string
+		expectedStatusCode int
+	}{
+		{"invalid checksum type should fail", "asdf", "", http.StatusBadRequest},
+		{"mismatched checksum should fail", "md5", "asdf", http.StatusBadRequest},
+		{"missing checksum should succeed", "sha512", "", http.StatusOK},
+	}
+
+	for _, test := range tests {
+		req, _ := http.NewRequest("PUT", s.APIURL, bytes.NewBuffer(s.ImageData))
+		req.Header.Add("X-Image-Type", "kvm")
+		req.Header.Add("X-Image-Checksum-Type", test.checksumType)
+		req.Header.Add("X-Image-Checksum", test.checksum)
+
+		resp, err := http.DefaultClient.Do(req)
+		s.NoError(err, test.description)
+		s.Equal(test.expectedStatusCode, resp.StatusCode, test.description)
+		logx.LogReturnedErr(resp.Body.Close, nil, "failed to close receive response body")
+	}
+}
+
 func (s *APITestSuite) TestFetchImage() {
 	tests := []struct {
 		description        string
@@ -146,6 +198,10 @@ func (s *APITestSuite) TestFetchImage() {
 			[]byte(fmt.Sprintf(`{"source":"%s"}`, s.FetchServer.URL)), http.StatusBadRequest},
 		{"invalid image type should fail",
 			[]byte(fmt.Sprintf(`{"source":"%s","type":"asdf"}`, s.FetchServer.URL)), http.StatusBadRequest},
+		{"invalid checksum type should fail",
+			[]byte(fmt.Sprintf(`{"source":"%s","type":"kvm","checksum_type":"asdf"}`, s.FetchServer.URL)), http.StatusBadRequest},
+		{"unknown image store should fail",
+			[]byte(fmt.Sprintf(`{"source":"%s","type":"kvm","image_store":"asdf"}`, s.FetchServer.URL)), http.StatusBadRequest},
 		{"complete kvm request should succeed",
 			[]byte(fmt.Sprintf(`{"source":"%s","type":"kvm"}`, s.FetchServer.URL)), http.StatusAccepted},
 		{"complete container request should succeed",
@@ -170,7 +226,7 @@ func (s *APITestSuite) TestFetchImage() {
 		image, err := unmarshalImageResp(resp)
 		s.NoError(err, msg("resp body should be valid image json"))
 		s.NotEmpty(image.ID, msg("should have ID assigned"))
-		s.Equal(metadata.StatusPending, image.Status, msg("status should start out pending"))
+		s.Equal(metadata.StatusQueued, image.Status, msg("status should start out queued"))
 
 		// Poll until the fetch request completes or errors
 		finalImage := &metadata.Image{}
@@ -190,6 +246,36 @@ func (s *APITestSuite) TestFetchImage() {
 	}
 }
 
+func (s *APITestSuite) TestFetchImageServiceFields() {
+	// Fields maintained by the service can't be set by the client
+	requestData := []byte(fmt.Sprintf(`{"source":"%s","type":"kvm","digest":"0123456789abcdef",`+
+		`"peer":"foo","attempts":5,"status":"complete","download_start":"2016-01-02T15:04:05Z",`+
+		`"service_key_id":"foo","service_signature":"Zm9v"}`, s.FetchServer.URL+"?fields"))
+	resp, err := http.Post(s.APIURL, "application/json", bytes.NewBuffer(requestData))
+	s.Require().NoError(err)
+	defer logx.LogReturnedErr(resp.Body.Close, nil, "failed to close fetch response body")
+	s.Equal(http.StatusAccepted, resp.StatusCode)
+
+	image, err := unmarshalImageResp(resp)
+	s.Require().NoError(err)
+	s.Equal(metadata.StatusQueued, image.Status)
+	s.Empty(image.Digest, "digest should not be taken from the request")
+	s.Empty(image.Peer, "peer should not be taken from the request")
+	s.Empty(image.ServiceKeyID, "service key id should not be taken from the request")
+	s.Empty(image.ServiceSignature, "service signature should not be taken from the request")
+	s.True(image.DownloadStart.IsZero(), "download start should not be taken from the request")
+
+	for i := 0; i < 300 && image.Status != metadata.StatusComplete && image.Status != metadata.StatusError; i++ {
+		time.Sleep(10 * time.Millisecond)
+		image, _, err = s.getImage(image.ID)
+		s.Require().NoError(err)
+	}
+	s.Equal(metadata.StatusComplete, image.Status)
+	s.Equal(1, image.Attempts, "attempts should only count the fetch")
+	digest := sha256.Sum256(s.ImageData)
+	s.Equal(hex.EncodeToString(digest[:]), image.Digest, "digest should be of the fetched data")
+}
+
 func (s *APITestSuite) TestListImages() {
 	imageKVM, _, _ := s.uploadImage("kvm")
 	imageContainer, _, _ := s.uploadImage("container")
@@ -243,6 +329,56 @@ func (s *APITestSuite) TestListImages() {
 	}
 }
 
+func (s *APITestSuite) TestListImagesQuery() {
+	var expectedIDs []string
+	for i := 0; i < 3; i++ {
+		image, _, err := s.uploadImage("kvm")
+		s.Require().NoError(err)
+		expectedIDs = append(expectedIDs, image.ID)
+	}
+	_, _, _ = s.uploadImage("container")
+
+	// Follow cursors through every page
+	var listedIDs []string
+	cursor := ""
+	for pages := 0; pages < 5; pages++ {
+		resp, err := http.Get(fmt.Sprintf("%s?type=kvm&status=complete&sort=downloaded&limit=2&cursor=%s", s.APIURL, cursor))
+		s.Require().NoError(err)
+		s.Require().Equal(http.StatusOK, resp.StatusCode)
+		var images []*metadata.Image
+		s.NoError(json.NewDecoder(resp.Body).Decode(&images))
+		_ = resp.Body.Close()
+
+		s.True(len(images) <= 2, "page should not exceed the limit")
+		for _, image := range images {
+			listedIDs = append(listedIDs, image.ID)
+		}
+		cursor = resp.Header.Get("X-Next-Cursor")
+		if cursor == "" {
+			break
+		}
+	}
+	s.ElementsMatch(expectedIDs, listedIDs, "pages should list every matching image once")
+
+	tests := []struct {
+		description string
+		query       string
+	}{
+		{"invalid sort should error", "sort=foobar"},
+		{"invalid order should error", "order=foobar"},
+		{"invalid limit should error", "limit=foobar"},
+		{"negative limit should error", "limit=-1"},
+		{"invalid date should error", "downloaded_after=yesterday"},
+		{"invalid cursor should error", "cursor=foobar"},
+	}
+	for _, test := range tests {
+		resp, err := http.Get(s.APIURL + "?" + test.query)
+		s.NoError(err, test.description)
+		s.Equal(http.StatusBadRequest, resp.StatusCode, test.description)
+		_ = resp.Body.Close()
+	}
+}
+
 func (s *APITestSuite) TestGetImage() {
 	imageKVM, _, err := s.uploadImage("kvm")
 	s.NoError(err)
@@ -274,6 +410,116 @@ func (s *APITestSuite) TestDeleteImage() {
 	s.Equal(http.StatusNotFound, resp.StatusCode)
 }
 
+func (s *APITestSuite) TestCancelImage() {
+	// Cancel with POST
+	image := s.fetchStalledImage("/stalled")
+	resp, err := http.Post(s.imageURL(image.ID)+"/cancel", "application/json", nil)
+	s.NoError(err)
+	cancelled, err := unmarshalImageResp(resp)
+	logx.LogReturnedErr(resp.Body.Close, nil, "failed to close cancel response body")
+	s.Equal(http.StatusOK, resp.StatusCode)
+	s.NoError(err)
+	s.Equal(metadata.StatusCancelled, cancelled.Status)
+
+	image, _, err = s.getImage(image.ID)
+	s.NoError(err)
+	s.Equal(metadata.StatusCancelled, image.Status, "cancelled status should be saved")
+
+	resp, err = http.Post(s.imageURL(image.ID)+"/cancel", "application/json", nil)
+	s.NoError(err)
+	logx.LogReturnedErr(resp.Body.Close, nil, "failed to close cancel response body")
+	s.Equal(http.StatusConflict, resp.StatusCode, "cancelled image should not be cancellable")
+
+	resp, err = http.Post(s.imageURL("asdf")+"/cancel", "application/json", nil)
+	s.NoError(err)
+	logx.LogReturnedErr(resp.Body.Close, nil, "failed to close cancel response body")
+	s.Equal(http.StatusNotFound, resp.StatusCode)
+
+	// Cancel with DELETE
+	image = s.fetchStalledImage("/stalled-delete")
+	req, _ := http.NewRequest("DELETE", s.imageURL(image.ID), nil)
+	resp, err = http.DefaultClient.Do(req)
+	s.NoError(err)
+	logx.LogReturnedErr(resp.Body.Close, nil, "failed to close delete response body")
+	s.Equal(http.StatusOK, resp.StatusCode)
+
+	_, resp, _ = s.getImage(image.ID)
+	s.Equal(http.StatusNotFound, resp.StatusCode, "cancelled image should stay deleted")
+}
+
+func (s *APITestSuite) TestCheck() {
+	_, _, _ = s.uploadImage("kvm")
+	checkURL := fmt.Sprintf("http://localhost:%d/admin/check", s.Port)
+
+	resp, err := http.Post(checkURL, "application/json", nil)
+	s.NoError(err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	logx.LogReturnedErr(resp.Body.Close, nil, "failed to close check response body")
+	s.Equal(http.StatusOK, resp.StatusCode)
+
+	report := &imageservice.CheckReport{}
+	s.NoError(json.Unmarshal(body, report))
+	s.Equal(1, report.Images)
+	s.Empty(report.Issues)
+
+	resp, err = http.Post(checkURL, "application/json", bytes.NewBufferString(`{"checksums":true,"repair":true}`))
+	s.NoError(err)
+	logx.LogReturnedErr(resp.Body.Close, nil, "failed to close check response body")
+	s.Equal(http.StatusOK, resp.StatusCode)
+
+	resp, err = http.Post(checkURL, "application/json", bytes.NewBufferString("asdf"))
+	s.NoError(err)
+	logx.LogReturnedErr(resp.Body.Close, nil, "failed to close check response body")
+	s.Equal(http.StatusBadRequest, resp.StatusCode, "bad json should fail")
+}
+
+func (s *APITestSuite) TestBackup() {
+	resp, err := http.Get(fmt.Sprintf("http://localhost:%d/admin/backup", s.Port))
+	s.NoError(err)
+	logx.LogReturnedErr(resp.Body.Close, nil, "failed to close backup response body")
+	s.Equal(http.StatusNotImplemented, resp.StatusCode, "store should not support backups")
+}
+
+func (s *APITestSuite) TestBlobs() {
+	first, _, err := s.uploadImage("kvm")
+	s.Require().NoError(err)
+	_, _, err = s.uploadImage("container")
+	s.Require().NoError(err)
+
+	resp, err := http.Get(fmt.Sprintf("http://localhost:%d/blobs", s.Port))
+	s.Require().NoError(err)
+	var blobIDs []string
+	s.NoError(json.NewDecoder(resp.Body).Decode(&blobIDs))
+	logx.LogReturnedErr(resp.Body.Close, nil, "failed to close blobs response body")
+	s.Equal([]string{first.Digest}, blobIDs, "shared blobs should be listed once")
+
+	resp, err = http.Get(fmt.Sprintf("http://localhost:%d/blobs/asdf", s.Port))
+	s.Require().NoError(err)
+	logx.LogReturnedErr(resp.Body.Close, nil, "failed to close blob response body")
+	s.Equal(http.StatusNotFound, resp.StatusCode)
+
+	// An edge service caches blobs read from this one
+	dir, err := ioutil.TempDir("", "apiTest-")
+	s.Require().NoError(err)
+	defer func() { s.NoError(os.RemoveAll(dir)) }()
+	config, _ := json.Marshal(&images.CacheConfig{
+		Dir:           dir,
+		BackingType:   "http",
+		BackingConfig: json.RawMessage(fmt.Sprintf(`{"url":"http://localhost:%d"}`, s.Port)),
+	})
+	cache := images.NewStore("cache")
+	s.Require().NoError(cache.Init(config))
+
+	out := &bytes.Buffer{}
+	s.NoError(cache.Get(first.Digest, out))
+	s.Equal(s.ImageData, out.Bytes(), "blob should be read through the cache")
+	out.Reset()
+	s.NoError(cache.GetRange(first.Digest, out, 4, 8))
+	s.Equal(s.ImageData[4:12], out.Bytes())
+	_, err = cache.Stat("asdf")
+	s.True(os.IsNotExist(err), "missing blob should not exist")
+}
+
 func (s *APITestSuite) TestDownloadImage() {
 	imageKVM, _, _ := s.uploadImage("kvm")
 	resp, err := http.Get(s.imageURL(imageKVM.ID) + "/download")
@@ -291,6 +537,62 @@ func (s *APITestSuite) TestDownloadImage() {
 
 }
 
+func (s *APITestSuite) TestDownloadImageRange() {
+	imageKVM, _, _ := s.uploadImage("kvm")
+	downloadURL := s.imageURL(imageKVM.ID) + "/download"
+	etag := `"` + imageKVM.Digest + `"`
+	size := len(s.ImageData)
+
+	tests := []struct {
+		description        string
+		method             string
+		headers            map[string]string
+		expectedStatusCode int
+		expectedBody       []byte
+	}{
+		{"head should succeed without a body",
+			"HEAD", nil, http.StatusOK, []byte{}},
+		{"range should return partial content",
+			"GET", map[string]string{"Range": "bytes=4-11"}, http.StatusPartialContent, s.ImageData[4:12]},
+		{"open ended range should return the remainder",
+			"GET", map[string]string{"Range": "bytes=8-"}, http.StatusPartialContent, s.ImageData[8:]},
+		{"unsatisfiable range should fail",
+			"GET", map[string]string{"Range": fmt.Sprintf("bytes=%d-", size+10)}, http.StatusRequestedRangeNotSatisfiable, nil},
+		{"matching etag should not be modified",
+			"GET", map[string]string{"If-None-Match": etag}, http.StatusNotModified, []byte{}},
+		{"other etag should return the image",
+			"GET", map[string]string{"If-None-Match": `"asdf"`}, http.StatusOK, s.ImageData},
+		{"later modified since should not be modified",
+			"GET", map[string]string{"If-Modified-Since": time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)}, http.StatusNotModified, []byte{}},
+		{"matching if-range should return partial content",
+			"GET", map[string]string{"Range": "bytes=0-3", "If-Range": etag}, http.StatusPartialContent, s.ImageData[0:4]},
+		{"stale if-range should return the image",
+			"GET", map[string]string{"Range": "bytes=0-3", "If-Range": `"asdf"`}, http.StatusOK, s.ImageData},
+	}
+
+	for _, test := range tests {
+		req, _ := http.NewRequest(test.method, downloadURL, nil)
+		for key, value := range test.headers {
+			req.Header.Set(key, value)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		s.NoError(err, test.description)
+		s.Equal(test.expectedStatusCode, resp.StatusCode, test.description)
+		body, err := ioutil.ReadAll(resp.Body)
+		s.NoError(err, test.description)
+		logx.LogReturnedErr(resp.Body.Close, nil, "failed to close download response body")
+
+		if test.expectedStatusCode == http.StatusOK || test.expectedStatusCode == http.StatusPartialContent {
+			s.Equal(etag, resp.Header.Get("ETag"), test.description)
+			s.NotEmpty(resp.Header.Get("Last-Modified"), test.description)
+		}
+		if test.expectedBody != nil {
+			s.Equal(test.expectedBody, body, test.description)
+		}
+	}
+}
+
 // uploadImage uploads the ImageData with valid properties
 func (s *APITestSuite) uploadImage(imageType string) (*metadata.Image, *http.Response, error) {
 	req, err := http.NewRequest("PUT", s.APIURL, bytes.NewBuffer(s.ImageData))
@@ -315,6 +617,25 @@ func (s *APITestSuite) uploadImage(imageType string) (*metadata.Image, *http.Res
 	return image, resp, err
 }
 
+// fetchStalledImage fetches an image from a path that stalls partway through,
+// returning once the download has started
+func (s *APITestSuite) fetchStalledImage(path string) *metadata.Image {
+	requestData := []byte(fmt.Sprintf(`{"source":"%s","type":"kvm"}`, s.FetchServer.URL+path))
+	resp, err := http.Post(s.APIURL, "application/json", bytes.NewBuffer(requestData))
+	s.Require().NoError(err)
+	defer logx.LogReturnedErr(resp.Body.Close, nil, "failed to close fetch response body")
+	image, err := unmarshalImageResp(resp)
+	s.Require().NoError(err)
+
+	for i := 0; i < 100 && image.Status != metadata.StatusDownloading; i++ {
+		time.Sleep(10 * time.Millisecond)
+		image, _, err = s.getImage(image.ID)
+		s.Require().NoError(err)
+	}
+	s.Require().Equal(metadata.StatusDownloading, image.Status)
+	return image
+}
+
 // getImage retrieves image metadata
 func (s *APITestSuite) getImage(id string) (*metadata.Image, *http.Response, error) {
 	resp, err := http.Get(s.imageURL(id))
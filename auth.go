@@ -0,0 +1,346 @@
+package imageservice
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/mistifyio/mistify-image-service/metadata"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// tokenLastUsedInterval limits how often the last use of a token is recorded,
+// so authenticated requests don't each write to the metadata store
+const tokenLastUsedInterval = time.Minute
+
+// tokenSecretSize is the number of random bytes in a token secret
+const tokenSecretSize = 32
+
+var (
+	// ErrUnauthorized is used when a request has no valid api token
+	ErrUnauthorized = errors.New("valid api token required")
+	// ErrTokensUnsupported is used when the metadata store can't hold api
+	// tokens
+	ErrTokensUnsupported = errors.New("metadata store does not support api tokens")
+)
+
+type (
+	// Authenticator authenticates requests with api tokens held in the
+	// metadata store. A token is given as "Authorization: Bearer <secret>",
+	// where the secret is the token id and a random part joined by a dot.
+	// Only the sha256 digest of the secret is stored.
+	Authenticator struct {
+		ctx *Context
+		// Required refuses requests without a valid token
+		Required bool
+		// AnonymousReads allows GET and HEAD requests outside of the admin
+		// routes without a token, so peers and mirrors can still pull images
+		AnonymousReads bool
+		now            func() time.Time
+	}
+
+	// TokenRequest is the request to create an api token. TTL is a duration
+	// such as "720h"; an empty TTL creates a token that doesn't expire.
+	TokenRequest struct {
+		Name string `json:"name"`
+		TTL  string `json:"ttl"`
+	}
+
+	// NewToken is a newly created api token along with its secret, which is
+	// not stored and can't be retrieved again
+	NewToken struct {
+		*metadata.Token
+		Secret string `json:"secret"`
+	}
+)
+
+// NewAuthenticator creates a new Authenticator configured by requireAuth
+// (default true) and anonymousReads. Requiring authentication fails if the
+// metadata store can't hold api tokens.
+func NewAuthenticator(ctx *Context) (*Authenticator, error) {
+	auth := &Authenticator{
+		ctx: ctx,
+		// Open access has to be asked for, so the first token is created
+		// with the tokens command rather than over the api
+		Required:       !viper.IsSet("requireAuth") || viper.GetBool("requireAuth"),
+		AnonymousReads: viper.GetBool("anonymousReads"),
+		now:            time.Now,
+	}
+
+	if _, err := auth.tokenStore(); err != nil && auth.Required {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Error("authentication can't be required")
+		return nil, err
+	}
+	return auth, nil
+}
+
+// CreateToken creates and stores a new api token, returning it with its secret.
+// A zero ttl creates a token that doesn't expire.
+func (auth *Authenticator) CreateToken(name string, ttl time.Duration) (*NewToken, error) {
+	tokenStore, err := auth.tokenStore()
+	if err != nil {
+		return nil, err
+	}
+	if name == "" {
+		return nil, errors.New("missing token name")
+	}
+	if ttl < 0 {
+		return nil, errors.New("invalid token ttl")
+	}
+
+	random := make([]byte, tokenSecretSize)
+	if _, err := rand.Read(random); err != nil {
+		log.WithField("error", err).Error("failed to generate token secret")
+		return nil, err
+	}
+
+	now := auth.now().UTC()
+	token := &metadata.Token{
+		ID:        metadata.NewID(),
+		Name:      name,
+		CreatedAt: now,
+	}
+	if ttl > 0 {
+		token.ExpiresAt = now.Add(ttl)
+	}
+	secret := token.ID + "." + base64.RawURLEncoding.EncodeToString(random)
+	token.Hash = metadata.HashToken(secret)
+
+	if err := tokenStore.PutToken(token); err != nil {
+		return nil, err
+	}
+	token.Hash = ""
+	return &NewToken{Token: token, Secret: secret}, nil
+}
+
+// ListTokens returns all api tokens, oldest first, without their hashes
+func (auth *Authenticator) ListTokens() ([]*metadata.Token, error) {
+	tokenStore, err := auth.tokenStore()
+	if err != nil {
+		return nil, err
+	}
+
+	tokens, err := tokenStore.ListTokens()
+	if err != nil {
+		return nil, err
+	}
+	if tokens == nil {
+		tokens = []*metadata.Token{}
+	}
+	for _, token := range tokens {
+		token.Hash = ""
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].CreatedAt.Before(tokens[j].CreatedAt)
+	})
+	return tokens, nil
+}
+
+// RevokeToken removes an api token, so it can no longer be used
+func (auth *Authenticator) RevokeToken(tokenID string) error {
+	tokenStore, err := auth.tokenStore()
+	if err != nil {
+		return err
+	}
+
+	if _, err := tokenStore.GetToken(tokenID); err != nil {
+		return err
+	}
+	return tokenStore.DeleteToken(tokenID)
+}
+
+// Authenticate checks a token secret, returning the token if it is valid and
+// hasn't expired. The last use of the token is recorded.
+func (auth *Authenticator) Authenticate(secret string) (*metadata.Token, error) {
+	tokenStore, err := auth.tokenStore()
+	if err != nil {
+		return nil, err
+	}
+
+	parts := strings.SplitN(secret, ".", 2)
+	if len(parts) != 2 {
+		return nil, ErrUnauthorized
+	}
+	token, err := tokenStore.GetToken(parts[0])
+	if err == metadata.ErrTokenNotFound {
+		return nil, ErrUnauthorized
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	hash := metadata.HashToken(secret)
+	now := auth.now().UTC()
+	if subtle.ConstantTimeCompare([]byte(hash), []byte(token.Hash)) != 1 || token.Expired(now) {
+		return nil, ErrUnauthorized
+	}
+
+	if now.Sub(token.LastUsed) >= tokenLastUsedInterval {
+		token.LastUsed = now
+		// The token may have been revoked since it was read. Failing to record
+		// the use otherwise doesn't fail the request.
+		err := tokenStore.TouchToken(token.ID, now)
+		if err == metadata.ErrTokenNotFound {
+			return nil, ErrUnauthorized
+		}
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error":   err,
+				"tokenID": token.ID,
+			}).Error("failed to record token use")
+		}
+	}
+	return token, nil
+}
+
+// Handler wraps a handler, refusing requests without a valid api token when
+// authentication is required
+func (auth *Authenticator) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !auth.Required || auth.isPublic(r) {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		hr := HTTPResponse{w}
+		secret, ok := bearerToken(r)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			hr.JSONError(http.StatusUnauthorized, ErrUnauthorized)
+			return
+		}
+
+		token, err := auth.Authenticate(secret)
+		if err != nil {
+			if err != ErrUnauthorized {
+				hr.JSONError(http.StatusInternalServerError, err)
+				return
+			}
+			log.WithFields(log.Fields{
+				"method": r.Method,
+				"path":   r.URL.Path,
+				"remote": r.RemoteAddr,
+			}).Warning("refused request with invalid api token")
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			hr.JSONError(http.StatusUnauthorized, ErrUnauthorized)
+			return
+		}
+
+		log.WithFields(log.Fields{
+			"method":  r.Method,
+			"path":    r.URL.Path,
+			"tokenID": token.ID,
+			"token":   token.Name,
+		}).Debug("authenticated request")
+		h.ServeHTTP(w, r)
+	})
+}
+
+// isPublic tests whether a request is allowed without a token. Well-known
+// service information is always public.
+func (auth *Authenticator) isPublic(r *http.Request) bool {
+	if strings.HasPrefix(r.URL.Path, "/.well-known/") {
+		return true
+	}
+	if !auth.AnonymousReads || strings.HasPrefix(r.URL.Path, "/admin") {
+		return false
+	}
+	return r.Method == "GET" || r.Method == "HEAD"
+}
+
+// tokenStore returns the metadata store as a TokenStore
+func (auth *Authenticator) tokenStore() (metadata.TokenStore, error) {
+	tokenStore, ok := auth.ctx.MetadataStore.(metadata.TokenStore)
+	if !ok {
+		return nil, ErrTokensUnsupported
+	}
+	return tokenStore, nil
+}
+
+// bearerToken retrieves the token secret from the Authorization header
+func bearerToken(r *http.Request) (string, bool) {
+	header := r.Header.Get("Authorization")
+	const prefix = "Bearer "
+	if len(header) <= len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return "", false
+	}
+	return strings.TrimSpace(header[len(prefix):]), true
+}
+
+// createTokenHandler creates an api token. The request body contains the
+// TokenRequest, and the response the NewToken with its secret.
+func createTokenHandler(w http.ResponseWriter, r *http.Request) {
+	hr := HTTPResponse{w}
+	ctx := GetContext(r)
+
+	req := &TokenRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		hr.JSONMsg(http.StatusBadRequest, err.Error())
+		return
+	}
+	var ttl time.Duration
+	if req.TTL != "" {
+		var err error
+		if ttl, err = time.ParseDuration(req.TTL); err != nil {
+			hr.JSONMsg(http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	token, err := ctx.Authenticator.CreateToken(req.Name, ttl)
+	if err != nil {
+		code := http.StatusBadRequest
+		if err == ErrTokensUnsupported {
+			code = http.StatusNotImplemented
+		}
+		hr.JSONError(code, err)
+		return
+	}
+	hr.JSON(http.StatusCreated, token)
+}
+
+// listTokensHandler lists the api tokens, without their secrets
+func listTokensHandler(w http.ResponseWriter, r *http.Request) {
+	hr := HTTPResponse{w}
+	ctx := GetContext(r)
+
+	tokens, err := ctx.Authenticator.ListTokens()
+	if err != nil {
+		code := http.StatusInternalServerError
+		if err == ErrTokensUnsupported {
+			code = http.StatusNotImplemented
+		}
+		hr.JSONError(code, err)
+		return
+	}
+	hr.JSON(http.StatusOK, tokens)
+}
+
+// revokeTokenHandler revokes an api token
+func revokeTokenHandler(w http.ResponseWriter, r *http.Request) {
+	hr := HTTPResponse{w}
+	ctx := GetContext(r)
+
+	if err := ctx.Authenticator.RevokeToken(mux.Vars(r)["tokenID"]); err != nil {
+		code := http.StatusInternalServerError
+		switch err {
+		case metadata.ErrTokenNotFound:
+			code = http.StatusNotFound
+		case ErrTokensUnsupported:
+			code = http.StatusNotImplemented
+		}
+		hr.JSONError(code, err)
+		return
+	}
+	hr.JSONMsg(http.StatusOK, "token revoked")
+}
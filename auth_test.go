@@ -0,0 +1,265 @@
+package imageservice_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/mistifyio/mistify-image-service"
+	"github.com/mistifyio/mistify-image-service/images"
+	"github.com/mistifyio/mistify-image-service/metadata"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/suite"
+	"github.com/tylerb/graceful"
+)
+
+type AuthTestSuite struct {
+	suite.Suite
+	Context        *imageservice.Context
+	APIServer      *graceful.Server
+	APIURL         string
+	AnonymousReads bool
+	Token          *imageservice.NewToken
+}
+
+func (s *AuthTestSuite) SetupSuite() {
+	log.SetLevel(log.FatalLevel)
+	s.APIURL = "http://localhost:54326"
+}
+
+func (s *AuthTestSuite) SetupTest() {
+	s.AnonymousReads = false
+	s.newContext()
+}
+
+func (s *AuthTestSuite) TearDownTest() {
+	viper.Set("requireAuth", false)
+	viper.Set("anonymousReads", nil)
+	s.stopServer()
+}
+
+// tokenlessStore is a memory metadata store without api token support
+type tokenlessStore struct {
+	metadata.Store
+}
+
+func init() {
+	// Other suites use the api without tokens
+	viper.Set("requireAuth", false)
+
+	metadata.Register("tokenless", func() metadata.Store {
+		return &tokenlessStore{Store: metadata.NewStore("memory")}
+	})
+}
+
+func TestAuthTestSuite(t *testing.T) {
+	suite.Run(t, new(AuthTestSuite))
+}
+
+func (s *AuthTestSuite) TestNewAuthenticator() {
+	viper.Set("metadataStoreType", "tokenless")
+	viper.Set("metadataStoreConfig", &metadata.MemoryConfig{})
+	viper.Set("requireAuth", nil)
+
+	ctx, err := imageservice.NewStoreContext()
+	s.Require().NoError(err)
+	defer func() { _ = ctx.MetadataStore.Shutdown() }()
+	_, err = imageservice.NewAuthenticator(ctx)
+	s.Equal(imageservice.ErrTokensUnsupported, err, "auth should be required by default, failing without token support")
+
+	viper.Set("requireAuth", false)
+	auth, err := imageservice.NewAuthenticator(ctx)
+	s.NoError(err, "auth that isn't required should not need token support")
+	_, err = auth.CreateToken("foo", 0)
+	s.Equal(imageservice.ErrTokensUnsupported, err)
+}
+
+func (s *AuthTestSuite) TestRequests() {
+	tests := []struct {
+		description    string
+		method         string
+		path           string
+		token          string
+		expectedStatus int
+	}{
+		{"list without a token should fail",
+			"GET", "/images", "", http.StatusUnauthorized},
+		{"delete without a token should fail",
+			"DELETE", "/images/foo", "", http.StatusUnauthorized},
+		{"fetch without a token should fail",
+			"POST", "/images", "", http.StatusUnauthorized},
+		{"invalid token should fail",
+			"GET", "/images", "foo", http.StatusUnauthorized},
+		{"wrong secret should fail",
+			"GET", "/images", s.Token.ID + ".foo", http.StatusUnauthorized},
+		{"valid token should succeed",
+			"GET", "/images", s.Token.Secret, http.StatusOK},
+		{"valid token should reach the handler",
+			"DELETE", "/images/foo", s.Token.Secret, http.StatusNotFound},
+		{"well-known routes should not need a token",
+			"GET", "/.well-known/mistify-image-service/signing-key", "", http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		resp := s.request(test.method, test.path, test.token, nil)
+		_ = resp.Body.Close()
+		s.Equal(test.expectedStatus, resp.StatusCode, test.description)
+		if test.expectedStatus == http.StatusUnauthorized {
+			s.NotEmpty(resp.Header.Get("WWW-Authenticate"), test.description)
+		}
+	}
+}
+
+func (s *AuthTestSuite) TestAnonymousReads() {
+	s.AnonymousReads = true
+	s.newContext()
+
+	tests := []struct {
+		description    string
+		method         string
+		path           string
+		expectedStatus int
+	}{
+		{"list should not need a token",
+			"GET", "/images", http.StatusOK},
+		{"download should not need a token",
+			"HEAD", "/images/foo/download", http.StatusNotFound},
+		{"delete should need a token",
+			"DELETE", "/images/foo", http.StatusUnauthorized},
+		{"admin reads should need a token",
+			"GET", "/admin/tokens", http.StatusUnauthorized},
+	}
+
+	for _, test := range tests {
+		resp := s.request(test.method, test.path, "", nil)
+		_ = resp.Body.Close()
+		s.Equal(test.expectedStatus, resp.StatusCode, test.description)
+	}
+}
+
+func (s *AuthTestSuite) TestExpiry() {
+	token, err := s.Context.Authenticator.CreateToken("expiring", 100*time.Millisecond)
+	s.Require().NoError(err)
+	s.Equal(token.CreatedAt.Add(100*time.Millisecond), token.ExpiresAt)
+
+	_, err = s.Context.Authenticator.Authenticate(token.Secret)
+	s.NoError(err, "token should be valid before it expires")
+
+	time.Sleep(150 * time.Millisecond)
+	_, err = s.Context.Authenticator.Authenticate(token.Secret)
+	s.Equal(imageservice.ErrUnauthorized, err, "expired token should fail")
+}
+
+func (s *AuthTestSuite) TestLastUsed() {
+	tokenStore := s.Context.MetadataStore.(metadata.TokenStore)
+	stored, err := tokenStore.GetToken(s.Token.ID)
+	s.Require().NoError(err)
+	s.True(stored.LastUsed.IsZero(), "unused token should have no last use")
+	s.Equal(metadata.HashToken(s.Token.Secret), stored.Hash, "only the token hash should be stored")
+
+	before := time.Now()
+	resp := s.request("GET", "/images", s.Token.Secret, nil)
+	_ = resp.Body.Close()
+
+	stored, err = tokenStore.GetToken(s.Token.ID)
+	s.Require().NoError(err)
+	s.False(stored.LastUsed.Before(before.Truncate(time.Second)), "use should be recorded")
+}
+
+func (s *AuthTestSuite) TestTokenAdmin() {
+	// Create
+	body, _ := json.Marshal(&imageservice.TokenRequest{Name: "created", TTL: "1h"})
+	resp := s.request("POST", "/admin/tokens", s.Token.Secret, body)
+	created := &imageservice.NewToken{}
+	s.NoError(json.NewDecoder(resp.Body).Decode(created))
+	_ = resp.Body.Close()
+	s.Equal(http.StatusCreated, resp.StatusCode)
+	s.Equal("created", created.Name)
+	s.Empty(created.Hash, "hash should not be returned")
+	s.NotEmpty(created.Secret)
+	s.False(created.ExpiresAt.IsZero())
+
+	for _, req := range []*imageservice.TokenRequest{{Name: ""}, {Name: "foo", TTL: "asdf"}} {
+		body, _ := json.Marshal(req)
+		resp := s.request("POST", "/admin/tokens", s.Token.Secret, body)
+		_ = resp.Body.Close()
+		s.Equal(http.StatusBadRequest, resp.StatusCode, "invalid token request should fail")
+	}
+
+	// List
+	resp = s.request("GET", "/admin/tokens", created.Secret, nil)
+	var tokens []*metadata.Token
+	s.NoError(json.NewDecoder(resp.Body).Decode(&tokens))
+	_ = resp.Body.Close()
+	s.Equal(http.StatusOK, resp.StatusCode, "created token should be usable")
+	if s.Len(tokens, 2) {
+		s.Equal(s.Token.ID, tokens[0].ID, "tokens should be oldest first")
+		s.Equal(created.ID, tokens[1].ID)
+		for _, token := range tokens {
+			s.Empty(token.Hash, "hashes should not be listed")
+		}
+	}
+
+	// Revoke
+	resp = s.request("DELETE", "/admin/tokens/"+created.ID, s.Token.Secret, nil)
+	_ = resp.Body.Close()
+	s.Equal(http.StatusOK, resp.StatusCode)
+	resp = s.request("DELETE", "/admin/tokens/"+created.ID, s.Token.Secret, nil)
+	_ = resp.Body.Close()
+	s.Equal(http.StatusNotFound, resp.StatusCode, "revoked token should not be found")
+	resp = s.request("GET", "/images", created.Secret, nil)
+	_ = resp.Body.Close()
+	s.Equal(http.StatusUnauthorized, resp.StatusCode, "revoked token should fail")
+}
+
+// newContext creates a context requiring auth with a token and starts an API
+// server for it, replacing any existing one
+func (s *AuthTestSuite) newContext() {
+	s.stopServer()
+
+	viper.Set("imageStoreType", "memory")
+	viper.Set("imageStoreConfig", &images.MemoryConfig{})
+	viper.Set("metadataStoreType", "memory")
+	viper.Set("metadataStoreConfig", &metadata.MemoryConfig{})
+	viper.Set("requireAuth", true)
+	viper.Set("anonymousReads", s.AnonymousReads)
+
+	ctx, err := imageservice.NewContext()
+	s.Require().NoError(err)
+	s.Context = ctx
+	s.Token, err = ctx.Authenticator.CreateToken("test", 0)
+	s.Require().NoError(err)
+	s.APIServer = imageservice.Run(ctx, 54326)
+	time.Sleep(100 * time.Millisecond)
+}
+
+// stopServer stops the API server, if running
+func (s *AuthTestSuite) stopServer() {
+	if s.APIServer == nil {
+		return
+	}
+	stopChan := s.APIServer.StopChan()
+	s.APIServer.Stop(5 * time.Second)
+	<-stopChan
+	s.APIServer = nil
+}
+
+// request makes a request to the API server with an optional token
+func (s *AuthTestSuite) request(method, path, token string, body []byte) *http.Response {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, s.APIURL+path, reader)
+	s.Require().NoError(err)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	s.Require().NoError(err)
+	return resp
+}
@@ -0,0 +1,94 @@
+package imageservice
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/mistifyio/mistify-image-service/metadata"
+	logx "github.com/mistifyio/mistify-logrus-ext"
+	log "github.com/sirupsen/logrus"
+)
+
+// RegisterBlobRoutes registers the blob routes and handlers, which serve image
+// data by digest for other image services, such as through the http image
+// store
+func RegisterBlobRoutes(prefix string, router *mux.Router) {
+	router.HandleFunc(prefix, listBlobsHandler).Methods("GET")
+	sub := router.PathPrefix(prefix).Subrouter()
+	sub.HandleFunc("/{blobID}", downloadBlobHandler).Methods("GET", "HEAD")
+}
+
+// listBlobsHandler lists the blob ids of all complete images, leaving out
+// those without a verified signature when signatures are required
+func listBlobsHandler(w http.ResponseWriter, r *http.Request) {
+	hr := HTTPResponse{w}
+	ctx := GetContext(r)
+
+	allImages, err := ctx.MetadataStore.List("")
+	if err != nil {
+		hr.JSONError(http.StatusInternalServerError, err)
+		return
+	}
+
+	// Images with identical data share a blob
+	seen := make(map[string]bool)
+	blobIDs := make([]string, 0, len(allImages))
+	for _, image := range allImages {
+		blobID := image.BlobID()
+		if image.Status != metadata.StatusComplete || seen[blobID] {
+			continue
+		}
+		if ctx.Verifier.RequireSigned && image.SignatureStatus != metadata.SignatureVerified {
+			continue
+		}
+		seen[blobID] = true
+		blobIDs = append(blobIDs, blobID)
+	}
+	sort.Strings(blobIDs)
+
+	hr.JSON(http.StatusOK, blobIDs)
+}
+
+// downloadBlobHandler downloads the data of complete images by digest, with
+// the same signature requirement as image downloads
+func downloadBlobHandler(w http.ResponseWriter, r *http.Request) {
+	hr := HTTPResponse{w}
+	ctx := GetContext(r)
+	blobID := mux.Vars(r)["blobID"]
+
+	refs, err := ctx.Blobs.References(blobID)
+	if err != nil {
+		hr.JSONError(http.StatusInternalServerError, err)
+		return
+	}
+
+	for _, image := range refs {
+		if image.Status != metadata.StatusComplete {
+			continue
+		}
+		if ctx.Verifier.RequireSigned && image.SignatureStatus != metadata.SignatureVerified {
+			continue
+		}
+		// The image may have been removed since the lookup, so try the next
+		content, err := ctx.Blobs.Open(image)
+		if err == metadata.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			hr.JSONError(http.StatusInternalServerError, err)
+			return
+		}
+		defer logx.LogReturnedErr(content.Close, log.Fields{
+			"blobID": blobID,
+		}, "failed to close image data reader")
+
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("ETag", strconv.Quote(image.Digest))
+		http.ServeContent(w, r, "", image.DownloadEnd, content)
+		return
+	}
+
+	hr.JSONMsg(http.StatusNotFound, "blob not found")
+}
@@ -0,0 +1,329 @@
+package imageservice
+
+import (
+	"encoding/hex"
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/mistifyio/mistify-image-service/images"
+	"github.com/mistifyio/mistify-image-service/metadata"
+	"github.com/pborman/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrImageChanged is used when an image changed while its data was being
+// relocated
+var ErrImageChanged = errors.New("image changed during relocation")
+
+type (
+	// Blobs manages content-addressed image data in the image stores. Images
+	// with identical data in the same image store share a single blob, keyed
+	// by the data digest, and the blob is only removed once no image
+	// references it.
+	Blobs struct {
+		ctx *Context
+		// lock serializes reference changes so a blob can't be removed while
+		// a new image is being pointed at it
+		lock sync.Mutex
+		// pins counts the readers and copies in progress of each blob. A
+		// pinned blob is only removed once the last pin is released.
+		pins map[blobKey]int
+		// removed holds pinned blobs waiting to be removed
+		removed map[blobKey]bool
+	}
+
+	// blobKey identifies a blob in a named image store
+	blobKey struct {
+		store  string
+		blobID string
+	}
+
+	// BlobReader reads the data of an image, keeping the data from being
+	// removed until the reader is closed
+	BlobReader struct {
+		*images.RangeReader
+		blobs *Blobs
+		key   blobKey
+	}
+)
+
+// NewBlobs creates a new Blobs
+func NewBlobs(ctx *Context) *Blobs {
+	return &Blobs{
+		ctx:     ctx,
+		pins:    make(map[blobKey]int),
+		removed: make(map[blobKey]bool),
+	}
+}
+
+// Commit moves newly transferred image data, stored under the image id, to
+// its content address. If a blob with the same digest already exists, the new
+// copy is discarded and the image shares the existing blob. The image digest
+// is saved before returning.
+func (blobs *Blobs) Commit(image *metadata.Image, digest string) error {
+	blobs.lock.Lock()
+	defer blobs.lock.Unlock()
+
+	imageStore, err := blobs.ctx.ImageStoreFor(image)
+	if err != nil {
+		return err
+	}
+	if _, err := imageStore.Stat(digest); err == nil {
+		// Identical data is already stored, and is no longer unreferenced
+		delete(blobs.removed, blobKey{imageStoreName(image), digest})
+		if err := imageStore.Delete(image.ID); err != nil {
+			return err
+		}
+	} else if err := images.Move(imageStore, image.ID, digest); err != nil {
+		log.WithFields(log.Fields{
+			"error":  err,
+			"image":  image,
+			"digest": digest,
+		}).Error("failed to move image data to blob")
+		return err
+	}
+
+	return image.SetDigest(digest)
+}
+
+// Release removes the image data, unless it is a blob still referenced by
+// another image. The image metadata should already have been removed.
+func (blobs *Blobs) Release(image *metadata.Image) error {
+	blobs.lock.Lock()
+	defer blobs.lock.Unlock()
+
+	return blobs.removeUnreferenced(image, imageStoreName(image))
+}
+
+// References retrieves the images that share a blob
+func (blobs *Blobs) References(digest string) ([]*metadata.Image, error) {
+	return blobs.ctx.MetadataStore.GetByDigest(digest)
+}
+
+// Open returns a reader of the data of a complete image. The current metadata
+// is used, so the reader follows data that was relocated since the image was
+// retrieved. The data is kept until the reader is closed, even if the image
+// is deleted or relocated in the meantime.
+func (blobs *Blobs) Open(image *metadata.Image) (*BlobReader, error) {
+	blobs.lock.Lock()
+	defer blobs.lock.Unlock()
+
+	current, err := blobs.ctx.MetadataStore.GetByID(image.ID)
+	if err != nil {
+		return nil, err
+	}
+	if current.Status != metadata.StatusComplete {
+		return nil, metadata.ErrNotFound
+	}
+	imageStore, err := blobs.ctx.ImageStoreFor(current)
+	if err != nil {
+		return nil, err
+	}
+
+	key := blobKey{imageStoreName(current), current.BlobID()}
+	blobs.pins[key]++
+	return &BlobReader{
+		RangeReader: images.NewRangeReader(imageStore, current.BlobID(), current.Size),
+		blobs:       blobs,
+		key:         key,
+	}, nil
+}
+
+// Relocate points an image at a copy of its data in another image store, then
+// removes the original unless another image in the original store still
+// references it. The copy should be pinned until Relocate returns. If the
+// image changed since the copy was made, the copy is discarded and
+// ErrImageChanged is returned.
+func (blobs *Blobs) Relocate(image *metadata.Image, storeName string) error {
+	blobs.lock.Lock()
+	defer blobs.lock.Unlock()
+
+	current, err := blobs.ctx.MetadataStore.GetByID(image.ID)
+	if err != nil && err != metadata.ErrNotFound {
+		return err
+	}
+	if current == nil || current.Status != metadata.StatusComplete ||
+		current.Digest != image.Digest || imageStoreName(current) != imageStoreName(image) {
+		if err := blobs.removeUnreferenced(image, storeName); err != nil {
+			return err
+		}
+		return ErrImageChanged
+	}
+
+	sourceName := imageStoreName(current)
+	current.ImageStore = storeName
+	if storeName == DefaultImageStore {
+		current.ImageStore = ""
+	}
+	current.Store = blobs.ctx.MetadataStore
+	if err := current.Store.Put(current); err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+			"image": current,
+			"store": storeName,
+		}).Error("failed to record relocated image data")
+		_ = blobs.removeUnreferenced(image, storeName)
+		return err
+	}
+
+	return blobs.removeUnreferenced(current, sourceName)
+}
+
+// Migrate moves the data of complete images stored before content addressing
+// from their image ids to their content addresses, deduplicating along the way
+func (blobs *Blobs) Migrate() error {
+	allImages, err := blobs.ctx.MetadataStore.List("")
+	if err != nil {
+		return err
+	}
+
+	migrated := 0
+	for _, image := range allImages {
+		if image.Status != metadata.StatusComplete || image.Digest != "" {
+			continue
+		}
+
+		imageStore, err := blobs.ctx.ImageStoreFor(image)
+		if err != nil {
+			return err
+		}
+		digester := metadata.NewHash(metadata.DigestType)
+		if err := imageStore.Get(image.ID, digester); err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+				"image": image,
+			}).Error("failed to read image data for migration")
+			return err
+		}
+
+		image.Store = blobs.ctx.MetadataStore
+		if err := blobs.Commit(image, hex.EncodeToString(digester.Sum(nil))); err != nil {
+			return err
+		}
+		migrated++
+	}
+
+	if migrated > 0 {
+		log.WithField("count", migrated).Info("migrated image data to content addressed blobs")
+	}
+	return nil
+}
+
+// pin keeps the data of an image in a named image store from being removed
+// until unpinned
+func (blobs *Blobs) pin(image *metadata.Image, storeName string) {
+	blobs.lock.Lock()
+	defer blobs.lock.Unlock()
+
+	blobs.pins[blobKey{storeName, image.BlobID()}]++
+}
+
+// unpin releases a pin on the data of an image in a named image store
+func (blobs *Blobs) unpin(image *metadata.Image, storeName string) {
+	blobs.lock.Lock()
+	defer blobs.lock.Unlock()
+
+	blobs.release(blobKey{storeName, image.BlobID()})
+}
+
+// pinned tests whether a blob is pinned or waiting to be removed. The lock
+// must be held.
+func (blobs *Blobs) pinned(storeName, blobID string) bool {
+	key := blobKey{storeName, blobID}
+	return blobs.pins[key] > 0 || blobs.removed[key]
+}
+
+// release releases a pin on a blob, removing it if it was waiting on the last
+// pin. The lock must be held.
+func (blobs *Blobs) release(key blobKey) {
+	blobs.pins[key]--
+	if blobs.pins[key] > 0 {
+		return
+	}
+	delete(blobs.pins, key)
+
+	if blobs.removed[key] {
+		delete(blobs.removed, key)
+		if err := blobs.remove(key); err != nil {
+			log.WithFields(log.Fields{
+				"error":  err,
+				"store":  key.store,
+				"blobID": key.blobID,
+			}).Error("failed to remove released image data")
+		}
+	}
+}
+
+// removeUnreferenced removes the data of an image from a named image store,
+// unless it is a blob referenced by another image in that store. The lock
+// must be held.
+func (blobs *Blobs) removeUnreferenced(image *metadata.Image, storeName string) error {
+	if image.Digest != "" {
+		refs, err := blobs.References(image.Digest)
+		if err != nil {
+			return err
+		}
+		for _, ref := range refs {
+			if ref.ID != image.ID && imageStoreName(ref) == storeName {
+				return nil
+			}
+		}
+	}
+
+	return blobs.remove(blobKey{storeName, image.BlobID()})
+}
+
+// referenced tests whether a blob is referenced by an image in its image
+// store, by image id or staging id while transferred or by digest once
+// committed. The lock must be held.
+func (blobs *Blobs) referenced(key blobKey) (bool, error) {
+	var refs []*metadata.Image
+	if imageID := strings.TrimSuffix(key.blobID, stagingSuffix); uuid.Parse(imageID) != nil {
+		image, err := blobs.ctx.MetadataStore.GetByID(imageID)
+		if err == metadata.ErrNotFound {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		refs = []*metadata.Image{image}
+	} else {
+		var err error
+		if refs, err = blobs.References(key.blobID); err != nil {
+			return false, err
+		}
+	}
+
+	for _, ref := range refs {
+		if imageStoreName(ref) == key.store {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// remove removes a blob from a named image store. Removal of a pinned blob
+// waits until it is released. The lock must be held.
+func (blobs *Blobs) remove(key blobKey) error {
+	if blobs.pins[key] > 0 {
+		blobs.removed[key] = true
+		return nil
+	}
+
+	imageStore, err := blobs.ctx.GetImageStore(key.store)
+	if err != nil {
+		return err
+	}
+	return imageStore.Delete(key.blobID)
+}
+
+// Close closes the reader and releases the data
+func (br *BlobReader) Close() error {
+	err := br.RangeReader.Close()
+
+	br.blobs.lock.Lock()
+	defer br.blobs.lock.Unlock()
+	br.blobs.release(br.key)
+	return err
+}
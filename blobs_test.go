@@ -0,0 +1,143 @@
+package imageservice_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mistifyio/mistify-image-service"
+	"github.com/mistifyio/mistify-image-service/images"
+	"github.com/mistifyio/mistify-image-service/metadata"
+	"github.com/pborman/uuid"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/suite"
+)
+
+type BlobsTestSuite struct {
+	suite.Suite
+	Context     *imageservice.Context
+	ImageData   []byte
+	ImageDigest string
+	StoreDir    string
+}
+
+func (s *BlobsTestSuite) SetupSuite() {
+	log.SetLevel(log.FatalLevel)
+
+	s.ImageData = []byte("testdatatestdatatestdata")
+	digest := sha256.Sum256(s.ImageData)
+	s.ImageDigest = hex.EncodeToString(digest[:])
+}
+
+func (s *BlobsTestSuite) SetupTest() {
+	s.StoreDir, _ = ioutil.TempDir("", "blobsTest-"+uuid.New())
+	// Images Store Setup
+	imageStoreConfig := &images.FSConfig{
+		Dir: s.StoreDir,
+	}
+	viper.Set("imageStoreType", "fs")
+	viper.Set("imageStoreConfig", imageStoreConfig)
+
+	// Metadata Store Setup
+	metadataStoreConfig := &metadata.KViteConfig{
+		Filename: filepath.Join(s.StoreDir, "kvite.db"),
+		Table:    "test",
+	}
+	viper.Set("metadataStoreType", "kvite")
+	viper.Set("metadataStoreConfig", metadataStoreConfig)
+
+	// Set up context
+	ctx, err := imageservice.NewContext()
+	s.Require().NoError(err)
+	s.Context = ctx
+}
+
+func (s *BlobsTestSuite) TearDownTest() {
+	s.NoError(os.RemoveAll(s.StoreDir))
+}
+
+func TestBlobsTestSuite(t *testing.T) {
+	suite.Run(t, new(BlobsTestSuite))
+}
+
+func (s *BlobsTestSuite) TestCommit() {
+	first := s.receiveImage()
+	second := s.receiveImage()
+
+	s.NotEqual(first.ID, second.ID, "images should be distinct")
+	s.Equal(s.ImageDigest, first.Digest, "digest should be recorded")
+	s.Equal(first.Digest, second.Digest, "identical data should have the same digest")
+	s.Equal(first.Digest, first.BlobID(), "data should be addressed by digest")
+
+	_, err := s.Context.ImageStore.Stat(first.ID)
+	s.Error(err, "data should not remain under the image id")
+	_, err = s.Context.ImageStore.Stat(second.ID)
+	s.Error(err, "duplicate data should not remain under the image id")
+	_, err = s.Context.ImageStore.Stat(s.ImageDigest)
+	s.NoError(err, "data should be stored under the digest")
+
+	refs, err := s.Context.Blobs.References(s.ImageDigest)
+	s.NoError(err)
+	s.Len(refs, 2, "both images should reference the blob")
+}
+
+func (s *BlobsTestSuite) TestRelease() {
+	first := s.receiveImage()
+	second := s.receiveImage()
+
+	s.NoError(s.Context.MetadataStore.Delete(first.ID))
+	s.NoError(s.Context.Blobs.Release(first))
+	_, err := s.Context.ImageStore.Stat(s.ImageDigest)
+	s.NoError(err, "blob should remain while still referenced")
+
+	s.NoError(s.Context.MetadataStore.Delete(second.ID))
+	s.NoError(s.Context.Blobs.Release(second))
+	_, err = s.Context.ImageStore.Stat(s.ImageDigest)
+	s.Error(err, "blob should be removed with the last reference")
+
+	// Data that was never committed is removed directly
+	pending := &metadata.Image{ID: metadata.NewID()}
+	s.NoError(s.Context.ImageStore.Put(pending.ID, bytes.NewReader(s.ImageData)))
+	s.NoError(s.Context.Blobs.Release(pending))
+	_, err = s.Context.ImageStore.Stat(pending.ID)
+	s.Error(err, "uncommitted data should be removed")
+}
+
+func (s *BlobsTestSuite) TestMigrate() {
+	// Simulate data stored before content addressing
+	legacy := &metadata.Image{
+		ID:     metadata.NewID(),
+		Type:   "kvm",
+		Status: metadata.StatusComplete,
+	}
+	s.NoError(s.Context.ImageStore.Put(legacy.ID, bytes.NewReader(s.ImageData)))
+	s.NoError(s.Context.MetadataStore.Put(legacy))
+
+	s.NoError(s.Context.Blobs.Migrate())
+
+	image, err := s.Context.MetadataStore.GetByID(legacy.ID)
+	s.NoError(err)
+	s.Equal(s.ImageDigest, image.Digest, "digest should be recorded")
+	_, err = s.Context.ImageStore.Stat(legacy.ID)
+	s.Error(err, "data should not remain under the image id")
+	_, err = s.Context.ImageStore.Stat(s.ImageDigest)
+	s.NoError(err, "data should be stored under the digest")
+
+	s.NoError(s.Context.Blobs.Migrate(), "migrating again should be a noop")
+}
+
+// receiveImage stores the ImageData as a new image
+func (s *BlobsTestSuite) receiveImage() *metadata.Image {
+	req, _ := http.NewRequest("PUT", "http://localhost", bytes.NewReader(s.ImageData))
+	req.Header.Add("X-Image-Type", "kvm")
+
+	image, err := s.Context.Fetcher.Receive(req)
+	s.Require().NoError(err)
+	return image
+}
@@ -0,0 +1,409 @@
+package imageservice
+
+import (
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/mistifyio/mistify-image-service/images"
+	"github.com/mistifyio/mistify-image-service/metadata"
+	"github.com/pborman/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// Problems found by a consistency check
+const (
+	// CheckMissingData is a complete image without data in the image store
+	CheckMissingData = "missing_data"
+	// CheckOrphanData is data in the image store not referenced by any image
+	CheckOrphanData = "orphan_data"
+	// CheckSizeMismatch is image data whose size differs from the image size
+	CheckSizeMismatch = "size_mismatch"
+	// CheckChecksumMismatch is image data that no longer matches the image
+	// checksum or digest
+	CheckChecksumMismatch = "checksum_mismatch"
+	// CheckTempData is a temporary file in the image store left behind by an
+	// interrupted write
+	CheckTempData = "temp_data"
+)
+
+// ErrMissingData is recorded on complete images repaired after their data was
+// found missing from the image store
+var ErrMissingData = errors.New("image data missing")
+
+type (
+	// CheckOptions control a consistency check
+	CheckOptions struct {
+		// Checksums verifies all image data against the recorded checksums
+		// and digests, which requires reading all of the data
+		Checksums bool `json:"checksums"`
+		// Repair fixes the problems found. Orphaned data and temporary files
+		// are removed, sizes are corrected when the data can be verified, and images with
+		// missing or corrupt data are marked with the error status.
+		Repair bool `json:"repair"`
+	}
+
+	// CheckIssue is a problem found by a consistency check
+	CheckIssue struct {
+		Problem  string `json:"problem"`
+		ImageID  string `json:"image_id,omitempty"`
+		Store    string `json:"store"`
+		BlobID   string `json:"blob_id"`
+		Expected string `json:"expected,omitempty"`
+		Actual   string `json:"actual,omitempty"`
+		Repaired bool   `json:"repaired"`
+	}
+
+	// CheckReport is the result of a consistency check
+	CheckReport struct {
+		Images int           `json:"images"`
+		Blobs  int           `json:"blobs"`
+		Issues []*CheckIssue `json:"issues"`
+	}
+)
+
+// Check compares the metadata and image stores, reporting complete images
+// whose data is missing, has the wrong size, or fails checksum verification,
+// stored data not referenced by any image, and temporary files left behind by
+// interrupted writes. Problems are optionally repaired.
+func Check(ctx *Context, options *CheckOptions) (*CheckReport, error) {
+	report := &CheckReport{
+		Issues: make([]*CheckIssue, 0),
+	}
+
+	allImages, err := checkOrphans(ctx, options, report)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, image := range allImages {
+		if image.Status != metadata.StatusComplete {
+			continue
+		}
+		image.Store = ctx.MetadataStore
+		if err := checkImage(ctx, image, options, report); err != nil {
+			return nil, err
+		}
+	}
+
+	log.WithFields(log.Fields{
+		"images": report.Images,
+		"blobs":  report.Blobs,
+		"issues": len(report.Issues),
+		"repair": options.Repair,
+	}).Info("consistency check finished")
+	return report, nil
+}
+
+// Unrepaired returns the number of issues that were not repaired
+func (report *CheckReport) Unrepaired() int {
+	count := 0
+	for _, issue := range report.Issues {
+		if !issue.Repaired {
+			count++
+		}
+	}
+	return count
+}
+
+// checkOrphans finds data in the image stores not referenced by any image,
+// returning the images listed along the way. Only data stored under an image
+// id or digest is considered, leaving any unrelated files alone.
+func checkOrphans(ctx *Context, options *CheckOptions, report *CheckReport) ([]*metadata.Image, error) {
+	// The data is listed before the images, since image metadata is saved
+	// before its data. Listing can be slow, so blobs are only locked to
+	// confirm each orphan found in the listings.
+	storeNames := ctx.ImageStoreNames()
+	storeBlobIDs := make(map[string][]string, len(storeNames))
+	for _, name := range storeNames {
+		imageStore, err := ctx.GetImageStore(name)
+		if err != nil {
+			return nil, err
+		}
+		blobIDs, err := imageStore.List()
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+				"store": name,
+			}).Error("failed to list image data")
+			return nil, err
+		}
+		storeBlobIDs[name] = blobIDs
+	}
+	allImages, err := ctx.MetadataStore.List("")
+	if err != nil {
+		log.WithField("error", err).Error("failed to list images")
+		return nil, err
+	}
+	report.Images = len(allImages)
+
+	// Data is referenced by staging id or image id while it is being
+	// transferred, and by digest once it is committed, in the image store
+	// holding the image data
+	referenced := make(map[blobKey]struct{}, len(allImages))
+	for _, image := range allImages {
+		storeName := imageStoreName(image)
+		referenced[blobKey{storeName, stagingID(image.ID)}] = struct{}{}
+		referenced[blobKey{storeName, image.ID}] = struct{}{}
+		referenced[blobKey{storeName, image.BlobID()}] = struct{}{}
+	}
+
+	for _, name := range storeNames {
+		for _, blobID := range storeBlobIDs[name] {
+			if !isBlobID(blobID) {
+				continue
+			}
+			report.Blobs++
+			key := blobKey{name, blobID}
+			if _, ok := referenced[key]; ok {
+				continue
+			}
+			if err := checkOrphan(ctx, key, options, report); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for _, name := range storeNames {
+		if err := checkTemp(ctx, name, options, report); err != nil {
+			return nil, err
+		}
+	}
+
+	return allImages, nil
+}
+
+// checkOrphan confirms that data missing from the image listing is still
+// stored and unreferenced, since blobs may have been committed or released
+// after the listings were taken
+func checkOrphan(ctx *Context, key blobKey, options *CheckOptions, report *CheckReport) error {
+	ctx.Blobs.lock.Lock()
+	defer ctx.Blobs.lock.Unlock()
+
+	// Data being read or relocated is handled by Blobs
+	if ctx.Blobs.pinned(key.store, key.blobID) {
+		return nil
+	}
+	referenced, err := ctx.Blobs.referenced(key)
+	if err != nil || referenced {
+		return err
+	}
+	imageStore, err := ctx.GetImageStore(key.store)
+	if err != nil {
+		return err
+	}
+	if _, err := imageStore.Stat(key.blobID); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	issue := &CheckIssue{
+		Problem: CheckOrphanData,
+		Store:   key.store,
+		BlobID:  key.blobID,
+	}
+	if options.Repair {
+		issue.Repaired = ctx.Blobs.remove(key) == nil
+	}
+	addCheckIssue(report, issue)
+	return nil
+}
+
+// checkTemp finds temporary files left behind by interrupted writes in an
+// image store that writes through them
+func checkTemp(ctx *Context, name string, options *CheckOptions, report *CheckReport) error {
+	imageStore, err := ctx.GetImageStore(name)
+	if err != nil {
+		return err
+	}
+	cleaner, ok := imageStore.(images.TempCleaner)
+	if !ok {
+		return nil
+	}
+
+	tempNames, err := cleaner.ListTemp()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+			"store": name,
+		}).Error("failed to list temporary files")
+		return err
+	}
+	for _, tempName := range tempNames {
+		issue := &CheckIssue{
+			Problem: CheckTempData,
+			Store:   name,
+			BlobID:  tempName,
+		}
+		if options.Repair {
+			issue.Repaired = cleaner.DeleteTemp(tempName) == nil
+		}
+		addCheckIssue(report, issue)
+	}
+	return nil
+}
+
+// checkImage checks the data of a complete image
+func checkImage(ctx *Context, image *metadata.Image, options *CheckOptions, report *CheckReport) error {
+	imageStore, err := ctx.ImageStoreFor(image)
+	if err != nil {
+		return err
+	}
+
+	blobID := image.BlobID()
+	stat, err := imageStore.Stat(blobID)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return err
+		}
+
+		issue := &CheckIssue{
+			Problem: CheckMissingData,
+			ImageID: image.ID,
+			Store:   imageStoreName(image),
+			BlobID:  blobID,
+		}
+		if options.Repair {
+			issue.Repaired = repairImage(ctx, image, func(current *metadata.Image) error {
+				return current.SetFinished(ErrMissingData)
+			})
+		}
+		addCheckIssue(report, issue)
+		return nil
+	}
+
+	// Verify the data when asked, or when needed to decide how to repair a
+	// size mismatch
+	sizeOK := stat.Size() == image.Size
+	verified := true
+	if options.Checksums || (options.Repair && !sizeOK) {
+		issue, err := verifyImageData(ctx, image)
+		if err != nil {
+			return err
+		}
+		if issue != nil {
+			verified = false
+			if options.Repair {
+				issue.Repaired = repairImage(ctx, image, func(current *metadata.Image) error {
+					return current.SetFinished(metadata.ErrChecksumMismatch)
+				})
+			}
+			addCheckIssue(report, issue)
+		}
+	}
+
+	if !sizeOK {
+		issue := &CheckIssue{
+			Problem:  CheckSizeMismatch,
+			ImageID:  image.ID,
+			Store:    imageStoreName(image),
+			BlobID:   blobID,
+			Expected: strconv.FormatInt(image.Size, 10),
+			Actual:   strconv.FormatInt(stat.Size(), 10),
+		}
+		// Only trust the stored size if the data is intact
+		if options.Repair && verified {
+			issue.Repaired = repairImage(ctx, image, func(current *metadata.Image) error {
+				return current.UpdateSize(stat.Size())
+			})
+		}
+		addCheckIssue(report, issue)
+	}
+
+	return nil
+}
+
+// verifyImageData reads the data of an image and compares it with the image
+// digest and checksum, returning an issue if either does not match. Data
+// without a recorded digest or checksum can't be verified and is assumed to be
+// intact.
+func verifyImageData(ctx *Context, image *metadata.Image) (*CheckIssue, error) {
+	digester := metadata.NewHash(metadata.DigestType)
+	hashWriters := []io.Writer{digester}
+	hasher := metadata.NewHash(image.ChecksumType)
+	if hasher != nil {
+		hashWriters = append(hashWriters, hasher)
+	}
+
+	imageStore, err := ctx.ImageStoreFor(image)
+	if err != nil {
+		return nil, err
+	}
+
+	blobID := image.BlobID()
+	if err := imageStore.Get(blobID, io.MultiWriter(hashWriters...)); err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+			"image": image,
+		}).Error("failed to read image data for verification")
+		return nil, err
+	}
+
+	issue := &CheckIssue{
+		Problem: CheckChecksumMismatch,
+		ImageID: image.ID,
+		Store:   imageStoreName(image),
+		BlobID:  blobID,
+	}
+	if digest := hex.EncodeToString(digester.Sum(nil)); image.Digest != "" && image.Digest != digest {
+		issue.Expected = image.Digest
+		issue.Actual = digest
+		return issue, nil
+	}
+	if hasher != nil && image.Checksum != "" {
+		if checksum := hex.EncodeToString(hasher.Sum(nil)); !strings.EqualFold(image.Checksum, checksum) {
+			issue.Expected = image.Checksum
+			issue.Actual = checksum
+			return issue, nil
+		}
+	}
+	return nil, nil
+}
+
+// repairImage applies a repair to the current metadata of an image, returning
+// whether it succeeded. Images removed since the check began are left alone.
+func repairImage(ctx *Context, image *metadata.Image, repair func(*metadata.Image) error) bool {
+	current, err := ctx.MetadataStore.GetByID(image.ID)
+	if err != nil {
+		return false
+	}
+	current.Store = ctx.MetadataStore
+
+	if err := repair(current); err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+			"image": current,
+		}).Error("failed to repair image")
+		return false
+	}
+	return true
+}
+
+// addCheckIssue logs and records an issue in a report
+func addCheckIssue(report *CheckReport, issue *CheckIssue) {
+	log.WithFields(log.Fields{
+		"problem":  issue.Problem,
+		"imageID":  issue.ImageID,
+		"store":    issue.Store,
+		"blobID":   issue.BlobID,
+		"expected": issue.Expected,
+		"actual":   issue.Actual,
+		"repaired": issue.Repaired,
+	}).Warn("consistency check found a problem")
+	report.Issues = append(report.Issues, issue)
+}
+
+// isBlobID tests whether an id in the image store is image data, either stored
+// under an image id, a staging id or a digest
+func isBlobID(id string) bool {
+	if uuid.Parse(strings.TrimSuffix(id, stagingSuffix)) != nil {
+		return true
+	}
+	digest, err := hex.DecodeString(id)
+	return err == nil && len(digest) == metadata.NewHash(metadata.DigestType).Size()
+}
@@ -0,0 +1,209 @@
+package imageservice_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mistifyio/mistify-image-service"
+	"github.com/mistifyio/mistify-image-service/images"
+	"github.com/mistifyio/mistify-image-service/metadata"
+	"github.com/pborman/uuid"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/suite"
+)
+
+type CheckTestSuite struct {
+	suite.Suite
+	Context   *imageservice.Context
+	ImageData []byte
+	StoreDir  string
+}
+
+func (s *CheckTestSuite) SetupSuite() {
+	log.SetLevel(log.FatalLevel)
+	s.ImageData = []byte("testdatatestdatatestdata")
+}
+
+func (s *CheckTestSuite) SetupTest() {
+	s.StoreDir, _ = ioutil.TempDir("", "checkTest-"+uuid.New())
+	// Images Store Setup
+	imageStoreConfig := &images.FSConfig{
+		Dir: s.StoreDir,
+	}
+	viper.Set("imageStoreType", "fs")
+	viper.Set("imageStoreConfig", imageStoreConfig)
+
+	// Metadata Store Setup
+	metadataStoreConfig := &metadata.KViteConfig{
+		Filename: filepath.Join(s.StoreDir, "kvite.db"),
+		Table:    "test",
+	}
+	viper.Set("metadataStoreType", "kvite")
+	viper.Set("metadataStoreConfig", metadataStoreConfig)
+
+	// Set up context
+	ctx, err := imageservice.NewContext()
+	s.Require().NoError(err)
+	s.Context = ctx
+}
+
+func (s *CheckTestSuite) TearDownTest() {
+	s.NoError(os.RemoveAll(s.StoreDir))
+}
+
+func TestCheckTestSuite(t *testing.T) {
+	suite.Run(t, new(CheckTestSuite))
+}
+
+func (s *CheckTestSuite) TestConsistent() {
+	_ = s.receiveImage()
+	_ = s.receiveImage()
+
+	report, err := imageservice.Check(s.Context, &imageservice.CheckOptions{Checksums: true})
+	s.NoError(err)
+	s.Equal(2, report.Images)
+	s.Equal(1, report.Blobs, "identical images should share a blob")
+	s.Empty(report.Issues)
+}
+
+func (s *CheckTestSuite) TestOrphanData() {
+	orphanID := metadata.NewID()
+	s.Require().NoError(s.Context.ImageStore.Put(orphanID, bytes.NewReader(s.ImageData)))
+	s.Require().NoError(s.Context.ImageStore.Put("notimagedata", bytes.NewReader(s.ImageData)))
+
+	report := s.check(false)
+	s.Require().Len(report.Issues, 1, "only image data should be considered")
+	s.Equal(imageservice.CheckOrphanData, report.Issues[0].Problem)
+	s.Equal(orphanID, report.Issues[0].BlobID)
+	s.False(report.Issues[0].Repaired)
+
+	report = s.check(true)
+	s.Require().Len(report.Issues, 1)
+	s.True(report.Issues[0].Repaired)
+	_, err := s.Context.ImageStore.Stat(orphanID)
+	s.Error(err, "orphaned data should be removed")
+	_, err = s.Context.ImageStore.Stat("notimagedata")
+	s.NoError(err, "other data should be left alone")
+
+	s.Empty(s.check(false).Issues)
+}
+
+// staleListStore is a metadata store listing no images, as if the images
+// were saved after the listing
+type staleListStore struct {
+	metadata.Store
+}
+
+func (store *staleListStore) List(imageType string) ([]*metadata.Image, error) {
+	return []*metadata.Image{}, nil
+}
+
+func (s *CheckTestSuite) TestOrphanDataRecheck() {
+	image := s.receiveImage()
+	s.Context.MetadataStore = &staleListStore{Store: s.Context.MetadataStore}
+
+	report := s.check(true)
+	s.Empty(report.Issues, "data referenced since the listing should not be an orphan")
+	_, err := s.Context.ImageStore.Stat(image.BlobID())
+	s.NoError(err, "referenced data should be kept")
+}
+
+func (s *CheckTestSuite) TestTempData() {
+	tempFilepath := filepath.Join(s.StoreDir, ".tmp-123")
+	s.Require().NoError(ioutil.WriteFile(tempFilepath, s.ImageData, 0644))
+
+	report := s.check(false)
+	s.Require().Len(report.Issues, 1)
+	s.Equal(imageservice.CheckTempData, report.Issues[0].Problem)
+	s.Equal(".tmp-123", report.Issues[0].BlobID)
+	s.False(report.Issues[0].Repaired)
+
+	report = s.check(true)
+	s.Require().Len(report.Issues, 1)
+	s.True(report.Issues[0].Repaired)
+	_, err := os.Stat(tempFilepath)
+	s.True(os.IsNotExist(err), "temporary file should be removed")
+
+	s.Empty(s.check(false).Issues)
+}
+
+func (s *CheckTestSuite) TestMissingData() {
+	image := s.receiveImage()
+	s.Require().NoError(s.Context.ImageStore.Delete(image.BlobID()))
+
+	report := s.check(true)
+	s.Require().Len(report.Issues, 1)
+	s.Equal(imageservice.CheckMissingData, report.Issues[0].Problem)
+	s.Equal(image.ID, report.Issues[0].ImageID)
+	s.True(report.Issues[0].Repaired)
+
+	image = s.getImage(image.ID)
+	s.Equal(metadata.StatusError, image.Status, "image should be marked as failed")
+	s.Equal(imageservice.ErrMissingData.Error(), image.Error)
+
+	s.Empty(s.check(false).Issues)
+}
+
+func (s *CheckTestSuite) TestSizeMismatch() {
+	image := s.receiveImage()
+	image.Store = s.Context.MetadataStore
+	s.Require().NoError(image.UpdateSize(1))
+
+	report := s.check(false)
+	s.Require().Len(report.Issues, 1)
+	s.Equal(imageservice.CheckSizeMismatch, report.Issues[0].Problem)
+	s.Equal("1", report.Issues[0].Expected)
+
+	report = s.check(true)
+	s.Require().Len(report.Issues, 1)
+	s.True(report.Issues[0].Repaired, "size should be repaired for intact data")
+	s.EqualValues(len(s.ImageData), s.getImage(image.ID).Size)
+}
+
+func (s *CheckTestSuite) TestChecksumMismatch() {
+	image := s.receiveImage()
+	corrupt := bytes.ToUpper(s.ImageData)
+	s.Require().NoError(s.Context.ImageStore.Put(image.BlobID(), bytes.NewReader(corrupt)))
+
+	s.Empty(s.check(false).Issues, "data should only be verified when requested")
+
+	report, err := imageservice.Check(s.Context, &imageservice.CheckOptions{Checksums: true, Repair: true})
+	s.NoError(err)
+	s.Require().Len(report.Issues, 1)
+	s.Equal(imageservice.CheckChecksumMismatch, report.Issues[0].Problem)
+	s.Equal(image.Digest, report.Issues[0].Expected)
+	s.True(report.Issues[0].Repaired)
+
+	image = s.getImage(image.ID)
+	s.Equal(metadata.StatusError, image.Status, "image should be marked as failed")
+	s.Equal(metadata.ErrChecksumMismatch.Error(), image.Error)
+}
+
+// check runs a consistency check without checksum verification
+func (s *CheckTestSuite) check(repair bool) *imageservice.CheckReport {
+	report, err := imageservice.Check(s.Context, &imageservice.CheckOptions{Repair: repair})
+	s.Require().NoError(err)
+	return report
+}
+
+// receiveImage stores the ImageData as a new image
+func (s *CheckTestSuite) receiveImage() *metadata.Image {
+	req, _ := http.NewRequest("PUT", "http://localhost", bytes.NewReader(s.ImageData))
+	req.Header.Add("X-Image-Type", "kvm")
+
+	image, err := s.Context.Fetcher.Receive(req)
+	s.Require().NoError(err)
+	return image
+}
+
+// getImage retrieves image metadata
+func (s *CheckTestSuite) getImage(imageID string) *metadata.Image {
+	image, err := s.Context.MetadataStore.GetByID(imageID)
+	s.Require().NoError(err)
+	return image
+}
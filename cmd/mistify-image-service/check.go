@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/mistifyio/mistify-image-service"
+	log "github.com/sirupsen/logrus"
+	flag "github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// runCheck runs a consistency check between the metadata and image stores,
+// writing the report to stdout. Returns the exit status, which is non-zero if
+// any problems remain unrepaired. Repairs are refused while the service is
+// running, since the command can't coordinate with its transfers and commits.
+func runCheck(args []string) int {
+	options := &imageservice.CheckOptions{}
+
+	flags := flag.NewFlagSet("check", flag.ExitOnError)
+	flags.BoolVar(&options.Checksums, "checksums", false, "verify image data checksums")
+	flags.BoolVar(&options.Repair, "repair", false, "repair problems found; refused while the service is running")
+	if err := flags.Parse(args); err != nil {
+		log.WithField("error", err).Fatal("failed to parse check flags")
+	}
+
+	port := viper.GetInt("port")
+	if options.Repair && serviceRunning(port) {
+		log.WithField("port", port).Fatal("refusing to repair while the service is running; stop it or use /admin/check")
+	}
+
+	// The stores are used directly, so no fetches are started
+	ctx, err := imageservice.NewStoreContext()
+	if err != nil {
+		log.Fatal("failed to create and initialize context")
+	}
+
+	report, err := imageservice.Check(ctx, options)
+	if err != nil {
+		log.WithField("error", err).Fatal("consistency check failed")
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(report); err != nil {
+		log.WithField("error", err).Fatal("failed to write report")
+	}
+
+	if report.Unrepaired() > 0 {
+		return 1
+	}
+	return 0
+}
+
+// serviceRunning tests whether something is listening on the service port
+func serviceRunning(port int) bool {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort("localhost", strconv.Itoa(port)), time.Second)
+	if err != nil {
+		return false
+	}
+	_ = conn.Close()
+	return true
+}
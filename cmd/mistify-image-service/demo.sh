@@ -2,6 +2,9 @@
 HOST=${1:-127.0.0.1}
 PORT=${2:-20000}
 FILE=${3:-/home/vagrant/ubuntu.zfs.gz}
+# An api token secret, created with the tokens command
+TOKEN=${4:-$TOKEN}
+AUTH="Authorization: Bearer $TOKEN"
 
 prefix () {
     NOW=$(date +"%Y/%m/%d %H:%M:%S")
@@ -41,16 +44,16 @@ http () {
 
     URL="http://$HOST:$PORT/$ENDPOINT"
     log "$METHOD\t$URL\t$@" 
-    OUTPUT=$(curl --fail -s -X $METHOD -H "$XIT" -H "$XIC" -H 'Content-Type: application/json' $URL "$@" | jq .)
+    OUTPUT=$(curl --fail -s -X $METHOD -H "$AUTH" -H "$XIT" -H "$XIC" -H 'Content-Type: application/json' $URL "$@" | jq .)
     log "Result:"
     echo "$OUTPUT" | indent
 }
 
 clean () {
-    CLEANIDS=($(curl --fail -s -X GET "http://$HOST:$PORT/images" | jq -r .[].id))
+    CLEANIDS=($(curl --fail -s -X GET -H "$AUTH" "http://$HOST:$PORT/images" | jq -r .[].id))
     for CLEANID in "${CLEANIDS[@]}"
     do
-        _=$(curl -s -X DELETE "http://$HOST:$PORT/images/$CLEANID")
+        _=$(curl -s -X DELETE -H "$AUTH" "http://$HOST:$PORT/images/$CLEANID")
     done
 }
 
@@ -8,5 +8,42 @@ Usage
 	-c, --config-file="": config file
 	-l, --log-level="warning": log level: debug/info/warning/error/critical/fatal
 	-a, --port=20000: listen address
+
+A command can follow the global flags, with its own flags after it.
+
+	$ mistify-image-service -c config.json check [--checksums] [--repair]
+
+check compares the metadata and image stores and writes a JSON report of the
+problems found. --checksums verifies all image data, and --repair fixes the
+problems found, including temporary files left behind by interrupted writes.
+The exit status is non-zero if any problems remain unrepaired. --repair is
+refused while the service is listening on the configured port, since the
+command can't coordinate with transfers and commits in progress; stop the
+service first, or use the /admin/check endpoint to repair a running service.
+
+	$ mistify-image-service -c config.json tokens create --name deploy [--ttl 720h]
+	$ mistify-image-service -c config.json tokens list
+	$ mistify-image-service -c config.json tokens revoke <token id>
+
+tokens manages the api tokens held in the metadata store. create writes the new
+token with its secret, which is shown only once, list writes the tokens with
+their expiry and last use, and revoke removes a token. Authentication is
+required unless requireAuth is set to false, so use it to create the first
+token before starting the service; after that the /admin/tokens endpoints do
+the same for a running service, which is needed when the metadata store is a
+bolt file held open by the service.
+
+	$ mistify-image-service migrate-metadata --from kvite:'{"filename":"/var/lib/images.db","table":"images"}' \
+		--to etcd3:'{"endpoints":["http://localhost:2379"]}' \
+		[--images-from fs:'{"dir":"/var/lib/images"}' --images-to s3:'{...}']
+
+migrate-metadata copies all image metadata from one metadata store to another,
+given as a store type and its JSON config, and needs no config file. With
+--images-from and --images-to, the data of complete images is copied between
+the image stores as well. Everything copied is verified, and images already
+migrated are skipped, so an interrupted migration is resumed by running it
+again. A JSON report is written, and the exit status is non-zero if any images
+could not be migrated. Stop the service first, since changes made during the
+migration may not be copied.
 */
 package main
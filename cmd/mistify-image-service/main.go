@@ -1,9 +1,11 @@
 package main
 
 import (
-	log "github.com/Sirupsen/logrus"
+	"os"
+
 	"github.com/mistifyio/mistify-image-service"
 	logx "github.com/mistifyio/mistify-logrus-ext"
+	log "github.com/sirupsen/logrus"
 	flag "github.com/spf13/pflag"
 	"github.com/spf13/viper"
 )
@@ -11,6 +13,8 @@ import (
 func main() {
 	var configFile, logLevel string
 
+	// Flags after a command belong to the command
+	flag.CommandLine.SetInterspersed(false)
 	flag.IntP("port", "a", 20000, "listen address")
 	flag.StringVarP(&logLevel, "log-level", "l", "warning", "log level: debug/info/warning/error/critical/fatal")
 	flag.StringVarP(&configFile, "config-file", "c", "", "config file")
@@ -24,6 +28,11 @@ func main() {
 		}).Fatal("failed to set up logging")
 	}
 
+	// Commands given their stores on the command line don't need the config
+	if args := flag.Args(); len(args) > 0 && args[0] == "migrate-metadata" {
+		os.Exit(runMigrateMetadata(args[1:]))
+	}
+
 	if configFile == "" {
 		log.Fatal("undefined config file")
 	}
@@ -34,6 +43,17 @@ func main() {
 		log.WithField("error", err).Fatal("failed to load config")
 	}
 
+	if args := flag.Args(); len(args) > 0 {
+		switch args[0] {
+		case "check":
+			os.Exit(runCheck(args[1:]))
+		case "tokens":
+			os.Exit(runTokens(args[1:]))
+		default:
+			log.WithField("command", args[0]).Fatal("unknown command")
+		}
+	}
+
 	context, err := imageservice.NewContext()
 	if nil != err {
 		log.Fatal("failed to create and initialize context")
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+
+	"github.com/mistifyio/mistify-image-service"
+	log "github.com/sirupsen/logrus"
+	flag "github.com/spf13/pflag"
+)
+
+// runMigrateMetadata copies image metadata, and optionally image data, from
+// one set of stores to another, writing the report to stdout. Returns the exit
+// status, which is non-zero if any images could not be migrated.
+func runMigrateMetadata(args []string) int {
+	var from, to, imagesFrom, imagesTo string
+
+	flags := flag.NewFlagSet("migrate-metadata", flag.ExitOnError)
+	flags.StringVar(&from, "from", "", "source metadata store, as type:json config")
+	flags.StringVar(&to, "to", "", "destination metadata store, as type:json config")
+	flags.StringVar(&imagesFrom, "images-from", "", "source image store for copying image data, as type:json config")
+	flags.StringVar(&imagesTo, "images-to", "", "destination image store for copying image data, as type:json config")
+	if err := flags.Parse(args); err != nil {
+		log.WithField("error", err).Fatal("failed to parse migrate-metadata flags")
+	}
+	if from == "" || to == "" {
+		log.Fatal("both --from and --to metadata stores are required")
+	}
+	if (imagesFrom == "") != (imagesTo == "") {
+		log.Fatal("both --images-from and --images-to image stores are required to copy image data")
+	}
+
+	fromCtx := newMigrateContext(from, imagesFrom)
+	toCtx := newMigrateContext(to, imagesTo)
+
+	report, err := imageservice.Migrate(fromCtx, toCtx)
+	if err != nil {
+		log.WithField("error", err).Fatal("migration failed")
+	}
+	shutdownMigrateContext(fromCtx)
+	shutdownMigrateContext(toCtx)
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(report); err != nil {
+		log.WithField("error", err).Fatal("failed to write report")
+	}
+
+	if len(report.Issues) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// newMigrateContext creates a context with the stores given on the command
+// line. The image store is optional.
+func newMigrateContext(metadataStore, imageStore string) *imageservice.Context {
+	ctx := &imageservice.Context{}
+
+	storeType, config, err := parseStoreFlag(metadataStore)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+			"store": metadataStore,
+		}).Fatal("invalid metadata store")
+	}
+	if err := ctx.InitMetadataStore(storeType, config); err != nil {
+		log.WithField("error", err).Fatal("failed to initialize metadata store")
+	}
+
+	if imageStore == "" {
+		return ctx
+	}
+	storeType, config, err = parseStoreFlag(imageStore)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+			"store": imageStore,
+		}).Fatal("invalid image store")
+	}
+	if err := ctx.InitImageStore(storeType, config); err != nil {
+		log.WithField("error", err).Fatal("failed to initialize image store")
+	}
+	return ctx
+}
+
+// shutdownMigrateContext shuts down the stores of a migration context
+func shutdownMigrateContext(ctx *imageservice.Context) {
+	if err := ctx.MetadataStore.Shutdown(); err != nil {
+		log.WithField("error", err).Error("failed to shut down metadata store")
+	}
+	if ctx.ImageStore != nil {
+		if err := ctx.ImageStore.Shutdown(); err != nil {
+			log.WithField("error", err).Error("failed to shut down image store")
+		}
+	}
+}
+
+// parseStoreFlag splits a store given as type:json config. The config is
+// optional and defaults to an empty object.
+func parseStoreFlag(value string) (string, []byte, error) {
+	parts := strings.SplitN(value, ":", 2)
+	if parts[0] == "" {
+		return "", nil, errors.New("missing store type")
+	}
+	if len(parts) == 1 || parts[1] == "" {
+		return parts[0], []byte("{}"), nil
+	}
+
+	config := []byte(parts[1])
+	if !json.Valid(config) {
+		return "", nil, errors.New("invalid store config json")
+	}
+	return parts[0], config, nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/mistifyio/mistify-image-service"
+	log "github.com/sirupsen/logrus"
+	flag "github.com/spf13/pflag"
+)
+
+// runTokens creates, lists or revokes api tokens in the metadata store,
+// writing the result to stdout. Returns the exit status.
+func runTokens(args []string) int {
+	if len(args) == 0 {
+		log.Fatal("missing tokens command: create/list/revoke")
+	}
+
+	var name string
+	var ttl string
+	flags := flag.NewFlagSet("tokens "+args[0], flag.ExitOnError)
+	if args[0] == "create" {
+		flags.StringVar(&name, "name", "", "token name")
+		flags.StringVar(&ttl, "ttl", "", "time until the token expires, such as 720h; empty for none")
+	}
+	if err := flags.Parse(args[1:]); err != nil {
+		log.WithField("error", err).Fatal("failed to parse tokens flags")
+	}
+
+	// The stores are used directly, so no fetches are started
+	ctx, err := imageservice.NewStoreContext()
+	if err != nil {
+		log.Fatal("failed to create and initialize context")
+	}
+	auth, err := imageservice.NewAuthenticator(ctx)
+	if err != nil {
+		log.Fatal("failed to create authenticator")
+	}
+
+	var result interface{}
+	switch args[0] {
+	case "create":
+		var duration time.Duration
+		if ttl != "" {
+			if duration, err = time.ParseDuration(ttl); err != nil {
+				log.WithField("error", err).Fatal("invalid token ttl")
+			}
+		}
+		result, err = auth.CreateToken(name, duration)
+	case "list":
+		result, err = auth.ListTokens()
+	case "revoke":
+		if flags.NArg() != 1 {
+			log.Fatal("revoke takes a token id")
+		}
+		err = auth.RevokeToken(flags.Arg(0))
+		result = map[string]string{"id": flags.Arg(0), "message": "token revoked"}
+	default:
+		log.WithField("command", args[0]).Fatal("unknown tokens command")
+	}
+	if err != nil {
+		log.WithField("error", err).Fatal("tokens " + args[0] + " failed")
+	}
+
+	if err := ctx.MetadataStore.Shutdown(); err != nil {
+		log.WithField("error", err).Error("failed to shut down metadata store")
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(result); err != nil {
+		log.WithField("error", err).Fatal("failed to write result")
+	}
+	return 0
+}
@@ -3,24 +3,112 @@ package imageservice
 import (
 	"encoding/json"
 	"errors"
+	"sort"
 
-	log "github.com/Sirupsen/logrus"
 	"github.com/mistifyio/mistify-image-service/images"
 	"github.com/mistifyio/mistify-image-service/metadata"
+	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 )
 
+// DefaultImageStore is the name of the image store configured by
+// imageStoreType and imageStoreConfig. Images without an image store recorded
+// have their data in it.
+const DefaultImageStore = "default"
+
+// ErrUnknownImageStore is used when an image store name isn't configured
+var ErrUnknownImageStore = errors.New("unknown image store")
+
 type (
 	// Context holds the initialized stores
 	Context struct {
 		ImageStore    images.Store
 		MetadataStore metadata.Store
-		Fetcher       *Fetcher
+		// ImageStores are the named image stores configured in addition to
+		// the default ImageStore
+		ImageStores map[string]images.Store
+		// ImageStoreRoutes select the image store for new images, in order
+		ImageStoreRoutes []*ImageStoreRoute
+		Blobs            *Blobs
+		Fetcher          *Fetcher
+		Relocator        *Relocator
+		Replicator       *Replicator
+		Mirror           *Mirror
+		Verifier         *Verifier
+		Signer           *Signer
+		Authenticator    *Authenticator
+	}
+
+	// ImageStoreConfig configures a named image store
+	ImageStoreConfig struct {
+		Name   string
+		Type   string
+		Config json.RawMessage
 	}
 )
 
-// NewContext creates a new context from configuration
+// NewContext creates a new context from configuration and starts fetching any
+// queued images
 func NewContext() (*Context, error) {
+	ctx, err := NewStoreContext()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ctx.Blobs.Migrate(); err != nil {
+		log.WithField("error", err).Error("failed to migrate image data to blobs")
+		return nil, err
+	}
+
+	// Signature verification of new images
+	ctx.Verifier, err = NewVerifier()
+	if err != nil {
+		return nil, err
+	}
+
+	// Signing of new images with the service key
+	ctx.Signer, err = NewSigner()
+	if err != nil {
+		return nil, err
+	}
+
+	// API token authentication of requests
+	ctx.Authenticator, err = NewAuthenticator(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Image Fetcher
+	ctx.Fetcher = NewFetcher(ctx)
+
+	// Image data relocation between image stores
+	ctx.Relocator = NewRelocator(ctx)
+
+	// Replication from upstream image services
+	ctx.Replicator, err = NewReplicator(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Mirroring of images missing here from upstream image services
+	ctx.Mirror, err = NewMirror(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// The peers are configured first, as fetches from them use their tokens
+	if err := ctx.Fetcher.Start(); err != nil {
+		return nil, err
+	}
+	ctx.Replicator.Start()
+
+	return ctx, nil
+}
+
+// NewStoreContext creates a new context from configuration with only the stores
+// initialized, for offline maintenance. No migrations are run and there is no
+// Fetcher.
+func NewStoreContext() (*Context, error) {
 	ctx := &Context{}
 
 	// Image Storage
@@ -31,6 +119,40 @@ func NewContext() (*Context, error) {
 		return nil, err
 	}
 
+	// Additional named image stores
+	var imageStoreConfigs []*ImageStoreConfig
+	// json errors would have been caught by viper when loading the file
+	imageStoresJSON, _ := json.Marshal(viper.Get("imageStores"))
+	if err := json.Unmarshal(imageStoresJSON, &imageStoreConfigs); err != nil {
+		log.WithFields(log.Fields{
+			"error":  err,
+			"config": string(imageStoresJSON),
+		}).Error("invalid image stores config")
+		return nil, err
+	}
+	for _, config := range imageStoreConfigs {
+		if err := ctx.AddImageStore(config.Name, config.Type, config.Config); err != nil {
+			return nil, err
+		}
+	}
+
+	// Image store routing of new images
+	var routes []*ImageStoreRoute
+	// json errors would have been caught by viper when loading the file
+	routesJSON, _ := json.Marshal(viper.Get("imageStoreRoutes"))
+	if err := json.Unmarshal(routesJSON, &routes); err != nil {
+		log.WithFields(log.Fields{
+			"error":  err,
+			"config": string(routesJSON),
+		}).Error("invalid image store routes config")
+		return nil, err
+	}
+	for _, route := range routes {
+		if err := ctx.AddImageStoreRoute(route); err != nil {
+			return nil, err
+		}
+	}
+
 	// Metadata Storage
 	metadataStoreType := viper.GetString("metadataStoreType")
 	// json errors would have been caught by viper when loading the file
@@ -44,14 +166,90 @@ func NewContext() (*Context, error) {
 		return nil, err
 	}
 
-	// Image Fetcher
-	ctx.Fetcher = NewFetcher(ctx)
+	// Content-addressed image data
+	ctx.Blobs = NewBlobs(ctx)
 
 	return ctx, nil
 }
 
-// InitImageStore creates a new image store for the context
+// InitImageStore creates a new default image store for the context
 func (ctx *Context) InitImageStore(storeType string, configBytes []byte) error {
+	store, err := newImageStore(storeType, configBytes)
+	if err != nil {
+		return err
+	}
+
+	ctx.ImageStore = store
+
+	return nil
+}
+
+// AddImageStore creates a new named image store for the context
+func (ctx *Context) AddImageStore(name, storeType string, configBytes []byte) error {
+	if _, exists := ctx.ImageStores[name]; exists || name == "" || name == DefaultImageStore {
+		err := errors.New("invalid or duplicate image store name")
+		log.WithFields(log.Fields{
+			"error": err,
+			"name":  name,
+		}).Error("failed to add image store")
+		return err
+	}
+
+	store, err := newImageStore(storeType, configBytes)
+	if err != nil {
+		return err
+	}
+
+	if ctx.ImageStores == nil {
+		ctx.ImageStores = make(map[string]images.Store)
+	}
+	ctx.ImageStores[name] = store
+
+	return nil
+}
+
+// GetImageStore retrieves an image store by name. An empty name is the
+// default image store.
+func (ctx *Context) GetImageStore(name string) (images.Store, error) {
+	if name == "" || name == DefaultImageStore {
+		if ctx.ImageStore == nil {
+			return nil, ErrUnknownImageStore
+		}
+		return ctx.ImageStore, nil
+	}
+
+	store, ok := ctx.ImageStores[name]
+	if !ok {
+		return nil, ErrUnknownImageStore
+	}
+	return store, nil
+}
+
+// ImageStoreFor retrieves the image store holding the data of an image
+func (ctx *Context) ImageStoreFor(image *metadata.Image) (images.Store, error) {
+	store, err := ctx.GetImageStore(image.ImageStore)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+			"image": image,
+		}).Error("image data is in an unknown image store")
+	}
+	return store, err
+}
+
+// ImageStoreNames returns the names of all image stores, starting with the
+// default image store
+func (ctx *Context) ImageStoreNames() []string {
+	names := make([]string, 0, len(ctx.ImageStores))
+	for name := range ctx.ImageStores {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return append([]string{DefaultImageStore}, names...)
+}
+
+// newImageStore creates and initializes an image store
+func newImageStore(storeType string, configBytes []byte) (images.Store, error) {
 	store := images.NewStore(storeType)
 	if store == nil {
 		err := errors.New("unknown image store type")
@@ -59,7 +257,7 @@ func (ctx *Context) InitImageStore(storeType string, configBytes []byte) error {
 			"error": err,
 			"type":  storeType,
 		}).Error("failed to create image store")
-		return err
+		return nil, err
 	}
 
 	if err := store.Init(configBytes); err != nil {
@@ -68,12 +266,19 @@ func (ctx *Context) InitImageStore(storeType string, configBytes []byte) error {
 			"type":   storeType,
 			"config": string(configBytes),
 		}).Error("failed to initialize image store")
-		return err
+		return nil, err
 	}
 
-	ctx.ImageStore = store
+	return store, nil
+}
 
-	return nil
+// imageStoreName returns the name of the image store holding the data of an
+// image
+func imageStoreName(image *metadata.Image) string {
+	if image.ImageStore == "" {
+		return DefaultImageStore
+	}
+	return image.ImageStore
 }
 
 // InitMetadataStore creates a new metadata store for the context
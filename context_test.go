@@ -5,12 +5,12 @@ import (
 	"errors"
 	"testing"
 
-	log "github.com/Sirupsen/logrus"
 	"github.com/mistifyio/mistify-image-service"
 	"github.com/mistifyio/mistify-image-service/images"
 	imocks "github.com/mistifyio/mistify-image-service/images/mocks"
 	"github.com/mistifyio/mistify-image-service/metadata"
 	mmocks "github.com/mistifyio/mistify-image-service/metadata/mocks"
+	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 	"github.com/stretchr/testify/suite"
 )
@@ -44,6 +44,7 @@ func (s *ContextTestSuite) SetupSuite() {
 		m.On("Init", vj).Return(nil)
 		ij, _ := json.Marshal(s.InvalidConfig)
 		m.On("Init", ij).Return(errors.New("asdf"))
+		m.On("List", "").Return(nil, nil)
 		return m
 	})
 }
@@ -97,6 +98,7 @@ func (s *ContextTestSuite) TestNewContext() {
 	s.NotNil(context)
 	s.NotNil(context.ImageStore)
 	s.NotNil(context.MetadataStore)
+	s.NotNil(context.Blobs)
 	s.NotNil(context.Fetcher)
 
 	viper.Set("metadataStoreConfig", s.InvalidConfig)
@@ -9,19 +9,207 @@ an external source over http.
 HTTP API Endpoints
 
 	/images
-		* GET  - Retrieve a list of images, optionally filtered by type.
+		* GET  - Retrieve a list of images, optionally filtered, sorted and paged
 		* POST - Fetch and store an image from an external http source
 		* PUT  - Upload and store image
 
 	/images/{imageID}
 		* GET    - Retrieves information for an image
-		* DELETE - Deletes an image
+		* DELETE - Deletes an image, cancelling any fetch in progress
+
+	/images/{imageID}/cancel
+		* POST - Cancel a queued or in-progress fetch of an image
 
 	/images/{imageID}/download
-		* GET - Download an image
+		* GET  - Download an image
+		* HEAD - Retrieve download headers for an image
+
+	/images/{imageID}/signature
+		* GET - Retrieve the service signature of an image
+
+	/blobs
+		* GET - Retrieve the blob ids (digests) of all complete image data
+
+	/blobs/{blobID}
+		* GET  - Download image data by digest
+		* HEAD - Retrieve download headers for image data by digest
+
+	/admin/check
+		* POST - Run a consistency check between the metadata and image stores
+
+	/admin/backup
+		* GET - Stream a consistent snapshot of the metadata store
+
+	/admin/relocate
+		* POST - Start moving image data to another image store
+		* GET  - Retrieve the progress of the current or last relocation
+
+	/admin/replication
+		* GET - Retrieve the replication status of each peer
+
+	/admin/replication/{peer}/sync
+		* POST - Start a sync with a peer without waiting for the poll interval
+
+	/admin/tokens
+		* GET  - Retrieve the api tokens, without their secrets
+		* POST - Create an api token, returning its secret
+
+	/admin/tokens/{tokenID}
+		* DELETE - Revoke an api token
+
+	/.well-known/mistify-image-service/signing-key
+		* GET - Retrieve the public key of the service signing key
+
+Image information uses the metadata.Image struct.  A fetch request body is a
+FetchRequest, holding the fields of an image a client can set; the rest are
+maintained by the service. When directly uploading an image, the body should be
+the raw image data, with the image type and optional comment provided via
+headers X-Image-Type and X-Image-Comment, respectively.
+
+The image list takes the query parameters type, status, source_prefix,
+downloaded_after and downloaded_before (RFC3339 times) as filters, sort (id,
+downloaded, size or comment) with order (asc or desc), and limit. When more
+images remain, the X-Next-Cursor response header holds a cursor to pass as the
+cursor parameter, with the same filters and sort, to retrieve the next page.
+
+Image data is hashed as it is stored and the result is recorded in the image
+checksum. An expected checksum can be provided with the expected_checksum and
+checksum_type fields when fetching, or the X-Image-Checksum and
+X-Image-Checksum-Type headers when uploading. Supported checksum types are
+sha256 (default), sha512, and md5. An image whose data does not match the
+expected checksum is marked with the error status and its data is discarded.
+
+Image data is stored by the sha256 digest of its content, recorded in the image
+digest, so images with identical data share a single copy. The data is only
+removed when the last image referencing it is deleted. Data stored under image
+IDs by earlier versions is migrated to its digest on startup.
+
+Fetches from an external source are queued and run by a pool of workers. The
+number of simultaneous fetches is limited by fetchConcurrency (default 4), and
+by fetchHostConcurrency (default 2) for any single source host; zero means no
+limit. Queued images have the queued status and are fetched in order of
+priority (highest first), then the time they were queued. The queue is kept in
+the metadata store, so queued fetches survive a restart. A queued or running
+fetch can be cancelled, which discards any partial data and leaves the image
+with the cancelled status.
+
+On startup, images left pending or downloading by a previous run have their
+partial data removed. With fetchRecoveryMode "requeue" (default) an
+interrupted fetch is queued again from its source; with "error", or for an
+interrupted upload, the image is marked with the error status.
+
+Fetches failing on the source, with a connection error, a 5xx, 408 or 429
+response status, or an interrupted transfer, are retried with exponential
+backoff, configured with fetchRetries (default 3), fetchRetryBackoff (default
+1s), and fetchRetryMaxBackoff (default 1m). Failures to store, verify or sign
+the data are not retried. A retry resumes from the data already received when
+the source supports Range requests. Until the fetch succeeds, the data received
+is staged in the image store under the image id with a .part suffix. The number
+of attempts and the most recent error are recorded on the image.
+
+A consistency check compares the metadata and image stores, reporting
+complete images whose data is missing or has the wrong size, data not
+referenced by any image, temporary files left behind by interrupted writes,
+and, with the checksums option, data that fails verification. With the repair
+option, unreferenced data and temporary files are removed, sizes are
+corrected for data that verifies, and images with missing or corrupt data are
+marked with the error status. The check takes an optional JSON body of
+CheckOptions and returns a CheckReport.
+
+The memory image and metadata stores keep everything in memory, for tests and
+ephemeral nodes, with optional limits on total image data size (maxSize) and
+number of images (maxImages).
+
+With the etcd3 metadata store, an update to an image that was changed by
+someone else since it was read fails rather than overwriting the change.
+Images being transferred also have a download record attached to a lease held
+by the service, so the record expires if the service goes away. When several
+services share the store, recovery on start leaves images another service is
+still downloading to it, and only recovers them if their download record is
+removed while they are unfinished.
+
+The metadata store can be backed up while the service is running when the
+store supports it, as the bolt store does. The backup of a bolt store is a
+copy of the database file.
+
+Downloads support Range requests for partial or resumed transfers, and
+conditional requests using the image digest as the ETag and the download end
+time as Last-Modified.
+
+Besides the default image store, additional named image stores can be
+configured as a list of name, type and config under imageStores. Each image
+records the store holding its data in image_store, which is empty for the
+default store. A relocation moves image data to a named store in the
+background, taking an optional JSON body with the store and a list of
+image_ids, which defaults to all complete images. The data is copied, verified
+against the image size, digest and checksum, and only then is the image
+switched to the new copy and the original removed. Downloads keep working
+throughout, and a download in progress finishes from the original copy.
+
+The image store for a new image is chosen when its transfer starts, by the
+first matching route configured under imageStoreRoutes, each with a store and
+optional types, minSize and maxSize to match the image type and expected size.
+Images matching no route go to the default store. A store can also be
+requested explicitly with the image_store field when fetching, or the
+X-Image-Store header when uploading.
+
+The cache image store keeps copies of the data of a slower backing store, set
+with backingType and backingConfig, in a local directory (dir). Data is copied
+the first time it is read, and readers of data still being copied share the
+copy. The least recently used copies are evicted to keep the total size within
+maxSize. The http image store reads the blobs of another image service, given
+its url and an optional api token, so an edge service can use a cache store
+backed by a central one.
+
+An image service can replicate the images of other image services, configured
+as a list of name, url and optional api token under replicationPeers. Each peer
+is polled every replicationInterval (default 1m). Complete images of a peer are
+queued for fetching like any other image, keeping the same id and metadata,
+including the original source, verified against the peer's checksum, and record
+the peer in the peer field and its download url in peer_source. Images pulled
+from a peer are deleted once the peer no longer lists them. Images of our own
+or of other peers are left alone. The status of each peer covers its most
+recent sync: the pulls it queued, and any earlier pulls found failed, which are
+queued again.
+
+In mirror mode, enabled by configuring mirrorPeers as a list of peers as for
+replication, an image missing here is looked up on each peer in turn when it is
+retrieved or downloaded. The first complete copy found is fetched like any
+other image, keeping its id and metadata and recording the peer. A download
+that starts the fetch streams the data as it is stored, while range and HEAD
+requests wait for the complete image. A failed fetch from a peer is tried again
+the next time the image is requested.
+
+Image data can carry a detached signature, verified against the public keys
+configured under trustedKeys as a list of name, type and key. An ed25519 key is
+the base64 encoded public key and signs the raw sha256 digest of the data. An
+openpgp key is an armored public key block, and its binary or armored
+signature covers the data itself. The signature is given base64 encoded in the
+signature field or fetched from signature_url when fetching, or in the
+X-Image-Signature header when uploading. It is verified before the image is
+marked complete, and an image whose signature fails verification is marked
+with the error status and its data is discarded. The result is recorded in
+signature_status (unsigned, verified or invalid) along with the name of the
+signer key. With requireSignedImages, downloads of images without a verified
+signature are refused.
+
+With a signingKey configured, the base64 encoded ed25519 seed or private key,
+the service signs the raw sha256 digest of the data of each image it stores and
+records it in service_signature, along with the key id in service_key_id. The
+signature endpoint returns the ImageSignature with the image digest, and the
+signing key endpoint publishes the SigningKey. A client verifies a download by
+checking its sha256 digest against the signed digest. Images stored before the
+current key was configured are signed on request.
 
-Image information uses the metadata.Image struct.  When directly uploading an
-image, the body should be the raw image data, with the image type and optional
-comment provided via headers X-Image-Type and X-Image-Comment, respectively.
+Unless requireAuth is set to false, every request except the well-known routes
+needs an api token, given as "Authorization: Bearer <secret>", and is refused
+with 401 otherwise. With anonymousReads as well, GET and HEAD requests outside of the
+admin routes are allowed without one, so peers and mirrors can still pull
+images; otherwise they are configured with a token of their own. Tokens are
+held in the metadata store, as all the metadata stores support. Only the sha256
+digest of the secret is stored, so the secret is shown once, when the token is
+created with a TokenRequest of a name and optional ttl such as "720h". Each
+token records its expiry and, to within a minute, its last use. The tokens
+command creates the first token before the service is started.
 */
 package imageservice
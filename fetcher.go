@@ -1,80 +1,376 @@
 package imageservice
 
 import (
+	"context"
+	"encoding/hex"
 	"errors"
+	"fmt"
+	"hash"
 	"io"
 	"net/http"
+	"strings"
+	"sync/atomic"
 	"time"
 
-	log "github.com/Sirupsen/logrus"
+	"github.com/mistifyio/mistify-image-service/images"
 	"github.com/mistifyio/mistify-image-service/metadata"
 	logx "github.com/mistifyio/mistify-logrus-ext"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
 )
 
+// Fetch defaults, used when not configured
+const (
+	defaultFetchRetries         = 3
+	defaultFetchRetryBackoff    = 1 * time.Second
+	defaultFetchRetryMaxBackoff = 1 * time.Minute
+	defaultFetchConcurrency     = 4
+	defaultFetchHostConcurrency = 2
+)
+
+// stagingSuffix is appended to an image id to form its staging id
+const stagingSuffix = ".part"
+
+// ErrNotCancellable is used when cancelling an image that is neither queued nor
+// being fetched
+var ErrNotCancellable = errors.New("image is not being fetched")
+
 type (
 	// Fetcher handles fetching new images and updating metadata accordingly
 	Fetcher struct {
 		ctx *Context
+		// Retries is the number of times a failed fetch is retried
+		Retries int
+		// RetryBackoff is the delay before the first retry, doubling for
+		// each subsequent retry up to MaxRetryBackoff
+		RetryBackoff    time.Duration
+		MaxRetryBackoff time.Duration
+		// Concurrency limits the number of simultaneous fetches
+		Concurrency int
+		// HostConcurrency limits the number of simultaneous fetches from a
+		// single source host
+		HostConcurrency int
+		// RecoveryMode determines how fetches interrupted by a restart are
+		// handled on Start
+		RecoveryMode string
+		queue        *fetchQueue
+	}
+
+	// sourceReader is an io.Reader that records the first error reading
+	// from a download source, to tell failed transfers from failures to
+	// store the data
+	sourceReader struct {
+		io.Reader
+		err error
+	}
+
+	// byteCounter is an io.Writer that counts the bytes written to it. The
+	// count can be read while writes are in progress.
+	byteCounter struct {
+		count int64
 	}
 )
 
 // NewFetcher creates a new Fetcher
 func NewFetcher(ctx *Context) *Fetcher {
 	fetcher := &Fetcher{
-		ctx: ctx,
+		ctx:             ctx,
+		Retries:         defaultFetchRetries,
+		RetryBackoff:    defaultFetchRetryBackoff,
+		MaxRetryBackoff: defaultFetchRetryMaxBackoff,
+		Concurrency:     defaultFetchConcurrency,
+		HostConcurrency: defaultFetchHostConcurrency,
+		RecoveryMode:    RecoveryRequeue,
+		queue:           newFetchQueue(),
+	}
+
+	if viper.IsSet("fetchRetries") {
+		fetcher.Retries = viper.GetInt("fetchRetries")
+	}
+	if viper.IsSet("fetchRetryBackoff") {
+		fetcher.RetryBackoff = viper.GetDuration("fetchRetryBackoff")
+	}
+	if viper.IsSet("fetchRetryMaxBackoff") {
+		fetcher.MaxRetryBackoff = viper.GetDuration("fetchRetryMaxBackoff")
+	}
+	if viper.IsSet("fetchConcurrency") {
+		fetcher.Concurrency = viper.GetInt("fetchConcurrency")
+	}
+	if viper.IsSet("fetchHostConcurrency") {
+		fetcher.HostConcurrency = viper.GetInt("fetchHostConcurrency")
+	}
+	if viper.IsSet("fetchRecoveryMode") {
+		fetcher.RecoveryMode = viper.GetString("fetchRecoveryMode")
 	}
 	return fetcher
 }
 
-// Fetch runs pre-flight checks and kicks off an asynchronous image download
+// Start restores the fetch queue from images left queued in the metadata store,
+// recovers images whose transfer was interrupted by a restart, and begins
+// processing the queue. Images another service sharing the metadata store is
+// still downloading are left to it.
+func (fetcher *Fetcher) Start() error {
+	if !isValidRecoveryMode(fetcher.RecoveryMode) {
+		err := errors.New("invalid fetch recovery mode")
+		log.WithFields(log.Fields{
+			"error":        err,
+			"recoveryMode": fetcher.RecoveryMode,
+		}).Error(err)
+		return err
+	}
+
+	// Watch before listing, so downloads finishing elsewhere in between are
+	// seen
+	remote := fetcher.watchRemoteDownloads()
+	allImages, err := fetcher.ctx.MetadataStore.List("")
+	if err != nil {
+		log.WithField("error", err).Error("failed to list images for fetch queue")
+		return err
+	}
+
+	for _, image := range allImages {
+		image.Store = fetcher.ctx.MetadataStore
+		switch image.Status {
+		case metadata.StatusQueued:
+			fetcher.queue.push(image)
+		case metadata.StatusPending, metadata.StatusDownloading:
+			if remote != nil {
+				leave, err := remote.leave(image)
+				if err != nil {
+					return err
+				}
+				if leave {
+					continue
+				}
+			}
+			if err := fetcher.recoverImage(image); err != nil {
+				return err
+			}
+		}
+	}
+
+	go fetcher.dispatch()
+	return nil
+}
+
+// dispatch starts fetches from the queue as the concurrency limits allow
+func (fetcher *Fetcher) dispatch() {
+	for {
+		fetch := fetcher.queue.next(fetcher)
+		go func() {
+			defer fetcher.queue.done(fetch)
+
+			// Skip images removed while queued
+			if _, err := fetcher.ctx.MetadataStore.GetByID(fetch.image.ID); err != nil {
+				return
+			}
+			if err := fetch.image.SetPending(); err != nil {
+				return
+			}
+			fetcher.fetchImage(fetch.ctx, fetch.image)
+		}()
+	}
+}
+
+// Fetch runs pre-flight checks and queues an asynchronous image download
 func (fetcher *Fetcher) Fetch(image *metadata.Image) (*metadata.Image, error) {
 	// Ensure sufficient information for fetching
-	if image.Source == "" {
+	if image.FetchURL() == "" {
 		return nil, errors.New("missing image source")
 	}
 	if image.Type == "" {
 		return nil, errors.New("missing image type")
 	}
+	if err := prepareChecksum(image); err != nil {
+		return nil, err
+	}
+	if _, err := fetcher.ctx.GetImageStore(image.ImageStore); err != nil {
+		return nil, err
+	}
 
 	// Avoid re-downloading the same image. If a redownload is desired, first
-	// delete the existing image.
-	existingImage, err := fetcher.ctx.MetadataStore.GetBySource(image.Source)
-	if existingImage != nil || (err != nil && err != metadata.ErrNotFound) {
-		return existingImage, err
+	// delete the existing image. Images pulled from a peer keep their id, so
+	// the callers look them up by id instead.
+	if image.PeerSource == "" {
+		existingImage, err := fetcher.ctx.MetadataStore.GetBySource(image.Source)
+		if existingImage != nil || (err != nil && err != metadata.ErrNotFound) {
+			return existingImage, err
+		}
 	}
 
-	// Additional metadata preparation and initial save
+	// Additional metadata preparation and initial save. The data, and so its
+	// digest, checksum, size and signatures, is only known once fetched, and
+	// the download times and attempts are recorded by the fetch itself.
+	image.Digest = ""
+	image.Checksum = ""
+	image.Size = 0
+	image.ExpectedSize = 0
+	image.Error = ""
+	image.SignatureStatus = ""
+	image.Signer = ""
+	image.ServiceSignature = ""
+	image.ServiceKeyID = ""
+	image.DownloadStart = time.Time{}
+	image.DownloadEnd = time.Time{}
+	image.Attempts = 0
 	image.Store = fetcher.ctx.MetadataStore
-	if err := image.SetPending(); err != nil {
+	if err := image.SetQueued(); err != nil {
 		return nil, err
 	}
 
-	// Kick off the download
-	go fetcher.fetchImage(image)
+	// Queue the download. The queued image is modified by the fetch once it
+	// starts, so the caller gets a copy.
+	queued := *image
+	fetcher.queue.push(image)
+
+	return &queued, nil
+}
 
-	return image, nil
+// Cancel stops fetching an image. A queued image is removed from the queue. A
+// running fetch is aborted and Cancel waits for it to finish, so the image is
+// no longer modified by the fetch once Cancel returns. A fetch that completes
+// before it can be aborted keeps its final status. The image is returned with
+// its updated status.
+func (fetcher *Fetcher) Cancel(imageID string) (*metadata.Image, error) {
+	image, fetch := fetcher.queue.cancel(imageID)
+	switch {
+	case image != nil:
+		if err := image.SetCancelled(); err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+				"image": image,
+			}).Error("failed to SetCancelled")
+			return nil, err
+		}
+		return image, nil
+	case fetch != nil:
+		<-fetch.done
+		return fetch.image, nil
+	default:
+		return nil, ErrNotCancellable
+	}
 }
 
-// fetchImage downloads a remote image
-func (fetcher *Fetcher) fetchImage(image *metadata.Image) {
+// fetchImage downloads a remote image, retrying failed attempts with
+// exponential backoff, until the fetch context is cancelled
+func (fetcher *Fetcher) fetchImage(fetchCtx context.Context, image *metadata.Image) {
 	var err error
 	defer func() {
+		if err != nil {
+			// Don't leave partial data behind
+			_ = fetcher.removeData(image)
+		}
 		// Set final status
-		_ = image.SetFinished(err)
+		if err != nil && fetchCtx.Err() != nil {
+			if err := image.SetCancelled(); err != nil {
+				log.WithFields(log.Fields{
+					"error": err,
+					"image": image,
+				}).Error("failed to SetCancelled")
+			}
+			return
+		}
+		if err := image.SetFinished(err); err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+				"image": image,
+			}).Error("failed to SetFinished")
+		}
 	}()
 
+	backoff := fetcher.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		if err = fetchCtx.Err(); err != nil {
+			return
+		}
+
+		var retry bool
+		retry, err = fetcher.fetchAttempt(fetchCtx, image, attempt > 0)
+		if err == nil || !retry || attempt >= fetcher.Retries || fetchCtx.Err() != nil {
+			return
+		}
+
+		log.WithFields(log.Fields{
+			"error":   err,
+			"image":   image,
+			"attempt": image.Attempts,
+			"backoff": backoff,
+		}).Warn("fetch attempt failed, retrying")
+		if err := image.SetRetrying(err); err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+				"image": image,
+			}).Error("failed to SetRetrying")
+		}
+
+		select {
+		case <-fetchCtx.Done():
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > fetcher.MaxRetryBackoff {
+			backoff = fetcher.MaxRetryBackoff
+		}
+	}
+}
+
+// fetchAttempt makes a single attempt to download a remote image. When
+// resuming, data already stored by a previous attempt is kept if the source
+// supports range requests. Returns whether a failed attempt can be retried.
+func (fetcher *Fetcher) fetchAttempt(fetchCtx context.Context, image *metadata.Image, resume bool) (bool, error) {
+	image.Attempts++
+
+	req, err := http.NewRequest("GET", image.FetchURL(), nil)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+			"image": image,
+		}).Error("failed to create request")
+		return false, err
+	}
+	req = req.WithContext(fetchCtx)
+	if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+		err = errors.New("unsupported source scheme")
+		log.WithFields(log.Fields{
+			"error": err,
+			"image": image,
+		}).Error(err)
+		return false, err
+	}
+
+	fetcher.authorizePeer(req, image)
+
+	imageStore, err := fetcher.ctx.ImageStoreFor(image)
+	if err != nil {
+		return false, err
+	}
+
+	var offset int64
+	if resume {
+		if stat, err := imageStore.Stat(stagingID(image.ID)); err == nil && stat.Size() > 0 {
+			offset = stat.Size()
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		}
+	}
+
 	// Start the download
-	resp, err := http.Get(image.Source)
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		log.WithFields(log.Fields{
 			"error": err,
 			"image": image,
 		}).Error(err)
-		return
+		return true, err
 	}
 	defer logx.LogReturnedErr(resp.Body.Close, nil, "failed to close response body")
 
-	if resp.StatusCode != http.StatusOK {
+	switch {
+	case offset > 0 && resp.StatusCode == http.StatusPartialContent && contentRangeStart(resp) == offset:
+		// Resuming
+	case resp.StatusCode == http.StatusOK:
+		// Range unsupported or not requested, so start from the beginning
+		offset = 0
+	default:
 		err = errors.New("unexpected response status")
 		log.WithFields(log.Fields{
 			"error":        err,
@@ -82,9 +378,20 @@ func (fetcher *Fetcher) fetchImage(image *metadata.Image) {
 			"statusCode":   resp.StatusCode,
 			"image":        image,
 		}).Error(err)
-		return
+		return isRetryableStatus(resp.StatusCode), err
 	}
-	err = fetcher.transferImage(image, resp.Body, resp.ContentLength)
+
+	expectedSize := resp.ContentLength
+	if expectedSize >= 0 {
+		expectedSize += offset
+	}
+	// Only transfers interrupted by the source are retried, including short
+	// reads. Failures to store, verify or sign the data fail the fetch.
+	source := &sourceReader{Reader: resp.Body}
+	if err := fetcher.transferImage(image, source, offset, expectedSize, true); err != nil {
+		return source.err != nil, err
+	}
+	return false, nil
 }
 
 // Receive adds and saves an image synchronously from the request body
@@ -93,30 +400,65 @@ func (fetcher *Fetcher) Receive(r *http.Request) (*metadata.Image, error) {
 
 	// Metadata preparation and initial save
 	image := &metadata.Image{
-		ID:      metadata.NewID(),
-		Type:    r.Header.Get("X-Image-Type"),
-		Comment: r.Header.Get("X-Image-Comment"),
-		Store:   fetcher.ctx.MetadataStore,
+		ID:               metadata.NewID(),
+		Type:             r.Header.Get("X-Image-Type"),
+		Comment:          r.Header.Get("X-Image-Comment"),
+		ChecksumType:     r.Header.Get("X-Image-Checksum-Type"),
+		ExpectedChecksum: r.Header.Get("X-Image-Checksum"),
+		ImageStore:       r.Header.Get("X-Image-Store"),
+		Signature:        r.Header.Get("X-Image-Signature"),
+		Store:            fetcher.ctx.MetadataStore,
 	}
 
 	if image.Type == "" {
 		return nil, errors.New("missing image type")
 	}
+	if err := prepareChecksum(image); err != nil {
+		return nil, err
+	}
+	if _, err := fetcher.ctx.GetImageStore(image.ImageStore); err != nil {
+		return nil, err
+	}
 
 	if err := image.SetPending(); err != nil {
 		return nil, err
 	}
 
-	err := fetcher.transferImage(image, r.Body, r.ContentLength)
+	err := fetcher.transferImage(image, r.Body, 0, r.ContentLength, false)
+	if err != nil {
+		// Don't leave partial data behind
+		_ = fetcher.removeData(image)
+	}
 	// Set final status
-	_ = image.SetFinished(err)
+	if err := image.SetFinished(err); err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+			"image": image,
+		}).Error("failed to SetFinished")
+	}
 	return image, err
 }
 
 // transferImage transfers an image from an input stream (e.g. resp.Body or
-// req.Body) to the image store. Closing of the stream should be handled by the
-// caller.
-func (fetcher *Fetcher) transferImage(image *metadata.Image, in io.Reader, estimatedLength int64) error {
+// req.Body) to the image store. A resumable transfer is appended to staging
+// data as it arrives, so the data stored before a failure is kept; a non-zero
+// offset continues from that data. The staging data is only moved under the
+// image id once the transfer succeeds. Other transfers are stored atomically.
+// Closing of the stream should be handled by the caller.
+func (fetcher *Fetcher) transferImage(image *metadata.Image, in io.Reader, offset, estimatedLength int64, resumable bool) error {
+	// The image store is chosen when the first transfer attempt starts,
+	// unless one was requested, and is recorded along with the status below.
+	// Attempts are only counted by the fetcher, so later attempts keep the
+	// recorded store.
+	if image.Attempts <= 1 {
+		if image.ImageStore == "" {
+			image.ImageStore = fetcher.ctx.RouteImage(image, estimatedLength)
+		}
+		if image.ImageStore == DefaultImageStore {
+			image.ImageStore = ""
+		}
+	}
+
 	// Update status to indicate download has begun
 	if err := image.SetDownloading(estimatedLength); err != nil {
 		log.WithFields(log.Fields{
@@ -126,49 +468,234 @@ func (fetcher *Fetcher) transferImage(image *metadata.Image, in io.Reader, estim
 		return err
 	}
 
-	// Stop monitoring when the download is done
+	// Everything hashed is counted, including data from a previous attempt,
+	// to track progress without depending on the image store
+	progress := &byteCounter{}
+	hasher := metadata.NewHash(image.ChecksumType)
+	digester := metadata.NewHash(metadata.DigestType)
+	hashWriter := io.MultiWriter(hasher, digester, progress)
+
+	// Start watching the size
 	monitorStop := make(chan struct{})
-	defer func() {
-		// Stop size monitoring
+	monitorDone := make(chan struct{})
+	go func() {
+		defer close(monitorDone)
+		fetcher.monitorDownload(image, progress, monitorStop)
+	}()
+
+	// Stop monitoring once the data is stored, waiting for any update in
+	// progress, so the monitor doesn't put the image while the steps that
+	// follow change it
+	monitoring := true
+	stopMonitor := func() {
+		if !monitoring {
+			return
+		}
+		monitoring = false
 		close(monitorStop)
+		<-monitorDone
 		// Last size update
-		_ = fetcher.updateImageSize(image)
-	}()
+		if err := image.UpdateSize(progress.Count()); err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+				"image": image,
+			}).Error("failed to UpdateSize")
+		}
+	}
+	defer stopMonitor()
 
-	// Start watching the size
-	go fetcher.monitorDownload(image, monitorStop)
+	imageStore, err := fetcher.ctx.ImageStoreFor(image)
+	if err != nil {
+		return err
+	}
+	put := imageStore.Put
+	dataID := image.ID
+	if resumable {
+		put = imageStore.Append
+		dataID = stagingID(image.ID)
+		// Start over from nothing, rather than any stale data
+		if offset == 0 {
+			if err := imageStore.Delete(dataID); err != nil {
+				return err
+			}
+		}
+	}
 
-	// Stream the image
-	if err := fetcher.ctx.ImageStore.Put(image.ID, in); err != nil {
+	// Include data stored by a previous attempt in the hashes
+	if offset > 0 {
+		if err := imageStore.GetRange(dataID, hashWriter, 0, offset); err != nil {
+			log.WithFields(log.Fields{
+				"error":  err,
+				"image":  image,
+				"offset": offset,
+			}).Error("failed to hash existing data")
+			return err
+		}
+	}
+
+	// Stream the image, hashing the data along the way
+	err = put(dataID, io.TeeReader(in, hashWriter))
+	stopMonitor()
+	if err != nil {
 		log.WithFields(log.Fields{
 			"error": err,
 			"image": image,
 		}).Error("failed to download")
 		return err
 	}
-	return nil
+	if dataID != image.ID {
+		if err := images.Move(imageStore, dataID, image.ID); err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+				"image": image,
+			}).Error("failed to move staged data")
+			return err
+		}
+	}
+	if err := fetcher.verifyChecksum(image, hasher); err != nil {
+		return err
+	}
+	digest := hex.EncodeToString(digester.Sum(nil))
+	if err := fetcher.ctx.Verifier.Verify(image, digest, imageStore); err != nil {
+		_ = fetcher.removeData(image)
+		return err
+	}
+	if err := fetcher.ctx.Signer.Sign(image, digest); err != nil {
+		return err
+	}
+
+	// Move the data to its content address, sharing any identical data
+	return fetcher.ctx.Blobs.Commit(image, digest)
 }
 
-// monitorDownload periodically gets the file stats from the image store and
-// updates the size in the metadata.
-func (fetcher *Fetcher) monitorDownload(image *metadata.Image, stop chan struct{}) {
+// verifyChecksum records the computed checksum on the image and compares it
+// with the expected checksum, if one was provided. Image data that fails
+// verification is removed from the image store.
+func (fetcher *Fetcher) verifyChecksum(image *metadata.Image, hasher hash.Hash) error {
+	image.Checksum = hex.EncodeToString(hasher.Sum(nil))
+	if image.ExpectedChecksum == "" || strings.EqualFold(image.ExpectedChecksum, image.Checksum) {
+		return nil
+	}
+
+	log.WithFields(log.Fields{
+		"error":            metadata.ErrChecksumMismatch,
+		"image":            image,
+		"checksumType":     image.ChecksumType,
+		"checksum":         image.Checksum,
+		"expectedChecksum": image.ExpectedChecksum,
+	}).Error(metadata.ErrChecksumMismatch)
+
+	_ = fetcher.removeData(image)
+	return metadata.ErrChecksumMismatch
+}
+
+// monitorDownload periodically updates the size in the metadata with the
+// progress of a transfer.
+func (fetcher *Fetcher) monitorDownload(image *metadata.Image, progress *byteCounter, stop chan struct{}) {
 	for {
+		// Periodic size update
+		if err := image.UpdateSize(progress.Count()); err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+				"image": image,
+			}).Error("failed to UpdateSize")
+		}
+
 		select {
 		case <-stop:
 			return
-		default:
-			// Periodic size update
-			_ = fetcher.updateImageSize(image)
-			time.Sleep(5 * time.Second)
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+// Read reads from the source, recording any error other than io.EOF
+func (sr *sourceReader) Read(p []byte) (int, error) {
+	n, err := sr.Reader.Read(p)
+	if err != nil && err != io.EOF && sr.err == nil {
+		sr.err = err
+	}
+	return n, err
+}
+
+// Write counts the bytes written
+func (bc *byteCounter) Write(p []byte) (int, error) {
+	atomic.AddInt64(&bc.count, int64(len(p)))
+	return len(p), nil
+}
+
+// Count returns the number of bytes written so far
+func (bc *byteCounter) Count() int64 {
+	return atomic.LoadInt64(&bc.count)
+}
+
+// contentRangeStart parses the start offset from a response Content-Range
+// header, returning -1 if it is missing or invalid
+func contentRangeStart(resp *http.Response) int64 {
+	var start int64
+	if _, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-", &start); err != nil {
+		return -1
+	}
+	return start
+}
+
+// isRetryableStatus tests whether a failed response status may succeed if the
+// request is retried
+func isRetryableStatus(code int) bool {
+	return code >= http.StatusInternalServerError ||
+		code == http.StatusRequestTimeout ||
+		code == http.StatusTooManyRequests
+}
+
+// authorizePeer adds the api token of the peer an image is pulled from to its
+// download request. The token is only sent to the peer's own url.
+func (fetcher *Fetcher) authorizePeer(req *http.Request, image *metadata.Image) {
+	if image.Peer == "" {
+		return
+	}
+
+	var peers []*ReplicationPeer
+	if fetcher.ctx.Replicator != nil {
+		peers = append(peers, fetcher.ctx.Replicator.peer(image.Peer))
+	}
+	if fetcher.ctx.Mirror != nil {
+		peers = append(peers, fetcher.ctx.Mirror.peer(image.Peer))
+	}
+	for _, peer := range peers {
+		if peer != nil && strings.HasPrefix(image.PeerSource, peerURL(peer, "/")) {
+			peer.authorize(req)
+			return
 		}
 	}
 }
 
-// updateImageSize updates the image size in metadata
-func (fetcher *Fetcher) updateImageSize(image *metadata.Image) error {
-	stat, err := fetcher.ctx.ImageStore.Stat(image.ID)
+// prepareChecksum validates the checksum type of an image, defaulting it if
+// unset
+func prepareChecksum(image *metadata.Image) error {
+	if image.ChecksumType == "" {
+		image.ChecksumType = metadata.DefaultChecksumType
+	}
+	if !metadata.IsValidChecksumType(image.ChecksumType) {
+		return errors.New("invalid checksum type")
+	}
+	return nil
+}
+
+// removeData removes the data of an image stored under its id or staging id,
+// such as partial data from an interrupted transfer
+func (fetcher *Fetcher) removeData(image *metadata.Image) error {
+	imageStore, err := fetcher.ctx.ImageStoreFor(image)
 	if err != nil {
 		return err
 	}
-	return image.UpdateSize(stat.Size())
+	if err := imageStore.Delete(stagingID(image.ID)); err != nil {
+		return err
+	}
+	return imageStore.Delete(image.ID)
+}
+
+// stagingID is the id resumable transfers of an image are appended under
+// until they succeed
+func stagingID(imageID string) string {
+	return imageID + stagingSuffix
 }
@@ -2,35 +2,52 @@ package imageservice_test
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
-	log "github.com/Sirupsen/logrus"
 	"github.com/mistifyio/mistify-image-service"
 	"github.com/mistifyio/mistify-image-service/images"
 	"github.com/mistifyio/mistify-image-service/metadata"
 	"github.com/pborman/uuid"
+	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 	"github.com/stretchr/testify/suite"
 )
 
 type FetcherTestSuite struct {
 	suite.Suite
-	Context     *imageservice.Context
-	ImageData   []byte
-	FetchServer *httptest.Server
-	StoreDir    string
+	Context       *imageservice.Context
+	ImageData     []byte
+	ImageChecksum string
+	FetchServer   *httptest.Server
+	FlakyServer   *httptest.Server
+	StoreDir      string
+	// FlakyRequests tracks the requests received by the FlakyServer per path
+	FlakyRequests     map[string][]*http.Request
+	FlakyRequestsLock sync.Mutex
+	// Stall holds up requests to /stall partway through the image
+	Stall chan struct{}
 }
 
 func (s *FetcherTestSuite) SetupSuite() {
 	log.SetLevel(log.FatalLevel)
 
 	s.ImageData = []byte("testdatatestdatatestdata")
+	checksum := sha256.Sum256(s.ImageData)
+	s.ImageChecksum = hex.EncodeToString(checksum[:])
 
 	// Test Server to serve image data for fetching
 	s.FetchServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -42,6 +59,37 @@ func (s *FetcherTestSuite) SetupSuite() {
 			log.WithField("error", err).Error("Failed to write mock image data to response")
 		}
 	}))
+
+	// Test Server that fails requests in various ways before succeeding
+	s.FlakyServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.FlakyRequestsLock.Lock()
+		s.FlakyRequests[r.URL.Path] = append(s.FlakyRequests[r.URL.Path], r)
+		attempt := len(s.FlakyRequests[r.URL.Path])
+		s.FlakyRequestsLock.Unlock()
+
+		switch {
+		case r.URL.Path == "/unavailable" && attempt < 3:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case r.URL.Path == "/always-unavailable":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case (r.URL.Path == "/resume" || r.URL.Path == "/norange") && attempt == 1:
+			// Drop the connection partway through the image
+			w.Header().Set("Content-Length", strconv.Itoa(len(s.ImageData)))
+			_, _ = w.Write(s.ImageData[:len(s.ImageData)/2])
+			w.(http.Flusher).Flush()
+			panic(http.ErrAbortHandler)
+		case r.URL.Path == "/stall":
+			w.Header().Set("Content-Length", strconv.Itoa(len(s.ImageData)))
+			_, _ = w.Write(s.ImageData[:len(s.ImageData)/2])
+			w.(http.Flusher).Flush()
+			<-s.Stall
+			panic(http.ErrAbortHandler)
+		case r.URL.Path == "/resume":
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(s.ImageData))
+		default:
+			_, _ = w.Write(s.ImageData)
+		}
+	}))
 }
 
 func (s *FetcherTestSuite) SetupTest() {
@@ -69,6 +117,10 @@ func (s *FetcherTestSuite) SetupTest() {
 	ctx, err := imageservice.NewContext()
 	s.Require().NoError(err)
 	s.Context = ctx
+	s.Context.Fetcher.RetryBackoff = 10 * time.Millisecond
+
+	s.FlakyRequests = make(map[string][]*http.Request)
+	s.Stall = make(chan struct{})
 }
 
 func (s *FetcherTestSuite) TearDownTest() {
@@ -77,6 +129,7 @@ func (s *FetcherTestSuite) TearDownTest() {
 
 func (s *FetcherTestSuite) TearDownSuite() {
 	s.FetchServer.Close()
+	s.FlakyServer.Close()
 }
 
 func TestFetcherTestSuite(t *testing.T) {
@@ -102,6 +155,50 @@ func (s *FetcherTestSuite) TestFetcherReceive() {
 	s.Equal(imageType, image.Type, "types should match")
 	s.Equal(imageComment, image.Comment, "comments should match")
 	s.NotEmpty(image.ID, "id should have been assigned")
+	s.Equal(metadata.DefaultChecksumType, image.ChecksumType, "checksum type should default")
+	s.Equal(s.ImageChecksum, image.Checksum, "checksum should be computed")
+}
+
+func (s *FetcherTestSuite) TestFetcherReceiveChecksum() {
+	tests := []struct {
+		description      string
+		checksumType     string
+		expectedChecksum string
+		expectedErr      error
+	}{
+		{"matching checksum should succeed",
+			"sha256", s.ImageChecksum, nil},
+		{"matching uppercase checksum should succeed",
+			"", strings.ToUpper(s.ImageChecksum), nil},
+		{"mismatched checksum should fail",
+			"sha256", "asdf", metadata.ErrChecksumMismatch},
+		{"mismatched checksum type should fail",
+			"md5", s.ImageChecksum, metadata.ErrChecksumMismatch},
+	}
+
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", "http://localhost", bytes.NewReader(s.ImageData))
+		req.Header.Add("X-Image-Type", "kvm")
+		req.Header.Add("X-Image-Checksum-Type", test.checksumType)
+		req.Header.Add("X-Image-Checksum", test.expectedChecksum)
+
+		image, err := s.Context.Fetcher.Receive(req)
+		s.Equal(test.expectedErr, err, test.description)
+		if test.expectedErr == nil {
+			s.Equal(metadata.StatusComplete, image.Status, test.description)
+			continue
+		}
+		s.Equal(metadata.StatusError, image.Status, test.description)
+		s.Equal(test.expectedErr.Error(), image.Error, test.description)
+		_, err = s.Context.ImageStore.Stat(image.ID)
+		s.Error(err, test.description+" : image data should be removed")
+	}
+
+	req, _ := http.NewRequest("GET", "http://localhost", bytes.NewReader(s.ImageData))
+	req.Header.Add("X-Image-Type", "kvm")
+	req.Header.Add("X-Image-Checksum-Type", "asdf")
+	_, err := s.Context.Fetcher.Receive(req)
+	s.Error(err, "invalid checksum type should fail")
 }
 
 func (s *FetcherTestSuite) TestFetcherFetch() {
@@ -118,25 +215,29 @@ func (s *FetcherTestSuite) TestFetcherFetch() {
 	imageReq.Type = "kvm"
 
 	tests := []struct {
-		source      string
-		finalStatus string
+		source           string
+		expectedChecksum string
+		finalStatus      string
 	}{
-		{"asdf", metadata.StatusError},
-		{s.FetchServer.URL + "/404", metadata.StatusError},
-		{s.FetchServer.URL, metadata.StatusComplete},
+		{"asdf", "", metadata.StatusError},
+		{s.FetchServer.URL + "/404", "", metadata.StatusError},
+		{s.FetchServer.URL + "/mismatch", "asdf", metadata.StatusError},
+		{s.FetchServer.URL + "/match", s.ImageChecksum, metadata.StatusComplete},
+		{s.FetchServer.URL, "", metadata.StatusComplete},
 	}
 
 	for _, test := range tests {
 		imageReq = &metadata.Image{
-			ID:     metadata.NewID(),
-			Source: test.source,
-			Type:   "kvm",
+			ID:               metadata.NewID(),
+			Source:           test.source,
+			Type:             "kvm",
+			ExpectedChecksum: test.expectedChecksum,
 		}
 		imageReq.Source = test.source
 		var image *metadata.Image
 		image, err = s.Context.Fetcher.Fetch(imageReq)
 		s.NoError(err, "valid config should have no initial error")
-		s.Equal(metadata.StatusPending, image.Status, "new image should start out pending")
+		s.Equal(metadata.StatusQueued, image.Status, "new image should start out queued")
 		for i := 0; i < 300; i++ {
 			image, err = s.Context.MetadataStore.GetByID(image.ID)
 			s.NotNil(image, "image should not be nil")
@@ -150,6 +251,9 @@ func (s *FetcherTestSuite) TestFetcherFetch() {
 		s.Equal(test.finalStatus, image.Status, "final status should be expected for source %s", test.source)
 		if test.finalStatus == metadata.StatusComplete {
 			s.EqualValues(len(s.ImageData), image.Size, "final size should be expected")
+			s.Equal(s.ImageChecksum, image.Checksum, "checksum should be computed")
+		} else {
+			s.NotEmpty(image.Error, "failure reason should be recorded for source %s", test.source)
 		}
 	}
 
@@ -158,3 +262,129 @@ func (s *FetcherTestSuite) TestFetcherFetch() {
 	s.NotNil(image)
 	s.Equal(metadata.StatusComplete, image.Status, "previously fetched image should be returned ready")
 }
+
+func (s *FetcherTestSuite) TestFetcherRetry() {
+	s.Context.Fetcher.Retries = 2
+
+	tests := []struct {
+		description      string
+		path             string
+		finalStatus      string
+		expectedAttempts int
+		expectedRange    string
+	}{
+		{"transient errors should be retried",
+			"/unavailable", metadata.StatusComplete, 3, ""},
+		{"retries should be limited",
+			"/always-unavailable", metadata.StatusError, 3, ""},
+		{"interrupted download should resume",
+			"/resume", metadata.StatusComplete, 2, fmt.Sprintf("bytes=%d-", len(s.ImageData)/2)},
+		{"interrupted download should restart if range is unsupported",
+			"/norange", metadata.StatusComplete, 2, fmt.Sprintf("bytes=%d-", len(s.ImageData)/2)},
+	}
+
+	for _, test := range tests {
+		image, err := s.Context.Fetcher.Fetch(&metadata.Image{
+			ID:               metadata.NewID(),
+			Source:           s.FlakyServer.URL + test.path,
+			Type:             "kvm",
+			ExpectedChecksum: s.ImageChecksum,
+		})
+		s.NoError(err, test.description)
+
+		image = s.waitForFetch(image.ID)
+		s.Equal(test.finalStatus, image.Status, test.description)
+		s.Equal(test.expectedAttempts, image.Attempts, test.description)
+		s.Len(s.FlakyRequests[test.path], test.expectedAttempts, test.description)
+		if test.expectedRange != "" {
+			s.Equal(test.expectedRange, s.FlakyRequests[test.path][1].Header.Get("Range"), test.description)
+		}
+
+		if test.finalStatus == metadata.StatusComplete {
+			s.EqualValues(len(s.ImageData), image.Size, test.description)
+			s.Equal(s.ImageChecksum, image.Checksum, test.description)
+			continue
+		}
+		s.NotEmpty(image.Error, test.description)
+		_, err = s.Context.ImageStore.Stat(image.ID)
+		s.Error(err, test.description+" : partial data should be removed")
+	}
+
+	// Permanent failures should not be retried
+	image, err := s.Context.Fetcher.Fetch(&metadata.Image{
+		ID:     metadata.NewID(),
+		Source: s.FetchServer.URL + "/404",
+		Type:   "kvm",
+	})
+	s.NoError(err)
+	image = s.waitForFetch(image.ID)
+	s.Equal(metadata.StatusError, image.Status)
+	s.Equal(1, image.Attempts, "not found should not be retried")
+
+	// Failures to store the data should not be retried
+	s.Context.ImageStore = &appendFailStore{Store: s.Context.ImageStore}
+	image, err = s.Context.Fetcher.Fetch(&metadata.Image{
+		ID:     metadata.NewID(),
+		Source: s.FlakyServer.URL + "/store-error",
+		Type:   "kvm",
+	})
+	s.NoError(err)
+	image = s.waitForFetch(image.ID)
+	s.Equal(metadata.StatusError, image.Status)
+	s.Equal(1, image.Attempts, "store errors should not be retried")
+	s.Len(s.FlakyRequests["/store-error"], 1)
+}
+
+// appendFailStore is an image store failing to append data
+type appendFailStore struct {
+	images.Store
+}
+
+func (store *appendFailStore) Append(id string, r io.Reader) error {
+	return errors.New("append failed")
+}
+
+func (s *FetcherTestSuite) TestFetcherStaging() {
+	s.Context.Fetcher.Retries = 0
+
+	image, err := s.Context.Fetcher.Fetch(&metadata.Image{
+		ID:     metadata.NewID(),
+		Source: s.FlakyServer.URL + "/stall",
+		Type:   "kvm",
+	})
+	s.Require().NoError(err)
+
+	// Wait for the first half of the data to be staged
+	stagedPath := filepath.Join(s.StoreDir, image.ID+".part")
+	for i := 0; i < 100; i++ {
+		if stat, err := os.Stat(stagedPath); err == nil && stat.Size() == int64(len(s.ImageData)/2) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	stat, err := os.Stat(stagedPath)
+	s.Require().NoError(err, "partial data should be staged")
+	s.EqualValues(len(s.ImageData)/2, stat.Size())
+	_, err = s.Context.ImageStore.Stat(image.ID)
+	s.Error(err, "partial data should not be stored under the image id")
+
+	close(s.Stall)
+	image = s.waitForFetch(image.ID)
+	s.Equal(metadata.StatusError, image.Status)
+	_, err = os.Stat(stagedPath)
+	s.True(os.IsNotExist(err), "staged data of a failed fetch should be removed")
+}
+
+// waitForFetch polls until an image fetch completes or errors
+func (s *FetcherTestSuite) waitForFetch(imageID string) *metadata.Image {
+	var image *metadata.Image
+	for i := 0; i < 300; i++ {
+		image, _ = s.Context.MetadataStore.GetByID(imageID)
+		if image != nil && (image.Status == metadata.StatusComplete || image.Status == metadata.StatusError) {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	s.Require().NotNil(image)
+	return image
+}
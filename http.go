@@ -9,12 +9,12 @@ import (
 	"strings"
 	"time"
 
-	log "github.com/Sirupsen/logrus"
 	"github.com/bakins/logrus-middleware"
 	"github.com/bakins/net-http-recover"
 	"github.com/gorilla/context"
 	"github.com/gorilla/mux"
 	"github.com/justinas/alice"
+	log "github.com/sirupsen/logrus"
 	"github.com/tylerb/graceful"
 )
 
@@ -57,6 +57,7 @@ func Run(ctx *Context, port int) *graceful.Server {
 				h.ServeHTTP(w, r)
 			})
 		},
+		ctx.Authenticator.Handler,
 	)
 
 	// NOTE: Due to weirdness with PrefixPath and StrictSlash, can't just pass
@@ -65,6 +66,9 @@ func Run(ctx *Context, port int) *graceful.Server {
 	// the main router before setting subhandlers on either main or subrouter
 
 	RegisterImageRoutes("/images", router)
+	RegisterBlobRoutes("/blobs", router)
+	RegisterAdminRoutes("/admin", router)
+	RegisterWellKnownRoutes("/.well-known", router)
 
 	server := &graceful.Server{
 		Timeout: 5 * time.Second,
@@ -4,37 +4,58 @@ import (
 	"encoding/json"
 	"errors"
 	"net/http"
+	"net/url"
 	"strconv"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/mistifyio/mistify-image-service/metadata"
+	logx "github.com/mistifyio/mistify-logrus-ext"
+	log "github.com/sirupsen/logrus"
 )
 
+// FetchRequest is the request to fetch an image from an external source. Only
+// these fields can be set by the client; the rest of the image is maintained
+// by the service.
+type FetchRequest struct {
+	Source           string `json:"source"`
+	Type             string `json:"type"`
+	Comment          string `json:"comment"`
+	Priority         int    `json:"priority"`
+	ChecksumType     string `json:"checksum_type"`
+	ExpectedChecksum string `json:"expected_checksum"`
+	ImageStore       string `json:"image_store"`
+	SignatureURL     string `json:"signature_url"`
+	Signature        string `json:"signature"`
+}
+
 // RegisterImageRoutes registers the image routes and handlers
 func RegisterImageRoutes(prefix string, router *mux.Router) {
-	router.HandleFunc(prefix, listImagesHandler).Queries("type", "{imageType:[a-zA-Z]+}").Methods("GET")
 	router.HandleFunc(prefix, listImagesHandler).Methods("GET")
 	router.HandleFunc(prefix, receiveImageHandler).Methods("PUT")
 	router.HandleFunc(prefix, fetchImageHandler).Methods("POST")
 	sub := router.PathPrefix(prefix).Subrouter()
 	sub.HandleFunc("/{imageID}", getImageHandler).Methods("GET")
 	sub.HandleFunc("/{imageID}", deleteImageHandler).Methods("DELETE")
-	sub.HandleFunc("/{imageID}/download", downloadImageHandler).Methods("GET")
+	sub.HandleFunc("/{imageID}/download", downloadImageHandler).Methods("GET", "HEAD")
+	sub.HandleFunc("/{imageID}/signature", imageSignatureHandler).Methods("GET")
+	sub.HandleFunc("/{imageID}/cancel", cancelImageHandler).Methods("POST")
 }
 
-// listImagesHandler gets a list of images, optionally filtered by type
+// listImagesHandler gets a page of images, optionally filtered and sorted.
+// The cursor for the next page, if any, is returned in the X-Next-Cursor
+// header.
 func listImagesHandler(w http.ResponseWriter, r *http.Request) {
 	hr := HTTPResponse{w}
 	ctx := GetContext(r)
 
-	vars := mux.Vars(r)
-	imageType := vars["imageType"]
-	if imageType != "" && !metadata.IsValidImageType(imageType) {
-		hr.JSONMsg(http.StatusBadRequest, "invalid type")
+	query, err := parseImageQuery(r.URL.Query())
+	if err != nil {
+		hr.JSONMsg(http.StatusBadRequest, err.Error())
 		return
 	}
 
-	images, err := ctx.MetadataStore.List(imageType)
+	images, cursor, err := ctx.MetadataStore.Query(query)
 	if err != nil {
 		hr.JSONError(http.StatusInternalServerError, err)
 		return
@@ -43,9 +64,63 @@ func listImagesHandler(w http.ResponseWriter, r *http.Request) {
 	if images == nil {
 		images = make([]*metadata.Image, 0)
 	}
+	if cursor != "" {
+		w.Header().Set("X-Next-Cursor", cursor)
+	}
 	hr.JSON(http.StatusOK, images)
 }
 
+// parseImageQuery builds an image query from request query parameters
+func parseImageQuery(values url.Values) (*metadata.Query, error) {
+	query := &metadata.Query{
+		Type:         values.Get("type"),
+		Status:       values.Get("status"),
+		SourcePrefix: values.Get("source_prefix"),
+		Sort:         values.Get("sort"),
+		Cursor:       values.Get("cursor"),
+	}
+
+	if query.Type != "" && !metadata.IsValidImageType(query.Type) {
+		return nil, errors.New("invalid type")
+	}
+
+	switch values.Get("order") {
+	case "", "asc":
+	case "desc":
+		query.Descending = true
+	default:
+		return nil, errors.New("invalid order")
+	}
+
+	if limit := values.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil {
+			return nil, errors.New("invalid limit")
+		}
+		query.Limit = n
+	}
+
+	for param, t := range map[string]*time.Time{
+		"downloaded_after":  &query.DownloadedAfter,
+		"downloaded_before": &query.DownloadedBefore,
+	} {
+		value := values.Get(param)
+		if value == "" {
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return nil, errors.New("invalid " + param)
+		}
+		*t = parsed
+	}
+
+	if err := query.Validate(); err != nil {
+		return nil, err
+	}
+	return query, nil
+}
+
 // receiveImageHandler adds and stores an image from the request body
 func receiveImageHandler(w http.ResponseWriter, r *http.Request) {
 	hr := HTTPResponse{w}
@@ -56,10 +131,27 @@ func receiveImageHandler(w http.ResponseWriter, r *http.Request) {
 		hr.JSONMsg(http.StatusBadRequest, "invalid X-Image-Type header")
 		return
 	}
+	checksumType := r.Header.Get("X-Image-Checksum-Type")
+	if checksumType != "" && !metadata.IsValidChecksumType(checksumType) {
+		hr.JSONMsg(http.StatusBadRequest, "invalid X-Image-Checksum-Type header")
+		return
+	}
+	if _, err := ctx.GetImageStore(r.Header.Get("X-Image-Store")); err != nil {
+		hr.JSONMsg(http.StatusBadRequest, "invalid X-Image-Store header")
+		return
+	}
+	if !IsValidSignature(r.Header.Get("X-Image-Signature")) {
+		hr.JSONMsg(http.StatusBadRequest, "invalid X-Image-Signature header")
+		return
+	}
 
 	image, err := ctx.Fetcher.Receive(r)
 	if err != nil {
-		hr.JSONError(http.StatusInternalServerError, err)
+		code := http.StatusInternalServerError
+		if err == metadata.ErrChecksumMismatch || err == metadata.ErrSignatureInvalid {
+			code = http.StatusBadRequest
+		}
+		hr.JSONError(code, err)
 		return
 	}
 
@@ -75,12 +167,23 @@ func fetchImageHandler(w http.ResponseWriter, r *http.Request) {
 	hr := HTTPResponse{w}
 	ctx := GetContext(r)
 
-	image := &metadata.Image{}
-	if err := json.NewDecoder(r.Body).Decode(image); err != nil {
+	req := &FetchRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
 		hr.JSONMsg(http.StatusBadRequest, err.Error())
 		return
 	}
-	image.ID = metadata.NewID()
+	image := &metadata.Image{
+		ID:               metadata.NewID(),
+		Source:           req.Source,
+		Type:             req.Type,
+		Comment:          req.Comment,
+		Priority:         req.Priority,
+		ChecksumType:     req.ChecksumType,
+		ExpectedChecksum: req.ExpectedChecksum,
+		ImageStore:       req.ImageStore,
+		SignatureURL:     req.SignatureURL,
+		Signature:        req.Signature,
+	}
 
 	// Ensure sufficient information for fetching
 	if image.Source == "" {
@@ -91,6 +194,18 @@ func fetchImageHandler(w http.ResponseWriter, r *http.Request) {
 		hr.JSONMsg(http.StatusBadRequest, "invalid image type")
 		return
 	}
+	if image.ChecksumType != "" && !metadata.IsValidChecksumType(image.ChecksumType) {
+		hr.JSONMsg(http.StatusBadRequest, "invalid checksum type")
+		return
+	}
+	if _, err := ctx.GetImageStore(image.ImageStore); err != nil {
+		hr.JSONMsg(http.StatusBadRequest, "invalid image store")
+		return
+	}
+	if !IsValidSignature(image.Signature) {
+		hr.JSONMsg(http.StatusBadRequest, "invalid signature")
+		return
+	}
 
 	image, err := ctx.Fetcher.Fetch(image)
 	if err != nil {
@@ -100,11 +215,12 @@ func fetchImageHandler(w http.ResponseWriter, r *http.Request) {
 	hr.JSON(http.StatusAccepted, image)
 }
 
-// getImageHandler retrieves information about an image.
+// getImageHandler retrieves information about an image. In mirror mode, an
+// image missing here is fetched from a peer that has it.
 func getImageHandler(w http.ResponseWriter, r *http.Request) {
 	hr := HTTPResponse{w}
 
-	image := getImage(w, r)
+	image := getMirroredImage(w, r)
 	if image == nil {
 		return
 	}
@@ -112,7 +228,7 @@ func getImageHandler(w http.ResponseWriter, r *http.Request) {
 	hr.JSON(http.StatusOK, image)
 }
 
-// deleteImageHandler removes an image.
+// deleteImageHandler removes an image, cancelling any fetch in progress.
 func deleteImageHandler(w http.ResponseWriter, r *http.Request) {
 	hr := HTTPResponse{w}
 	ctx := GetContext(r)
@@ -122,39 +238,208 @@ func deleteImageHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := ctx.ImageStore.Delete(image.ID); err != nil {
+	image, err := DeleteImage(ctx, image)
+	if err != nil {
 		hr.JSONError(http.StatusInternalServerError, err)
 		return
 	}
+
+	hr.JSON(http.StatusOK, image)
+}
+
+// DeleteImage removes an image and releases its data, cancelling any fetch in
+// progress. The image is returned as it was when removed.
+func DeleteImage(ctx *Context, image *metadata.Image) (*metadata.Image, error) {
+	// Stop any fetch first so it doesn't write to the image after removal
+	cancelled, err := ctx.Fetcher.Cancel(image.ID)
+	switch err {
+	case nil:
+		image = cancelled
+	case ErrNotCancellable:
+	default:
+		return nil, err
+	}
+
+	// Remove the metadata first so the image no longer counts as a reference
+	// to shared image data
 	if err := ctx.MetadataStore.Delete(image.ID); err != nil {
-		hr.JSONError(http.StatusInternalServerError, err)
+		return nil, err
+	}
+	if err := ctx.Blobs.Release(image); err != nil {
+		return nil, err
+	}
+	return image, nil
+}
+
+// cancelImageHandler stops a queued or in-progress fetch of an image. Partial
+// image data is removed and the image is left with cancelled status.
+func cancelImageHandler(w http.ResponseWriter, r *http.Request) {
+	hr := HTTPResponse{w}
+	ctx := GetContext(r)
+
+	image := getImage(w, r)
+	if image == nil {
+		return
+	}
+
+	image, err := ctx.Fetcher.Cancel(image.ID)
+	if err != nil {
+		code := http.StatusInternalServerError
+		if err == ErrNotCancellable {
+			code = http.StatusConflict
+		}
+		hr.JSONError(code, err)
 		return
 	}
 
 	hr.JSON(http.StatusOK, image)
 }
 
-// downloadImageHandler streams an image data
+// downloadImageHandler streams an image data. Range and conditional requests
+// are supported, using the image digest as the ETag. In mirror mode, an image
+// missing here is fetched from a peer that has it and streamed while it is
+// being stored. When signatures are required, images without a verified
+// signature are refused.
 func downloadImageHandler(w http.ResponseWriter, r *http.Request) {
 	hr := &HTTPResponse{w}
 	ctx := GetContext(r)
 
-	image := getImage(w, r)
+	image := getMirroredImage(w, r)
 	if image == nil {
 		return
 	}
 
+	if ctx.Mirror.IsMirroring(image) {
+		// Plain downloads start as soon as the data does; anything else
+		// waits for the complete image, as do all downloads when the
+		// signature has to be verified first
+		stream := !ctx.Verifier.RequireSigned && r.Method == "GET" && r.Header.Get("Range") == ""
+		current, err := ctx.Mirror.Wait(r.Context(), image, !stream)
+		if err != nil {
+			code := http.StatusInternalServerError
+			if err == metadata.ErrNotFound {
+				code = http.StatusNotFound
+			}
+			hr.JSONError(code, err)
+			return
+		}
+		image = current
+
+		if image.Status == metadata.StatusDownloading {
+			streamMirroredImage(w, r, image)
+			return
+		}
+	}
+
 	if image.Status != metadata.StatusComplete {
 		hr.JSONError(http.StatusNotFound, errors.New("incomplete image"))
 		return
 	}
+	if ctx.Verifier.RequireSigned && image.SignatureStatus != metadata.SignatureVerified {
+		hr.JSONError(http.StatusForbidden, ErrUnsignedImage)
+		return
+	}
+
+	// The data stays available until the download finishes, even if the
+	// image is deleted or its data relocated meanwhile
+	content, err := ctx.Blobs.Open(image)
+	if err != nil {
+		code := http.StatusInternalServerError
+		if err == metadata.ErrNotFound {
+			code = http.StatusNotFound
+		}
+		hr.JSONError(code, err)
+		return
+	}
+	defer logx.LogReturnedErr(content.Close, log.Fields{
+		"image": image,
+	}, "failed to close image data reader")
 
-	w.Header().Set("Content-Length", strconv.FormatInt(image.Size, 10))
 	w.Header().Set("Content-Type", "application/octet-stream")
-	if err := ctx.ImageStore.Get(image.ID, w); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if image.Digest != "" {
+		w.Header().Set("ETag", strconv.Quote(image.Digest))
+	}
+
+	http.ServeContent(w, r, "", image.DownloadEnd, content)
+}
+
+// streamMirroredImage streams the data of an image while it is being fetched
+// from a peer. The response is cut short if the fetch fails, which the client
+// sees as a response shorter than its Content-Length.
+func streamMirroredImage(w http.ResponseWriter, r *http.Request, image *metadata.Image) {
+	ctx := GetContext(r)
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if image.ExpectedSize >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(image.ExpectedSize, 10))
+	}
+	w.WriteHeader(http.StatusOK)
+	if flusher, ok := w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+
+	if err := ctx.Mirror.Stream(r.Context(), image, w); err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+			"image": image,
+		}).Error("failed to stream mirrored image")
+	}
+}
+
+// getMirroredImage retrieves an image like getImage. In mirror mode, an image
+// missing here, or a failed fetch of one from a peer, is fetched from a peer
+// that has it.
+func getMirroredImage(w http.ResponseWriter, r *http.Request) *metadata.Image {
+	hr := HTTPResponse{w}
+	ctx := GetContext(r)
+
+	if !ctx.Mirror.Enabled() {
+		return getImage(w, r)
+	}
+
+	imageID := mux.Vars(r)["imageID"]
+	image, err := ctx.MetadataStore.GetByID(imageID)
+	if err == metadata.ErrNotFound || (err == nil && ctx.Mirror.IsRetryable(image)) {
+		image, err = ctx.Mirror.Fetch(imageID)
+	}
+	if err != nil {
+		code := http.StatusInternalServerError
+		if err == metadata.ErrNotFound {
+			code = http.StatusNotFound
+		}
+
+		hr.JSONError(code, err)
+		return nil
+	}
+
+	return image
+}
+
+// imageSignatureHandler retrieves the service signature of a complete image
+func imageSignatureHandler(w http.ResponseWriter, r *http.Request) {
+	hr := HTTPResponse{w}
+	ctx := GetContext(r)
+
+	image := getImage(w, r)
+	if image == nil {
+		return
+	}
+
+	if image.Status != metadata.StatusComplete || image.Digest == "" {
+		hr.JSONError(http.StatusNotFound, errors.New("incomplete image"))
+		return
+	}
+
+	signature, err := ctx.Signer.ImageSignature(image)
+	if err != nil {
+		code := http.StatusInternalServerError
+		if err == ErrSigningDisabled {
+			code = http.StatusNotFound
+		}
+		hr.JSONError(code, err)
 		return
 	}
+	hr.JSON(http.StatusOK, signature)
 }
 
 func getImage(w http.ResponseWriter, r *http.Request) *metadata.Image {
@@ -0,0 +1,535 @@
+package images
+
+import (
+	"container/list"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	logx "github.com/mistifyio/mistify-logrus-ext"
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrMissingBackingType is used when the required backing store type is
+// omitted from the config
+var ErrMissingBackingType = errors.New("missing backing type")
+
+// cacheReadSize is the size of the chunks read from an image being filled
+const cacheReadSize = 32 << 10
+
+type (
+	// Cache is an image store keeping copies of the image data of a slow
+	// backing store in a local filesystem tier. Data is copied to the local
+	// tier the first time it is read, and the least recently used copies are
+	// evicted to stay within the size budget. Readers of data still being
+	// copied follow the copy rather than reading the backing store again.
+	// Changes are made to the backing store, dropping any local copy.
+	Cache struct {
+		Config  *CacheConfig
+		backing Store
+		local   *FS
+		lock    sync.Mutex
+		// entries holds the cached images, most recently used first
+		entries *list.List
+		index   map[string]*list.Element
+		size    int64
+		// fills holds the images being copied to the local tier
+		fills map[string]*cacheFill
+	}
+
+	// CacheConfig contains necessary config options to set up the cache store
+	CacheConfig struct {
+		// Dir is the directory of the local tier
+		Dir string
+		// MaxSize is the maximum total size of image data in the local tier
+		// in bytes. Zero means no limit. Images larger than the limit are
+		// read from the backing store without being cached.
+		MaxSize int64
+		// BackingType and BackingConfig set up the backing store, as with
+		// imageStoreType and imageStoreConfig
+		BackingType   string
+		BackingConfig json.RawMessage
+	}
+
+	// cacheEntry is an image in the local tier
+	cacheEntry struct {
+		imageID string
+		size    int64
+	}
+
+	// cacheFill is an image being copied to the local tier. Readers follow the
+	// temporary file as it is written. A cached image is represented by a
+	// finished fill, so all reads are handled the same way.
+	cacheFill struct {
+		file    *os.File
+		path    string
+		lock    sync.Mutex
+		cond    *sync.Cond
+		written int64
+		done    bool
+		err     error
+		// stale is set, with the cache lock held, when the image is changed
+		// while being copied, so the copy is discarded
+		stale bool
+	}
+)
+
+// cacheLogFields contain fields to include on all logs
+var cacheLogFields = log.Fields{
+	"type":  "images",
+	"store": "cache",
+}
+
+// Validate checks whether the config is valid
+func (cc *CacheConfig) Validate() error {
+	if cc.Dir == "" {
+		return ErrMissingDir
+	}
+	if cc.MaxSize < 0 {
+		return ErrInvalidMaxSize
+	}
+	if cc.BackingType == "" {
+		return ErrMissingBackingType
+	}
+	return nil
+}
+
+// Init parses the config, sets up the local tier and the backing store, and
+// indexes the image data already cached
+func (cache *Cache) Init(configBytes []byte) error {
+	config := &CacheConfig{}
+
+	// Parse the config json
+	if err := json.Unmarshal(configBytes, config); err != nil {
+		log.WithFields(cacheLogFields).WithFields(log.Fields{
+			"error": err,
+			"json":  string(configBytes),
+		}).Error("failed to unmarshal config json")
+		return err
+	}
+
+	if err := config.Validate(); err != nil {
+		log.WithFields(cacheLogFields).WithFields(log.Fields{
+			"error": err,
+		}).Error("failed config validation")
+		return err
+	}
+
+	cache.Config = config
+	log.WithFields(cacheLogFields).WithFields(log.Fields{
+		"config": cache.Config,
+	}).Info("config loaded")
+
+	// Local tier
+	localConfig, _ := json.Marshal(&FSConfig{Dir: config.Dir})
+	cache.local = &FS{}
+	if err := cache.local.Init(localConfig); err != nil {
+		return err
+	}
+
+	// Backing store
+	cache.backing = NewStore(config.BackingType)
+	if cache.backing == nil {
+		err := errors.New("unknown backing store type")
+		log.WithFields(cacheLogFields).WithFields(log.Fields{
+			"error": err,
+			"type":  config.BackingType,
+		}).Error("failed to create backing store")
+		return err
+	}
+	backingConfig := []byte(config.BackingConfig)
+	if len(backingConfig) == 0 {
+		backingConfig = []byte("{}")
+	}
+	if err := cache.backing.Init(backingConfig); err != nil {
+		return err
+	}
+
+	return cache.loadEntries()
+}
+
+// loadEntries indexes the image data in the local tier, oldest first, and
+// removes copies left unfinished by a previous run
+func (cache *Cache) loadEntries() error {
+	cache.entries = list.New()
+	cache.index = make(map[string]*list.Element)
+	cache.fills = make(map[string]*cacheFill)
+	cache.size = 0
+
+	files, err := ioutil.ReadDir(cache.Config.Dir)
+	if err != nil {
+		log.WithFields(cacheLogFields).WithFields(log.Fields{
+			"error": err,
+			"dir":   cache.Config.Dir,
+		}).Error("failed to read cache dir")
+		return err
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().Before(files[j].ModTime())
+	})
+
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	for _, file := range files {
+		if !file.Mode().IsRegular() {
+			continue
+		}
+		if strings.HasPrefix(file.Name(), fsTempPrefix) {
+			_ = os.Remove(filepath.Join(cache.Config.Dir, file.Name()))
+			continue
+		}
+		cache.add(file.Name(), file.Size())
+	}
+	cache.evict()
+	return nil
+}
+
+// Shutdown shuts down the backing store
+func (cache *Cache) Shutdown() error {
+	return cache.backing.Shutdown()
+}
+
+// Stat retrieves file information about an image, from the local tier if it
+// is cached
+func (cache *Cache) Stat(imageID string) (os.FileInfo, error) {
+	if !validID(imageID) {
+		return nil, ErrInvalidID
+	}
+
+	cache.lock.Lock()
+	_, cached := cache.index[imageID]
+	cache.lock.Unlock()
+
+	if cached {
+		if info, err := cache.local.Stat(imageID); err == nil {
+			return info, nil
+		}
+	}
+	return cache.backing.Stat(imageID)
+}
+
+// Get retrieves an image, caching it if necessary
+func (cache *Cache) Get(imageID string, out io.Writer) error {
+	return cache.GetRange(imageID, out, 0, -1)
+}
+
+// GetRange retrieves part of an image, caching it if necessary
+func (cache *Cache) GetRange(imageID string, out io.Writer, offset, length int64) error {
+	if !validID(imageID) {
+		return ErrInvalidID
+	}
+
+	fill, file, err := cache.open(imageID)
+	if err != nil {
+		return err
+	}
+	if fill == nil {
+		// Too large to cache
+		return cache.backing.GetRange(imageID, out, offset, length)
+	}
+	defer logx.LogReturnedErr(file.Close, log.Fields{
+		"imageID": imageID,
+	}, "failed to close cached image file")
+
+	if err := fill.read(file, out, offset, length); err != nil {
+		log.WithFields(cacheLogFields).WithFields(log.Fields{
+			"error":   err,
+			"imageID": imageID,
+			"offset":  offset,
+			"length":  length,
+		}).Error("failed to copy image data to output stream")
+		return err
+	}
+	return nil
+}
+
+// Put stores an image in the backing store
+func (cache *Cache) Put(imageID string, in io.Reader) error {
+	if !validID(imageID) {
+		return ErrInvalidID
+	}
+	defer cache.invalidate(imageID)
+	return cache.backing.Put(imageID, in)
+}
+
+// Append adds data to the end of an image in the backing store
+func (cache *Cache) Append(imageID string, in io.Reader) error {
+	if !validID(imageID) {
+		return ErrInvalidID
+	}
+	defer cache.invalidate(imageID)
+	return cache.backing.Append(imageID, in)
+}
+
+// Move moves an image in the backing store
+func (cache *Cache) Move(fromID, toID string) error {
+	if !validID(fromID) || !validID(toID) {
+		return ErrInvalidID
+	}
+	defer cache.invalidate(fromID)
+	defer cache.invalidate(toID)
+	return Move(cache.backing, fromID, toID)
+}
+
+// Delete removes an image from the backing store and the local tier
+func (cache *Cache) Delete(imageID string) error {
+	// Nothing can be stored under an invalid id, so there is nothing to
+	// remove
+	if !validID(imageID) {
+		return nil
+	}
+	defer cache.invalidate(imageID)
+	return cache.backing.Delete(imageID)
+}
+
+// List retrieves the ids of all images in the backing store
+func (cache *Cache) List() ([]string, error) {
+	return cache.backing.List()
+}
+
+// open returns the fill to read an image from, along with a file to read it
+// with. A cached image is read from the local tier. Otherwise a copy to the
+// local tier is started, unless one is already in progress. Returns a nil fill
+// if the image is too large to be cached.
+func (cache *Cache) open(imageID string) (*cacheFill, *os.File, error) {
+	if fill, file, ok, err := cache.openExisting(imageID); ok {
+		return fill, file, err
+	}
+
+	// The size is needed to decide whether to cache the image, and fetching
+	// it shouldn't hold up other images
+	info, err := cache.backing.Stat(imageID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if cache.Config.MaxSize > 0 && info.Size() > cache.Config.MaxSize {
+		return nil, nil, nil
+	}
+
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	// Another reader may have gotten here first
+	if fill, file, ok, err := cache.openExistingLocked(imageID); ok {
+		return fill, file, err
+	}
+
+	writer, err := ioutil.TempFile(cache.Config.Dir, fsTempPrefix)
+	if err != nil {
+		log.WithFields(cacheLogFields).WithFields(log.Fields{
+			"error":   err,
+			"imageID": imageID,
+		}).Error("failed to create temporary image file")
+		return nil, nil, err
+	}
+	fill := newCacheFill(writer, writer.Name())
+	file, err := os.Open(fill.path)
+	if err != nil {
+		logx.LogReturnedErr(writer.Close, nil, "failed to close temporary image file")
+		_ = os.Remove(fill.path)
+		return nil, nil, err
+	}
+
+	cache.fills[imageID] = fill
+	go cache.fill(imageID, fill)
+	return fill, file, nil
+}
+
+// openExisting opens a cached image or one already being copied, returning
+// whether one was found
+func (cache *Cache) openExisting(imageID string) (*cacheFill, *os.File, bool, error) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	return cache.openExistingLocked(imageID)
+}
+
+// openExistingLocked opens a cached image or one already being copied. The
+// lock must be held, so the file can't be evicted or renamed before it is
+// opened.
+func (cache *Cache) openExistingLocked(imageID string) (*cacheFill, *os.File, bool, error) {
+	if elem, ok := cache.index[imageID]; ok {
+		cache.entries.MoveToFront(elem)
+		fill := newCacheFill(nil, filepath.Join(cache.Config.Dir, imageID))
+		fill.written = elem.Value.(*cacheEntry).size
+		fill.done = true
+		file, err := os.Open(fill.path)
+		return fill, file, true, err
+	}
+
+	if fill, ok := cache.fills[imageID]; ok {
+		file, err := os.Open(fill.path)
+		return fill, file, true, err
+	}
+	return nil, nil, false, nil
+}
+
+// fill copies an image from the backing store to the local tier, adding it to
+// the cache once complete
+func (cache *Cache) fill(imageID string, fill *cacheFill) {
+	err := cache.backing.Get(imageID, fill)
+	if err == nil {
+		err = fill.file.Sync()
+	}
+	if closeErr := fill.file.Close(); err == nil {
+		err = closeErr
+	}
+
+	cache.lock.Lock()
+	delete(cache.fills, imageID)
+	if err == nil && !fill.stale {
+		err = os.Rename(fill.path, filepath.Join(cache.Config.Dir, imageID))
+		if err == nil {
+			cache.add(imageID, fill.written)
+			cache.evict()
+		}
+	}
+	if err != nil || fill.stale {
+		_ = os.Remove(fill.path)
+	}
+	cache.lock.Unlock()
+
+	if err != nil {
+		log.WithFields(cacheLogFields).WithFields(log.Fields{
+			"error":   err,
+			"imageID": imageID,
+		}).Error("failed to cache image")
+	}
+	fill.finish(err)
+}
+
+// add adds an image to the front of the cache. The lock must be held.
+func (cache *Cache) add(imageID string, size int64) {
+	cache.index[imageID] = cache.entries.PushFront(&cacheEntry{
+		imageID: imageID,
+		size:    size,
+	})
+	cache.size += size
+}
+
+// remove removes an image from the cache and the local tier. The lock must be
+// held.
+func (cache *Cache) remove(elem *list.Element) {
+	entry := elem.Value.(*cacheEntry)
+	cache.entries.Remove(elem)
+	delete(cache.index, entry.imageID)
+	cache.size -= entry.size
+
+	// Readers with the file open can keep reading it
+	if err := cache.local.Delete(entry.imageID); err != nil {
+		log.WithFields(cacheLogFields).WithFields(log.Fields{
+			"error":   err,
+			"imageID": entry.imageID,
+		}).Error("failed to remove cached image")
+	}
+}
+
+// evict removes the least recently used images until the cache is within its
+// size limit. The lock must be held.
+func (cache *Cache) evict() {
+	for cache.Config.MaxSize > 0 && cache.size > cache.Config.MaxSize {
+		cache.remove(cache.entries.Back())
+	}
+}
+
+// invalidate drops the local copy of an image that was changed in the backing
+// store
+func (cache *Cache) invalidate(imageID string) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	if elem, ok := cache.index[imageID]; ok {
+		cache.remove(elem)
+	}
+	if fill, ok := cache.fills[imageID]; ok {
+		fill.stale = true
+	}
+}
+
+// newCacheFill creates a new cacheFill writing to a file
+func newCacheFill(file *os.File, path string) *cacheFill {
+	fill := &cacheFill{
+		file: file,
+		path: path,
+	}
+	fill.cond = sync.NewCond(&fill.lock)
+	return fill
+}
+
+// Write writes image data to the file, waking any waiting readers
+func (fill *cacheFill) Write(p []byte) (int, error) {
+	n, err := fill.file.Write(p)
+
+	fill.lock.Lock()
+	fill.written += int64(n)
+	fill.lock.Unlock()
+	fill.cond.Broadcast()
+	return n, err
+}
+
+// finish records the result of the copy, waking any waiting readers
+func (fill *cacheFill) finish(err error) {
+	fill.lock.Lock()
+	fill.done = true
+	fill.err = err
+	fill.lock.Unlock()
+	fill.cond.Broadcast()
+}
+
+// read reads part of the image from a file as it is written, waiting for more
+// data until the copy is finished. A negative length reads to the end of the
+// image.
+func (fill *cacheFill) read(file *os.File, out io.Writer, offset, length int64) error {
+	end := int64(-1)
+	if length >= 0 {
+		end = offset + length
+	}
+
+	buf := make([]byte, cacheReadSize)
+	for pos := offset; end < 0 || pos < end; {
+		fill.lock.Lock()
+		for fill.written <= pos && !fill.done {
+			fill.cond.Wait()
+		}
+		written, err := fill.written, fill.err
+		fill.lock.Unlock()
+
+		if err != nil {
+			return err
+		}
+		if pos >= written {
+			// Finished before reaching the end of the range
+			if end >= 0 {
+				return io.ErrUnexpectedEOF
+			}
+			return nil
+		}
+
+		n := written - pos
+		if end >= 0 && end-pos < n {
+			n = end - pos
+		}
+		if n > int64(len(buf)) {
+			n = int64(len(buf))
+		}
+		if _, err := file.ReadAt(buf[:n], pos); err != nil {
+			return err
+		}
+		if _, err := out.Write(buf[:n]); err != nil {
+			return err
+		}
+		pos += n
+	}
+	return nil
+}
+
+func init() {
+	Register("cache", func() Store {
+		return &Cache{}
+	})
+}
@@ -0,0 +1,307 @@
+package images_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/mistifyio/mistify-image-service/images"
+	"github.com/mistifyio/mistify-image-service/images/storetest"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/suite"
+)
+
+type CacheTestSuite struct {
+	storetest.StoreSuite
+	CacheConfig *images.CacheConfig
+	Backing     *gatedStore
+}
+
+func (s *CacheTestSuite) SetupTest() {
+	// Cache specific test setup. The backing store is the one registered
+	// below, so tests can watch and hold up reads from it.
+	dir, _ := ioutil.TempDir("", "cacheTest-"+uuid.New())
+	s.CacheConfig = &images.CacheConfig{
+		Dir:           dir,
+		BackingType:   "gated",
+		BackingConfig: json.RawMessage(`{}`),
+	}
+	s.StoreConfig, _ = json.Marshal(s.CacheConfig)
+	s.Backing = &gatedStore{}
+	testGatedStore = s.Backing
+
+	// General store test setup
+	s.StoreSuite.SetupTest()
+}
+
+func (s *CacheTestSuite) TearDownTest() {
+	s.NoError(os.RemoveAll(s.CacheConfig.Dir))
+}
+
+func TestCacheTestSuite(t *testing.T) {
+	s := new(CacheTestSuite)
+	s.StoreName = "cache"
+	suite.Run(t, s)
+}
+
+func (s *CacheTestSuite) TestConfigValidate() {
+	tests := []struct {
+		description string
+		config      *images.CacheConfig
+		expectedErr error
+	}{
+		{"empty config should be invalid",
+			&images.CacheConfig{}, images.ErrMissingDir},
+		{"negative max size should be invalid",
+			&images.CacheConfig{Dir: "/tmp", MaxSize: -1, BackingType: "memory"}, images.ErrInvalidMaxSize},
+		{"missing backing type should be invalid",
+			&images.CacheConfig{Dir: "/tmp"}, images.ErrMissingBackingType},
+		{"config to use for tests should be valid",
+			s.CacheConfig, nil},
+	}
+
+	for _, test := range tests {
+		s.Equal(test.expectedErr, test.config.Validate(), test.description)
+	}
+}
+
+func (s *CacheTestSuite) TestInit() {
+	tests := []struct {
+		description string
+		configJSON  string
+		expectedErr bool
+	}{
+		{"bad json should fail",
+			"not actually json", true},
+		{"invalid config should fail",
+			`{}`, true},
+		{"unknown backing type should fail",
+			`{"dir":"` + s.CacheConfig.Dir + `","backingType":"asdf"}`, true},
+		{"invalid backing config should fail",
+			`{"dir":"` + s.CacheConfig.Dir + `","backingType":"fs","backingConfig":{}}`, true},
+		{"config to use for tests should succeed",
+			string(s.StoreConfig), false},
+	}
+
+	for _, test := range tests {
+		store := images.NewStore("cache")
+		config := []byte(test.configJSON)
+		err := store.Init(config)
+		if test.expectedErr {
+			s.Error(err, test.description)
+		} else {
+			s.NoError(err, test.description)
+		}
+	}
+}
+
+func (s *CacheTestSuite) TestReadThrough() {
+	s.Require().NoError(s.Store.Put(s.ImageID, bytes.NewReader(s.ImageData)))
+	s.NoFileExists(filepath.Join(s.CacheConfig.Dir, s.ImageID), "put should not cache")
+
+	for i := 0; i < 3; i++ {
+		out := &bytes.Buffer{}
+		s.NoError(s.Store.Get(s.ImageID, out))
+		s.Equal(s.ImageData, out.Bytes())
+	}
+	s.EqualValues(1, s.Backing.Gets(), "data should only be read from the backing store once")
+	s.FileExists(filepath.Join(s.CacheConfig.Dir, s.ImageID), "data should be cached")
+
+	out := &bytes.Buffer{}
+	s.NoError(s.Store.GetRange(s.ImageID, out, 4, 8))
+	s.Equal(s.ImageData[4:12], out.Bytes(), "ranges should be served from the cache")
+
+	replacement := bytes.ToUpper(s.ImageData)
+	s.Require().NoError(s.Store.Put(s.ImageID, bytes.NewReader(replacement)))
+	out = &bytes.Buffer{}
+	s.NoError(s.Store.Get(s.ImageID, out))
+	s.Equal(replacement, out.Bytes(), "changed data should not be served from the cache")
+
+	s.NoError(s.Store.Delete(s.ImageID))
+	s.NoFileExists(filepath.Join(s.CacheConfig.Dir, s.ImageID), "deleted data should be removed from the cache")
+}
+
+func (s *CacheTestSuite) TestEvict() {
+	s.CacheConfig.MaxSize = int64(len(s.ImageData) * 2)
+	store := s.newStore()
+
+	for _, imageID := range []string{"first", "second", "third"} {
+		s.Require().NoError(store.Put(imageID, bytes.NewReader(s.ImageData)))
+	}
+	s.NoError(store.Get("first", ioutil.Discard))
+	s.NoError(store.Get("second", ioutil.Discard))
+	s.NoError(store.Get("first", ioutil.Discard))
+	s.NoError(store.Get("third", ioutil.Discard))
+
+	s.FileExists(filepath.Join(s.CacheConfig.Dir, "first"), "recently used data should be kept")
+	s.NoFileExists(filepath.Join(s.CacheConfig.Dir, "second"), "least recently used data should be evicted")
+	s.FileExists(filepath.Join(s.CacheConfig.Dir, "third"))
+
+	// The cache is rebuilt from the local tier on restart
+	s.CacheConfig.MaxSize = int64(len(s.ImageData))
+	store = s.newStore()
+	files, _ := ioutil.ReadDir(s.CacheConfig.Dir)
+	s.Len(files, 1, "cache should be trimmed to a smaller size limit")
+	gets := s.Backing.Gets()
+	s.NoError(store.Get(files[0].Name(), ioutil.Discard))
+	s.Equal(gets, s.Backing.Gets(), "data cached by a previous run should be used")
+}
+
+func (s *CacheTestSuite) TestTooLarge() {
+	s.CacheConfig.MaxSize = int64(len(s.ImageData) - 1)
+	store := s.newStore()
+
+	s.Require().NoError(store.Put(s.ImageID, bytes.NewReader(s.ImageData)))
+	out := &bytes.Buffer{}
+	s.NoError(store.Get(s.ImageID, out))
+	s.Equal(s.ImageData, out.Bytes(), "data too large to cache should be served")
+	files, _ := ioutil.ReadDir(s.CacheConfig.Dir)
+	s.Empty(files, "data too large to cache should not be cached")
+}
+
+func (s *CacheTestSuite) TestConcurrentFill() {
+	s.Require().NoError(s.Store.Put(s.ImageID, bytes.NewReader(s.ImageData)))
+	s.Backing.Hold()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(offset int64) {
+			defer wg.Done()
+			out := &bytes.Buffer{}
+			s.NoError(s.Store.GetRange(s.ImageID, out, offset, -1))
+			s.Equal(s.ImageData[offset:], out.Bytes(), "readers should get the data being filled")
+		}(int64(i))
+	}
+
+	// Let the readers pile up on the partially filled data
+	s.Backing.WaitForGets(1)
+	s.Backing.Release()
+	wg.Wait()
+	s.EqualValues(1, s.Backing.Gets(), "data should only be read from the backing store once")
+}
+
+func (s *CacheTestSuite) TestFailedFill() {
+	s.Require().NoError(s.Store.Put(s.ImageID, bytes.NewReader(s.ImageData)))
+	s.Backing.Fail()
+
+	s.Error(s.Store.Get(s.ImageID, ioutil.Discard), "failed read of the backing store should fail")
+	files, _ := ioutil.ReadDir(s.CacheConfig.Dir)
+	s.Empty(files, "partial data should not be cached")
+
+	out := &bytes.Buffer{}
+	s.NoError(s.Store.Get(s.ImageID, out), "data should be read again after a failure")
+	s.Equal(s.ImageData, out.Bytes())
+}
+
+// newStore creates a cache store with the current config sharing the backing
+// store
+func (s *CacheTestSuite) newStore() images.Store {
+	config, _ := json.Marshal(s.CacheConfig)
+	store := images.NewStore("cache")
+	s.Require().NoError(store.Init(config))
+	return store
+}
+
+// testGatedStore is the backing store used by the cache tests
+var testGatedStore *gatedStore
+
+// gatedStore is a memory image store counting full reads, which can hold up a
+// read halfway through the data or fail it
+type gatedStore struct {
+	images.Memory
+	gets int32
+	lock sync.Mutex
+	cond *sync.Cond
+	held bool
+	fail bool
+}
+
+// Init initializes the memory store once, so it is shared by caches
+func (gs *gatedStore) Init(configBytes []byte) error {
+	if gs.cond != nil {
+		return nil
+	}
+	gs.cond = sync.NewCond(&gs.lock)
+	return gs.Memory.Init(configBytes)
+}
+
+// Get retrieves an image, waiting halfway through while held
+func (gs *gatedStore) Get(imageID string, out io.Writer) error {
+	data := &bytes.Buffer{}
+	if err := gs.Memory.Get(imageID, data); err != nil {
+		return err
+	}
+
+	gs.lock.Lock()
+	gs.gets++
+	gs.cond.Broadcast()
+	fail := gs.fail
+	gs.fail = false
+	gs.lock.Unlock()
+
+	if _, err := out.Write(data.Next(data.Len() / 2)); err != nil {
+		return err
+	}
+	if fail {
+		return io.ErrUnexpectedEOF
+	}
+
+	gs.lock.Lock()
+	for gs.held {
+		gs.cond.Wait()
+	}
+	gs.lock.Unlock()
+
+	_, err := out.Write(data.Bytes())
+	return err
+}
+
+// Gets returns the number of full reads so far
+func (gs *gatedStore) Gets() int32 {
+	gs.lock.Lock()
+	defer gs.lock.Unlock()
+	return gs.gets
+}
+
+// WaitForGets waits until a number of full reads have started
+func (gs *gatedStore) WaitForGets(n int32) {
+	gs.lock.Lock()
+	defer gs.lock.Unlock()
+	for gs.gets < n {
+		gs.cond.Wait()
+	}
+}
+
+// Hold holds up reads until released
+func (gs *gatedStore) Hold() {
+	gs.lock.Lock()
+	defer gs.lock.Unlock()
+	gs.held = true
+}
+
+// Release lets held reads continue
+func (gs *gatedStore) Release() {
+	gs.lock.Lock()
+	defer gs.lock.Unlock()
+	gs.held = false
+	gs.cond.Broadcast()
+}
+
+// Fail fails the next read halfway through
+func (gs *gatedStore) Fail() {
+	gs.lock.Lock()
+	defer gs.lock.Unlock()
+	gs.fail = true
+}
+
+func init() {
+	images.Register("gated", func() images.Store {
+		return testGatedStore
+	})
+}
@@ -4,20 +4,30 @@ import (
 	"encoding/json"
 	"errors"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 
-	log "github.com/Sirupsen/logrus"
 	logx "github.com/mistifyio/mistify-logrus-ext"
+	log "github.com/sirupsen/logrus"
 )
 
 // ErrMissingDir is used when the required dir is omitted from the config
 var ErrMissingDir = errors.New("missing dir")
 
+// fsTempPrefix is the file name prefix for images being written by Put
+const fsTempPrefix = ".tmp-"
+
 type (
 	// FS is an image store using the filesystem
 	FS struct {
 		Config *FSConfig
+
+		// writing holds the names of the temporary files of Puts in progress
+		writing   map[string]struct{}
+		writingMu sync.Mutex
 	}
 
 	// FSConfig contains necessary config options to set up the fs store
@@ -93,16 +103,22 @@ func (fs *FS) Shutdown() error {
 	return nil
 }
 
-// imageFilepath generates the full imageFilepath from the image id
-func (fs *FS) imageFilepath(imageID string) string {
-	// Clean the imageID to prevent use of relative paths to get outside of the
-	// configured dir
-	return filepath.Join(fs.Config.Dir, filepath.Clean(imageID))
+// imageFilepath generates the full imageFilepath from the image id. Ids that
+// aren't a single path element are rejected so relative paths can't be used
+// to reach other images or get outside of the configured dir.
+func (fs *FS) imageFilepath(imageID string) (string, error) {
+	if !validID(imageID) {
+		return "", ErrInvalidID
+	}
+	return filepath.Join(fs.Config.Dir, imageID), nil
 }
 
 // Stat retrieves file information about an image
 func (fs *FS) Stat(imageID string) (os.FileInfo, error) {
-	imageFilepath := fs.imageFilepath(imageID)
+	imageFilepath, err := fs.imageFilepath(imageID)
+	if err != nil {
+		return nil, err
+	}
 	info, err := os.Stat(imageFilepath)
 	if err != nil {
 		log.WithFields(fsLogFields).WithFields(log.Fields{
@@ -116,7 +132,10 @@ func (fs *FS) Stat(imageID string) (os.FileInfo, error) {
 
 // Get retrieves an image from the filesystem
 func (fs *FS) Get(imageID string, out io.Writer) error {
-	imageFilepath := fs.imageFilepath(imageID)
+	imageFilepath, err := fs.imageFilepath(imageID)
+	if err != nil {
+		return err
+	}
 	file, err := os.Open(imageFilepath)
 	if err != nil {
 		log.WithFields(fsLogFields).WithFields(log.Fields{
@@ -143,48 +162,238 @@ func (fs *FS) Get(imageID string, out io.Writer) error {
 	return nil
 }
 
-// Put stores an image in the filesystem
+// GetRange retrieves part of an image from the filesystem
+func (fs *FS) GetRange(imageID string, out io.Writer, offset, length int64) error {
+	imageFilepath, err := fs.imageFilepath(imageID)
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(imageFilepath)
+	if err != nil {
+		log.WithFields(fsLogFields).WithFields(log.Fields{
+			"error":    err,
+			"imageID":  imageID,
+			"filepath": imageFilepath,
+		}).Error("failed to open image")
+		return err
+	}
+	defer logx.LogReturnedErr(file.Close, log.Fields{
+		"imageID":  imageID,
+		"filepath": imageFilepath,
+	}, "failed to close image file")
+
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		log.WithFields(fsLogFields).WithFields(log.Fields{
+			"error":    err,
+			"imageID":  imageID,
+			"filepath": imageFilepath,
+			"offset":   offset,
+		}).Error("failed to seek image file")
+		return err
+	}
+
+	if length < 0 {
+		_, err = io.Copy(out, file)
+	} else {
+		_, err = io.CopyN(out, file, length)
+	}
+	if err != nil {
+		log.WithFields(fsLogFields).WithFields(log.Fields{
+			"error":    err,
+			"imageID":  imageID,
+			"filepath": imageFilepath,
+			"offset":   offset,
+			"length":   length,
+		}).Error("failed to copy image data to output stream")
+		return err
+	}
+
+	return nil
+}
+
+// Put stores an image in the filesystem. The data is written to a temporary
+// file, synced, and only renamed into place once complete, so a failed or
+// interrupted write never leaves partial data under the image id.
 func (fs *FS) Put(imageID string, in io.Reader) error {
-	imageFilepath := fs.imageFilepath(imageID)
-	file, err := os.Create(imageFilepath)
+	imageFilepath, err := fs.imageFilepath(imageID)
+	if err != nil {
+		return err
+	}
+
+	file, err := fs.createTemp()
 	if err != nil {
 		log.WithFields(fsLogFields).WithFields(log.Fields{
 			"error":    err,
 			"imageID":  imageID,
 			"filepath": imageFilepath,
-		}).Error("failed to create image file")
+		}).Error("failed to create temporary image file")
+		return err
+	}
+	tempFilepath := file.Name()
+	defer fs.doneTemp(tempFilepath)
+
+	if err := fs.writeTemp(file, in); err != nil {
+		log.WithFields(fsLogFields).WithFields(log.Fields{
+			"error":        err,
+			"imageID":      imageID,
+			"filepath":     imageFilepath,
+			"tempFilepath": tempFilepath,
+		}).Error("failed to write image file")
+		_ = os.Remove(tempFilepath)
+		return err
+	}
+
+	if err := os.Rename(tempFilepath, imageFilepath); err != nil {
+		log.WithFields(fsLogFields).WithFields(log.Fields{
+			"error":        err,
+			"imageID":      imageID,
+			"filepath":     imageFilepath,
+			"tempFilepath": tempFilepath,
+		}).Error("failed to rename image file into place")
+		_ = os.Remove(tempFilepath)
+		return err
+	}
+
+	return fs.syncDir()
+}
+
+// writeTemp writes and syncs data to a temporary image file, closing it
+func (fs *FS) writeTemp(file *os.File, in io.Reader) error {
+	defer logx.LogReturnedErr(file.Close, log.Fields{
+		"filepath": file.Name(),
+	}, "failed to close temporary image file")
+
+	if err := file.Chmod(os.FileMode(0755)); err != nil {
+		return err
+	}
+	if _, err := io.Copy(file, in); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+// createTemp creates a temporary image file, recording it as in use until
+// doneTemp is called. Both happen under the lock, so ListTemp never sees the
+// file without the record.
+func (fs *FS) createTemp() (*os.File, error) {
+	fs.writingMu.Lock()
+	defer fs.writingMu.Unlock()
+
+	file, err := ioutil.TempFile(fs.Config.Dir, fsTempPrefix)
+	if err != nil {
+		return nil, err
+	}
+	if fs.writing == nil {
+		fs.writing = make(map[string]struct{})
+	}
+	fs.writing[filepath.Base(file.Name())] = struct{}{}
+	return file, nil
+}
+
+// doneTemp records that a temporary image file is no longer in use
+func (fs *FS) doneTemp(tempFilepath string) {
+	fs.writingMu.Lock()
+	defer fs.writingMu.Unlock()
+	delete(fs.writing, filepath.Base(tempFilepath))
+}
+
+// syncDir syncs the directory, making renames and removals durable
+func (fs *FS) syncDir() error {
+	dir, err := os.Open(fs.Config.Dir)
+	if err != nil {
+		log.WithFields(fsLogFields).WithFields(log.Fields{
+			"error": err,
+			"dir":   fs.Config.Dir,
+		}).Error("failed to open directory")
 		return err
 	}
+	defer logx.LogReturnedErr(dir.Close, log.Fields{
+		"dir": fs.Config.Dir,
+	}, "failed to close directory")
 
+	if err := dir.Sync(); err != nil {
+		log.WithFields(fsLogFields).WithFields(log.Fields{
+			"error": err,
+			"dir":   fs.Config.Dir,
+		}).Error("failed to sync directory")
+		return err
+	}
+	return nil
+}
+
+// Append adds data to the end of an image in the filesystem. Unlike Put, the
+// data is written in place, so the data appended before a failure is kept and
+// a transfer can be resumed from it.
+func (fs *FS) Append(imageID string, in io.Reader) error {
+	imageFilepath, err := fs.imageFilepath(imageID)
+	if err != nil {
+		return err
+	}
 	mode := os.FileMode(0755)
-	if err := file.Chmod(mode); err != nil {
+	file, err := os.OpenFile(imageFilepath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, mode)
+	if err != nil {
 		log.WithFields(fsLogFields).WithFields(log.Fields{
-			"error":       err,
-			"imageID":     imageID,
-			"filepath":    imageFilepath,
-			"desiredMode": mode,
-		}).Error("failed to chmod image file")
+			"error":    err,
+			"imageID":  imageID,
+			"filepath": imageFilepath,
+		}).Error("failed to open image file for appending")
 		return err
 	}
+	defer logx.LogReturnedErr(file.Close, log.Fields{
+		"imageID":  imageID,
+		"filepath": imageFilepath,
+	}, "failed to close image file")
 
 	if _, err := io.Copy(file, in); err != nil {
 		log.WithFields(fsLogFields).WithFields(log.Fields{
 			"error":    err,
 			"imageID":  imageID,
 			"filepath": imageFilepath,
-		}).Error("failed to create image file")
+		}).Error("failed to append to image file")
+		return err
+	}
+
+	if err := file.Sync(); err != nil {
+		log.WithFields(fsLogFields).WithFields(log.Fields{
+			"error":    err,
+			"imageID":  imageID,
+			"filepath": imageFilepath,
+		}).Error("failed to sync image file")
 		return err
 	}
 	return nil
 }
 
+// Move renames an image in the filesystem
+func (fs *FS) Move(fromID, toID string) error {
+	fromFilepath, err := fs.imageFilepath(fromID)
+	if err != nil {
+		return err
+	}
+	toFilepath, err := fs.imageFilepath(toID)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Rename(fromFilepath, toFilepath); err != nil {
+		log.WithFields(fsLogFields).WithFields(log.Fields{
+			"error":        err,
+			"fromImageID":  fromID,
+			"toImageID":    toID,
+			"fromFilepath": fromFilepath,
+			"toFilepath":   toFilepath,
+		}).Error("failed to move image")
+		return err
+	}
+	return fs.syncDir()
+}
+
 // Delete removes an image from the filesystem
 func (fs *FS) Delete(imageID string) error {
-	imageFilepath := fs.imageFilepath(imageID)
-
-	// Since os.Remove will remove an empty dir, don't chance it if the
-	// imageFilepath ended up as the base dir
-	if imageFilepath == fs.Config.Dir {
+	// Nothing can be stored under an invalid id, so there is nothing to
+	// remove
+	imageFilepath, err := fs.imageFilepath(imageID)
+	if err != nil {
 		return nil
 	}
 
@@ -199,6 +408,72 @@ func (fs *FS) Delete(imageID string) error {
 	return nil
 }
 
+// List retrieves the ids of all images in the filesystem
+func (fs *FS) List() ([]string, error) {
+	files, err := ioutil.ReadDir(fs.Config.Dir)
+	if err != nil {
+		log.WithFields(fsLogFields).WithFields(log.Fields{
+			"error": err,
+			"dir":   fs.Config.Dir,
+		}).Error("failed to read image dir")
+		return nil, err
+	}
+
+	imageIDs := make([]string, 0, len(files))
+	for _, file := range files {
+		// Skip any temporary files left behind by an interrupted Put
+		if file.Mode().IsRegular() && !strings.HasPrefix(file.Name(), fsTempPrefix) {
+			imageIDs = append(imageIDs, file.Name())
+		}
+	}
+	return imageIDs, nil
+}
+
+// ListTemp retrieves the names of temporary files left behind by interrupted
+// Puts, leaving out those of Puts still in progress
+func (fs *FS) ListTemp() ([]string, error) {
+	files, err := ioutil.ReadDir(fs.Config.Dir)
+	if err != nil {
+		log.WithFields(fsLogFields).WithFields(log.Fields{
+			"error": err,
+			"dir":   fs.Config.Dir,
+		}).Error("failed to read image dir")
+		return nil, err
+	}
+
+	fs.writingMu.Lock()
+	defer fs.writingMu.Unlock()
+
+	names := make([]string, 0)
+	for _, file := range files {
+		name := file.Name()
+		if !file.Mode().IsRegular() || !strings.HasPrefix(name, fsTempPrefix) {
+			continue
+		}
+		if _, ok := fs.writing[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// DeleteTemp removes a temporary file
+func (fs *FS) DeleteTemp(name string) error {
+	if !validID(name) || !strings.HasPrefix(name, fsTempPrefix) {
+		return ErrInvalidID
+	}
+
+	tempFilepath := filepath.Join(fs.Config.Dir, name)
+	if err := os.Remove(tempFilepath); err != nil && !os.IsNotExist(err) {
+		log.WithFields(fsLogFields).WithFields(log.Fields{
+			"error":        err,
+			"tempFilepath": tempFilepath,
+		}).Error("failed to remove temporary image file")
+		return err
+	}
+	return nil
+}
+
 func init() {
 	Register("fs", func() Store {
 		return &FS{}
@@ -1,18 +1,23 @@
 package images_test
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
+	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/mistifyio/mistify-image-service/images"
+	"github.com/mistifyio/mistify-image-service/images/storetest"
 	"github.com/pborman/uuid"
 	"github.com/stretchr/testify/suite"
 )
 
 type FSTestSuite struct {
-	StoreTestSuite
+	storetest.StoreSuite
 	FSConfig *images.FSConfig
 }
 
@@ -25,7 +30,7 @@ func (s *FSTestSuite) SetupTest() {
 	s.StoreConfig, _ = json.Marshal(s.FSConfig)
 
 	// General store test setup
-	s.StoreTestSuite.SetupTest()
+	s.StoreSuite.SetupTest()
 }
 
 func (s *FSTestSuite) TearDownTest() {
@@ -85,7 +90,7 @@ func (s *FSTestSuite) TestInit() {
 
 func (s *FSTestSuite) TestDelete() {
 	// General Store.Delete tests
-	s.StoreTestSuite.TestDelete()
+	s.StoreSuite.TestDelete()
 
 	// FS specific tests
 
@@ -94,3 +99,82 @@ func (s *FSTestSuite) TestDelete() {
 	_, err := os.Stat(s.FSConfig.Dir)
 	s.NoError(err, "should not delete base directory")
 }
+
+func (s *FSTestSuite) TestMove() {
+	// General Store.Move tests
+	s.StoreSuite.TestMove()
+
+	// FS specific tests
+	s.Error(s.Store.(images.Mover).Move(s.ImageID, ""), "should not move onto the base directory")
+	_, err := os.Stat(s.FSConfig.Dir)
+	s.NoError(err, "should not replace base directory")
+}
+
+func (s *FSTestSuite) TestPut() {
+	// General Store.Put tests
+	s.StoreSuite.TestPut()
+
+	// FS specific tests
+
+	// A failed write should leave the existing data alone
+	in := io.MultiReader(bytes.NewReader([]byte("partial")), &errReader{})
+	s.Error(s.Store.Put(s.ImageID, in))
+	out := &bytes.Buffer{}
+	s.NoError(s.Store.Get(s.ImageID, out))
+	s.Equal(s.ImageData, out.Bytes(), "failed put should not replace existing data")
+
+	s.Error(s.Store.Put("new", io.MultiReader(bytes.NewReader([]byte("partial")), &errReader{})))
+	_, err := s.Store.Stat("new")
+	s.True(os.IsNotExist(err), "failed put should not leave partial data")
+
+	files, _ := ioutil.ReadDir(s.FSConfig.Dir)
+	s.Len(files, 1, "temporary files should be removed")
+}
+
+func (s *FSTestSuite) TestList() {
+	// General Store.List tests
+	s.StoreSuite.TestList()
+
+	// FS specific tests
+	s.NoError(ioutil.WriteFile(filepath.Join(s.FSConfig.Dir, ".tmp-123"), s.ImageData, 0644))
+	s.NoError(os.Mkdir(filepath.Join(s.FSConfig.Dir, "subdir"), 0755))
+	imageIDs, err := s.Store.List()
+	s.NoError(err)
+	s.NotContains(imageIDs, ".tmp-123", "temporary files should not be listed")
+	s.NotContains(imageIDs, "subdir", "directories should not be listed")
+}
+
+func (s *FSTestSuite) TestTemp() {
+	s.NoError(ioutil.WriteFile(filepath.Join(s.FSConfig.Dir, ".tmp-123"), s.ImageData, 0644))
+	s.NoError(ioutil.WriteFile(filepath.Join(s.FSConfig.Dir, "notemp"), s.ImageData, 0644))
+
+	// Hold a Put open so its temporary file is in use
+	pr, pw := io.Pipe()
+	putErr := make(chan error)
+	go func() {
+		putErr <- s.Store.Put("foobar", pr)
+	}()
+	_, err := pw.Write(s.ImageData)
+	s.NoError(err)
+
+	cleaner := s.Store.(images.TempCleaner)
+	names, err := cleaner.ListTemp()
+	s.NoError(err)
+	s.Equal([]string{".tmp-123"}, names, "only unused temporary files should be listed")
+
+	s.NoError(pw.Close())
+	s.NoError(<-putErr)
+
+	s.Equal(images.ErrInvalidID, cleaner.DeleteTemp("notemp"), "only temporary files should be removed")
+	s.NoError(cleaner.DeleteTemp(".tmp-123"))
+	names, err = cleaner.ListTemp()
+	s.NoError(err)
+	s.Empty(names)
+}
+
+// errReader is an io.Reader that always fails
+type errReader struct{}
+
+func (er *errReader) Read(p []byte) (int, error) {
+	return 0, errors.New("read failed")
+}
@@ -0,0 +1,302 @@
+package images
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	logx "github.com/mistifyio/mistify-logrus-ext"
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrMissingURL is used when the required url is omitted from the config
+var ErrMissingURL = errors.New("missing url")
+
+// ErrReadOnly is used when modifying a store that can only be read
+var ErrReadOnly = errors.New("store is read only")
+
+// ErrUnexpectedStatus is used when a remote service responds with an
+// unexpected status
+var ErrUnexpectedStatus = errors.New("unexpected response status")
+
+type (
+	// HTTP is a read only image store backed by the blobs of another image
+	// service, typically used as the backing store of a Cache
+	HTTP struct {
+		Config *HTTPConfig
+		client *http.Client
+	}
+
+	// HTTPConfig contains necessary config options to set up the http store
+	HTTPConfig struct {
+		// URL is the base url of the image service
+		URL string
+		// Token is an api token secret sent with each request, for services
+		// that require auth
+		Token string
+	}
+
+	// httpFileInfo is the os.FileInfo for a remote blob
+	httpFileInfo struct {
+		name    string
+		size    int64
+		modTime time.Time
+	}
+)
+
+// httpLogFields contain fields to include on all logs
+var httpLogFields = log.Fields{
+	"type":  "images",
+	"store": "http",
+}
+
+// Validate checks whether the config is valid
+func (hc *HTTPConfig) Validate() error {
+	if hc.URL == "" {
+		return ErrMissingURL
+	}
+	if _, err := url.Parse(hc.URL); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Init parses the config and creates the client
+func (store *HTTP) Init(configBytes []byte) error {
+	config := &HTTPConfig{}
+
+	// Parse the config json
+	if err := json.Unmarshal(configBytes, config); err != nil {
+		log.WithFields(httpLogFields).WithFields(log.Fields{
+			"error": err,
+			"json":  string(configBytes),
+		}).Error("failed to unmarshal config json")
+		return err
+	}
+
+	if err := config.Validate(); err != nil {
+		log.WithFields(httpLogFields).WithFields(log.Fields{
+			"error": err,
+		}).Error("failed config validation")
+		return err
+	}
+
+	store.Config = config
+	store.client = &http.Client{
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+		},
+	}
+	// Log the config without the token
+	logConfig := *config
+	logConfig.Token = ""
+	log.WithFields(httpLogFields).WithFields(log.Fields{
+		"config": logConfig,
+	}).Info("config loaded")
+	return nil
+}
+
+// Shutdown closes idle connections
+func (store *HTTP) Shutdown() error {
+	if transport, ok := store.client.Transport.(*http.Transport); ok {
+		transport.CloseIdleConnections()
+	}
+	return nil
+}
+
+// blobURL generates the url of a blob from the image id
+func (store *HTTP) blobURL(imageID string) string {
+	return strings.TrimSuffix(store.Config.URL, "/") + "/blobs/" + url.PathEscape(imageID)
+}
+
+// do sends a request for a blob, returning an error satisfying os.IsNotExist
+// if the blob is missing or ErrUnexpectedStatus for other unexpected
+// responses. The response body must be closed by the caller on success.
+func (store *HTTP) do(req *http.Request, op string, okCodes ...int) (*http.Response, error) {
+	if store.Config.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+store.Config.Token)
+	}
+	resp, err := store.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, code := range okCodes {
+		if resp.StatusCode == code {
+			return resp, nil
+		}
+	}
+	logx.LogReturnedErr(resp.Body.Close, nil, "failed to close response body")
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, &os.PathError{Op: op, Path: req.URL.String(), Err: os.ErrNotExist}
+	}
+	return nil, ErrUnexpectedStatus
+}
+
+// Stat retrieves information about a remote blob. A missing blob results in an
+// error satisfying os.IsNotExist.
+func (store *HTTP) Stat(imageID string) (os.FileInfo, error) {
+	if !validID(imageID) {
+		return nil, ErrInvalidID
+	}
+
+	req, err := http.NewRequest("HEAD", store.blobURL(imageID), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := store.do(req, "stat", http.StatusOK)
+	if err != nil {
+		log.WithFields(httpLogFields).WithFields(log.Fields{
+			"error":   err,
+			"imageID": imageID,
+		}).Error("failed to stat image")
+		return nil, err
+	}
+	logx.LogReturnedErr(resp.Body.Close, nil, "failed to close response body")
+
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return &httpFileInfo{
+		name:    imageID,
+		size:    resp.ContentLength,
+		modTime: modTime,
+	}, nil
+}
+
+// Get retrieves a remote blob
+func (store *HTTP) Get(imageID string, out io.Writer) error {
+	return store.GetRange(imageID, out, 0, -1)
+}
+
+// GetRange retrieves part of a remote blob
+func (store *HTTP) GetRange(imageID string, out io.Writer, offset, length int64) error {
+	if !validID(imageID) {
+		return ErrInvalidID
+	}
+	if length == 0 {
+		return nil
+	}
+
+	req, err := http.NewRequest("GET", store.blobURL(imageID), nil)
+	if err != nil {
+		return err
+	}
+	okCode := http.StatusOK
+	if length > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+		okCode = http.StatusPartialContent
+	} else if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		okCode = http.StatusPartialContent
+	}
+
+	resp, err := store.do(req, "get", okCode)
+	if err != nil {
+		log.WithFields(httpLogFields).WithFields(log.Fields{
+			"error":   err,
+			"imageID": imageID,
+			"offset":  offset,
+			"length":  length,
+		}).Error("failed to get image")
+		return err
+	}
+	defer logx.LogReturnedErr(resp.Body.Close, log.Fields{
+		"imageID": imageID,
+	}, "failed to close response body")
+
+	copied, err := io.Copy(out, resp.Body)
+	if err == nil && length > 0 && copied < length {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		log.WithFields(httpLogFields).WithFields(log.Fields{
+			"error":   err,
+			"imageID": imageID,
+			"offset":  offset,
+			"length":  length,
+		}).Error("failed to copy image data to output stream")
+		return err
+	}
+	return nil
+}
+
+// Put is not supported, since the store is read only
+func (store *HTTP) Put(imageID string, in io.Reader) error {
+	return ErrReadOnly
+}
+
+// Append is not supported, since the store is read only
+func (store *HTTP) Append(imageID string, in io.Reader) error {
+	return ErrReadOnly
+}
+
+// Delete is not supported, since the store is read only
+func (store *HTTP) Delete(imageID string) error {
+	return ErrReadOnly
+}
+
+// List retrieves the ids of all remote blobs
+func (store *HTTP) List() ([]string, error) {
+	req, err := http.NewRequest("GET", strings.TrimSuffix(store.Config.URL, "/")+"/blobs", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := store.do(req, "list", http.StatusOK)
+	if err != nil {
+		log.WithFields(httpLogFields).WithFields(log.Fields{
+			"error": err,
+		}).Error("failed to list images")
+		return nil, err
+	}
+	defer logx.LogReturnedErr(resp.Body.Close, nil, "failed to close response body")
+
+	var imageIDs []string
+	if err := json.NewDecoder(resp.Body).Decode(&imageIDs); err != nil {
+		log.WithFields(httpLogFields).WithFields(log.Fields{
+			"error": err,
+		}).Error("failed to decode image list")
+		return nil, err
+	}
+	return imageIDs, nil
+}
+
+// Name returns the image id
+func (fi *httpFileInfo) Name() string {
+	return fi.name
+}
+
+// Size returns the size of the blob
+func (fi *httpFileInfo) Size() int64 {
+	return fi.size
+}
+
+// Mode returns the mode used for image files
+func (fi *httpFileInfo) Mode() os.FileMode {
+	return 0755
+}
+
+// ModTime returns the time the blob was last modified
+func (fi *httpFileInfo) ModTime() time.Time {
+	return fi.modTime
+}
+
+// IsDir is always false, since a blob isn't a directory
+func (fi *httpFileInfo) IsDir() bool {
+	return false
+}
+
+// Sys returns nil, since there is no underlying data source
+func (fi *httpFileInfo) Sys() interface{} {
+	return nil
+}
+
+func init() {
+	Register("http", func() Store {
+		return &HTTP{}
+	})
+}
@@ -0,0 +1,208 @@
+package images_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mistifyio/mistify-image-service/images"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/suite"
+)
+
+type HTTPTestSuite struct {
+	suite.Suite
+	Server     *httptest.Server
+	Remote     images.Store
+	HTTPConfig *images.HTTPConfig
+	Store      images.Store
+	ImageID    string
+	ImageData  []byte
+	// Token is required by the remote when set
+	Token string
+}
+
+func (s *HTTPTestSuite) SetupSuite() {
+	log.SetLevel(log.FatalLevel)
+	s.ImageID = "foobar"
+	s.ImageData = []byte("testdatatestdatatestdata")
+}
+
+func (s *HTTPTestSuite) SetupTest() {
+	s.Token = ""
+	// The remote image service is stood in for by its blob routes over a
+	// memory store
+	s.Remote = images.NewStore("memory")
+	s.Require().NoError(s.Remote.Init([]byte("{}")))
+	s.Require().NoError(s.Remote.Put(s.ImageID, bytes.NewReader(s.ImageData)))
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveBlobs))
+
+	s.HTTPConfig = &images.HTTPConfig{
+		URL: s.Server.URL,
+	}
+	config, _ := json.Marshal(s.HTTPConfig)
+	s.Store = images.NewStore("http")
+	s.Require().NoError(s.Store.Init(config))
+}
+
+func (s *HTTPTestSuite) TearDownTest() {
+	s.NoError(s.Store.Shutdown())
+	s.Server.Close()
+}
+
+func TestHTTPTestSuite(t *testing.T) {
+	suite.Run(t, new(HTTPTestSuite))
+}
+
+func (s *HTTPTestSuite) TestConfigValidate() {
+	tests := []struct {
+		description string
+		config      *images.HTTPConfig
+		expectedErr error
+	}{
+		{"empty config should be invalid",
+			&images.HTTPConfig{}, images.ErrMissingURL},
+		{"config to use for tests should be valid",
+			s.HTTPConfig, nil},
+	}
+
+	for _, test := range tests {
+		s.Equal(test.expectedErr, test.config.Validate(), test.description)
+	}
+}
+
+func (s *HTTPTestSuite) TestInit() {
+	tests := []struct {
+		description string
+		configJSON  string
+		expectedErr bool
+	}{
+		{"bad json should fail",
+			"not actually json", true},
+		{"invalid config should fail",
+			`{}`, true},
+		{"bad url should fail",
+			`{"url":"http://%zz"}`, true},
+		{"config to use for tests should succeed",
+			`{"url":"` + s.Server.URL + `"}`, false},
+	}
+
+	for _, test := range tests {
+		store := images.NewStore("http")
+		config := []byte(test.configJSON)
+		err := store.Init(config)
+		if test.expectedErr {
+			s.Error(err, test.description)
+		} else {
+			s.NoError(err, test.description)
+		}
+	}
+}
+
+func (s *HTTPTestSuite) TestStat() {
+	stat, err := s.Store.Stat(s.ImageID)
+	s.NoError(err)
+	s.Equal(s.ImageID, stat.Name())
+	s.EqualValues(len(s.ImageData), stat.Size())
+
+	_, err = s.Store.Stat("asdf")
+	s.True(os.IsNotExist(err), "stat of a missing image should not exist")
+	_, err = s.Store.Stat("../" + s.ImageID)
+	s.Equal(images.ErrInvalidID, err)
+}
+
+func (s *HTTPTestSuite) TestGet() {
+	out := &bytes.Buffer{}
+	s.NoError(s.Store.Get(s.ImageID, out))
+	s.Equal(s.ImageData, out.Bytes())
+
+	s.True(os.IsNotExist(s.Store.Get("asdf", &bytes.Buffer{})), "get of a missing image should not exist")
+}
+
+func (s *HTTPTestSuite) TestGetRange() {
+	tests := []struct {
+		description string
+		offset      int64
+		length      int64
+		expected    []byte
+		expectedErr bool
+	}{
+		{"range should be retrieved", 4, 8, s.ImageData[4:12], false},
+		{"negative length should read to the end", 4, -1, s.ImageData[4:], false},
+		{"zero length should read nothing", 4, 0, []byte{}, false},
+		{"range past the end should fail", 20, 10, s.ImageData[20:], true},
+	}
+
+	for _, test := range tests {
+		out := &bytes.Buffer{}
+		err := s.Store.GetRange(s.ImageID, out, test.offset, test.length)
+		if test.expectedErr {
+			s.Error(err, test.description)
+		} else {
+			s.NoError(err, test.description)
+		}
+		s.Equal(string(test.expected), out.String(), test.description)
+	}
+}
+
+func (s *HTTPTestSuite) TestList() {
+	imageIDs, err := s.Store.List()
+	s.NoError(err)
+	s.Equal([]string{s.ImageID}, imageIDs)
+}
+
+func (s *HTTPTestSuite) TestReadOnly() {
+	s.Equal(images.ErrReadOnly, s.Store.Put("new", bytes.NewReader(s.ImageData)))
+	s.Equal(images.ErrReadOnly, s.Store.Append(s.ImageID, bytes.NewReader(s.ImageData)))
+	s.Equal(images.ErrReadOnly, s.Store.Delete(s.ImageID))
+	s.Error(images.Move(s.Store, s.ImageID, "new"))
+
+	_, err := s.Remote.Stat(s.ImageID)
+	s.NoError(err, "remote image should be untouched")
+}
+
+func (s *HTTPTestSuite) TestToken() {
+	s.Token = "foo.bar"
+	_, err := s.Store.Stat(s.ImageID)
+	s.Equal(images.ErrUnexpectedStatus, err, "request without the token should fail")
+
+	config, _ := json.Marshal(&images.HTTPConfig{URL: s.Server.URL, Token: s.Token})
+	store := images.NewStore("http")
+	s.Require().NoError(store.Init(config))
+	defer func() { _ = store.Shutdown() }()
+
+	_, err = store.Stat(s.ImageID)
+	s.NoError(err, "request with the token should succeed")
+	out := &bytes.Buffer{}
+	s.NoError(store.Get(s.ImageID, out))
+	s.Equal(s.ImageData, out.Bytes())
+}
+
+// serveBlobs serves the remote memory store the way the image service blob
+// routes do
+func (s *HTTPTestSuite) serveBlobs(w http.ResponseWriter, r *http.Request) {
+	if s.Token != "" && r.Header.Get("Authorization") != "Bearer "+s.Token {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if r.URL.Path == "/blobs" {
+		imageIDs, _ := s.Remote.List()
+		_ = json.NewEncoder(w).Encode(imageIDs)
+		return
+	}
+
+	imageID := strings.TrimPrefix(r.URL.Path, "/blobs/")
+	stat, err := s.Remote.Stat(imageID)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	content := images.NewRangeReader(s.Remote, imageID, stat.Size())
+	defer func() { _ = content.Close() }()
+	http.ServeContent(w, r, "", time.Time{}, content)
+}
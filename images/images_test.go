@@ -3,9 +3,9 @@ package images_test
 import (
 	"testing"
 
-	log "github.com/Sirupsen/logrus"
 	"github.com/mistifyio/mistify-image-service/images"
 	"github.com/mistifyio/mistify-image-service/images/mocks"
+	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/suite"
 )
 
@@ -0,0 +1,322 @@
+package images
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrStoreFull is used when storing image data would exceed the store's size
+// limit
+var ErrStoreFull = errors.New("store is full")
+
+// ErrInvalidMaxSize is used when the store config has a negative size limit
+var ErrInvalidMaxSize = errors.New("invalid max size")
+
+type (
+	// Memory is an image store holding image data in memory. It is meant for
+	// tests and ephemeral nodes; nothing survives a restart.
+	Memory struct {
+		Config *MemoryConfig
+		lock   sync.RWMutex
+		blobs  map[string]*memoryBlob
+		size   int64
+	}
+
+	// MemoryConfig contains config options for the memory store
+	MemoryConfig struct {
+		// MaxSize is the maximum total size of image data in bytes. Zero
+		// means no limit.
+		MaxSize int64
+	}
+
+	// memoryBlob is stored image data. The data is never modified once
+	// stored, so readers can use it without holding the lock.
+	memoryBlob struct {
+		data    []byte
+		modTime time.Time
+	}
+
+	// memoryFileInfo is file information for image data in memory
+	memoryFileInfo struct {
+		name string
+		blob *memoryBlob
+	}
+)
+
+// memoryLogFields contain fields to include on all logs
+var memoryLogFields = log.Fields{
+	"type":  "images",
+	"store": "memory",
+}
+
+// Validate checks whether the config is valid
+func (mc *MemoryConfig) Validate() error {
+	if mc.MaxSize < 0 {
+		return ErrInvalidMaxSize
+	}
+	return nil
+}
+
+// Init parses the config and sets up the store
+func (store *Memory) Init(configBytes []byte) error {
+	config := &MemoryConfig{}
+
+	// Parse the config json
+	if err := json.Unmarshal(configBytes, config); err != nil {
+		log.WithFields(memoryLogFields).WithFields(log.Fields{
+			"error": err,
+			"json":  string(configBytes),
+		}).Error("failed to unmarshal config json")
+		return err
+	}
+
+	if err := config.Validate(); err != nil {
+		log.WithFields(memoryLogFields).WithFields(log.Fields{
+			"error": err,
+		}).Error("failed config validation")
+		return err
+	}
+
+	store.Config = config
+	store.blobs = make(map[string]*memoryBlob)
+	return nil
+}
+
+// Shutdown does nothing, since there is no connection to close
+func (store *Memory) Shutdown() error {
+	return nil
+}
+
+// Stat retrieves information about an image. A missing image results in an
+// error satisfying os.IsNotExist.
+func (store *Memory) Stat(imageID string) (os.FileInfo, error) {
+	blob, err := store.blob("stat", imageID)
+	if err != nil {
+		return nil, err
+	}
+	return &memoryFileInfo{name: imageID, blob: blob}, nil
+}
+
+// Get retrieves an image from memory
+func (store *Memory) Get(imageID string, out io.Writer) error {
+	return store.GetRange(imageID, out, 0, -1)
+}
+
+// GetRange retrieves part of an image from memory
+func (store *Memory) GetRange(imageID string, out io.Writer, offset, length int64) error {
+	blob, err := store.blob("get", imageID)
+	if err != nil {
+		return err
+	}
+
+	size := int64(len(blob.data))
+	if offset > size {
+		offset = size
+	}
+	end := size
+	if length >= 0 && offset+length < size {
+		end = offset + length
+	}
+
+	if _, err := out.Write(blob.data[offset:end]); err != nil {
+		log.WithFields(memoryLogFields).WithFields(log.Fields{
+			"error":   err,
+			"imageID": imageID,
+		}).Error("failed to copy image data to output stream")
+		return err
+	}
+	if length >= 0 && end-offset < length {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+
+// Put stores an image in memory. The data only replaces any existing data
+// once it has been read completely.
+func (store *Memory) Put(imageID string, in io.Reader) error {
+	if imageID == "" {
+		return ErrInvalidID
+	}
+
+	data, err := store.read(in)
+	if err != nil {
+		log.WithFields(memoryLogFields).WithFields(log.Fields{
+			"error":   err,
+			"imageID": imageID,
+		}).Error("failed to read image data")
+		return err
+	}
+
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	return store.set(imageID, data)
+}
+
+// Append adds data to the end of an image in memory. As with the filesystem
+// store, the data read before a failure is kept so a transfer can be resumed.
+func (store *Memory) Append(imageID string, in io.Reader) error {
+	if imageID == "" {
+		return ErrInvalidID
+	}
+
+	data, readErr := store.read(in)
+
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if existing, ok := store.blobs[imageID]; ok {
+		data = append(append(make([]byte, 0, len(existing.data)+len(data)), existing.data...), data...)
+	}
+	if err := store.set(imageID, data); err != nil {
+		return err
+	}
+
+	if readErr != nil {
+		log.WithFields(memoryLogFields).WithFields(log.Fields{
+			"error":   readErr,
+			"imageID": imageID,
+		}).Error("failed to read image data")
+	}
+	return readErr
+}
+
+// Move renames an image in memory
+func (store *Memory) Move(fromID, toID string) error {
+	if fromID == "" || toID == "" {
+		return ErrInvalidID
+	}
+
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	blob, ok := store.blobs[fromID]
+	if !ok {
+		return &os.PathError{Op: "rename", Path: fromID, Err: os.ErrNotExist}
+	}
+	if existing, ok := store.blobs[toID]; ok && fromID != toID {
+		store.size -= int64(len(existing.data))
+	}
+	delete(store.blobs, fromID)
+	store.blobs[toID] = blob
+	return nil
+}
+
+// Delete removes an image from memory
+func (store *Memory) Delete(imageID string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	if blob, ok := store.blobs[imageID]; ok {
+		store.size -= int64(len(blob.data))
+		delete(store.blobs, imageID)
+	}
+	return nil
+}
+
+// List retrieves the ids of all images in memory
+func (store *Memory) List() ([]string, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	imageIDs := make([]string, 0, len(store.blobs))
+	for imageID := range store.blobs {
+		imageIDs = append(imageIDs, imageID)
+	}
+	sort.Strings(imageIDs)
+	return imageIDs, nil
+}
+
+// blob retrieves the stored data for an image
+func (store *Memory) blob(op, imageID string) (*memoryBlob, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	blob, ok := store.blobs[imageID]
+	if !ok {
+		return nil, &os.PathError{Op: op, Path: imageID, Err: os.ErrNotExist}
+	}
+	return blob, nil
+}
+
+// read reads image data, stopping early once it can't fit in the store
+func (store *Memory) read(in io.Reader) ([]byte, error) {
+	if store.Config.MaxSize == 0 {
+		return ioutil.ReadAll(in)
+	}
+
+	buf := &bytes.Buffer{}
+	_, err := io.Copy(buf, io.LimitReader(in, store.Config.MaxSize+1))
+	if err == nil && int64(buf.Len()) > store.Config.MaxSize {
+		err = ErrStoreFull
+	}
+	return buf.Bytes(), err
+}
+
+// set replaces the data for an image if it fits within the size limit. The
+// lock must be held.
+func (store *Memory) set(imageID string, data []byte) error {
+	size := store.size + int64(len(data))
+	if existing, ok := store.blobs[imageID]; ok {
+		size -= int64(len(existing.data))
+	}
+	if store.Config.MaxSize > 0 && size > store.Config.MaxSize {
+		log.WithFields(memoryLogFields).WithFields(log.Fields{
+			"error":   ErrStoreFull,
+			"imageID": imageID,
+			"size":    len(data),
+			"maxSize": store.Config.MaxSize,
+		}).Error("image data exceeds store size limit")
+		return ErrStoreFull
+	}
+
+	store.blobs[imageID] = &memoryBlob{
+		data:    data,
+		modTime: time.Now(),
+	}
+	store.size = size
+	return nil
+}
+
+// Name returns the image id
+func (fi *memoryFileInfo) Name() string {
+	return fi.name
+}
+
+// Size returns the size of the image data
+func (fi *memoryFileInfo) Size() int64 {
+	return int64(len(fi.blob.data))
+}
+
+// Mode returns the mode used for image files
+func (fi *memoryFileInfo) Mode() os.FileMode {
+	return 0755
+}
+
+// ModTime returns the time the image data was last modified
+func (fi *memoryFileInfo) ModTime() time.Time {
+	return fi.blob.modTime
+}
+
+// IsDir is always false, since image data isn't a directory
+func (fi *memoryFileInfo) IsDir() bool {
+	return false
+}
+
+// Sys returns nil, since there is no underlying data source
+func (fi *memoryFileInfo) Sys() interface{} {
+	return nil
+}
+
+func init() {
+	Register("memory", func() Store {
+		return &Memory{}
+	})
+}
@@ -0,0 +1,99 @@
+package images_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/mistifyio/mistify-image-service/images"
+	"github.com/mistifyio/mistify-image-service/images/storetest"
+	"github.com/stretchr/testify/suite"
+)
+
+type MemoryTestSuite struct {
+	storetest.StoreSuite
+	MemoryConfig *images.MemoryConfig
+}
+
+func (s *MemoryTestSuite) SetupTest() {
+	// Memory specific test setup. Limits are tested separately, so the
+	// general tests have none.
+	s.MemoryConfig = &images.MemoryConfig{}
+	s.StoreConfig, _ = json.Marshal(s.MemoryConfig)
+
+	// General store test setup
+	s.StoreSuite.SetupTest()
+}
+
+func TestMemoryTestSuite(t *testing.T) {
+	s := new(MemoryTestSuite)
+	s.StoreName = "memory"
+	suite.Run(t, s)
+}
+
+func (s *MemoryTestSuite) TestConfigValidate() {
+	tests := []struct {
+		description string
+		config      *images.MemoryConfig
+		expectedErr error
+	}{
+		{"empty config should be valid",
+			&images.MemoryConfig{}, nil},
+		{"negative max size should be invalid",
+			&images.MemoryConfig{MaxSize: -1}, images.ErrInvalidMaxSize},
+		{"config to use for tests should be valid",
+			s.MemoryConfig, nil},
+	}
+
+	for _, test := range tests {
+		s.Equal(test.expectedErr, test.config.Validate(), test.description)
+	}
+}
+
+func (s *MemoryTestSuite) TestInit() {
+	tests := []struct {
+		description string
+		configJSON  string
+		expectedErr bool
+	}{
+		{"bad json should fail",
+			"not actually json", true},
+		{"invalid config should fail",
+			`{"maxSize":-1}`, true},
+		{"empty config should succeed",
+			`{}`, false},
+		{"config to use for tests should succeed",
+			string(s.StoreConfig), false},
+	}
+
+	for _, test := range tests {
+		store := images.NewStore("memory")
+		config := []byte(test.configJSON)
+		err := store.Init(config)
+		if test.expectedErr {
+			s.Error(err, test.description)
+		} else {
+			s.NoError(err, test.description)
+		}
+	}
+}
+
+func (s *MemoryTestSuite) TestMaxSize() {
+	store := images.NewStore("memory")
+	config, _ := json.Marshal(&images.MemoryConfig{MaxSize: int64(len(s.ImageData) * 4)})
+	s.Require().NoError(store.Init(config))
+
+	for i := 0; i < 4; i++ {
+		s.NoError(store.Put(fmt.Sprintf("image%d", i), bytes.NewReader(s.ImageData)), "images within the limit should be stored")
+	}
+	s.Equal(images.ErrStoreFull, store.Put("full", bytes.NewReader(s.ImageData)), "image over the limit should fail")
+	s.Equal(images.ErrStoreFull, store.Append("image0", bytes.NewReader(s.ImageData)), "append over the limit should fail")
+	s.NoError(store.Put("image0", bytes.NewReader(s.ImageData)), "replacing data should only count the new data")
+
+	s.NoError(store.Delete("image0"))
+	s.NoError(store.Put("full", bytes.NewReader(s.ImageData)), "deleted data should free space")
+
+	bigData := bytes.Repeat(s.ImageData, 5)
+	s.Equal(images.ErrStoreFull, store.Put("big", bytes.NewReader(bigData)), "image larger than the store should fail")
+}
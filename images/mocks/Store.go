@@ -73,6 +73,20 @@ func (_m *Store) Get(_a0 string, _a1 io.Writer) error {
 	return r0
 }
 
+// GetRange mocked by mockery
+func (_m *Store) GetRange(_a0 string, _a1 io.Writer, _a2 int64, _a3 int64) error {
+	ret := _m.Called(_a0, _a1, _a2, _a3)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(string, io.Writer, int64, int64) error); ok {
+		r0 = rf(_a0, _a1, _a2, _a3)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
 // Put mocked by mockery
 func (_m *Store) Put(_a0 string, _a1 io.Reader) error {
 	ret := _m.Called(_a0, _a1)
@@ -87,6 +101,20 @@ func (_m *Store) Put(_a0 string, _a1 io.Reader) error {
 	return r0
 }
 
+// Append mocked by mockery
+func (_m *Store) Append(_a0 string, _a1 io.Reader) error {
+	ret := _m.Called(_a0, _a1)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(string, io.Reader) error); ok {
+		r0 = rf(_a0, _a1)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
 // Delete mocked by mockery
 func (_m *Store) Delete(_a0 string) error {
 	ret := _m.Called(_a0)
@@ -100,3 +128,26 @@ func (_m *Store) Delete(_a0 string) error {
 
 	return r0
 }
+
+// List mocked by mockery
+func (_m *Store) List() ([]string, error) {
+	ret := _m.Called()
+
+	var r0 []string
+	if rf, ok := ret.Get(0).(func() []string); ok {
+		r0 = rf()
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]string)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func() error); ok {
+		r1 = rf()
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
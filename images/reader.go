@@ -0,0 +1,84 @@
+package images
+
+import (
+	"errors"
+	"io"
+)
+
+// ErrInvalidSeek is used when a seek would move before the start of an image
+var ErrInvalidSeek = errors.New("invalid seek")
+
+type (
+	// RangeReader is an io.ReadSeeker over image data in a Store. Each run of
+	// sequential reads is streamed from a single Store.GetRange call, so
+	// seeking does not require reading the image from the beginning.
+	RangeReader struct {
+		store   Store
+		imageID string
+		size    int64
+		offset  int64
+		stream  *io.PipeReader
+	}
+)
+
+// NewRangeReader creates a new RangeReader for an image of a known size
+func NewRangeReader(store Store, imageID string, size int64) *RangeReader {
+	return &RangeReader{
+		store:   store,
+		imageID: imageID,
+		size:    size,
+	}
+}
+
+// Read reads image data from the current offset
+func (rr *RangeReader) Read(p []byte) (int, error) {
+	if rr.offset >= rr.size {
+		return 0, io.EOF
+	}
+
+	if rr.stream == nil {
+		pr, pw := io.Pipe()
+		offset, length := rr.offset, rr.size-rr.offset
+		go func() {
+			_ = pw.CloseWithError(rr.store.GetRange(rr.imageID, pw, offset, length))
+		}()
+		rr.stream = pr
+	}
+
+	n, err := rr.stream.Read(p)
+	rr.offset += int64(n)
+	if err == io.EOF && rr.offset < rr.size {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// Seek sets the offset for the next Read
+func (rr *RangeReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += rr.offset
+	case io.SeekEnd:
+		offset += rr.size
+	}
+	if offset < 0 {
+		return rr.offset, ErrInvalidSeek
+	}
+
+	// A stream can only be reused for a read continuing where it left off
+	if offset != rr.offset {
+		_ = rr.Close()
+		rr.offset = offset
+	}
+	return rr.offset, nil
+}
+
+// Close stops any in-progress stream from the Store
+func (rr *RangeReader) Close() error {
+	if rr.stream == nil {
+		return nil
+	}
+	err := rr.stream.Close()
+	rr.stream = nil
+	return err
+}
@@ -0,0 +1,100 @@
+package images_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/mistifyio/mistify-image-service/images"
+	"github.com/pborman/uuid"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/suite"
+)
+
+type RangeReaderTestSuite struct {
+	suite.Suite
+	Dir       string
+	Store     images.Store
+	ImageID   string
+	ImageData []byte
+}
+
+func (s *RangeReaderTestSuite) SetupSuite() {
+	log.SetLevel(log.FatalLevel)
+	s.ImageID = "foobar"
+	s.ImageData = []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+}
+
+func (s *RangeReaderTestSuite) SetupTest() {
+	s.Dir, _ = ioutil.TempDir("", "rangeReaderTest-"+uuid.New())
+	config, _ := json.Marshal(&images.FSConfig{Dir: s.Dir})
+	s.Store = images.NewStore("fs")
+	s.Require().NoError(s.Store.Init(config))
+	s.Require().NoError(s.Store.Put(s.ImageID, bytes.NewReader(s.ImageData)))
+}
+
+func (s *RangeReaderTestSuite) TearDownTest() {
+	s.NoError(os.RemoveAll(s.Dir))
+}
+
+func TestRangeReaderTestSuite(t *testing.T) {
+	suite.Run(t, new(RangeReaderTestSuite))
+}
+
+func (s *RangeReaderTestSuite) TestRead() {
+	rr := images.NewRangeReader(s.Store, s.ImageID, int64(len(s.ImageData)))
+	defer func() { s.NoError(rr.Close()) }()
+
+	data, err := ioutil.ReadAll(rr)
+	s.NoError(err)
+	s.Equal(s.ImageData, data)
+
+	n, err := rr.Read(make([]byte, 1))
+	s.Equal(0, n, "reading at the end should return nothing")
+	s.Equal(io.EOF, err, "reading at the end should return EOF")
+}
+
+func (s *RangeReaderTestSuite) TestSeek() {
+	size := int64(len(s.ImageData))
+	rr := images.NewRangeReader(s.Store, s.ImageID, size)
+	defer func() { s.NoError(rr.Close()) }()
+
+	tests := []struct {
+		description    string
+		offset         int64
+		whence         int
+		expectedOffset int64
+		expectedErr    bool
+	}{
+		{"seek from start", 10, io.SeekStart, 10, false},
+		{"seek from current", 5, io.SeekCurrent, 19, false},
+		{"seek from end", -6, io.SeekEnd, size - 6, false},
+		{"seek before start", -1, io.SeekStart, 0, true},
+	}
+
+	for _, test := range tests {
+		offset, err := rr.Seek(test.offset, test.whence)
+		if test.expectedErr {
+			s.Error(err, test.description)
+			continue
+		}
+		s.NoError(err, test.description)
+		s.Equal(test.expectedOffset, offset, test.description)
+
+		buf := make([]byte, 4)
+		_, err = io.ReadFull(rr, buf)
+		s.NoError(err, test.description)
+		s.Equal(s.ImageData[offset:offset+4], buf, test.description)
+	}
+}
+
+func (s *RangeReaderTestSuite) TestReadMissing() {
+	rr := images.NewRangeReader(s.Store, "asdf", 10)
+	defer func() { s.NoError(rr.Close()) }()
+
+	_, err := ioutil.ReadAll(rr)
+	s.Error(err, "reading a missing image should fail")
+}
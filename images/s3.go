@@ -0,0 +1,438 @@
+package images
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	logx "github.com/mistifyio/mistify-logrus-ext"
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrMissingBucket is used when the required bucket is omitted from the config
+var ErrMissingBucket = errors.New("missing bucket")
+
+// ErrMissingSecretAccessKey is used when an access key id is configured without
+// its secret
+var ErrMissingSecretAccessKey = errors.New("missing secret access key")
+
+// s3MaxCopySize is the largest object that can be copied in a single request
+const s3MaxCopySize = 5 << 30
+
+type (
+	// S3 is an image store using an S3-compatible object store
+	S3 struct {
+		Config   *S3Config
+		client   *s3.S3
+		uploader *s3manager.Uploader
+	}
+
+	// S3Config contains necessary config options to set up the s3 store. The
+	// endpoint defaults to AWS, and credentials default to the usual AWS
+	// environment variables, shared credentials file, or instance role.
+	S3Config struct {
+		Endpoint        string
+		Region          string
+		Bucket          string
+		Prefix          string
+		AccessKeyID     string
+		SecretAccessKey string
+		// PathStyle addresses the bucket in the request path rather than the
+		// host name, which many S3-compatible servers require
+		PathStyle bool
+	}
+
+	// s3FileInfo is the os.FileInfo for an object
+	s3FileInfo struct {
+		name    string
+		size    int64
+		modTime time.Time
+	}
+)
+
+// s3LogFields contain fields to include on all logs
+var s3LogFields = log.Fields{
+	"type":  "images",
+	"store": "s3",
+}
+
+// Validate checks whether the config is valid
+func (s3c *S3Config) Validate() error {
+	if s3c.Bucket == "" {
+		return ErrMissingBucket
+	}
+	if s3c.AccessKeyID != "" && s3c.SecretAccessKey == "" {
+		return ErrMissingSecretAccessKey
+	}
+	return nil
+}
+
+// Init parses the config, creates the client, and ensures the bucket is
+// accessible
+func (store *S3) Init(configBytes []byte) error {
+	config := &S3Config{}
+
+	// Parse the config json
+	if err := json.Unmarshal(configBytes, config); err != nil {
+		log.WithFields(s3LogFields).WithFields(log.Fields{
+			"error": err,
+			"json":  string(configBytes),
+		}).Error("failed to unmarshal config json")
+		return err
+	}
+
+	if err := config.Validate(); err != nil {
+		log.WithFields(s3LogFields).WithFields(log.Fields{
+			"error": err,
+		}).Error("failed config validation")
+		return err
+	}
+
+	awsConfig := aws.NewConfig().
+		WithRegion("us-east-1").
+		WithS3ForcePathStyle(config.PathStyle)
+	if config.Region != "" {
+		awsConfig.WithRegion(config.Region)
+	}
+	if config.Endpoint != "" {
+		awsConfig.WithEndpoint(config.Endpoint)
+	}
+	if config.AccessKeyID != "" {
+		awsConfig.WithCredentials(credentials.NewStaticCredentials(config.AccessKeyID, config.SecretAccessKey, ""))
+	}
+
+	sess, err := session.NewSession(awsConfig)
+	if err != nil {
+		log.WithFields(s3LogFields).WithFields(log.Fields{
+			"error": err,
+		}).Error("failed to create session")
+		return err
+	}
+
+	store.Config = config
+	store.client = s3.New(sess)
+	store.uploader = s3manager.NewUploaderWithClient(store.client)
+
+	// Log the config without the secret
+	logConfig := *config
+	logConfig.SecretAccessKey = ""
+	log.WithFields(s3LogFields).WithFields(log.Fields{
+		"config": logConfig,
+	}).Info("config loaded")
+
+	if _, err := store.client.HeadBucket(&s3.HeadBucketInput{
+		Bucket: aws.String(config.Bucket),
+	}); err != nil {
+		log.WithFields(s3LogFields).WithFields(log.Fields{
+			"error":  err,
+			"bucket": config.Bucket,
+		}).Error("failed to access bucket")
+		return err
+	}
+
+	return nil
+}
+
+// Shutdown is a noop
+func (store *S3) Shutdown() error {
+	return nil
+}
+
+// key generates the object key from the image id
+func (store *S3) key(imageID string) string {
+	return store.Config.Prefix + imageID
+}
+
+// Stat retrieves object information about an image. A missing image results in
+// an error satisfying os.IsNotExist.
+func (store *S3) Stat(imageID string) (os.FileInfo, error) {
+	if !validID(imageID) {
+		return nil, ErrInvalidID
+	}
+
+	key := store.key(imageID)
+	head, err := store.client.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(store.Config.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		err = s3Error("stat", key, err)
+		log.WithFields(s3LogFields).WithFields(log.Fields{
+			"error":   err,
+			"imageID": imageID,
+			"key":     key,
+		}).Error("failed to stat image")
+		return nil, err
+	}
+
+	return &s3FileInfo{
+		name:    imageID,
+		size:    aws.Int64Value(head.ContentLength),
+		modTime: aws.TimeValue(head.LastModified),
+	}, nil
+}
+
+// Get retrieves an image from the object store
+func (store *S3) Get(imageID string, out io.Writer) error {
+	return store.GetRange(imageID, out, 0, -1)
+}
+
+// GetRange retrieves part of an image from the object store
+func (store *S3) GetRange(imageID string, out io.Writer, offset, length int64) error {
+	if !validID(imageID) {
+		return ErrInvalidID
+	}
+	if length == 0 {
+		return nil
+	}
+
+	key := store.key(imageID)
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(store.Config.Bucket),
+		Key:    aws.String(key),
+	}
+	if length > 0 {
+		input.Range = aws.String(fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	} else if offset > 0 {
+		input.Range = aws.String(fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	obj, err := store.client.GetObject(input)
+	if err != nil {
+		err = s3Error("get", key, err)
+		log.WithFields(s3LogFields).WithFields(log.Fields{
+			"error":   err,
+			"imageID": imageID,
+			"key":     key,
+			"offset":  offset,
+			"length":  length,
+		}).Error("failed to get image")
+		return err
+	}
+	defer logx.LogReturnedErr(obj.Body.Close, log.Fields{
+		"imageID": imageID,
+		"key":     key,
+	}, "failed to close object body")
+
+	// A range past the end of the object is cut short rather than failing
+	copied, err := io.Copy(out, obj.Body)
+	if err == nil && length > 0 && copied < length {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		log.WithFields(s3LogFields).WithFields(log.Fields{
+			"error":   err,
+			"imageID": imageID,
+			"key":     key,
+			"offset":  offset,
+			"length":  length,
+		}).Error("failed to copy image data to output stream")
+		return err
+	}
+
+	return nil
+}
+
+// Put stores an image in the object store. The data is streamed as a multipart
+// upload, so it does not need to fit in memory or have a known size.
+func (store *S3) Put(imageID string, in io.Reader) error {
+	if !validID(imageID) {
+		return ErrInvalidID
+	}
+
+	key := store.key(imageID)
+	if _, err := store.uploader.Upload(&s3manager.UploadInput{
+		Bucket: aws.String(store.Config.Bucket),
+		Key:    aws.String(key),
+		Body:   in,
+	}); err != nil {
+		log.WithFields(s3LogFields).WithFields(log.Fields{
+			"error":   err,
+			"imageID": imageID,
+			"key":     key,
+		}).Error("failed to upload image")
+		return err
+	}
+	return nil
+}
+
+// Append adds data to the end of an image in the object store. Objects can't be
+// modified, so the existing data is streamed into a new upload ahead of the new
+// data.
+func (store *S3) Append(imageID string, in io.Reader) error {
+	if !validID(imageID) {
+		return ErrInvalidID
+	}
+
+	key := store.key(imageID)
+	if _, err := store.client.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(store.Config.Bucket),
+		Key:    aws.String(key),
+	}); err != nil {
+		if err = s3Error("stat", key, err); os.IsNotExist(err) {
+			return store.Put(imageID, in)
+		}
+		return err
+	}
+
+	// The existing object remains readable until the upload completes
+	pr, pw := io.Pipe()
+	go func() {
+		_ = pw.CloseWithError(store.Get(imageID, pw))
+	}()
+	err := store.Put(imageID, io.MultiReader(pr, in))
+	_ = pr.CloseWithError(err)
+	return err
+}
+
+// Move copies an image to a new key within the object store and removes the
+// original. Images too large for a single copy request are streamed instead.
+func (store *S3) Move(fromID, toID string) error {
+	if !validID(fromID) || !validID(toID) {
+		return ErrInvalidID
+	}
+
+	stat, err := store.Stat(fromID)
+	if err != nil {
+		return err
+	}
+	if stat.Size() > s3MaxCopySize {
+		pr, pw := io.Pipe()
+		go func() {
+			_ = pw.CloseWithError(store.Get(fromID, pw))
+		}()
+		if err := store.Put(toID, pr); err != nil {
+			_ = pr.CloseWithError(err)
+			return err
+		}
+		return store.Delete(fromID)
+	}
+
+	fromKey := store.key(fromID)
+	toKey := store.key(toID)
+	if _, err := store.client.CopyObject(&s3.CopyObjectInput{
+		Bucket:     aws.String(store.Config.Bucket),
+		Key:        aws.String(toKey),
+		CopySource: aws.String((&url.URL{Path: path.Join(store.Config.Bucket, fromKey)}).EscapedPath()),
+	}); err != nil {
+		err = s3Error("move", fromKey, err)
+		log.WithFields(s3LogFields).WithFields(log.Fields{
+			"error":       err,
+			"fromImageID": fromID,
+			"toImageID":   toID,
+			"fromKey":     fromKey,
+			"toKey":       toKey,
+		}).Error("failed to copy image")
+		return err
+	}
+	return store.Delete(fromID)
+}
+
+// Delete removes an image from the object store
+func (store *S3) Delete(imageID string) error {
+	// Don't touch the bare prefix or anything outside of it
+	if !validID(imageID) {
+		return nil
+	}
+
+	key := store.key(imageID)
+	if _, err := store.client.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(store.Config.Bucket),
+		Key:    aws.String(key),
+	}); err != nil {
+		if err = s3Error("delete", key, err); os.IsNotExist(err) {
+			return nil
+		}
+		log.WithFields(s3LogFields).WithFields(log.Fields{
+			"error":   err,
+			"imageID": imageID,
+			"key":     key,
+		}).Error("failed to remove image")
+		return err
+	}
+	return nil
+}
+
+// List retrieves the ids of all images under the prefix in the object store
+func (store *S3) List() ([]string, error) {
+	var imageIDs []string
+	err := store.client.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(store.Config.Bucket),
+		Prefix: aws.String(store.Config.Prefix),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, obj := range page.Contents {
+			imageID := strings.TrimPrefix(aws.StringValue(obj.Key), store.Config.Prefix)
+			if imageID != "" {
+				imageIDs = append(imageIDs, imageID)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		log.WithFields(s3LogFields).WithFields(log.Fields{
+			"error":  err,
+			"bucket": store.Config.Bucket,
+			"prefix": store.Config.Prefix,
+		}).Error("failed to list images")
+		return nil, err
+	}
+	return imageIDs, nil
+}
+
+// s3Error converts a missing object error to one satisfying os.IsNotExist,
+// matching the errors from the filesystem store
+func s3Error(op, key string, err error) error {
+	if reqErr, ok := err.(awserr.RequestFailure); ok && reqErr.StatusCode() == http.StatusNotFound {
+		return &os.PathError{Op: op, Path: key, Err: os.ErrNotExist}
+	}
+	return err
+}
+
+// Name returns the image id
+func (fi *s3FileInfo) Name() string {
+	return fi.name
+}
+
+// Size returns the object size
+func (fi *s3FileInfo) Size() int64 {
+	return fi.size
+}
+
+// Mode returns the mode used for image files
+func (fi *s3FileInfo) Mode() os.FileMode {
+	return 0755
+}
+
+// ModTime returns the time the object was last modified
+func (fi *s3FileInfo) ModTime() time.Time {
+	return fi.modTime
+}
+
+// IsDir is always false, since objects aren't directories
+func (fi *s3FileInfo) IsDir() bool {
+	return false
+}
+
+// Sys returns nil, since there is no underlying data source
+func (fi *s3FileInfo) Sys() interface{} {
+	return nil
+}
+
+func init() {
+	Register("s3", func() Store {
+		return &S3{}
+	})
+}
@@ -0,0 +1,126 @@
+package images_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/johannesboyne/gofakes3"
+	"github.com/johannesboyne/gofakes3/backend/s3mem"
+	"github.com/mistifyio/mistify-image-service/images"
+	"github.com/mistifyio/mistify-image-service/images/storetest"
+	"github.com/stretchr/testify/suite"
+)
+
+type S3TestSuite struct {
+	storetest.StoreSuite
+	S3Config *images.S3Config
+	Server   *httptest.Server
+}
+
+func (s *S3TestSuite) SetupTest() {
+	// S3 specific test setup, using an in-process fake S3 server
+	backend := s3mem.New()
+	s.Require().NoError(backend.CreateBucket("images"))
+	s.Server = httptest.NewServer(gofakes3.New(backend).Server())
+	s.S3Config = &images.S3Config{
+		Endpoint:        s.Server.URL,
+		Bucket:          "images",
+		Prefix:          "test/",
+		AccessKeyID:     "id",
+		SecretAccessKey: "secret",
+		PathStyle:       true,
+	}
+	s.StoreConfig, _ = json.Marshal(s.S3Config)
+
+	// General store test setup
+	s.StoreSuite.SetupTest()
+}
+
+func (s *S3TestSuite) TearDownTest() {
+	s.Server.Close()
+}
+
+func TestS3TestSuite(t *testing.T) {
+	s := new(S3TestSuite)
+	s.StoreName = "s3"
+	suite.Run(t, s)
+}
+
+func (s *S3TestSuite) TestConfigValidate() {
+	tests := []struct {
+		description string
+		config      *images.S3Config
+		expectedErr error
+	}{
+		{"empty config should be invalid",
+			&images.S3Config{}, images.ErrMissingBucket},
+		{"access key without secret should be invalid",
+			&images.S3Config{Bucket: "images", AccessKeyID: "id"}, images.ErrMissingSecretAccessKey},
+		{"bucket alone should be valid",
+			&images.S3Config{Bucket: "images"}, nil},
+		{"config to use for tests should be valid",
+			s.S3Config, nil},
+	}
+
+	for _, test := range tests {
+		s.Equal(test.expectedErr, test.config.Validate(), test.description)
+	}
+}
+
+func (s *S3TestSuite) TestInit() {
+	missingBucket := *s.S3Config
+	missingBucket.Bucket = "asdf"
+	missingBucketJSON, _ := json.Marshal(missingBucket)
+
+	tests := []struct {
+		description string
+		configJSON  string
+		expectedErr bool
+	}{
+		{"bad json should fail",
+			"not actually json", true},
+		{"invalid config should fail",
+			`{}`, true},
+		{"missing bucket should fail",
+			string(missingBucketJSON), true},
+		{"config to use for tests should succeed",
+			string(s.StoreConfig), false},
+	}
+
+	for _, test := range tests {
+		store := images.NewStore("s3")
+		config := []byte(test.configJSON)
+		err := store.Init(config)
+		if test.expectedErr {
+			s.Error(err, test.description)
+		} else {
+			s.NoError(err, test.description)
+		}
+	}
+}
+
+func (s *S3TestSuite) TestStat() {
+	// General Store.Stat tests
+	s.StoreSuite.TestStat()
+
+	// S3 specific tests
+	_, err := s.Store.Stat("asdf")
+	s.True(os.IsNotExist(err), "missing image error should match the fs store")
+}
+
+func (s *S3TestSuite) TestPutMultipart() {
+	// Larger than a single upload part
+	data := bytes.Repeat(s.ImageData, int(s3manager.MinUploadPartSize)/len(s.ImageData)+1)
+
+	s.NoError(s.Store.Put(s.ImageID, bytes.NewReader(data)))
+	s.NoError(s.Store.Append(s.ImageID, bytes.NewReader(s.ImageData)))
+
+	out := &bytes.Buffer{}
+	s.NoError(s.Store.Get(s.ImageID, out))
+	s.Equal(len(data)+len(s.ImageData), out.Len())
+	s.True(bytes.Equal(append(data, s.ImageData...), out.Bytes()), "multipart data should be intact")
+}
@@ -2,8 +2,10 @@
 package images
 
 import (
+	"errors"
 	"io"
 	"os"
+	"strings"
 )
 
 // stores maps names to functions that generate a new Store of that type.
@@ -16,6 +18,9 @@ var stores = map[string]func() Store{}
 
 const configKey = "imageStoreConfig"
 
+// ErrInvalidID is used when an image id does not resolve to a usable location
+var ErrInvalidID = errors.New("invalid image id")
+
 type (
 	// Store provides a common API for image storage backends
 	Store interface {
@@ -29,10 +34,35 @@ type (
 		Stat(string) (os.FileInfo, error)
 		// Get retrieves an image from the Store
 		Get(string, io.Writer) error
+		// GetRange retrieves part of an image from the Store, given an offset
+		// and a length. A negative length reads to the end of the image.
+		GetRange(string, io.Writer, int64, int64) error
 		// Put stores an image in the Store
 		Put(string, io.Reader) error
+		// Append adds data to the end of an image in the Store, creating the
+		// image if it does not exist
+		Append(string, io.Reader) error
 		// Delete removes an image from the Store
 		Delete(string) error
+		// List retrieves the ids of all images in the Store
+		List() ([]string, error)
+	}
+
+	// Mover is implemented by Stores that can move image data from one id to
+	// another without copying it
+	Mover interface {
+		// Move renames image data from one id to another, replacing any
+		// existing data at the destination
+		Move(string, string) error
+	}
+
+	// TempCleaner is implemented by Stores that write data through temporary
+	// files, which an interrupted write can leave behind
+	TempCleaner interface {
+		// ListTemp retrieves the names of temporary files not in use
+		ListTemp() ([]string, error)
+		// DeleteTemp removes a temporary file
+		DeleteTemp(string) error
 	}
 )
 
@@ -50,6 +80,32 @@ func List() []string {
 	return names
 }
 
+// Move moves image data from one id to another within a Store. Stores
+// implementing Mover handle it directly; otherwise the data is copied to the
+// new id and removed from the old one.
+func Move(store Store, fromID, toID string) error {
+	if mover, ok := store.(Mover); ok {
+		return mover.Move(fromID, toID)
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		_ = pw.CloseWithError(store.Get(fromID, pw))
+	}()
+	if err := store.Put(toID, pr); err != nil {
+		_ = pr.CloseWithError(err)
+		return err
+	}
+	return store.Delete(fromID)
+}
+
+// validID checks whether an image id is a single path element, so that stores
+// mapping ids to paths or keys can't resolve it to another image or to a
+// location outside of the store
+func validID(imageID string) bool {
+	return imageID != "" && imageID != "." && imageID != ".." && !strings.ContainsAny(imageID, `/\`)
+}
+
 // NewStore create a new instance of a Store from a name
 func NewStore(name string) Store {
 	newFunc, ok := stores[name]
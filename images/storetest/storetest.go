@@ -0,0 +1,291 @@
+// Package storetest provides a conformance test suite for images.Store
+// implementations. A store registered with images.Register should pass it.
+//
+// Embed StoreSuite in a testify suite, set StoreName, and set StoreConfig
+// before calling StoreSuite.SetupTest. Config handling is specific to each
+// store, so TestConfigValidate and TestInit must be overridden.
+package storetest
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/mistifyio/mistify-image-service/images"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/suite"
+)
+
+// LargeImageSize is the size of the image streamed by TestLargeImage, large
+// enough to need multiple reads, writes, or upload parts
+const LargeImageSize = 8 << 20
+
+// StoreSuite is the conformance test suite for an images.Store
+type StoreSuite struct {
+	suite.Suite
+	StoreName   string
+	StoreConfig []byte
+	Store       images.Store
+	ImageID     string
+	ImageData   []byte
+}
+
+func (s *StoreSuite) SetupSuite() {
+	log.SetLevel(log.FatalLevel)
+	s.ImageID = "foobar"
+	s.ImageData = []byte("testdatatestdatatestdata")
+}
+
+func (s *StoreSuite) SetupTest() {
+	s.Store = images.NewStore(s.StoreName)
+	_ = s.Store.Init(s.StoreConfig)
+}
+
+func (s *StoreSuite) TestConfigValidate() {
+	// This is going to be unique to each store type
+	s.Fail("test suite does not define TestConfigValidate", s.StoreName)
+}
+
+func (s *StoreSuite) TestInit() {
+	// This is going to be unique to each store type based on the config
+	s.Fail("test suite does not define TestInit", s.StoreName)
+}
+
+func (s *StoreSuite) TestPut() {
+	in := bytes.NewReader(s.ImageData)
+	s.NoError(s.Store.Put(s.ImageID, in))
+	s.Error(s.Store.Put("", in), "shouldn't work without id")
+}
+
+func (s *StoreSuite) TestAppend() {
+	half := len(s.ImageData) / 2
+	s.NoError(s.Store.Append(s.ImageID, bytes.NewReader(s.ImageData[:half])), "appending to a new image shouldn't error")
+	s.NoError(s.Store.Append(s.ImageID, bytes.NewReader(s.ImageData[half:])), "appending to an existing image shouldn't error")
+
+	out := bytes.NewBuffer(make([]byte, 0, len(s.ImageData)))
+	s.NoError(s.Store.Get(s.ImageID, out))
+	s.Equal(s.ImageData, out.Bytes(), "appended data should follow existing data")
+
+	s.Error(s.Store.Append("", bytes.NewReader(s.ImageData)), "shouldn't work without id")
+}
+
+func (s *StoreSuite) TestStat() {
+	in := bytes.NewReader(s.ImageData)
+	_ = s.Store.Put(s.ImageID, in)
+
+	stat, err := s.Store.Stat(s.ImageID)
+	s.NoError(err)
+	s.NotNil(stat)
+	s.EqualValues(len(s.ImageData), stat.Size())
+
+	_, err = s.Store.Stat("asdf")
+	s.True(os.IsNotExist(err), "missing image should not exist")
+}
+
+func (s *StoreSuite) TestGet() {
+	in := bytes.NewReader(s.ImageData)
+	_ = s.Store.Put(s.ImageID, in)
+
+	out := bytes.NewBuffer(make([]byte, 0, len(s.ImageData)))
+	s.NoError(s.Store.Get(s.ImageID, out))
+	s.Equal(s.ImageData, out.Bytes())
+
+	s.True(os.IsNotExist(s.Store.Get("asdf", out)), "missing image should not exist")
+	s.Error(s.Store.Get("", out), "missing id should error")
+}
+
+func (s *StoreSuite) TestGetRange() {
+	in := bytes.NewReader(s.ImageData)
+	_ = s.Store.Put(s.ImageID, in)
+
+	tests := []struct {
+		description string
+		offset      int64
+		length      int64
+		expected    []byte
+		expectedErr bool
+	}{
+		{"whole image should be retrieved",
+			0, int64(len(s.ImageData)), s.ImageData, false},
+		{"middle of image should be retrieved",
+			4, 8, s.ImageData[4:12], false},
+		{"negative length should read to the end",
+			8, -1, s.ImageData[8:], false},
+		{"range past the end should fail",
+			8, int64(len(s.ImageData)), nil, true},
+	}
+
+	for _, test := range tests {
+		out := &bytes.Buffer{}
+		err := s.Store.GetRange(s.ImageID, out, test.offset, test.length)
+		if test.expectedErr {
+			s.Error(err, test.description)
+			continue
+		}
+		s.NoError(err, test.description)
+		s.Equal(test.expected, out.Bytes(), test.description)
+	}
+
+	s.True(os.IsNotExist(s.Store.GetRange("asdf", &bytes.Buffer{}, 0, 1)), "missing image should not exist")
+}
+
+func (s *StoreSuite) TestMove() {
+	in := bytes.NewReader(s.ImageData)
+	_ = s.Store.Put(s.ImageID, in)
+
+	newID := s.ImageID + "-moved"
+	s.NoError(images.Move(s.Store, s.ImageID, newID), "moving existing image shouldn't error")
+	_, err := s.Store.Stat(s.ImageID)
+	s.Error(err, "image should no longer exist under the old id")
+
+	out := bytes.NewBuffer(make([]byte, 0, len(s.ImageData)))
+	s.NoError(s.Store.Get(newID, out), "image should exist under the new id")
+	s.Equal(s.ImageData, out.Bytes())
+
+	s.Error(images.Move(s.Store, "asdf", s.ImageID), "moving nonexistant image should error")
+}
+
+func (s *StoreSuite) TestDelete() {
+	in := bytes.NewReader(s.ImageData)
+	_ = s.Store.Put(s.ImageID, in)
+
+	s.NoError(s.Store.Delete(s.ImageID), "deleting existing image shouldn't error")
+	s.NoError(s.Store.Delete("asdf"), "deleting nonexistant image should error")
+	s.NoError(s.Store.Delete(""), "missing id should not error")
+}
+
+func (s *StoreSuite) TestList() {
+	_ = s.Store.Put(s.ImageID, bytes.NewReader(s.ImageData))
+	_ = s.Store.Put("barbaz", bytes.NewReader(s.ImageData))
+
+	imageIDs, err := s.Store.List()
+	s.NoError(err)
+	s.Contains(imageIDs, s.ImageID)
+	s.Contains(imageIDs, "barbaz")
+
+	s.NoError(s.Store.Delete("barbaz"))
+	imageIDs, err = s.Store.List()
+	s.NoError(err)
+	s.NotContains(imageIDs, "barbaz", "deleted image should not be listed")
+}
+
+func (s *StoreSuite) TestNotFound() {
+	_, err := s.Store.Stat("asdf")
+	s.True(os.IsNotExist(err), "stat of a missing image should not exist")
+	s.True(os.IsNotExist(s.Store.Get("asdf", &bytes.Buffer{})), "get of a missing image should not exist")
+	s.True(os.IsNotExist(s.Store.GetRange("asdf", &bytes.Buffer{}, 0, -1)), "range of a missing image should not exist")
+	s.NoError(s.Store.Delete("asdf"), "delete of a missing image should not error")
+	s.Error(images.Move(s.Store, "asdf", s.ImageID), "move of a missing image should error")
+	_, err = s.Store.Stat(s.ImageID)
+	s.True(os.IsNotExist(err), "failed move should not create the destination")
+}
+
+func (s *StoreSuite) TestConcurrent() {
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(imageID string) {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				s.NoError(s.Store.Put(imageID, bytes.NewReader(s.ImageData)))
+				out := &bytes.Buffer{}
+				s.NoError(s.Store.Get(imageID, out))
+				s.Equal(s.ImageData, out.Bytes(), "concurrent puts of different images should not interfere")
+			}
+		}(fmt.Sprintf("%s-%d", s.ImageID, i))
+	}
+
+	// Readers of an image being replaced should see either complete version
+	_ = s.Store.Put(s.ImageID, bytes.NewReader(s.ImageData))
+	replacement := bytes.ToUpper(s.ImageData)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(writer bool) {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				if writer {
+					s.NoError(s.Store.Put(s.ImageID, bytes.NewReader(replacement)))
+					continue
+				}
+				out := &bytes.Buffer{}
+				s.NoError(s.Store.Get(s.ImageID, out))
+				if !bytes.Equal(s.ImageData, out.Bytes()) {
+					s.Equal(replacement, out.Bytes(), "readers should not see partial data")
+				}
+			}
+		}(i == 0)
+	}
+	wg.Wait()
+}
+
+func (s *StoreSuite) TestLargeImage() {
+	expected := sha256.New()
+	in := io.TeeReader(io.LimitReader(&patternReader{}, LargeImageSize), expected)
+	s.Require().NoError(s.Store.Put(s.ImageID, in))
+
+	stat, err := s.Store.Stat(s.ImageID)
+	s.NoError(err)
+	s.EqualValues(LargeImageSize, stat.Size())
+
+	actual := sha256.New()
+	s.NoError(s.Store.Get(s.ImageID, actual))
+	s.Equal(expected.Sum(nil), actual.Sum(nil), "streamed data should be stored intact")
+
+	out := &bytes.Buffer{}
+	s.NoError(s.Store.GetRange(s.ImageID, out, LargeImageSize-10, 10))
+	s.Equal(10, out.Len())
+}
+
+func (s *StoreSuite) TestPathTraversal() {
+	s.Require().NoError(s.Store.Put(s.ImageID, bytes.NewReader(s.ImageData)))
+
+	// An id must either be rejected or be stored under exactly that id. It
+	// must never resolve to another image or to a location outside the store.
+	replacement := bytes.ToUpper(s.ImageData)
+	for _, imageID := range []string{
+		"../" + s.ImageID,
+		"../../" + s.ImageID,
+		"x/../" + s.ImageID,
+		"./" + s.ImageID,
+		"/" + s.ImageID,
+		".",
+		"..",
+	} {
+		if err := s.Store.Put(imageID, bytes.NewReader(replacement)); err == nil {
+			out := &bytes.Buffer{}
+			s.NoError(s.Store.Get(imageID, out), imageID)
+			s.Equal(replacement, out.Bytes(), imageID)
+			s.NoError(s.Store.Delete(imageID), imageID)
+		}
+
+		out := &bytes.Buffer{}
+		s.NoError(s.Store.Get(s.ImageID, out), imageID)
+		s.Equal(s.ImageData, out.Bytes(), imageID+" should not resolve to another image")
+		s.NoError(s.Store.Delete(imageID), imageID)
+	}
+
+	out := &bytes.Buffer{}
+	s.NoError(s.Store.Get(s.ImageID, out))
+	s.Equal(s.ImageData, out.Bytes(), "deleting other ids should not remove the image")
+}
+
+func (s *StoreSuite) TestShutdown() {
+	s.NoError(s.Store.Shutdown(), "shutdown shouldn't error")
+	s.NoError(s.Store.Shutdown(), "second shutdown shouldn't error")
+}
+
+// patternReader is an endless reader of non-repeating data
+type patternReader struct {
+	count uint64
+}
+
+func (pr *patternReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = byte(pr.count ^ pr.count>>8 ^ pr.count>>16)
+		pr.count++
+	}
+	return len(p), nil
+}
@@ -0,0 +1,592 @@
+package metadata
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/boltdb/bolt"
+	log "github.com/sirupsen/logrus"
+)
+
+type (
+	// Bolt is a metadata store using an embedded bolt database
+	Bolt struct {
+		db     *bolt.DB
+		Config *BoltConfig
+	}
+
+	// BoltConfig contains necessary config options to set up bolt
+	BoltConfig struct {
+		Filename string
+	}
+)
+
+// boltLogFields contain fields to include on all logs
+var boltLogFields = log.Fields{
+	"type":  "metadata",
+	"store": "bolt",
+}
+
+// Bolt buckets. Each index is a nested bucket of the indexes bucket, keyed by
+// the index key and image id so lookups are a prefix scan.
+var (
+	boltImagesBucket  = []byte("images")
+	boltIndexesBucket = []byte("indexes")
+	boltMetaBucket    = []byte("meta")
+	boltTokensBucket  = []byte("tokens")
+)
+
+var boltIndexVersionKey = []byte("index_version")
+
+// boltOpenTimeout is how long to wait for another process to release the
+// database file lock
+const boltOpenTimeout = 5 * time.Second
+
+// Validate checks whether the config is valid
+func (bc *BoltConfig) Validate() error {
+	if bc.Filename == "" {
+		return ErrMissingFilename
+	}
+	return nil
+}
+
+// Init parses the config and opens the bolt database
+func (bs *Bolt) Init(configBytes []byte) error {
+	config := &BoltConfig{}
+
+	// Parse the config json
+	if err := json.Unmarshal(configBytes, config); err != nil {
+		log.WithFields(boltLogFields).WithFields(log.Fields{
+			"error": err,
+			"json":  string(configBytes),
+		}).Error("failed to unmarshal config json")
+		return err
+	}
+
+	if err := config.Validate(); err != nil {
+		log.WithFields(boltLogFields).WithFields(log.Fields{
+			"error": err,
+		}).Error("failed config validation")
+		return err
+	}
+
+	bs.Config = config
+	log.WithFields(boltLogFields).WithFields(log.Fields{
+		"config": bs.Config,
+	}).Info("config loaded")
+
+	db, err := bolt.Open(bs.Config.Filename, 0600, &bolt.Options{Timeout: boltOpenTimeout})
+	if err != nil {
+		log.WithFields(boltLogFields).WithFields(log.Fields{
+			"error":  err,
+			"config": bs.Config,
+		}).Error("failed to open db")
+		return err
+	}
+	bs.db = db
+
+	// Create the buckets and build any missing indexes
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltImagesBucket, boltIndexesBucket, boltMetaBucket, boltTokensBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				log.WithFields(boltLogFields).WithFields(log.Fields{
+					"error":  err,
+					"bucket": string(name),
+				}).Error("failed to create bucket")
+				return err
+			}
+		}
+		return bs.buildIndexes(tx)
+	})
+}
+
+// Shutdown closes the bolt database
+func (bs *Bolt) Shutdown() error {
+	if err := bs.db.Close(); err != nil {
+		log.WithFields(boltLogFields).WithFields(log.Fields{
+			"error": err,
+		}).Error("failed to close db")
+		return err
+	}
+	return nil
+}
+
+// List retrieves a list of images from bolt
+func (bs *Bolt) List(imageType string) ([]*Image, error) {
+	var images []*Image
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltImagesBucket).ForEach(func(key, value []byte) error {
+			image, err := bs.unmarshalImage(key, value)
+			if err != nil {
+				return err
+			}
+			if imageType == "" || image.Type == imageType {
+				images = append(images, image)
+			}
+			return nil
+		})
+	})
+	return images, err
+}
+
+// Query retrieves a page of images from bolt matching a query. A status,
+// source prefix or download range filter is looked up in the indexes, so only
+// candidate images are read. Otherwise, images are keyed by id, so queries
+// sorted by id seek straight to the cursor and stop once the page is full.
+func (bs *Bolt) Query(query *Query) ([]*Image, string, error) {
+	if err := query.Validate(); err != nil {
+		return nil, "", err
+	}
+	pc, err := query.newPageCollector()
+	if err != nil {
+		return nil, "", err
+	}
+
+	err = bs.db.View(func(tx *bolt.Tx) error {
+		if query.hasIndexedFilter() {
+			for _, imageID := range bs.queryIDs(tx, query) {
+				if !pc.wantsID(imageID) {
+					continue
+				}
+				image, err := bs.getImage(tx, imageID)
+				if err != nil {
+					return err
+				}
+				if image != nil {
+					pc.add(image)
+				}
+			}
+			return nil
+		}
+
+		c := tx.Bucket(boltImagesBucket).Cursor()
+		key, value := c.First()
+		next := c.Next
+		if query.sortField() == SortID {
+			if query.Descending {
+				key, value = c.Last()
+				next = c.Prev
+			}
+			if pc.after != nil {
+				key, value = c.Seek([]byte(pc.after.ID))
+				if query.Descending && key == nil {
+					key, value = c.Last()
+				}
+			}
+		}
+
+		for ; key != nil; key, value = next() {
+			if !pc.wantsID(string(key)) {
+				// Past the page, since the keys are in page order
+				if pc.full() {
+					break
+				}
+				continue
+			}
+			image, err := bs.unmarshalImage(key, value)
+			if err != nil {
+				return err
+			}
+			pc.add(image)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	return pc.page()
+}
+
+// GetByID retrieves an image from bolt using the image id
+func (bs *Bolt) GetByID(imageID string) (*Image, error) {
+	var image *Image
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		var err error
+		image, err = bs.getImage(tx, imageID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if image == nil {
+		return nil, ErrNotFound
+	}
+	return image, nil
+}
+
+// GetBySource retrieves an image from bolt using the image source
+func (bs *Bolt) GetBySource(imageSource string) (*Image, error) {
+	images, err := bs.lookup(sourceIndex, imageSource)
+	if err != nil {
+		return nil, err
+	}
+	if len(images) == 0 {
+		return nil, ErrNotFound
+	}
+	return images[0], nil
+}
+
+// GetByDigest retrieves the images from bolt with a data digest
+func (bs *Bolt) GetByDigest(digest string) ([]*Image, error) {
+	return bs.lookup(digestIndex, digest)
+}
+
+// Put stores an image in bolt
+func (bs *Bolt) Put(image *Image) error {
+	value, err := json.Marshal(image)
+	if err != nil {
+		log.WithFields(boltLogFields).WithFields(log.Fields{
+			"error": err,
+			"image": image,
+		}).Error("failed to marshal image")
+		return err
+	}
+
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		oldImage, err := bs.getImage(tx, image.ID)
+		if err != nil {
+			return err
+		}
+		if err := bs.updateIndexes(tx, oldImage, image); err != nil {
+			return err
+		}
+
+		if err := tx.Bucket(boltImagesBucket).Put([]byte(image.ID), value); err != nil {
+			log.WithFields(boltLogFields).WithFields(log.Fields{
+				"error": err,
+				"key":   image.ID,
+				"value": string(value),
+			}).Error("failed to store image")
+			return err
+		}
+		return nil
+	})
+}
+
+// Delete removes an image from bolt
+func (bs *Bolt) Delete(imageID string) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		oldImage, err := bs.getImage(tx, imageID)
+		if err != nil || oldImage == nil {
+			return err
+		}
+		if err := bs.updateIndexes(tx, oldImage, nil); err != nil {
+			return err
+		}
+
+		if err := tx.Bucket(boltImagesBucket).Delete([]byte(imageID)); err != nil {
+			log.WithFields(boltLogFields).WithFields(log.Fields{
+				"error": err,
+				"key":   imageID,
+			}).Error("failed to delete image")
+			return err
+		}
+		return nil
+	})
+}
+
+// Backup writes a consistent snapshot of the database while it remains
+// available for reads and writes
+func (bs *Bolt) Backup(w io.Writer) error {
+	return bs.db.View(func(tx *bolt.Tx) error {
+		if _, err := tx.WriteTo(w); err != nil {
+			log.WithFields(boltLogFields).WithFields(log.Fields{
+				"error": err,
+			}).Error("failed to write backup")
+			return err
+		}
+		return nil
+	})
+}
+
+// PutToken stores an api token in bolt
+func (bs *Bolt) PutToken(token *Token) error {
+	value, err := json.Marshal(token)
+	if err != nil {
+		log.WithFields(boltLogFields).WithFields(log.Fields{
+			"error":   err,
+			"tokenID": token.ID,
+		}).Error("failed to marshal token")
+		return err
+	}
+
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(boltTokensBucket).Put([]byte(token.ID), value); err != nil {
+			log.WithFields(boltLogFields).WithFields(log.Fields{
+				"error": err,
+				"key":   token.ID,
+			}).Error("failed to store token")
+			return err
+		}
+		return nil
+	})
+}
+
+// GetToken retrieves an api token from bolt using the token id
+func (bs *Bolt) GetToken(tokenID string) (*Token, error) {
+	var token *Token
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(boltTokensBucket).Get([]byte(tokenID))
+		if value == nil {
+			return ErrTokenNotFound
+		}
+		var err error
+		token, err = bs.unmarshalToken([]byte(tokenID), value)
+		return err
+	})
+	return token, err
+}
+
+// ListTokens retrieves all api tokens from bolt
+func (bs *Bolt) ListTokens() ([]*Token, error) {
+	var tokens []*Token
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltTokensBucket).ForEach(func(key, value []byte) error {
+			token, err := bs.unmarshalToken(key, value)
+			if err != nil {
+				return err
+			}
+			tokens = append(tokens, token)
+			return nil
+		})
+	})
+	return tokens, err
+}
+
+// DeleteToken removes an api token from bolt
+func (bs *Bolt) DeleteToken(tokenID string) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(boltTokensBucket).Delete([]byte(tokenID)); err != nil {
+			log.WithFields(boltLogFields).WithFields(log.Fields{
+				"error": err,
+				"key":   tokenID,
+			}).Error("failed to delete token")
+			return err
+		}
+		return nil
+	})
+}
+
+// TouchToken records the last use of an api token in bolt
+func (bs *Bolt) TouchToken(tokenID string, lastUsed time.Time) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltTokensBucket)
+		value := bucket.Get([]byte(tokenID))
+		if value == nil {
+			return ErrTokenNotFound
+		}
+		token, err := bs.unmarshalToken([]byte(tokenID), value)
+		if err != nil {
+			return err
+		}
+		token.LastUsed = lastUsed
+		if value, err = json.Marshal(token); err != nil {
+			log.WithFields(boltLogFields).WithFields(log.Fields{
+				"error":   err,
+				"tokenID": token.ID,
+			}).Error("failed to marshal token")
+			return err
+		}
+		if err := bucket.Put([]byte(tokenID), value); err != nil {
+			log.WithFields(boltLogFields).WithFields(log.Fields{
+				"error": err,
+				"key":   tokenID,
+			}).Error("failed to store token")
+			return err
+		}
+		return nil
+	})
+}
+
+// unmarshalToken parses stored token json
+func (bs *Bolt) unmarshalToken(key, value []byte) (*Token, error) {
+	token := &Token{}
+	if err := json.Unmarshal(value, token); err != nil {
+		log.WithFields(boltLogFields).WithFields(log.Fields{
+			"error":  err,
+			"bucket": string(boltTokensBucket),
+			"key":    string(key),
+		}).Error("failed to parse token json")
+		return nil, err
+	}
+	return token, nil
+}
+
+// getImage retrieves an image within a transaction, returning nil if it does
+// not exist
+func (bs *Bolt) getImage(tx *bolt.Tx, imageID string) (*Image, error) {
+	value := tx.Bucket(boltImagesBucket).Get([]byte(imageID))
+	if value == nil {
+		return nil, nil
+	}
+	return bs.unmarshalImage([]byte(imageID), value)
+}
+
+// unmarshalImage parses stored image json
+func (bs *Bolt) unmarshalImage(key, value []byte) (*Image, error) {
+	image := &Image{}
+	if err := json.Unmarshal(value, image); err != nil {
+		log.WithFields(boltLogFields).WithFields(log.Fields{
+			"error":  err,
+			"bucket": string(boltImagesBucket),
+			"key":    string(key),
+			"value":  string(value),
+		}).Error("failed to parse image json")
+		return nil, err
+	}
+	image.Store = bs
+	return image, nil
+}
+
+// lookup retrieves the images with a key in an index
+func (bs *Bolt) lookup(idx *index, key string) ([]*Image, error) {
+	var images []*Image
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltIndexesBucket).Bucket([]byte(idx.name))
+		if bucket == nil {
+			return nil
+		}
+
+		prefix := boltIndexKey(key, "")
+		c := bucket.Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			image, err := bs.getImage(tx, string(k[len(prefix):]))
+			if err != nil {
+				return err
+			}
+			if image != nil {
+				images = append(images, image)
+			}
+		}
+		return nil
+	})
+	return images, err
+}
+
+// queryIDs retrieves the ids of the images that may match a query's indexed
+// filters, seeking to the index entries for a status, source prefix or
+// download range
+func (bs *Bolt) queryIDs(tx *bolt.Tx, query *Query) []string {
+	var idx *index
+	var seek []byte
+	var done func([]byte) bool
+	switch {
+	case query.Status != "":
+		idx = statusIndex
+		seek = boltIndexKey(query.Status, "")
+		done = func(k []byte) bool { return !bytes.HasPrefix(k, seek) }
+	case query.SourcePrefix != "":
+		idx = sourceIndex
+		seek = []byte(query.SourcePrefix)
+		done = func(k []byte) bool { return !bytes.HasPrefix(k, seek) }
+	default:
+		// Keys are fixed width, so entries before the end of the range
+		// sort before it
+		after, before := downloadedRange(query)
+		idx = downloadedIndex
+		seek = []byte(after)
+		done = func(k []byte) bool { return before != "" && bytes.Compare(k, []byte(before)) >= 0 }
+	}
+
+	bucket := tx.Bucket(boltIndexesBucket).Bucket([]byte(idx.name))
+	if bucket == nil {
+		return nil
+	}
+	var ids []string
+	c := bucket.Cursor()
+	for k, _ := c.Seek(seek); k != nil && !done(k); k, _ = c.Next() {
+		if i := bytes.IndexByte(k, 0); i >= 0 {
+			ids = append(ids, string(k[i+1:]))
+		}
+	}
+	return ids
+}
+
+// updateIndexes updates all index entries for a change to an image within the
+// same transaction as the change. A nil oldImage is an addition and a nil
+// newImage is a removal.
+func (bs *Bolt) updateIndexes(tx *bolt.Tx, oldImage, newImage *Image) error {
+	for _, idx := range queryIndexes {
+		bucket, err := tx.Bucket(boltIndexesBucket).CreateBucketIfNotExists([]byte(idx.name))
+		if err != nil {
+			log.WithFields(boltLogFields).WithFields(log.Fields{
+				"error":  err,
+				"bucket": idx.name,
+			}).Error("failed to create index bucket")
+			return err
+		}
+
+		if indexKeyChanged(idx, oldImage, newImage) {
+			if err := bucket.Delete(boltIndexKey(idx.key(oldImage), oldImage.ID)); err != nil {
+				log.WithFields(boltLogFields).WithFields(log.Fields{
+					"error": err,
+					"index": idx.name,
+					"key":   idx.key(oldImage),
+				}).Error("failed to delete index entry")
+				return err
+			}
+		}
+		if newImage != nil && idx.key(newImage) != "" {
+			if err := bucket.Put(boltIndexKey(idx.key(newImage), newImage.ID), []byte{}); err != nil {
+				log.WithFields(boltLogFields).WithFields(log.Fields{
+					"error": err,
+					"index": idx.name,
+					"key":   idx.key(newImage),
+				}).Error("failed to store index entry")
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// buildIndexes rebuilds the indexes from the image metadata when they were
+// built for a different set of indexes, or not at all
+func (bs *Bolt) buildIndexes(tx *bolt.Tx) error {
+	meta := tx.Bucket(boltMetaBucket)
+	if string(meta.Get(boltIndexVersionKey)) == indexVersion(queryIndexes) {
+		return nil
+	}
+
+	// Clear out existing index entries
+	indexesBucket := tx.Bucket(boltIndexesBucket)
+	for _, idx := range queryIndexes {
+		if err := indexesBucket.DeleteBucket([]byte(idx.name)); err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+	}
+
+	count := 0
+	err := tx.Bucket(boltImagesBucket).ForEach(func(key, value []byte) error {
+		image, err := bs.unmarshalImage(key, value)
+		if err != nil {
+			return err
+		}
+		count++
+		return bs.updateIndexes(tx, nil, image)
+	})
+	if err != nil {
+		return err
+	}
+
+	log.WithFields(boltLogFields).WithFields(log.Fields{
+		"indexes": indexVersion(queryIndexes),
+		"count":   count,
+	}).Info("built indexes")
+	return meta.Put(boltIndexVersionKey, []byte(indexVersion(queryIndexes)))
+}
+
+// boltIndexKey builds the key for an index entry. The image id follows a
+// separator that can't appear in the index key.
+func boltIndexKey(key, imageID string) []byte {
+	return []byte(key + "\x00" + imageID)
+}
+
+func init() {
+	Register("bolt", func() Store {
+		return &Bolt{}
+	})
+}
@@ -0,0 +1,140 @@
+package metadata_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mistifyio/mistify-image-service/metadata"
+	"github.com/mistifyio/mistify-image-service/metadata/storetest"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/suite"
+)
+
+type BoltTestSuite struct {
+	storetest.StoreSuite
+	Dir        string
+	BoltConfig *metadata.BoltConfig
+}
+
+func (s *BoltTestSuite) SetupTest() {
+	// Bolt specific test setup
+	s.Dir, _ = ioutil.TempDir("", "boltTest-"+uuid.New())
+	s.BoltConfig = &metadata.BoltConfig{
+		Filename: filepath.Join(s.Dir, "metadata.db"),
+	}
+	s.StoreConfig, _ = json.Marshal(s.BoltConfig)
+
+	// General store test setup
+	s.StoreSuite.SetupTest()
+}
+
+func (s *BoltTestSuite) TearDownTest() {
+	_ = s.Store.Shutdown()
+	s.NoError(os.RemoveAll(s.Dir))
+}
+
+func TestBoltTestSuite(t *testing.T) {
+	s := new(BoltTestSuite)
+	s.StoreName = "bolt"
+	suite.Run(t, s)
+}
+
+func (s *BoltTestSuite) TestConfigValidate() {
+	tests := []struct {
+		description string
+		config      *metadata.BoltConfig
+		expectedErr error
+	}{
+		{"empty config should be invalid",
+			&metadata.BoltConfig{}, metadata.ErrMissingFilename},
+		{"config to use for tests should be valid",
+			s.BoltConfig, nil},
+	}
+
+	for _, test := range tests {
+		s.Equal(test.expectedErr, test.config.Validate(), test.description)
+	}
+}
+
+func (s *BoltTestSuite) TestInit() {
+	// The store from SetupTest holds the database lock
+	s.NoError(s.Store.Shutdown())
+
+	tests := []struct {
+		description string
+		configJSON  string
+		expectedErr bool
+	}{
+		{"bad json should fail",
+			"not actually json", true},
+		{"incomplete config should fail",
+			`{}`, true},
+		{"invalid filename should fail",
+			`{"filename":"/dev/null/foo"}`, true},
+		{"valid config should succeed",
+			string(s.StoreConfig), false},
+	}
+
+	for _, test := range tests {
+		store := metadata.NewStore("bolt")
+		config := []byte(test.configJSON)
+		err := store.Init(config)
+		if test.expectedErr {
+			s.Error(err, test.description)
+		} else {
+			s.NoError(err, test.description)
+			s.NoError(store.Shutdown())
+		}
+	}
+}
+
+func (s *BoltTestSuite) TestQueryPages() {
+	var expectedIDs []string
+	for i := 0; i < 5; i++ {
+		image := &metadata.Image{ID: metadata.NewID(), Type: "kvm"}
+		s.Require().NoError(s.Store.Put(image))
+		expectedIDs = append(expectedIDs, image.ID)
+	}
+	s.Require().NoError(s.Store.Put(&metadata.Image{ID: metadata.NewID(), Type: "container"}))
+
+	for _, descending := range []bool{false, true} {
+		query := &metadata.Query{Type: "kvm", Descending: descending, Limit: 2}
+		var listedIDs []string
+		for pages := 0; pages < 5; pages++ {
+			images, cursor, err := s.Store.Query(query)
+			s.Require().NoError(err)
+			s.True(len(images) <= 2, "page should not exceed the limit")
+			listedIDs = append(listedIDs, storetest.ImageIDs(images)...)
+			if cursor == "" {
+				break
+			}
+			query.Cursor = cursor
+		}
+		s.ElementsMatch(expectedIDs, listedIDs, "pages should list every matching image once")
+	}
+}
+
+func (s *BoltTestSuite) TestBackup() {
+	_ = s.Store.Put(s.Image)
+
+	backup := &bytes.Buffer{}
+	s.NoError(s.Store.(metadata.Backuper).Backup(backup))
+
+	// The backup should be a usable database
+	restored := &metadata.BoltConfig{
+		Filename: filepath.Join(s.Dir, "restored.db"),
+	}
+	s.Require().NoError(ioutil.WriteFile(restored.Filename, backup.Bytes(), 0600))
+	restoredConfig, _ := json.Marshal(restored)
+	store := metadata.NewStore("bolt")
+	s.Require().NoError(store.Init(restoredConfig))
+	defer func() { _ = store.Shutdown() }()
+
+	image, err := store.GetBySource(s.Image.Source)
+	s.NoError(err, "restored image should be found")
+	s.Equal(s.Image.ID, image.ID)
+}
@@ -0,0 +1,52 @@
+package metadata
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"hash"
+)
+
+// Checksum types
+const (
+	ChecksumTypeSHA256 = "sha256"
+	ChecksumTypeSHA512 = "sha512"
+	ChecksumTypeMD5    = "md5"
+)
+
+// DefaultChecksumType is used when an image does not specify a checksum type
+const DefaultChecksumType = ChecksumTypeSHA256
+
+// DigestType is the checksum type used to content-address image data
+const DigestType = ChecksumTypeSHA256
+
+// ErrChecksumMismatch is used when the computed checksum of image data does
+// not match the expected checksum
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// ValidChecksumTypes maps valid checksum types to their hash constructors
+var ValidChecksumTypes = map[string]func() hash.Hash{
+	ChecksumTypeSHA256: sha256.New,
+	ChecksumTypeSHA512: sha512.New,
+	ChecksumTypeMD5:    md5.New,
+}
+
+// IsValidChecksumType tests whether the checksum type is valid
+func IsValidChecksumType(checksumType string) bool {
+	_, ok := ValidChecksumTypes[checksumType]
+	return ok
+}
+
+// NewHash creates a new hash for a checksum type. An empty checksum type will
+// use the DefaultChecksumType. Returns nil if the checksum type is invalid.
+func NewHash(checksumType string) hash.Hash {
+	if checksumType == "" {
+		checksumType = DefaultChecksumType
+	}
+	newFunc, ok := ValidChecksumTypes[checksumType]
+	if !ok {
+		return nil
+	}
+	return newFunc()
+}
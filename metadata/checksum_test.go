@@ -0,0 +1,47 @@
+package metadata_test
+
+import (
+	"testing"
+
+	"github.com/mistifyio/mistify-image-service/metadata"
+	"github.com/stretchr/testify/suite"
+)
+
+type ChecksumTestSuite struct {
+	suite.Suite
+}
+
+func TestChecksumTestSuite(t *testing.T) {
+	suite.Run(t, new(ChecksumTestSuite))
+}
+
+func (s *ChecksumTestSuite) TestIsValidChecksumType() {
+	for checksumType := range metadata.ValidChecksumTypes {
+		s.True(metadata.IsValidChecksumType(checksumType), "should be a valid checksum type")
+	}
+
+	s.False(metadata.IsValidChecksumType(""), "empty should be an invalid checksum type")
+	s.False(metadata.IsValidChecksumType("foobar"), "should be an invalid checksum type")
+}
+
+func (s *ChecksumTestSuite) TestNewHash() {
+	tests := []struct {
+		description  string
+		checksumType string
+		expectedSize int
+	}{
+		{"empty type should use the default", "", 32},
+		{"sha256 should be supported", metadata.ChecksumTypeSHA256, 32},
+		{"sha512 should be supported", metadata.ChecksumTypeSHA512, 64},
+		{"md5 should be supported", metadata.ChecksumTypeMD5, 16},
+	}
+
+	for _, test := range tests {
+		hasher := metadata.NewHash(test.checksumType)
+		if s.NotNil(hasher, test.description) {
+			s.Equal(test.expectedSize, hasher.Size(), test.description)
+		}
+	}
+
+	s.Nil(metadata.NewHash("foobar"), "invalid type should not create a hash")
+}
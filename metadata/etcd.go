@@ -4,11 +4,13 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net/url"
 	"path"
+	"time"
 
-	log "github.com/Sirupsen/logrus"
 	etcderr "github.com/coreos/etcd/error"
 	"github.com/coreos/go-etcd/etcd"
+	log "github.com/sirupsen/logrus"
 )
 
 // ErrIncompleteTLSConfig is used when something is missing from an etcd tls
@@ -18,9 +20,11 @@ var ErrIncompleteTLSConfig = errors.New("incomplete tls config")
 type (
 	// etcdStore is a metadata store using etcd
 	etcdStore struct {
-		client *etcd.Client
-		prefix string
-		config *EtcdConfig
+		client      *etcd.Client
+		prefix      string
+		indexPrefix string
+		tokenPrefix string
+		config      *EtcdConfig
 	}
 
 	// EtcdConfig contains config options to set up an etcd client
@@ -90,6 +94,8 @@ func (es *etcdStore) Init(configBytes []byte) error {
 	}).Info("config loaded")
 
 	es.prefix = path.Join(es.config.Prefix, "images")
+	es.indexPrefix = path.Join(es.config.Prefix, "indexes")
+	es.tokenPrefix = path.Join(es.config.Prefix, "tokens")
 
 	// Create the etcd client
 	var client *etcd.Client
@@ -122,7 +128,7 @@ func (es *etcdStore) Init(configBytes []byte) error {
 			return err
 		}
 	}
-	return nil
+	return es.buildIndexes()
 }
 
 // Shutdown closes the etcd client connection
@@ -133,35 +139,29 @@ func (es *etcdStore) Shutdown() error {
 
 // List retrieves a list of images from etcd
 func (es *etcdStore) List(imageType string) ([]*Image, error) {
-	var images []*Image
+	return es.scan(func(image *Image) bool {
+		return imageType == "" || imageType == image.Type
+	})
+}
 
-	// Look up the prefix to get a list of imageIDs
-	resp, err := es.client.Get(es.prefix, false, false)
-	if err != nil {
-		log.WithFields(etcdLogFields).WithFields(log.Fields{
-			"error": err,
-			"key":   es.prefix,
-		}).Error("failed to look up images dir")
-		return nil, err
+// Query retrieves a page of images from etcd matching a query
+func (es *etcdStore) Query(query *Query) ([]*Image, string, error) {
+	if err := query.Validate(); err != nil {
+		return nil, "", err
 	}
 
-	// Look up metadata for each imageID and filter by type
-	for _, node := range resp.Node.Nodes {
-		imageID := path.Base(node.Key)
-		image, err := es.GetByID(imageID)
-		if err != nil {
-			return nil, err
-		}
-		if imageType == "" || imageType == image.Type {
-			images = append(images, image)
-		}
+	images, err := es.scan(query.Match)
+	if err != nil {
+		return nil, "", err
 	}
-
-	return images, nil
+	return query.Page(images)
 }
 
 // GetByID retrieves an image from etcd using the image id
 func (es *etcdStore) GetByID(imageID string) (*Image, error) {
+	if !validID(imageID) {
+		return nil, ErrNotFound
+	}
 	image := &Image{}
 
 	metadataKey := es.metadataKey(imageID)
@@ -194,33 +194,34 @@ func (es *etcdStore) GetByID(imageID string) (*Image, error) {
 
 // GetBySource retrieves an image from etcd using the image source
 func (es *etcdStore) GetBySource(imageSource string) (*Image, error) {
-	// Look up the prefix to get a list of imageIDs
-	resp, err := es.client.Get(es.prefix, false, false)
+	images, err := es.lookup(sourceIndex, imageSource)
 	if err != nil {
-		log.WithFields(etcdLogFields).WithFields(log.Fields{
-			"error": err,
-			"key":   es.prefix,
-		}).Error("failed to look up images dir")
 		return nil, err
 	}
-
-	// Look up metadata for each imageID and return if the right image is found
-	for _, node := range resp.Node.Nodes {
-		imageID := path.Base(node.Key)
-		image, err := es.GetByID(imageID)
-		if err != nil {
-			return nil, err
-		}
-		if imageSource == image.Source {
-			return image, nil
-		}
+	if len(images) == 0 {
+		return nil, ErrNotFound
 	}
+	return images[0], nil
+}
 
-	return nil, ErrNotFound
+// GetByDigest retrieves the images from etcd with a data digest
+func (es *etcdStore) GetByDigest(digest string) ([]*Image, error) {
+	return es.lookup(digestIndex, digest)
 }
 
-// Put stores an image in etcd
+// Put stores an image in etcd. The etcd v2 API has no multi-key transactions,
+// so index entries are updated after the image and lookups check each entry
+// against the image it points to.
 func (es *etcdStore) Put(image *Image) error {
+	if !validID(image.ID) {
+		return ErrInvalidID
+	}
+
+	oldImage, err := es.GetByID(image.ID)
+	if err != nil && err != ErrNotFound {
+		return err
+	}
+
 	imageJSON, err := json.Marshal(image)
 	if err != nil {
 		log.WithFields(etcdLogFields).WithFields(log.Fields{
@@ -240,11 +241,22 @@ func (es *etcdStore) Put(image *Image) error {
 		return err
 	}
 
-	return nil
+	return es.updateIndexes(oldImage, image)
 }
 
 // Delete removes an image from etcd
 func (es *etcdStore) Delete(imageID string) error {
+	// Nothing can be stored under an invalid id, and the key could be another
+	// image's
+	if !validID(imageID) {
+		return nil
+	}
+
+	oldImage, err := es.GetByID(imageID)
+	if err != nil && err != ErrNotFound {
+		return err
+	}
+
 	key := path.Join(es.prefix, imageID)
 	if _, err := es.client.Delete(key, true); err != nil {
 		etcdErr := err.(*etcd.EtcdError)
@@ -257,13 +269,328 @@ func (es *etcdStore) Delete(imageID string) error {
 		}
 	}
 
+	return es.updateIndexes(oldImage, nil)
+}
+
+// PutToken stores an api token in etcd
+func (es *etcdStore) PutToken(token *Token) error {
+	if !validID(token.ID) {
+		return ErrInvalidID
+	}
+
+	tokenJSON, err := json.Marshal(token)
+	if err != nil {
+		log.WithFields(etcdLogFields).WithFields(log.Fields{
+			"error":   err,
+			"tokenID": token.ID,
+		}).Error("failed to marshal token to json")
+		return err
+	}
+
+	key := es.tokenKey(token.ID)
+	if _, err := es.client.Set(key, string(tokenJSON), 0); err != nil {
+		log.WithFields(etcdLogFields).WithFields(log.Fields{
+			"error": err,
+			"key":   key,
+		}).Error("failed to store token")
+		return err
+	}
+	return nil
+}
+
+// GetToken retrieves an api token from etcd using the token id
+func (es *etcdStore) GetToken(tokenID string) (*Token, error) {
+	if !validID(tokenID) {
+		return nil, ErrTokenNotFound
+	}
+
+	key := es.tokenKey(tokenID)
+	resp, err := es.client.Get(key, false, false)
+	if err != nil {
+		if isEtcdNotFound(err) {
+			return nil, ErrTokenNotFound
+		}
+		log.WithFields(etcdLogFields).WithFields(log.Fields{
+			"error": err,
+			"key":   key,
+		}).Error("failed to look up token")
+		return nil, err
+	}
+	return es.unmarshalToken(resp.Node.Key, resp.Node.Value)
+}
+
+// ListTokens retrieves all api tokens from etcd with a single lookup
+func (es *etcdStore) ListTokens() ([]*Token, error) {
+	resp, err := es.client.Get(es.tokenPrefix, false, false)
+	if err != nil {
+		if isEtcdNotFound(err) {
+			return nil, nil
+		}
+		log.WithFields(etcdLogFields).WithFields(log.Fields{
+			"error": err,
+			"key":   es.tokenPrefix,
+		}).Error("failed to look up tokens dir")
+		return nil, err
+	}
+
+	var tokens []*Token
+	for _, node := range resp.Node.Nodes {
+		token, err := es.unmarshalToken(node.Key, node.Value)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, nil
+}
+
+// DeleteToken removes an api token from etcd
+func (es *etcdStore) DeleteToken(tokenID string) error {
+	if !validID(tokenID) {
+		return nil
+	}
+
+	key := es.tokenKey(tokenID)
+	if _, err := es.client.Delete(key, false); err != nil && !isEtcdNotFound(err) {
+		log.WithFields(etcdLogFields).WithFields(log.Fields{
+			"error": err,
+			"key":   key,
+		}).Error("failed to delete token")
+		return err
+	}
+	return nil
+}
+
+// TouchToken records the last use of an api token in etcd, comparing the
+// token's index so a revoked token isn't stored again
+func (es *etcdStore) TouchToken(tokenID string, lastUsed time.Time) error {
+	if !validID(tokenID) {
+		return ErrTokenNotFound
+	}
+
+	key := es.tokenKey(tokenID)
+	for {
+		resp, err := es.client.Get(key, false, false)
+		if err != nil {
+			if isEtcdNotFound(err) {
+				return ErrTokenNotFound
+			}
+			log.WithFields(etcdLogFields).WithFields(log.Fields{
+				"error": err,
+				"key":   key,
+			}).Error("failed to look up token")
+			return err
+		}
+		token, err := es.unmarshalToken(resp.Node.Key, resp.Node.Value)
+		if err != nil {
+			return err
+		}
+
+		token.LastUsed = lastUsed
+		tokenJSON, err := json.Marshal(token)
+		if err != nil {
+			log.WithFields(etcdLogFields).WithFields(log.Fields{
+				"error":   err,
+				"tokenID": token.ID,
+			}).Error("failed to marshal token to json")
+			return err
+		}
+		_, err = es.client.CompareAndSwap(key, string(tokenJSON), 0, "", resp.Node.ModifiedIndex)
+		if err == nil {
+			return nil
+		}
+		// The token changed or was removed since it was read
+		if etcdErr, ok := err.(*etcd.EtcdError); !ok || (etcdErr.ErrorCode != etcderr.EcodeTestFailed && etcdErr.ErrorCode != etcderr.EcodeKeyNotFound) {
+			log.WithFields(etcdLogFields).WithFields(log.Fields{
+				"error": err,
+				"key":   key,
+			}).Error("failed to store token")
+			return err
+		}
+	}
+}
+
+// unmarshalToken parses stored token json
+func (es *etcdStore) unmarshalToken(key, value string) (*Token, error) {
+	token := &Token{}
+	if err := json.Unmarshal([]byte(value), token); err != nil {
+		log.WithFields(etcdLogFields).WithFields(log.Fields{
+			"error": err,
+			"key":   key,
+		}).Error("invalid token json")
+		return nil, err
+	}
+	return token, nil
+}
+
+// scan retrieves all image metadata with a single recursive lookup and
+// returns the images accepted by the filter
+func (es *etcdStore) scan(filter func(*Image) bool) ([]*Image, error) {
+	var images []*Image
+
+	resp, err := es.client.Get(es.prefix, false, true)
+	if err != nil {
+		log.WithFields(etcdLogFields).WithFields(log.Fields{
+			"error": err,
+			"key":   es.prefix,
+		}).Error("failed to look up images dir")
+		return nil, err
+	}
+
+	for _, imageNode := range resp.Node.Nodes {
+		for _, node := range imageNode.Nodes {
+			if path.Base(node.Key) != "metadata" {
+				continue
+			}
+
+			image := &Image{}
+			if err := json.Unmarshal([]byte(node.Value), image); err != nil {
+				log.WithFields(etcdLogFields).WithFields(log.Fields{
+					"error": err,
+					"key":   node.Key,
+					"value": node.Value,
+				}).Error("invalid image json")
+				return nil, err
+			}
+			if filter(image) {
+				image.Store = es
+				images = append(images, image)
+			}
+		}
+	}
+
+	return images, nil
+}
+
+// lookup retrieves the images with a key in an index
+func (es *etcdStore) lookup(idx *index, key string) ([]*Image, error) {
+	dir := es.indexDir(idx, key)
+	resp, err := es.client.Get(dir, false, false)
+	if err != nil {
+		if isEtcdNotFound(err) {
+			return nil, nil
+		}
+		log.WithFields(etcdLogFields).WithFields(log.Fields{
+			"error": err,
+			"key":   dir,
+		}).Error("failed to look up index entry")
+		return nil, err
+	}
+
+	var images []*Image
+	for _, node := range resp.Node.Nodes {
+		image, err := es.GetByID(path.Base(node.Key))
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		// Skip entries left behind by an interrupted update
+		if idx.key(image) == key {
+			images = append(images, image)
+		}
+	}
+	return images, nil
+}
+
+// updateIndexes updates all index entries for a change to an image. A nil
+// oldImage is an addition and a nil newImage is a removal.
+func (es *etcdStore) updateIndexes(oldImage, newImage *Image) error {
+	for _, idx := range indexes {
+		if indexKeyChanged(idx, oldImage, newImage) {
+			key := path.Join(es.indexDir(idx, idx.key(oldImage)), oldImage.ID)
+			if _, err := es.client.Delete(key, false); err != nil && !isEtcdNotFound(err) {
+				log.WithFields(etcdLogFields).WithFields(log.Fields{
+					"error": err,
+					"key":   key,
+				}).Error("failed to delete index entry")
+				return err
+			}
+		}
+		if newImage != nil && idx.key(newImage) != "" {
+			key := path.Join(es.indexDir(idx, idx.key(newImage)), newImage.ID)
+			if _, err := es.client.Set(key, newImage.ID, 0); err != nil {
+				log.WithFields(etcdLogFields).WithFields(log.Fields{
+					"error": err,
+					"key":   key,
+				}).Error("failed to store index entry")
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// buildIndexes rebuilds the indexes from the image metadata when they were
+// built for a different set of indexes, or not at all
+func (es *etcdStore) buildIndexes() error {
+	versionKey := path.Join(es.config.Prefix, "index_version")
+	resp, err := es.client.Get(versionKey, false, false)
+	if err != nil && !isEtcdNotFound(err) {
+		log.WithFields(etcdLogFields).WithFields(log.Fields{
+			"error": err,
+			"key":   versionKey,
+		}).Error("failed to look up index version")
+		return err
+	}
+	if err == nil && resp.Node.Value == indexVersion(indexes) {
+		return nil
+	}
+
+	// Clear out existing index entries
+	if _, err := es.client.Delete(es.indexPrefix, true); err != nil && !isEtcdNotFound(err) {
+		log.WithFields(etcdLogFields).WithFields(log.Fields{
+			"error": err,
+			"key":   es.indexPrefix,
+		}).Error("failed to delete indexes")
+		return err
+	}
+
+	allImages, err := es.scan(func(*Image) bool { return true })
+	if err != nil {
+		return err
+	}
+	for _, image := range allImages {
+		if err := es.updateIndexes(nil, image); err != nil {
+			return err
+		}
+	}
+
+	if _, err := es.client.Set(versionKey, indexVersion(indexes), 0); err != nil {
+		log.WithFields(etcdLogFields).WithFields(log.Fields{
+			"error": err,
+			"key":   versionKey,
+		}).Error("failed to store index version")
+		return err
+	}
+
+	log.WithFields(etcdLogFields).WithFields(log.Fields{
+		"indexes": indexVersion(indexes),
+		"count":   len(allImages),
+	}).Info("built indexes")
 	return nil
 }
 
+// indexDir returns the directory holding the image ids for a key in an index
+func (es *etcdStore) indexDir(idx *index, key string) string {
+	return path.Join(es.indexPrefix, idx.name, url.PathEscape(key))
+}
+
 func (es *etcdStore) metadataKey(imageID string) string {
 	return path.Join(es.prefix, imageID, "metadata")
 }
 
+func (es *etcdStore) tokenKey(tokenID string) string {
+	return path.Join(es.tokenPrefix, tokenID)
+}
+
+// isEtcdNotFound checks whether an error is an etcd key not found error
+func isEtcdNotFound(err error) bool {
+	etcdErr, ok := err.(*etcd.EtcdError)
+	return ok && etcdErr.ErrorCode == etcderr.EcodeKeyNotFound
+}
+
 func init() {
 	Register("etcd", func() Store {
 		return &etcdStore{}
@@ -0,0 +1,779 @@
+package metadata
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"go.etcd.io/etcd/client/pkg/v3/transport"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// Etcd3 config defaults
+const (
+	etcd3DefaultDialTimeout    = 5 * time.Second
+	etcd3DefaultRequestTimeout = 5 * time.Second
+	etcd3DefaultLeaseTTL       = 30
+)
+
+type (
+	// etcd3Store is a metadata store using the etcd v3 API
+	etcd3Store struct {
+		client *clientv3.Client
+		config *Etcd3Config
+		// lease is kept alive for as long as the store is running. Records
+		// of downloads in progress are attached to it, so they expire if the
+		// service goes away mid-download.
+		lease clientv3.LeaseID
+		// stopKeepAlive stops renewing the lease
+		stopKeepAlive context.CancelFunc
+	}
+
+	// Etcd3Config contains config options to set up an etcd v3 client
+	Etcd3Config struct {
+		Endpoints []string
+		Cert      string
+		Key       string
+		CaCert    string
+		Prefix    string
+		// DialTimeout and RequestTimeout are in seconds
+		DialTimeout    int
+		RequestTimeout int
+		// LeaseTTL is the time in seconds a download record outlives the
+		// service that created it
+		LeaseTTL int
+	}
+)
+
+// etcd3LogFields contain fields to include on all logs
+var etcd3LogFields = log.Fields{
+	"type":  "metadata",
+	"store": "etcd3",
+}
+
+// Validate checks whether the config is valid
+func (ec *Etcd3Config) Validate() error {
+	// All tls related properties should be empty or all should be defined
+	tlsPresent := ec.Cert != "" || ec.Key != "" || ec.CaCert != ""
+	tlsMissing := ec.Cert == "" || ec.Key == "" || ec.CaCert == ""
+	if tlsPresent && tlsMissing {
+		return ErrIncompleteTLSConfig
+	}
+	return nil
+}
+
+// Init parses the config, connects to etcd, and acquires the lease for
+// download records
+func (es *etcd3Store) Init(configBytes []byte) error {
+	config := &Etcd3Config{}
+
+	// Parse the config json
+	if err := json.Unmarshal(configBytes, config); err != nil {
+		log.WithFields(etcd3LogFields).WithFields(log.Fields{
+			"error": err,
+			"json":  string(configBytes),
+		}).Error("failed to unmarshal config json")
+		return err
+	}
+
+	if err := config.Validate(); err != nil {
+		log.WithFields(etcd3LogFields).WithFields(log.Fields{
+			"error": err,
+		}).Error("failed config validation")
+		return err
+	}
+	if len(config.Endpoints) == 0 {
+		config.Endpoints = []string{"127.0.0.1:2379"}
+	}
+	if config.LeaseTTL == 0 {
+		config.LeaseTTL = etcd3DefaultLeaseTTL
+	}
+
+	es.config = config
+	log.WithFields(etcd3LogFields).WithFields(log.Fields{
+		"config": es.config,
+	}).Info("config loaded")
+
+	clientConfig := clientv3.Config{
+		Endpoints:   es.config.Endpoints,
+		DialTimeout: etcd3DefaultDialTimeout,
+	}
+	if es.config.DialTimeout > 0 {
+		clientConfig.DialTimeout = time.Duration(es.config.DialTimeout) * time.Second
+	}
+	if es.config.Cert != "" {
+		tlsConfig, err := es.tlsConfig()
+		if err != nil {
+			return err
+		}
+		clientConfig.TLS = tlsConfig
+	}
+
+	client, err := clientv3.New(clientConfig)
+	if err != nil {
+		log.WithFields(etcd3LogFields).WithFields(log.Fields{
+			"error":  err,
+			"config": es.config,
+		}).Error("failed to create client")
+		return err
+	}
+	es.client = client
+
+	ctx, cancel := es.requestContext()
+	defer cancel()
+	lease, err := es.client.Grant(ctx, int64(es.config.LeaseTTL))
+	if err != nil {
+		log.WithFields(etcd3LogFields).WithFields(log.Fields{
+			"error": err,
+		}).Error("failed to grant lease")
+		_ = es.client.Close()
+		return err
+	}
+	es.lease = lease.ID
+
+	keepAliveCtx, stopKeepAlive := context.WithCancel(context.Background())
+	keepAlive, err := es.client.KeepAlive(keepAliveCtx, es.lease)
+	if err != nil {
+		log.WithFields(etcd3LogFields).WithFields(log.Fields{
+			"error": err,
+			"lease": es.lease,
+		}).Error("failed to keep lease alive")
+		stopKeepAlive()
+		_ = es.client.Close()
+		return err
+	}
+	es.stopKeepAlive = stopKeepAlive
+	go func() {
+		// Responses need to be drained for renewal to continue
+		for range keepAlive {
+		}
+	}()
+
+	return es.buildIndexes()
+}
+
+// Shutdown revokes the lease and closes the etcd client connection
+func (es *etcd3Store) Shutdown() error {
+	if es.client == nil {
+		return nil
+	}
+
+	es.stopKeepAlive()
+	ctx, cancel := es.requestContext()
+	defer cancel()
+	if _, err := es.client.Revoke(ctx, es.lease); err != nil {
+		log.WithFields(etcd3LogFields).WithFields(log.Fields{
+			"error": err,
+			"lease": es.lease,
+		}).Error("failed to revoke lease")
+	}
+
+	err := es.client.Close()
+	es.client = nil
+	if err != nil {
+		log.WithFields(etcd3LogFields).WithFields(log.Fields{
+			"error": err,
+		}).Error("failed to close client")
+	}
+	return err
+}
+
+// List retrieves a list of images from etcd with a single range read
+func (es *etcd3Store) List(imageType string) ([]*Image, error) {
+	return es.scan(es.imageKey(""), clientv3.GetPrefixRangeEnd(es.imageKey("")), func(image *Image) bool {
+		return imageType == "" || imageType == image.Type
+	})
+}
+
+// Query retrieves a page of images from etcd matching a query. Images are
+// keyed by id, so a query sorted by id only reads the range after the cursor.
+func (es *etcd3Store) Query(query *Query) ([]*Image, string, error) {
+	if err := query.Validate(); err != nil {
+		return nil, "", err
+	}
+
+	start := es.imageKey("")
+	end := clientv3.GetPrefixRangeEnd(start)
+	if after, _ := query.after(); after != nil && query.sortField() == SortID {
+		if query.Descending {
+			end = es.imageKey(after.ID)
+		} else {
+			start = es.imageKey(after.ID) + "\x00"
+		}
+	}
+
+	images, err := es.scan(start, end, query.Match)
+	if err != nil {
+		return nil, "", err
+	}
+	return query.Page(images)
+}
+
+// GetByID retrieves an image from etcd using the image id
+func (es *etcd3Store) GetByID(imageID string) (*Image, error) {
+	if !validID(imageID) {
+		return nil, ErrNotFound
+	}
+
+	ctx, cancel := es.requestContext()
+	defer cancel()
+
+	key := es.imageKey(imageID)
+	resp, err := es.client.Get(ctx, key)
+	if err != nil {
+		log.WithFields(etcd3LogFields).WithFields(log.Fields{
+			"error": err,
+			"key":   key,
+		}).Error("failed to look up image")
+		return nil, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, ErrNotFound
+	}
+	return es.unmarshalImage(resp.Kvs[0].Key, resp.Kvs[0].Value, resp.Kvs[0].ModRevision)
+}
+
+// GetBySource retrieves an image from etcd using the image source
+func (es *etcd3Store) GetBySource(imageSource string) (*Image, error) {
+	images, err := es.lookup(sourceIndex, imageSource)
+	if err != nil {
+		return nil, err
+	}
+	if len(images) == 0 {
+		return nil, ErrNotFound
+	}
+	return images[0], nil
+}
+
+// GetByDigest retrieves the images from etcd with a data digest
+func (es *etcd3Store) GetByDigest(digest string) ([]*Image, error) {
+	return es.lookup(digestIndex, digest)
+}
+
+// Put stores an image in etcd along with its index entries in a single
+// transaction. An image that was read from or written to the store is only
+// stored if it hasn't changed since, otherwise ErrConflict is returned.
+func (es *etcd3Store) Put(image *Image) error {
+	if !validID(image.ID) {
+		return ErrInvalidID
+	}
+
+	imageJSON, err := json.Marshal(image)
+	if err != nil {
+		log.WithFields(etcd3LogFields).WithFields(log.Fields{
+			"error": err,
+			"image": image,
+		}).Error("failed to marshal image to json")
+		return err
+	}
+
+	key := es.imageKey(image.ID)
+	for {
+		oldImage, err := es.GetByID(image.ID)
+		if err != nil && err != ErrNotFound {
+			return err
+		}
+		var oldRevision int64
+		if oldImage != nil {
+			oldRevision = oldImage.revision
+		}
+		if image.revision != 0 && image.revision != oldRevision {
+			return ErrConflict
+		}
+
+		ops := append(es.indexOps(oldImage, image), clientv3.OpPut(key, string(imageJSON)))
+		downloadKey := es.downloadKey(image.ID)
+		if image.Status == StatusPending || image.Status == StatusDownloading {
+			ops = append(ops, clientv3.OpPut(downloadKey, image.ID, clientv3.WithLease(es.lease)))
+		} else {
+			ops = append(ops, clientv3.OpDelete(downloadKey))
+		}
+
+		resp, err := es.txn(ops, clientv3.Compare(clientv3.ModRevision(key), "=", oldRevision))
+		if err != nil {
+			log.WithFields(etcd3LogFields).WithFields(log.Fields{
+				"error": err,
+				"key":   key,
+				"value": string(imageJSON),
+			}).Error("failed to store image")
+			return err
+		}
+		if resp.Succeeded {
+			image.revision = resp.Header.Revision
+			return nil
+		}
+		if image.revision != 0 {
+			return ErrConflict
+		}
+		// A new image raced with another write; rebuild the index changes
+		// against the current version
+	}
+}
+
+// Delete removes an image and its index entries from etcd
+func (es *etcd3Store) Delete(imageID string) error {
+	key := es.imageKey(imageID)
+	for {
+		oldImage, err := es.GetByID(imageID)
+		if err == ErrNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		ops := append(es.indexOps(oldImage, nil),
+			clientv3.OpDelete(key),
+			clientv3.OpDelete(es.downloadKey(imageID)),
+		)
+		resp, err := es.txn(ops, clientv3.Compare(clientv3.ModRevision(key), "=", oldImage.revision))
+		if err != nil {
+			log.WithFields(etcd3LogFields).WithFields(log.Fields{
+				"error": err,
+				"key":   key,
+			}).Error("failed to delete image")
+			return err
+		}
+		if resp.Succeeded {
+			return nil
+		}
+		// Changed since it was read; retry so the right index entries go
+	}
+}
+
+// PutToken stores an api token in etcd
+func (es *etcd3Store) PutToken(token *Token) error {
+	if !validID(token.ID) {
+		return ErrInvalidID
+	}
+
+	tokenJSON, err := json.Marshal(token)
+	if err != nil {
+		log.WithFields(etcd3LogFields).WithFields(log.Fields{
+			"error":   err,
+			"tokenID": token.ID,
+		}).Error("failed to marshal token to json")
+		return err
+	}
+
+	ctx, cancel := es.requestContext()
+	defer cancel()
+
+	key := es.tokenKey(token.ID)
+	if _, err := es.client.Put(ctx, key, string(tokenJSON)); err != nil {
+		log.WithFields(etcd3LogFields).WithFields(log.Fields{
+			"error": err,
+			"key":   key,
+		}).Error("failed to store token")
+		return err
+	}
+	return nil
+}
+
+// GetToken retrieves an api token from etcd using the token id
+func (es *etcd3Store) GetToken(tokenID string) (*Token, error) {
+	if !validID(tokenID) {
+		return nil, ErrTokenNotFound
+	}
+
+	ctx, cancel := es.requestContext()
+	defer cancel()
+
+	key := es.tokenKey(tokenID)
+	resp, err := es.client.Get(ctx, key)
+	if err != nil {
+		log.WithFields(etcd3LogFields).WithFields(log.Fields{
+			"error": err,
+			"key":   key,
+		}).Error("failed to look up token")
+		return nil, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, ErrTokenNotFound
+	}
+	return es.unmarshalToken(resp.Kvs[0].Key, resp.Kvs[0].Value)
+}
+
+// ListTokens retrieves all api tokens from etcd with a single range read
+func (es *etcd3Store) ListTokens() ([]*Token, error) {
+	ctx, cancel := es.requestContext()
+	defer cancel()
+
+	prefix := es.tokenKey("")
+	resp, err := es.client.Get(ctx, prefix, clientv3.WithPrefix())
+	if err != nil {
+		log.WithFields(etcd3LogFields).WithFields(log.Fields{
+			"error": err,
+			"key":   prefix,
+		}).Error("failed to look up tokens")
+		return nil, err
+	}
+
+	var tokens []*Token
+	for _, kv := range resp.Kvs {
+		token, err := es.unmarshalToken(kv.Key, kv.Value)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, nil
+}
+
+// DeleteToken removes an api token from etcd
+func (es *etcd3Store) DeleteToken(tokenID string) error {
+	if !validID(tokenID) {
+		return nil
+	}
+
+	ctx, cancel := es.requestContext()
+	defer cancel()
+
+	key := es.tokenKey(tokenID)
+	if _, err := es.client.Delete(ctx, key); err != nil {
+		log.WithFields(etcd3LogFields).WithFields(log.Fields{
+			"error": err,
+			"key":   key,
+		}).Error("failed to delete token")
+		return err
+	}
+	return nil
+}
+
+// TouchToken records the last use of an api token in etcd, comparing the
+// token's revision so a revoked token isn't stored again
+func (es *etcd3Store) TouchToken(tokenID string, lastUsed time.Time) error {
+	if !validID(tokenID) {
+		return ErrTokenNotFound
+	}
+
+	key := es.tokenKey(tokenID)
+	for {
+		ctx, cancel := es.requestContext()
+		resp, err := es.client.Get(ctx, key)
+		cancel()
+		if err != nil {
+			log.WithFields(etcd3LogFields).WithFields(log.Fields{
+				"error": err,
+				"key":   key,
+			}).Error("failed to look up token")
+			return err
+		}
+		if len(resp.Kvs) == 0 {
+			return ErrTokenNotFound
+		}
+		token, err := es.unmarshalToken(resp.Kvs[0].Key, resp.Kvs[0].Value)
+		if err != nil {
+			return err
+		}
+
+		token.LastUsed = lastUsed
+		tokenJSON, err := json.Marshal(token)
+		if err != nil {
+			log.WithFields(etcd3LogFields).WithFields(log.Fields{
+				"error":   err,
+				"tokenID": token.ID,
+			}).Error("failed to marshal token to json")
+			return err
+		}
+		txnResp, err := es.txn([]clientv3.Op{clientv3.OpPut(key, string(tokenJSON))},
+			clientv3.Compare(clientv3.ModRevision(key), "=", resp.Kvs[0].ModRevision))
+		if err != nil {
+			log.WithFields(etcd3LogFields).WithFields(log.Fields{
+				"error": err,
+				"key":   key,
+			}).Error("failed to store token")
+			return err
+		}
+		if txnResp.Succeeded {
+			return nil
+		}
+		// The token changed or was removed since it was read
+	}
+}
+
+// scan retrieves images in a key range with a single range read and returns
+// the images accepted by the filter
+func (es *etcd3Store) scan(start, end string, filter func(*Image) bool) ([]*Image, error) {
+	ctx, cancel := es.requestContext()
+	defer cancel()
+
+	resp, err := es.client.Get(ctx, start, clientv3.WithRange(end))
+	if err != nil {
+		log.WithFields(etcd3LogFields).WithFields(log.Fields{
+			"error": err,
+			"key":   start,
+		}).Error("failed to look up images")
+		return nil, err
+	}
+
+	var images []*Image
+	for _, kv := range resp.Kvs {
+		image, err := es.unmarshalImage(kv.Key, kv.Value, kv.ModRevision)
+		if err != nil {
+			return nil, err
+		}
+		if filter(image) {
+			images = append(images, image)
+		}
+	}
+	return images, nil
+}
+
+// lookup retrieves the images with a key in an index. The entries and images
+// are read in one transaction so they are consistent with each other.
+func (es *etcd3Store) lookup(idx *index, key string) ([]*Image, error) {
+	ctx, cancel := es.requestContext()
+	defer cancel()
+
+	prefix := es.indexKey(idx, key, "")
+	resp, err := es.client.Get(ctx, prefix, clientv3.WithPrefix(), clientv3.WithKeysOnly())
+	if err != nil {
+		log.WithFields(etcd3LogFields).WithFields(log.Fields{
+			"error": err,
+			"key":   prefix,
+		}).Error("failed to look up index entries")
+		return nil, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, nil
+	}
+
+	ops := make([]clientv3.Op, len(resp.Kvs))
+	for i, kv := range resp.Kvs {
+		ops[i] = clientv3.OpGet(es.imageKey(strings.TrimPrefix(string(kv.Key), prefix)))
+	}
+	txnResp, err := es.client.Txn(ctx).Then(ops...).Commit()
+	if err != nil {
+		log.WithFields(etcd3LogFields).WithFields(log.Fields{
+			"error": err,
+			"key":   prefix,
+		}).Error("failed to look up indexed images")
+		return nil, err
+	}
+
+	var images []*Image
+	for _, opResp := range txnResp.Responses {
+		for _, kv := range opResp.GetResponseRange().Kvs {
+			image, err := es.unmarshalImage(kv.Key, kv.Value, kv.ModRevision)
+			if err != nil {
+				return nil, err
+			}
+			images = append(images, image)
+		}
+	}
+	return images, nil
+}
+
+// indexOps returns the operations to update all index entries for a change
+// to an image. A nil oldImage is an addition and a nil newImage is a removal.
+func (es *etcd3Store) indexOps(oldImage, newImage *Image) []clientv3.Op {
+	var ops []clientv3.Op
+	for _, idx := range indexes {
+		if indexKeyChanged(idx, oldImage, newImage) {
+			ops = append(ops, clientv3.OpDelete(es.indexKey(idx, idx.key(oldImage), oldImage.ID)))
+		}
+		if newImage != nil && idx.key(newImage) != "" {
+			ops = append(ops, clientv3.OpPut(es.indexKey(idx, idx.key(newImage), newImage.ID), ""))
+		}
+	}
+	return ops
+}
+
+// buildIndexes rebuilds the indexes from the image metadata when they were
+// built for a different set of indexes, or not at all. Images are indexed
+// individually to stay within the transaction size limit.
+func (es *etcd3Store) buildIndexes() error {
+	ctx, cancel := es.requestContext()
+	defer cancel()
+
+	versionKey := path.Join(es.config.Prefix, "index_version")
+	resp, err := es.client.Get(ctx, versionKey)
+	if err != nil {
+		log.WithFields(etcd3LogFields).WithFields(log.Fields{
+			"error": err,
+			"key":   versionKey,
+		}).Error("failed to look up index version")
+		return err
+	}
+	if len(resp.Kvs) > 0 && string(resp.Kvs[0].Value) == indexVersion(indexes) {
+		return nil
+	}
+
+	indexPrefix := path.Join(es.config.Prefix, "indexes") + "/"
+	if _, err := es.client.Delete(ctx, indexPrefix, clientv3.WithPrefix()); err != nil {
+		log.WithFields(etcd3LogFields).WithFields(log.Fields{
+			"error": err,
+			"key":   indexPrefix,
+		}).Error("failed to delete indexes")
+		return err
+	}
+
+	allImages, err := es.List("")
+	if err != nil {
+		return err
+	}
+	for _, image := range allImages {
+		if ops := es.indexOps(nil, image); len(ops) > 0 {
+			if _, err := es.txn(ops); err != nil {
+				log.WithFields(etcd3LogFields).WithFields(log.Fields{
+					"error": err,
+					"image": image.ID,
+				}).Error("failed to index image")
+				return err
+			}
+		}
+	}
+
+	if _, err := es.client.Put(ctx, versionKey, indexVersion(indexes)); err != nil {
+		log.WithFields(etcd3LogFields).WithFields(log.Fields{
+			"error": err,
+			"key":   versionKey,
+		}).Error("failed to store index version")
+		return err
+	}
+
+	log.WithFields(etcd3LogFields).WithFields(log.Fields{
+		"indexes": indexVersion(indexes),
+		"count":   len(allImages),
+	}).Info("built indexes")
+	return nil
+}
+
+// txn runs operations in a transaction, conditional on any comparisons
+func (es *etcd3Store) txn(ops []clientv3.Op, cmps ...clientv3.Cmp) (*clientv3.TxnResponse, error) {
+	ctx, cancel := es.requestContext()
+	defer cancel()
+
+	return es.client.Txn(ctx).If(cmps...).Then(ops...).Commit()
+}
+
+// unmarshalImage parses stored image json
+func (es *etcd3Store) unmarshalImage(key, value []byte, revision int64) (*Image, error) {
+	image := &Image{}
+	if err := json.Unmarshal(value, image); err != nil {
+		log.WithFields(etcd3LogFields).WithFields(log.Fields{
+			"error": err,
+			"key":   string(key),
+			"value": string(value),
+		}).Error("invalid image json")
+		return nil, err
+	}
+	image.Store = es
+	image.revision = revision
+	return image, nil
+}
+
+// unmarshalToken parses stored token json
+func (es *etcd3Store) unmarshalToken(key, value []byte) (*Token, error) {
+	token := &Token{}
+	if err := json.Unmarshal(value, token); err != nil {
+		log.WithFields(etcd3LogFields).WithFields(log.Fields{
+			"error": err,
+			"key":   string(key),
+		}).Error("invalid token json")
+		return nil, err
+	}
+	return token, nil
+}
+
+// requestContext returns a context for a single request to etcd
+func (es *etcd3Store) requestContext() (context.Context, context.CancelFunc) {
+	timeout := etcd3DefaultRequestTimeout
+	if es.config.RequestTimeout > 0 {
+		timeout = time.Duration(es.config.RequestTimeout) * time.Second
+	}
+	return context.WithTimeout(context.Background(), timeout)
+}
+
+// Downloading checks whether an image is being downloaded by another service
+// sharing the store, meaning its download record is attached to a lease other
+// than the one held by this store
+func (es *etcd3Store) Downloading(imageID string) (bool, error) {
+	ctx, cancel := es.requestContext()
+	defer cancel()
+
+	resp, err := es.client.Get(ctx, es.downloadKey(imageID))
+	if err != nil {
+		log.WithFields(etcd3LogFields).WithFields(log.Fields{
+			"error":   err,
+			"imageID": imageID,
+		}).Error("failed to retrieve download record")
+		return false, err
+	}
+	return len(resp.Kvs) > 0 && clientv3.LeaseID(resp.Kvs[0].Lease) != es.lease, nil
+}
+
+// WatchDownloads calls a function with the id of each image whose download
+// record is removed, until the context is done. Records are removed when a
+// download finishes, or when the lease of the service downloading the image
+// expires.
+func (es *etcd3Store) WatchDownloads(ctx context.Context, removed func(string)) {
+	prefix := es.downloadPrefix()
+	watch := es.client.Watch(ctx, prefix, clientv3.WithPrefix(), clientv3.WithFilterPut())
+	go func() {
+		for resp := range watch {
+			if err := resp.Err(); err != nil {
+				log.WithFields(etcd3LogFields).WithFields(log.Fields{
+					"error": err,
+				}).Error("failed to watch download records")
+				continue
+			}
+			for _, event := range resp.Events {
+				removed(strings.TrimPrefix(string(event.Kv.Key), prefix))
+			}
+		}
+	}()
+}
+
+// tlsConfig loads the client certificates
+func (es *etcd3Store) tlsConfig() (*tls.Config, error) {
+	tlsInfo := transport.TLSInfo{
+		CertFile:      es.config.Cert,
+		KeyFile:       es.config.Key,
+		TrustedCAFile: es.config.CaCert,
+	}
+	tlsConfig, err := tlsInfo.ClientConfig()
+	if err != nil {
+		log.WithFields(etcd3LogFields).WithFields(log.Fields{
+			"error":  err,
+			"cert":   es.config.Cert,
+			"key":    es.config.Key,
+			"caCert": es.config.CaCert,
+		}).Error("failed to load tls config")
+	}
+	return tlsConfig, err
+}
+
+func (es *etcd3Store) imageKey(imageID string) string {
+	return path.Join(es.config.Prefix, "images") + "/" + imageID
+}
+
+func (es *etcd3Store) tokenKey(tokenID string) string {
+	return path.Join(es.config.Prefix, "tokens") + "/" + tokenID
+}
+
+func (es *etcd3Store) downloadKey(imageID string) string {
+	return es.downloadPrefix() + imageID
+}
+
+func (es *etcd3Store) downloadPrefix() string {
+	return path.Join(es.config.Prefix, "downloads") + "/"
+}
+
+// indexKey returns the key of an index entry. An empty imageID gives the
+// prefix of all entries for the index key.
+func (es *etcd3Store) indexKey(idx *index, key, imageID string) string {
+	return path.Join(es.config.Prefix, "indexes", idx.name, url.PathEscape(key)) + "/" + imageID
+}
+
+func init() {
+	Register("etcd3", func() Store {
+		return &etcd3Store{}
+	})
+}
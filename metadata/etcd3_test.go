@@ -0,0 +1,263 @@
+package metadata_test
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/mistifyio/mistify-image-service/metadata"
+	"github.com/mistifyio/mistify-image-service/metadata/storetest"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/suite"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/server/v3/embed"
+)
+
+type Etcd3TestSuite struct {
+	storetest.StoreSuite
+	Etcd3Config *metadata.Etcd3Config
+	// EtcdDir holds the data of the embedded etcd server
+	EtcdDir string
+	Etcd    *embed.Etcd
+	// EtcdClient is for inspecting and cleaning up etcd
+	EtcdClient *clientv3.Client
+}
+
+func (s *Etcd3TestSuite) SetupSuite() {
+	// Etcd3 specific suite setup
+	s.EtcdDir, _ = ioutil.TempDir("", "etcd3Test-"+uuid.New())
+	config := embed.NewConfig()
+	config.Dir = s.EtcdDir
+	config.LogLevel = "fatal"
+	config.ListenClientUrls = []url.URL{*freeURL(s)}
+	config.AdvertiseClientUrls = config.ListenClientUrls
+	config.ListenPeerUrls = []url.URL{*freeURL(s)}
+	config.AdvertisePeerUrls = config.ListenPeerUrls
+	config.InitialCluster = config.InitialClusterFromName(config.Name)
+
+	etcd, err := embed.StartEtcd(config)
+	s.Require().NoError(err)
+	select {
+	case <-etcd.Server.ReadyNotify():
+	case <-time.After(30 * time.Second):
+		s.FailNow("embedded etcd did not start")
+	}
+	s.Etcd = etcd
+
+	s.EtcdClient, err = clientv3.New(clientv3.Config{
+		Endpoints: []string{config.ListenClientUrls[0].Host},
+	})
+	s.Require().NoError(err)
+
+	// General store suite setup
+	s.StoreSuite.SetupSuite()
+}
+
+func (s *Etcd3TestSuite) TearDownSuite() {
+	s.NoError(s.EtcdClient.Close())
+	s.Etcd.Close()
+	s.NoError(os.RemoveAll(s.EtcdDir))
+}
+
+func (s *Etcd3TestSuite) SetupTest() {
+	// Etcd3 specific test setup
+	s.Etcd3Config = &metadata.Etcd3Config{
+		Endpoints: s.EtcdClient.Endpoints(),
+		Prefix:    "etcd3Test-" + uuid.New(),
+		LeaseTTL:  5,
+	}
+	s.StoreConfig, _ = json.Marshal(s.Etcd3Config)
+
+	// General store test setup
+	s.StoreSuite.SetupTest()
+}
+
+func (s *Etcd3TestSuite) TearDownTest() {
+	_ = s.Store.Shutdown()
+	_, err := s.EtcdClient.Delete(context.Background(), s.Etcd3Config.Prefix, clientv3.WithPrefix())
+	s.NoError(err)
+}
+
+func TestEtcd3TestSuite(t *testing.T) {
+	s := new(Etcd3TestSuite)
+	s.StoreName = "etcd3"
+	suite.Run(t, s)
+}
+
+func (s *Etcd3TestSuite) TestConfigValidate() {
+	tests := []struct {
+		description string
+		config      *metadata.Etcd3Config
+		expectedErr error
+	}{
+		{"empty config should be valid",
+			&metadata.Etcd3Config{}, nil},
+		{"config to use for tests should be valid",
+			s.Etcd3Config, nil},
+		{"cert-only config should be invalid",
+			&metadata.Etcd3Config{Cert: "foo"}, metadata.ErrIncompleteTLSConfig},
+		{"complete tls config should be valid",
+			&metadata.Etcd3Config{Cert: "foo", Key: "bar", CaCert: "baz"}, nil},
+	}
+
+	for _, test := range tests {
+		s.Equal(test.expectedErr, test.config.Validate(), test.description)
+	}
+}
+
+func (s *Etcd3TestSuite) TestInit() {
+	tests := []struct {
+		description string
+		configJSON  string
+		expectedErr bool
+	}{
+		{"bad json should fail",
+			"not actually json", true},
+		{"incomplete tls config should fail",
+			`{"cert":"blah"}`, true},
+		{"bad tls config should fail",
+			`{"cert":"/dev/null/foo", "key":"asdf", "cacert":"asdf"}`, true},
+		{"valid config should succeed",
+			string(s.StoreConfig), false},
+	}
+
+	for _, test := range tests {
+		store := metadata.NewStore("etcd3")
+		config := []byte(test.configJSON)
+		err := store.Init(config)
+		if test.expectedErr {
+			s.Error(err, test.description)
+		} else {
+			s.NoError(err, test.description)
+			s.NoError(store.Shutdown())
+		}
+	}
+}
+
+func (s *Etcd3TestSuite) TestPutConflict() {
+	s.Require().NoError(s.Store.Put(s.Image))
+
+	first, err := s.Store.GetByID(s.Image.ID)
+	s.Require().NoError(err)
+	second, err := s.Store.GetByID(s.Image.ID)
+	s.Require().NoError(err)
+
+	first.Comment = "modified"
+	s.NoError(s.Store.Put(first), "update of the latest version should succeed")
+	s.Equal(metadata.ErrConflict, s.Store.Put(second), "update of a stale version should conflict")
+
+	image, err := s.Store.GetByID(s.Image.ID)
+	s.NoError(err)
+	s.Equal("modified", image.Comment, "stale update should not be stored")
+
+	second.Size = 10
+	s.NoError(second.SetFinished(nil), "status change of a stale version should be applied to the latest")
+	image, err = s.Store.GetByID(s.Image.ID)
+	s.NoError(err)
+	s.Equal(metadata.StatusComplete, image.Status, "status change should be stored")
+	s.EqualValues(10, image.Size, "fetch state should be stored")
+	s.Equal("modified", image.Comment, "other changes should be kept")
+	s.Equal("modified", second.Comment, "image should take on the stored version")
+	s.NoError(second.UpdateSize(20), "later updates should not conflict")
+
+	s.Require().NoError(s.Store.Delete(s.Image.ID))
+	s.Equal(metadata.ErrNotFound, second.SetCancelled(), "status change should not store a removed image again")
+	_, err = s.Store.GetByID(s.Image.ID)
+	s.Equal(metadata.ErrNotFound, err)
+}
+
+func (s *Etcd3TestSuite) TestDownloadLease() {
+	downloadKey := s.Etcd3Config.Prefix + "/downloads/" + s.Image.ID
+	ctx := context.Background()
+
+	s.Image.Store = s.Store
+	s.Require().NoError(s.Image.SetDownloading(10))
+	resp, err := s.EtcdClient.Get(ctx, downloadKey)
+	s.NoError(err)
+	s.Require().Len(resp.Kvs, 1, "download record should exist while downloading")
+	s.NotZero(resp.Kvs[0].Lease, "download record should be attached to a lease")
+
+	s.Require().NoError(s.Image.SetFinished(nil))
+	resp, err = s.EtcdClient.Get(ctx, downloadKey)
+	s.NoError(err)
+	s.Empty(resp.Kvs, "download record should be removed once finished")
+
+	// The record should go away with the store that created it
+	s.Require().NoError(s.Image.SetDownloading(10))
+	s.Require().NoError(s.Store.Shutdown())
+	resp, err = s.EtcdClient.Get(ctx, downloadKey)
+	s.NoError(err)
+	s.Empty(resp.Kvs, "download record should be removed with its lease")
+}
+
+func (s *Etcd3TestSuite) TestDownloadTracker() {
+	other := metadata.NewStore("etcd3")
+	s.Require().NoError(other.Init(s.StoreConfig))
+	defer func() { _ = other.Shutdown() }()
+	tracker := s.Store.(metadata.DownloadTracker)
+	otherTracker := other.(metadata.DownloadTracker)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	removed := make(chan string, 10)
+	tracker.WatchDownloads(ctx, func(imageID string) {
+		removed <- imageID
+	})
+
+	// Downloaded by the other store
+	image := &metadata.Image{ID: metadata.NewID(), Type: "kvm", Store: other}
+	s.Require().NoError(image.SetDownloading(10))
+
+	downloading, err := tracker.Downloading(image.ID)
+	s.NoError(err)
+	s.True(downloading, "download by another store should be seen")
+	downloading, err = otherTracker.Downloading(image.ID)
+	s.NoError(err)
+	s.False(downloading, "own download should not be seen as another's")
+	downloading, err = tracker.Downloading(s.Image.ID)
+	s.NoError(err)
+	s.False(downloading, "image not downloading should not be seen")
+
+	// The record goes away with the other store
+	s.Require().NoError(other.Shutdown())
+	select {
+	case imageID := <-removed:
+		s.Equal(image.ID, imageID, "removed download record should be watched")
+	case <-time.After(10 * time.Second):
+		s.Fail("removed download record was not watched")
+	}
+	downloading, err = tracker.Downloading(image.ID)
+	s.NoError(err)
+	s.False(downloading)
+}
+
+func (s *Etcd3TestSuite) TestBuildIndexes() {
+	// Store an image the way an unindexed store would
+	image := &metadata.Image{ID: metadata.NewID(), Type: "kvm", Source: "http://localhost/unindexed"}
+	imageJSON, _ := json.Marshal(image)
+	ctx := context.Background()
+	_, err := s.EtcdClient.Put(ctx, s.Etcd3Config.Prefix+"/images/"+image.ID, string(imageJSON))
+	s.Require().NoError(err)
+	_, err = s.EtcdClient.Delete(ctx, s.Etcd3Config.Prefix+"/index_version")
+	s.Require().NoError(err)
+
+	store := metadata.NewStore("etcd3")
+	s.Require().NoError(store.Init(s.StoreConfig))
+	defer func() { _ = store.Shutdown() }()
+	found, err := store.GetBySource(image.Source)
+	s.NoError(err, "existing images should be indexed on init")
+	s.Equal(image.ID, found.ID)
+}
+
+// freeURL finds an unused local address for the embedded etcd server
+func freeURL(s *Etcd3TestSuite) *url.URL {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	s.Require().NoError(err)
+	defer func() { _ = listener.Close() }()
+	return &url.URL{Scheme: "http", Host: listener.Addr().String()}
+}
@@ -6,12 +6,13 @@ import (
 
 	"github.com/coreos/go-etcd/etcd"
 	"github.com/mistifyio/mistify-image-service/metadata"
+	"github.com/mistifyio/mistify-image-service/metadata/storetest"
 	"github.com/pborman/uuid"
 	"github.com/stretchr/testify/suite"
 )
 
 type EtcdTestSuite struct {
-	StoreTestSuite
+	storetest.StoreSuite
 	EtcdConfig *metadata.EtcdConfig
 	// EtcdClient is for post-test cleanup of etcd
 	EtcdClient *etcd.Client
@@ -22,7 +23,7 @@ func (s *EtcdTestSuite) SetupSuite() {
 	s.EtcdClient = etcd.NewClient(nil)
 
 	// General store suite setup
-	s.StoreTestSuite.SetupSuite()
+	s.StoreSuite.SetupSuite()
 }
 
 func (s *EtcdTestSuite) SetupTest() {
@@ -34,7 +35,7 @@ func (s *EtcdTestSuite) SetupTest() {
 	s.StoreConfig = configBytes
 
 	// General store test setup
-	s.StoreTestSuite.SetupTest()
+	s.StoreSuite.SetupTest()
 }
 
 func (s *EtcdTestSuite) TearDownTest() {
@@ -8,10 +8,12 @@ import (
 
 // Image statuses
 const (
+	StatusQueued      = "queued"
 	StatusPending     = "pending"
 	StatusDownloading = "downloading"
 	StatusComplete    = "complete"
 	StatusError       = "error"
+	StatusCancelled   = "cancelled"
 )
 
 // Valid image types
@@ -29,16 +31,36 @@ var ValidImageTypes = map[string]struct{}{
 type (
 	// Image is metadata for an image
 	Image struct {
-		ID            string    `json:"id"`
-		Source        string    `json:"source"`
-		Type          string    `json:"type"`
-		Comment       string    `json:"comment"`
-		Status        string    `json:"status"`
-		Size          int64     `json:"size"`
-		ExpectedSize  int64     `json:"expected_size"`
-		DownloadStart time.Time `json:"download_start"`
-		DownloadEnd   time.Time `json:"download_end"`
-		Store         Store     `json:"-"`
+		ID               string    `json:"id"`
+		Source           string    `json:"source"`
+		Type             string    `json:"type"`
+		Comment          string    `json:"comment"`
+		Status           string    `json:"status"`
+		Error            string    `json:"error"`
+		Attempts         int       `json:"attempts"`
+		Priority         int       `json:"priority"`
+		Size             int64     `json:"size"`
+		ExpectedSize     int64     `json:"expected_size"`
+		ChecksumType     string    `json:"checksum_type"`
+		Checksum         string    `json:"checksum"`
+		ExpectedChecksum string    `json:"expected_checksum"`
+		Digest           string    `json:"digest"`
+		ImageStore       string    `json:"image_store"`
+		Peer             string    `json:"peer"`
+		PeerSource       string    `json:"peer_source"`
+		SignatureURL     string    `json:"signature_url"`
+		Signature        string    `json:"signature"`
+		SignatureStatus  string    `json:"signature_status"`
+		Signer           string    `json:"signer"`
+		ServiceSignature string    `json:"service_signature"`
+		ServiceKeyID     string    `json:"service_key_id"`
+		QueuedAt         time.Time `json:"queued_at"`
+		DownloadStart    time.Time `json:"download_start"`
+		DownloadEnd      time.Time `json:"download_end"`
+		Store            Store     `json:"-"`
+		// revision is the store revision the image was last read or written
+		// at, for stores that detect conflicting updates
+		revision int64
 	}
 )
 
@@ -47,36 +69,130 @@ func NewID() string {
 	return uuid.New()
 }
 
+// BlobID returns the id the image data is stored under. Data for a complete
+// image is addressed by its digest so identical data can be shared between
+// images. Data still being transferred, or stored before content addressing
+// was introduced, is stored under the image id.
+func (image *Image) BlobID() string {
+	if image.Digest != "" {
+		return image.Digest
+	}
+	return image.ID
+}
+
+// FetchURL returns the url the image data is fetched from. An image replicated
+// or mirrored from a peer keeps its original source and is pulled from the
+// peer source instead.
+func (image *Image) FetchURL() string {
+	if image.PeerSource != "" {
+		return image.PeerSource
+	}
+	return image.Source
+}
+
+// SetQueued updates an image to queued status, waiting to be fetched
+func (image *Image) SetQueued() error {
+	image.Status = StatusQueued
+	image.QueuedAt = time.Now()
+	return image.save()
+}
+
 // SetPending updates an image to pending status
 func (image *Image) SetPending() error {
 	image.Status = StatusPending
-	return image.Store.Put(image)
+	return image.save()
 }
 
-// SetDownloading updates an image to downloading status with estimated size
+// SetDownloading updates an image to downloading status with estimated size.
+// The download start time is kept from the first download attempt.
 func (image *Image) SetDownloading(size int64) error {
 	image.Status = StatusDownloading
-	image.DownloadStart = time.Now()
+	if image.DownloadStart.IsZero() {
+		image.DownloadStart = time.Now()
+	}
 	image.ExpectedSize = size
-	return image.Store.Put(image)
+	return image.save()
+}
+
+// SetRetrying records the error from a failed download attempt that will be
+// retried
+func (image *Image) SetRetrying(err error) error {
+	image.Error = err.Error()
+	return image.save()
 }
 
 // UpdateSize upates an image's current size
 func (image *Image) UpdateSize(size int64) error {
 	image.Size = size
-	return image.Store.Put(image)
+	return image.save()
+}
+
+// SetDigest records the digest of an image's data once it is stored at its
+// content address
+func (image *Image) SetDigest(digest string) error {
+	image.Digest = digest
+	return image.save()
 }
 
-// SetFinished updates an image to the final status
+// SetFinished updates an image to the final status, recording the error
+// message as the reason when the image failed
 func (image *Image) SetFinished(err error) error {
 	if err != nil {
 		image.Status = StatusError
+		image.Error = err.Error()
 	} else {
 		image.Status = StatusComplete
+		image.Error = ""
 	}
 
 	image.DownloadEnd = time.Now()
-	return image.Store.Put(image)
+	return image.save()
+}
+
+// SetCancelled updates an image to cancelled status, for a fetch stopped before
+// it finished
+func (image *Image) SetCancelled() error {
+	image.Status = StatusCancelled
+	image.Error = ""
+	image.DownloadEnd = time.Now()
+	return image.save()
+}
+
+// save stores an image after a fetch status change. A store that detects
+// conflicting updates refuses the image if someone else modified it since it
+// was read, for example to relocate or repair it. The current version is then
+// read again and the fetch state of this copy, which the fetch owns, is
+// applied to it, keeping the other changes. This copy takes on the stored
+// version, so later updates don't conflict.
+func (image *Image) save() error {
+	err := image.Store.Put(image)
+	for err == ErrConflict {
+		var current *Image
+		if current, err = image.Store.GetByID(image.ID); err != nil {
+			return err
+		}
+		current.Status = image.Status
+		current.Error = image.Error
+		current.Attempts = image.Attempts
+		current.Size = image.Size
+		current.ExpectedSize = image.ExpectedSize
+		current.Checksum = image.Checksum
+		current.Digest = image.Digest
+		current.ImageStore = image.ImageStore
+		current.SignatureStatus = image.SignatureStatus
+		current.Signer = image.Signer
+		current.ServiceSignature = image.ServiceSignature
+		current.ServiceKeyID = image.ServiceKeyID
+		current.QueuedAt = image.QueuedAt
+		current.DownloadStart = image.DownloadStart
+		current.DownloadEnd = image.DownloadEnd
+		if err = current.Store.Put(current); err == nil {
+			store := image.Store
+			*image = *current
+			image.Store = store
+		}
+	}
+	return err
 }
 
 // IsValidImageType tests whether the image type is valid
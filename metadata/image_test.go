@@ -50,6 +50,12 @@ func (s *ImageTestSuite) TestIsValidImageType() {
 	s.False(metadata.IsValidImageType("foobar"), "should be an invalid image type")
 }
 
+func (s *ImageTestSuite) TestSetQueued() {
+	s.NoError(s.TestImage.SetQueued())
+	s.Equal(metadata.StatusQueued, s.TestImage.Status)
+	s.WithinDuration(s.TestImage.QueuedAt, time.Now(), 1*time.Second, "queuedat should be set to now")
+}
+
 func (s *ImageTestSuite) TestSetPending() {
 	s.NoError(s.TestImage.SetPending())
 	s.Equal(metadata.StatusPending, s.TestImage.Status)
@@ -62,6 +68,15 @@ func (s *ImageTestSuite) TestSetDownloading() {
 	s.Equal(metadata.StatusDownloading, s.TestImage.Status)
 	s.WithinDuration(s.TestImage.DownloadStart, time.Now(), 1*time.Second, "downloadstart should be set to now")
 	s.Equal(size, s.TestImage.ExpectedSize, "expected size should be set to the size")
+
+	downloadStart := s.TestImage.DownloadStart
+	s.NoError(s.TestImage.SetDownloading(size))
+	s.Equal(downloadStart, s.TestImage.DownloadStart, "downloadstart should be kept from the first attempt")
+}
+
+func (s *ImageTestSuite) TestSetRetrying() {
+	s.NoError(s.TestImage.SetRetrying(errors.New("An Error")))
+	s.Equal("An Error", s.TestImage.Error, "attempt error should be recorded")
 }
 
 func (s *ImageTestSuite) TestUpdateSize() {
@@ -77,6 +92,7 @@ func (s *ImageTestSuite) TestUpdateSize() {
 func (s *ImageTestSuite) TestSetFinished() {
 	s.NoError(s.TestImage.SetFinished(nil))
 	s.Equal(metadata.StatusComplete, s.TestImage.Status, "finishing with no error should set complete status")
+	s.Empty(s.TestImage.Error, "finishing with no error should not set an error")
 	s.WithinDuration(s.TestImage.DownloadEnd, time.Now(), 1*time.Second, "downloadend should be set to now")
 
 	image := &metadata.Image{
@@ -86,5 +102,14 @@ func (s *ImageTestSuite) TestSetFinished() {
 	image.Store.(*mocks.Store).On("Put", image).Return(nil)
 	s.NoError(image.SetFinished(errors.New("An Error")))
 	s.Equal(metadata.StatusError, image.Status, "finishing with error should set error status")
+	s.Equal("An Error", image.Error, "finishing with error should record the error")
 	s.WithinDuration(image.DownloadEnd, time.Now(), 1*time.Minute, "downloadend should be set to now")
 }
+
+func (s *ImageTestSuite) TestSetCancelled() {
+	s.TestImage.Error = "An Error"
+	s.NoError(s.TestImage.SetCancelled())
+	s.Equal(metadata.StatusCancelled, s.TestImage.Status, "status should be cancelled")
+	s.Empty(s.TestImage.Error, "cancelling should clear any attempt error")
+	s.WithinDuration(s.TestImage.DownloadEnd, time.Now(), 1*time.Second, "downloadend should be set to now")
+}
@@ -0,0 +1,99 @@
+package metadata
+
+import (
+	"strings"
+	"time"
+)
+
+// downloadedKeyFormat formats download end times as fixed width UTC strings,
+// so keys sort in time order
+const downloadedKeyFormat = "2006-01-02T15:04:05.000000000Z"
+
+type (
+	// index describes a secondary lookup of images by a derived key. Stores
+	// maintain a key to image ids mapping for each index alongside the image
+	// metadata so lookups don't require a full scan.
+	index struct {
+		name string
+		// key returns the index key for an image. Images with an empty key
+		// are not indexed.
+		key func(*Image) string
+	}
+)
+
+var (
+	// sourceIndex looks up images by source
+	sourceIndex = &index{
+		name: "source",
+		key: func(image *Image) string {
+			return image.Source
+		},
+	}
+
+	// digestIndex looks up images by data digest
+	digestIndex = &index{
+		name: "digest",
+		key: func(image *Image) string {
+			return image.Digest
+		},
+	}
+
+	// statusIndex looks up images by status
+	statusIndex = &index{
+		name: "status",
+		key: func(image *Image) string {
+			return image.Status
+		},
+	}
+
+	// downloadedIndex orders images that finished downloading by download
+	// end time
+	downloadedIndex = &index{
+		name: "downloaded",
+		key: func(image *Image) string {
+			return downloadedKey(image.DownloadEnd)
+		},
+	}
+
+	// indexes are the indexes maintained by all stores
+	indexes = []*index{sourceIndex, digestIndex}
+
+	// queryIndexes are the indexes maintained by stores that push query
+	// filters down to them
+	queryIndexes = []*index{sourceIndex, digestIndex, statusIndex, downloadedIndex}
+)
+
+// indexVersion identifies a set of indexes maintained. Stores record it when
+// building indexes and rebuild them from the image metadata when it changes,
+// such as when a new index is added.
+func indexVersion(idxs []*index) string {
+	names := make([]string, len(idxs))
+	for i, idx := range idxs {
+		names[i] = idx.name
+	}
+	return strings.Join(names, ",")
+}
+
+// indexKeyChanged checks whether an image update requires an index entry to
+// be removed. A nil image has no index entries.
+func indexKeyChanged(idx *index, oldImage, newImage *Image) bool {
+	if oldImage == nil || idx.key(oldImage) == "" {
+		return false
+	}
+	return newImage == nil || idx.key(oldImage) != idx.key(newImage)
+}
+
+// downloadedKey returns the downloaded index key for a download end time,
+// which is empty for images that have not finished downloading
+func downloadedKey(downloadEnd time.Time) string {
+	if downloadEnd.IsZero() {
+		return ""
+	}
+	return downloadEnd.UTC().Format(downloadedKeyFormat)
+}
+
+// downloadedRange returns the downloaded index keys bounding a query download
+// range, inclusive and exclusive respectively. Either is empty if unbounded.
+func downloadedRange(q *Query) (string, string) {
+	return downloadedKey(q.DownloadedAfter), downloadedKey(q.DownloadedBefore)
+}
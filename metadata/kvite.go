@@ -3,9 +3,11 @@ package metadata
 import (
 	"encoding/json"
 	"errors"
+	"strings"
+	"time"
 
-	log "github.com/Sirupsen/logrus"
 	"github.com/mistifyio/kvite"
+	log "github.com/sirupsen/logrus"
 )
 
 // ErrMissingFilename is used when the store config is missing a required
@@ -38,6 +40,14 @@ var kviteLogFields = log.Fields{
 
 const kviteBucket = "images"
 
+// kviteMetaBucket holds store bookkeeping, such as the version of the indexes
+const kviteMetaBucket = "meta"
+
+const kviteIndexVersionKey = "index_version"
+
+// kviteTokensBucket holds the api tokens
+const kviteTokensBucket = "tokens"
+
 // Validate checks whether the config is valid
 func (kvc *KViteConfig) Validate() error {
 	if kvc.Filename == "" {
@@ -86,7 +96,7 @@ func (kv *KVite) Init(configBytes []byte) error {
 	}
 
 	kv.db = db
-	return nil
+	return kv.buildIndexes()
 }
 
 // Shutdown closes the connection to kvite
@@ -132,15 +142,83 @@ func (kv *KVite) List(imageType string) ([]*Image, error) {
 	return images, err
 }
 
+// Query retrieves a page of images from kvite matching a query. A status,
+// source prefix or download range filter is looked up in the indexes, so only
+// candidate images are read, and only the images that could be on the page
+// are kept while scanning.
+func (kv *KVite) Query(query *Query) ([]*Image, string, error) {
+	if err := query.Validate(); err != nil {
+		return nil, "", err
+	}
+	pc, err := query.newPageCollector()
+	if err != nil {
+		return nil, "", err
+	}
+
+	err = kv.db.Transaction(func(tx *kvite.Tx) error {
+		// Setup the bucket
+		bucket, err := kv.bucketSetup(tx)
+		if bucket == nil || err != nil {
+			return err
+		}
+
+		if query.hasIndexedFilter() {
+			ids, err := kv.queryIDs(tx, query)
+			if err != nil {
+				return err
+			}
+			for _, imageID := range ids {
+				if !pc.wantsID(imageID) {
+					continue
+				}
+				image, err := kv.getImage(bucket, imageID)
+				if err != nil {
+					return err
+				}
+				if image != nil {
+					pc.add(image)
+				}
+			}
+			return nil
+		}
+
+		return bucket.ForEach(func(key string, value []byte) error {
+			if !pc.wantsID(key) {
+				return nil
+			}
+			image := &Image{}
+			if err := json.Unmarshal(value, image); err != nil {
+				log.WithFields(kviteLogFields).WithFields(log.Fields{
+					"error":  err,
+					"bucket": kviteBucket,
+					"key":    key,
+					"value":  string(value),
+				}).Error("failed to parse image json")
+				return err
+			}
+			pc.add(image)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	return pc.page()
+}
+
 // GetByID retrieves an image from kvite using the image id
 func (kv *KVite) GetByID(imageID string) (*Image, error) {
 	var image Image
 	err := kv.db.Transaction(func(tx *kvite.Tx) error {
 		// Setup the bucket
 		bucket, err := kv.bucketSetup(tx)
-		if bucket == nil || err != nil {
+		if err != nil {
 			return err
 		}
+		if bucket == nil {
+			return ErrNotFound
+		}
 
 		value, err := bucket.Get(imageID)
 		if err != nil {
@@ -169,49 +247,24 @@ func (kv *KVite) GetByID(imageID string) (*Image, error) {
 	if err != nil {
 		return nil, err
 	}
-	if image.ID == "" {
-		return nil, nil
-	}
 	return &image, nil
 }
 
 // GetBySource retrieves an image from kvite using the image source
 func (kv *KVite) GetBySource(imageSource string) (*Image, error) {
-	var foundImage Image
-	err := kv.db.Transaction(func(tx *kvite.Tx) error {
-		// Setup the bucket
-		bucket, err := kv.bucketSetup(tx)
-		if bucket == nil || err != nil {
-			return err
-		}
-
-		// Go through the image and check the sources
-		// Is there a more efficient way with kvite?
-		return bucket.ForEach(func(key string, value []byte) error {
-			image := &Image{}
-			if err := json.Unmarshal(value, image); err != nil {
-				log.WithFields(kviteLogFields).WithFields(log.Fields{
-					"error":  err,
-					"bucket": kviteBucket,
-					"key":    key,
-					"value":  string(value),
-				}).Error("failed to parse image json")
-				return err
-			}
-			if image.Source == imageSource {
-				foundImage = *image
-			}
-			return nil
-		})
-	})
-
+	images, err := kv.lookup(sourceIndex, imageSource)
 	if err != nil {
 		return nil, err
 	}
-	if foundImage.ID == "" {
+	if len(images) == 0 {
 		return nil, ErrNotFound
 	}
-	return &foundImage, nil
+	return images[0], nil
+}
+
+// GetByDigest retrieves the images from kvite with a data digest
+func (kv *KVite) GetByDigest(digest string) ([]*Image, error) {
+	return kv.lookup(digestIndex, digest)
 }
 
 // Put stores an image in kvite
@@ -231,6 +284,14 @@ func (kv *KVite) Put(image *Image) error {
 			}).Error("failed to marshal image")
 		}
 
+		oldImage, err := kv.getImage(bucket, image.ID)
+		if err != nil {
+			return err
+		}
+		if err := kv.updateIndexes(tx, oldImage, image); err != nil {
+			return err
+		}
+
 		if err := bucket.Put(image.ID, value); err != nil {
 			log.WithFields(kviteLogFields).WithFields(log.Fields{
 				"error": err,
@@ -253,6 +314,14 @@ func (kv *KVite) Delete(imageID string) error {
 			return err
 		}
 
+		oldImage, err := kv.getImage(bucket, imageID)
+		if err != nil {
+			return err
+		}
+		if err := kv.updateIndexes(tx, oldImage, nil); err != nil {
+			return err
+		}
+
 		if err := bucket.Delete(imageID); err != nil {
 			log.WithFields(kviteLogFields).WithFields(log.Fields{
 				"error": err,
@@ -265,6 +334,165 @@ func (kv *KVite) Delete(imageID string) error {
 	return err
 }
 
+// PutToken stores an api token in kvite
+func (kv *KVite) PutToken(token *Token) error {
+	value, err := json.Marshal(token)
+	if err != nil {
+		log.WithFields(kviteLogFields).WithFields(log.Fields{
+			"error":   err,
+			"tokenID": token.ID,
+		}).Error("failed to marshal token")
+		return err
+	}
+
+	return kv.db.Transaction(func(tx *kvite.Tx) error {
+		bucket, err := kv.tokenBucket(tx)
+		if err != nil {
+			return err
+		}
+		if err := bucket.Put(token.ID, value); err != nil {
+			log.WithFields(kviteLogFields).WithFields(log.Fields{
+				"error": err,
+				"key":   token.ID,
+			}).Error("failed to store token")
+			return err
+		}
+		return nil
+	})
+}
+
+// GetToken retrieves an api token from kvite using the token id
+func (kv *KVite) GetToken(tokenID string) (*Token, error) {
+	var token *Token
+	err := kv.db.Transaction(func(tx *kvite.Tx) error {
+		bucket, err := kv.tokenBucket(tx)
+		if err != nil {
+			return err
+		}
+		value, err := bucket.Get(tokenID)
+		if err != nil {
+			log.WithFields(kviteLogFields).WithFields(log.Fields{
+				"error":   err,
+				"tokenID": tokenID,
+			}).Error("failed to retrieve token")
+			return err
+		}
+		if value == nil {
+			return ErrTokenNotFound
+		}
+		token, err = kv.unmarshalToken(tokenID, value)
+		return err
+	})
+	return token, err
+}
+
+// ListTokens retrieves all api tokens from kvite
+func (kv *KVite) ListTokens() ([]*Token, error) {
+	var tokens []*Token
+	err := kv.db.Transaction(func(tx *kvite.Tx) error {
+		bucket, err := kv.tokenBucket(tx)
+		if err != nil {
+			return err
+		}
+		return bucket.ForEach(func(key string, value []byte) error {
+			token, err := kv.unmarshalToken(key, value)
+			if err != nil {
+				return err
+			}
+			tokens = append(tokens, token)
+			return nil
+		})
+	})
+	return tokens, err
+}
+
+// DeleteToken removes an api token from kvite
+func (kv *KVite) DeleteToken(tokenID string) error {
+	return kv.db.Transaction(func(tx *kvite.Tx) error {
+		bucket, err := kv.tokenBucket(tx)
+		if err != nil {
+			return err
+		}
+		if err := bucket.Delete(tokenID); err != nil {
+			log.WithFields(kviteLogFields).WithFields(log.Fields{
+				"error": err,
+				"key":   tokenID,
+			}).Error("failed to delete token")
+			return err
+		}
+		return nil
+	})
+}
+
+// TouchToken records the last use of an api token in kvite
+func (kv *KVite) TouchToken(tokenID string, lastUsed time.Time) error {
+	return kv.db.Transaction(func(tx *kvite.Tx) error {
+		bucket, err := kv.tokenBucket(tx)
+		if err != nil {
+			return err
+		}
+		value, err := bucket.Get(tokenID)
+		if err != nil {
+			log.WithFields(kviteLogFields).WithFields(log.Fields{
+				"error":   err,
+				"tokenID": tokenID,
+			}).Error("failed to retrieve token")
+			return err
+		}
+		if value == nil {
+			return ErrTokenNotFound
+		}
+		token, err := kv.unmarshalToken(tokenID, value)
+		if err != nil {
+			return err
+		}
+		token.LastUsed = lastUsed
+		if value, err = json.Marshal(token); err != nil {
+			log.WithFields(kviteLogFields).WithFields(log.Fields{
+				"error":   err,
+				"tokenID": token.ID,
+			}).Error("failed to marshal token")
+			return err
+		}
+		if err := bucket.Put(tokenID, value); err != nil {
+			log.WithFields(kviteLogFields).WithFields(log.Fields{
+				"error": err,
+				"key":   tokenID,
+			}).Error("failed to store token")
+			return err
+		}
+		return nil
+	})
+}
+
+// tokenBucket gets the kvite bucket holding the api tokens, creating it if
+// needed
+func (kv *KVite) tokenBucket(tx *kvite.Tx) (*kvite.Bucket, error) {
+	bucket, err := tx.CreateBucketIfNotExists(kviteTokensBucket)
+	if err != nil {
+		log.WithFields(kviteLogFields).WithFields(log.Fields{
+			"error":  err,
+			"bucket": kviteTokensBucket,
+		}).Error("failed to retrieve bucket")
+		return nil, err
+	}
+	return bucket, nil
+}
+
+// unmarshalToken parses stored token json
+func (kv *KVite) unmarshalToken(key string, value []byte) (*Token, error) {
+	token := &Token{}
+	if err := json.Unmarshal(value, token); err != nil {
+		log.WithFields(kviteLogFields).WithFields(log.Fields{
+			"error":  err,
+			"bucket": kviteTokensBucket,
+			"key":    key,
+		}).Error("failed to parse token json")
+		return nil, err
+	}
+	return token, nil
+}
+
 // bucketSetup gets a kvite bucket and logs any issues/errors
 func (kv *KVite) bucketSetup(tx *kvite.Tx) (*kvite.Bucket, error) {
 	// Setup the bucket
@@ -284,6 +512,292 @@ func (kv *KVite) bucketSetup(tx *kvite.Tx) (*kvite.Bucket, error) {
 	return bucket, err
 }
 
+// getImage retrieves an image within a transaction, returning nil if it does
+// not exist
+func (kv *KVite) getImage(bucket *kvite.Bucket, imageID string) (*Image, error) {
+	value, err := bucket.Get(imageID)
+	if err != nil {
+		log.WithFields(kviteLogFields).WithFields(log.Fields{
+			"error":   err,
+			"imageID": imageID,
+		}).Error("failed to retrieve image")
+		return nil, err
+	}
+	if value == nil {
+		return nil, nil
+	}
+
+	image := &Image{}
+	if err := json.Unmarshal(value, image); err != nil {
+		log.WithFields(kviteLogFields).WithFields(log.Fields{
+			"error":  err,
+			"bucket": kviteBucket,
+			"key":    imageID,
+			"value":  string(value),
+		}).Error("failed to parse image json")
+		return nil, err
+	}
+	return image, nil
+}
+
+// lookup retrieves the images with a key in an index
+func (kv *KVite) lookup(idx *index, key string) ([]*Image, error) {
+	var images []*Image
+	err := kv.db.Transaction(func(tx *kvite.Tx) error {
+		ids, err := kv.indexIDs(tx, idx, key)
+		if err != nil || len(ids) == 0 {
+			return err
+		}
+
+		bucket, err := kv.bucketSetup(tx)
+		if bucket == nil || err != nil {
+			return err
+		}
+
+		for _, imageID := range ids {
+			image, err := kv.getImage(bucket, imageID)
+			if err != nil {
+				return err
+			}
+			if image != nil {
+				images = append(images, image)
+			}
+		}
+		return nil
+	})
+	return images, err
+}
+
+// indexIDs retrieves the image ids stored under a key in an index, reading
+// only the entries of that key
+func (kv *KVite) indexIDs(tx *kvite.Tx, idx *index, key string) ([]string, error) {
+	bucketName := kviteIndexKeyBucket(idx, key)
+	bucket, err := tx.CreateBucketIfNotExists(bucketName)
+	if err != nil {
+		log.WithFields(kviteLogFields).WithFields(log.Fields{
+			"error":  err,
+			"bucket": bucketName,
+		}).Error("failed to retrieve bucket")
+		return nil, err
+	}
+
+	var ids []string
+	err = bucket.ForEach(func(imageID string, value []byte) error {
+		ids = append(ids, imageID)
+		return nil
+	})
+	return ids, err
+}
+
+// queryIDs retrieves the ids of the images that may match a query's indexed
+// filters. A status is looked up directly, and a source prefix or download
+// range by scanning the index entries.
+func (kv *KVite) queryIDs(tx *kvite.Tx, query *Query) ([]string, error) {
+	switch {
+	case query.Status != "":
+		return kv.indexIDs(tx, statusIndex, query.Status)
+	case query.SourcePrefix != "":
+		return kv.scanIndex(tx, sourceIndex, func(key string) bool {
+			return strings.HasPrefix(key, query.SourcePrefix)
+		})
+	default:
+		after, before := downloadedRange(query)
+		return kv.scanIndex(tx, downloadedIndex, func(key string) bool {
+			return key >= after && (before == "" || key < before)
+		})
+	}
+}
+
+// scanIndex retrieves the image ids of the entries of an index whose keys
+// satisfy a test
+func (kv *KVite) scanIndex(tx *kvite.Tx, idx *index, test func(string) bool) ([]string, error) {
+	bucketName := kviteIndexBucket(idx)
+	bucket, err := tx.CreateBucketIfNotExists(bucketName)
+	if err != nil {
+		log.WithFields(kviteLogFields).WithFields(log.Fields{
+			"error":  err,
+			"bucket": bucketName,
+		}).Error("failed to retrieve bucket")
+		return nil, err
+	}
+
+	var ids []string
+	err = bucket.ForEach(func(entry string, value []byte) error {
+		if key, imageID, ok := splitKViteIndexEntry(entry); ok && test(key) {
+			ids = append(ids, imageID)
+		}
+		return nil
+	})
+	return ids, err
+}
+
+// modifyIndex adds or removes the entry of an image id under a key in an
+// index, touching only that entry
+func (kv *KVite) modifyIndex(tx *kvite.Tx, idx *index, key, imageID string, add bool) error {
+	entries := []struct{ bucket, key string }{
+		{kviteIndexBucket(idx), kviteIndexEntry(key, imageID)},
+		{kviteIndexKeyBucket(idx, key), imageID},
+	}
+	for _, entry := range entries {
+		bucket, err := tx.CreateBucketIfNotExists(entry.bucket)
+		if err != nil {
+			return err
+		}
+		if add {
+			err = bucket.Put(entry.key, []byte{})
+		} else {
+			err = bucket.Delete(entry.key)
+		}
+		if err != nil {
+			log.WithFields(kviteLogFields).WithFields(log.Fields{
+				"error":  err,
+				"bucket": entry.bucket,
+				"key":    entry.key,
+			}).Error("failed to update index entry")
+			return err
+		}
+	}
+	return nil
+}
+
+// updateIndexes updates all index entries for a change to an image within the
+// same transaction as the change. A nil oldImage is an addition and a nil
+// newImage is a removal.
+func (kv *KVite) updateIndexes(tx *kvite.Tx, oldImage, newImage *Image) error {
+	for _, idx := range queryIndexes {
+		if indexKeyChanged(idx, oldImage, newImage) {
+			if err := kv.modifyIndex(tx, idx, idx.key(oldImage), oldImage.ID, false); err != nil {
+				return err
+			}
+		}
+		if newImage != nil && idx.key(newImage) != "" {
+			if err := kv.modifyIndex(tx, idx, idx.key(newImage), newImage.ID, true); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// buildIndexes rebuilds the indexes from the image metadata when they were
+// built for a different set of indexes, or not at all
+func (kv *KVite) buildIndexes() error {
+	return kv.db.Transaction(func(tx *kvite.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists(kviteMetaBucket)
+		if err != nil {
+			log.WithFields(kviteLogFields).WithFields(log.Fields{
+				"error":  err,
+				"bucket": kviteMetaBucket,
+			}).Error("failed to retrieve bucket")
+			return err
+		}
+		version, err := meta.Get(kviteIndexVersionKey)
+		if err != nil {
+			return err
+		}
+		if string(version) == kviteIndexVersion() {
+			return nil
+		}
+
+		// Clear out existing index entries, including those of the earlier
+		// layout with a list of ids under each key
+		for _, idx := range queryIndexes {
+			bucket, err := tx.CreateBucketIfNotExists(kviteIndexBucket(idx))
+			if err != nil {
+				return err
+			}
+			var entries []string
+			if err := bucket.ForEach(func(entry string, value []byte) error {
+				entries = append(entries, entry)
+				return nil
+			}); err != nil {
+				return err
+			}
+			for _, entry := range entries {
+				if key, imageID, ok := splitKViteIndexEntry(entry); ok {
+					if err := kv.modifyIndex(tx, idx, key, imageID, false); err != nil {
+						return err
+					}
+				}
+				if err := bucket.Delete(entry); err != nil {
+					return err
+				}
+			}
+		}
+
+		// Index every image. Images are collected first so the index
+		// buckets aren't modified while iterating.
+		var allImages []*Image
+		bucket, err := kv.bucketSetup(tx)
+		if err != nil {
+			return err
+		}
+		if bucket != nil {
+			if err := bucket.ForEach(func(key string, value []byte) error {
+				image := &Image{}
+				if err := json.Unmarshal(value, image); err != nil {
+					log.WithFields(kviteLogFields).WithFields(log.Fields{
+						"error":  err,
+						"bucket": kviteBucket,
+						"key":    key,
+						"value":  string(value),
+					}).Error("failed to parse image json")
+					return err
+				}
+				allImages = append(allImages, image)
+				return nil
+			}); err != nil {
+				return err
+			}
+		}
+		for _, image := range allImages {
+			if err := kv.updateIndexes(tx, nil, image); err != nil {
+				return err
+			}
+		}
+
+		log.WithFields(kviteLogFields).WithFields(log.Fields{
+			"indexes": kviteIndexVersion(),
+			"count":   len(allImages),
+		}).Info("built indexes")
+		return meta.Put(kviteIndexVersionKey, []byte(kviteIndexVersion()))
+	})
+}
+
+// kviteIndexBucket returns the name of the bucket holding an index, with an
+// entry for each pair of indexed key and image id
+func kviteIndexBucket(idx *index) string {
+	return kviteBucket + "_by_" + idx.name
+}
+
+// kviteIndexKeyBucket returns the name of the bucket holding the image ids
+// indexed under a key. kvite has no range reads, so the entries of each key
+// are also kept in a bucket of their own, which lookups read directly.
+func kviteIndexKeyBucket(idx *index, key string) string {
+	return kviteIndexBucket(idx) + "/" + key
+}
+
+// kviteIndexEntry returns the index entry for an image id under a key. Image
+// ids can't contain a slash, so the entry is split at the last one.
+func kviteIndexEntry(key, imageID string) string {
+	return key + "/" + imageID
+}
+
+// splitKViteIndexEntry splits an index entry into its key and image id
+func splitKViteIndexEntry(entry string) (string, string, bool) {
+	i := strings.LastIndex(entry, "/")
+	if i < 0 {
+		return "", "", false
+	}
+	return entry[:i], entry[i+1:], true
+}
+
+// kviteIndexVersion identifies the indexes and their layout, so indexes built
+// for others are rebuilt
+func kviteIndexVersion() string {
+	return indexVersion(queryIndexes) + ";entries"
+}
+
 func init() {
 	Register("kvite", func() Store {
 		return &KVite{}
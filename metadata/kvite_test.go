@@ -6,13 +6,15 @@ import (
 	"os"
 	"testing"
 
+	"github.com/mistifyio/kvite"
 	"github.com/mistifyio/mistify-image-service/metadata"
+	"github.com/mistifyio/mistify-image-service/metadata/storetest"
 	"github.com/pborman/uuid"
 	"github.com/stretchr/testify/suite"
 )
 
 type KViteTestSuite struct {
-	StoreTestSuite
+	storetest.StoreSuite
 	KViteConfig *metadata.KViteConfig
 }
 
@@ -29,7 +31,7 @@ func (s *KViteTestSuite) SetupTest() {
 	s.StoreConfig = configBytes
 
 	// General store test setup
-	s.StoreTestSuite.SetupTest()
+	s.StoreSuite.SetupTest()
 }
 
 func (s *KViteTestSuite) TearDownTest() {
@@ -91,3 +93,66 @@ func (s *KViteTestSuite) TestInit() {
 		}
 	}
 }
+
+func (s *KViteTestSuite) TestBuildIndexes() {
+	// Store an image the way versions without indexes did
+	db, err := kvite.Open(s.KViteConfig.Filename, s.KViteConfig.Table)
+	s.Require().NoError(err)
+	image := &metadata.Image{ID: metadata.NewID(), Type: "kvm", Source: "http://localhost/unindexed"}
+	imageJSON, _ := json.Marshal(image)
+	s.Require().NoError(db.Transaction(func(tx *kvite.Tx) error {
+		meta, _ := tx.CreateBucketIfNotExists("meta")
+		if err := meta.Delete("index_version"); err != nil {
+			return err
+		}
+		bucket, _ := tx.CreateBucketIfNotExists("images")
+		return bucket.Put(image.ID, imageJSON)
+	}))
+	s.Require().NoError(db.Close())
+
+	store := metadata.NewStore("kvite")
+	s.Require().NoError(store.Init(s.StoreConfig))
+	found, err := store.GetBySource(image.Source)
+	s.NoError(err, "existing images should be indexed on init")
+	s.Equal(image.ID, found.ID)
+}
+
+func (s *KViteTestSuite) TestBuildIndexesLayout() {
+	// Store an index entry the way versions with a list of ids under each
+	// key did
+	db, err := kvite.Open(s.KViteConfig.Filename, s.KViteConfig.Table)
+	s.Require().NoError(err)
+	image := &metadata.Image{ID: metadata.NewID(), Type: "kvm", Source: "http://localhost/listed", Status: metadata.StatusComplete}
+	imageJSON, _ := json.Marshal(image)
+	idsJSON, _ := json.Marshal([]string{image.ID})
+	s.Require().NoError(db.Transaction(func(tx *kvite.Tx) error {
+		meta, _ := tx.CreateBucketIfNotExists("meta")
+		if err := meta.Put("index_version", []byte("source,digest,status,downloaded")); err != nil {
+			return err
+		}
+		index, _ := tx.CreateBucketIfNotExists("images_by_source")
+		if err := index.Put("http://localhost/stale", idsJSON); err != nil {
+			return err
+		}
+		bucket, _ := tx.CreateBucketIfNotExists("images")
+		return bucket.Put(image.ID, imageJSON)
+	}))
+	s.Require().NoError(db.Close())
+
+	store := metadata.NewStore("kvite")
+	s.Require().NoError(store.Init(s.StoreConfig))
+	found, err := store.GetBySource(image.Source)
+	s.NoError(err, "indexes of the earlier layout should be rebuilt on init")
+	s.Equal(image.ID, found.ID)
+	_, err = store.GetBySource("http://localhost/stale")
+	s.Equal(metadata.ErrNotFound, err, "entries of the earlier layout should be removed")
+
+	for _, query := range []*metadata.Query{
+		{Status: metadata.StatusComplete},
+		{SourcePrefix: "http://localhost/"},
+	} {
+		images, _, err := store.Query(query)
+		s.NoError(err)
+		s.Equal([]string{image.ID}, storetest.ImageIDs(images), "rebuilt indexes should be queried")
+	}
+}
@@ -0,0 +1,362 @@
+package metadata
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrStoreFull is used when storing an image would exceed the store's limit
+var ErrStoreFull = errors.New("store is full")
+
+// ErrInvalidMaxImages is used when the store config has a negative limit
+var ErrInvalidMaxImages = errors.New("invalid max images")
+
+type (
+	// Memory is a metadata store holding images in memory. It is meant for
+	// tests and ephemeral nodes; nothing survives a restart.
+	Memory struct {
+		Config *MemoryConfig
+		lock   sync.RWMutex
+		// images holds image json, so images handed out can't modify the
+		// stored copy, just as with other stores
+		images map[string][]byte
+		// indexes maps index name to index key to the set of image ids
+		indexes map[string]map[string]map[string]struct{}
+		// tokens holds api token json by token id
+		tokens map[string][]byte
+	}
+
+	// MemoryConfig contains config options for the memory store
+	MemoryConfig struct {
+		// MaxImages is the maximum number of images stored. Zero means no
+		// limit.
+		MaxImages int
+	}
+)
+
+// memoryLogFields contain fields to include on all logs
+var memoryLogFields = log.Fields{
+	"type":  "metadata",
+	"store": "memory",
+}
+
+// Validate checks whether the config is valid
+func (mc *MemoryConfig) Validate() error {
+	if mc.MaxImages < 0 {
+		return ErrInvalidMaxImages
+	}
+	return nil
+}
+
+// Init parses the config and sets up the store
+func (ms *Memory) Init(configBytes []byte) error {
+	config := &MemoryConfig{}
+
+	// Parse the config json
+	if err := json.Unmarshal(configBytes, config); err != nil {
+		log.WithFields(memoryLogFields).WithFields(log.Fields{
+			"error": err,
+			"json":  string(configBytes),
+		}).Error("failed to unmarshal config json")
+		return err
+	}
+
+	if err := config.Validate(); err != nil {
+		log.WithFields(memoryLogFields).WithFields(log.Fields{
+			"error": err,
+		}).Error("failed config validation")
+		return err
+	}
+
+	ms.Config = config
+	ms.images = make(map[string][]byte)
+	ms.indexes = make(map[string]map[string]map[string]struct{})
+	ms.tokens = make(map[string][]byte)
+	for _, idx := range indexes {
+		ms.indexes[idx.name] = make(map[string]map[string]struct{})
+	}
+	return nil
+}
+
+// Shutdown does nothing, since there is no connection to close
+func (ms *Memory) Shutdown() error {
+	return nil
+}
+
+// List retrieves a list of images from memory
+func (ms *Memory) List(imageType string) ([]*Image, error) {
+	return ms.scan(func(image *Image) bool {
+		return imageType == "" || image.Type == imageType
+	})
+}
+
+// Query retrieves a page of images from memory matching a query
+func (ms *Memory) Query(query *Query) ([]*Image, string, error) {
+	if err := query.Validate(); err != nil {
+		return nil, "", err
+	}
+
+	images, err := ms.scan(query.Match)
+	if err != nil {
+		return nil, "", err
+	}
+	return query.Page(images)
+}
+
+// GetByID retrieves an image from memory using the image id
+func (ms *Memory) GetByID(imageID string) (*Image, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+
+	value, ok := ms.images[imageID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return ms.unmarshalImage(imageID, value)
+}
+
+// GetBySource retrieves an image from memory using the image source
+func (ms *Memory) GetBySource(imageSource string) (*Image, error) {
+	images, err := ms.lookup(sourceIndex, imageSource)
+	if err != nil {
+		return nil, err
+	}
+	if len(images) == 0 {
+		return nil, ErrNotFound
+	}
+	return images[0], nil
+}
+
+// GetByDigest retrieves the images from memory with a data digest
+func (ms *Memory) GetByDigest(digest string) ([]*Image, error) {
+	return ms.lookup(digestIndex, digest)
+}
+
+// Put stores an image in memory
+func (ms *Memory) Put(image *Image) error {
+	value, err := json.Marshal(image)
+	if err != nil {
+		log.WithFields(memoryLogFields).WithFields(log.Fields{
+			"error": err,
+			"image": image,
+		}).Error("failed to marshal image")
+		return err
+	}
+
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	oldValue, exists := ms.images[image.ID]
+	if !exists && ms.Config.MaxImages > 0 && len(ms.images) >= ms.Config.MaxImages {
+		log.WithFields(memoryLogFields).WithFields(log.Fields{
+			"error":     ErrStoreFull,
+			"imageID":   image.ID,
+			"maxImages": ms.Config.MaxImages,
+		}).Error("image exceeds store limit")
+		return ErrStoreFull
+	}
+
+	var oldImage *Image
+	if exists {
+		if oldImage, err = ms.unmarshalImage(image.ID, oldValue); err != nil {
+			return err
+		}
+	}
+	ms.updateIndexes(oldImage, image)
+	ms.images[image.ID] = value
+	return nil
+}
+
+// Delete removes an image from memory
+func (ms *Memory) Delete(imageID string) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	value, ok := ms.images[imageID]
+	if !ok {
+		return nil
+	}
+	oldImage, err := ms.unmarshalImage(imageID, value)
+	if err != nil {
+		return err
+	}
+	ms.updateIndexes(oldImage, nil)
+	delete(ms.images, imageID)
+	return nil
+}
+
+// PutToken stores an api token in memory
+func (ms *Memory) PutToken(token *Token) error {
+	value, err := json.Marshal(token)
+	if err != nil {
+		log.WithFields(memoryLogFields).WithFields(log.Fields{
+			"error":   err,
+			"tokenID": token.ID,
+		}).Error("failed to marshal token")
+		return err
+	}
+
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	ms.tokens[token.ID] = value
+	return nil
+}
+
+// GetToken retrieves an api token from memory using the token id
+func (ms *Memory) GetToken(tokenID string) (*Token, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+
+	value, ok := ms.tokens[tokenID]
+	if !ok {
+		return nil, ErrTokenNotFound
+	}
+	return ms.unmarshalToken(tokenID, value)
+}
+
+// ListTokens retrieves all api tokens from memory
+func (ms *Memory) ListTokens() ([]*Token, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+
+	var tokens []*Token
+	for tokenID, value := range ms.tokens {
+		token, err := ms.unmarshalToken(tokenID, value)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, nil
+}
+
+// DeleteToken removes an api token from memory
+func (ms *Memory) DeleteToken(tokenID string) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	delete(ms.tokens, tokenID)
+	return nil
+}
+
+// TouchToken records the last use of an api token in memory
+func (ms *Memory) TouchToken(tokenID string, lastUsed time.Time) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	value, ok := ms.tokens[tokenID]
+	if !ok {
+		return ErrTokenNotFound
+	}
+	token, err := ms.unmarshalToken(tokenID, value)
+	if err != nil {
+		return err
+	}
+	token.LastUsed = lastUsed
+	value, err = json.Marshal(token)
+	if err != nil {
+		log.WithFields(memoryLogFields).WithFields(log.Fields{
+			"error":   err,
+			"tokenID": token.ID,
+		}).Error("failed to marshal token")
+		return err
+	}
+	ms.tokens[tokenID] = value
+	return nil
+}
+
+// scan returns the images accepted by the filter
+func (ms *Memory) scan(filter func(*Image) bool) ([]*Image, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+
+	var images []*Image
+	for imageID, value := range ms.images {
+		image, err := ms.unmarshalImage(imageID, value)
+		if err != nil {
+			return nil, err
+		}
+		if filter(image) {
+			images = append(images, image)
+		}
+	}
+	return images, nil
+}
+
+// lookup retrieves the images with a key in an index
+func (ms *Memory) lookup(idx *index, key string) ([]*Image, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+
+	var images []*Image
+	for imageID := range ms.indexes[idx.name][key] {
+		image, err := ms.unmarshalImage(imageID, ms.images[imageID])
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, image)
+	}
+	return images, nil
+}
+
+// updateIndexes updates all index entries for a change to an image. A nil
+// oldImage is an addition and a nil newImage is a removal. The lock must be
+// held.
+func (ms *Memory) updateIndexes(oldImage, newImage *Image) {
+	for _, idx := range indexes {
+		entries := ms.indexes[idx.name]
+		if indexKeyChanged(idx, oldImage, newImage) {
+			key := idx.key(oldImage)
+			delete(entries[key], oldImage.ID)
+			if len(entries[key]) == 0 {
+				delete(entries, key)
+			}
+		}
+		if newImage != nil && idx.key(newImage) != "" {
+			key := idx.key(newImage)
+			if entries[key] == nil {
+				entries[key] = make(map[string]struct{})
+			}
+			entries[key][newImage.ID] = struct{}{}
+		}
+	}
+}
+
+// unmarshalImage parses stored image json
+func (ms *Memory) unmarshalImage(imageID string, value []byte) (*Image, error) {
+	image := &Image{}
+	if err := json.Unmarshal(value, image); err != nil {
+		log.WithFields(memoryLogFields).WithFields(log.Fields{
+			"error":   err,
+			"imageID": imageID,
+			"value":   string(value),
+		}).Error("failed to parse image json")
+		return nil, err
+	}
+	image.Store = ms
+	return image, nil
+}
+
+// unmarshalToken parses stored token json
+func (ms *Memory) unmarshalToken(tokenID string, value []byte) (*Token, error) {
+	token := &Token{}
+	if err := json.Unmarshal(value, token); err != nil {
+		log.WithFields(memoryLogFields).WithFields(log.Fields{
+			"error":   err,
+			"tokenID": tokenID,
+		}).Error("failed to parse token json")
+		return nil, err
+	}
+	return token, nil
+}
+
+func init() {
+	Register("memory", func() Store {
+		return &Memory{}
+	})
+}
@@ -0,0 +1,97 @@
+package metadata_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/mistifyio/mistify-image-service/metadata"
+	"github.com/mistifyio/mistify-image-service/metadata/storetest"
+	"github.com/stretchr/testify/suite"
+)
+
+type MemoryTestSuite struct {
+	storetest.StoreSuite
+	MemoryConfig *metadata.MemoryConfig
+}
+
+func (s *MemoryTestSuite) SetupTest() {
+	// Memory specific test setup. Limits are tested separately, so the
+	// general tests have none.
+	s.MemoryConfig = &metadata.MemoryConfig{}
+	s.StoreConfig, _ = json.Marshal(s.MemoryConfig)
+
+	// General store test setup
+	s.StoreSuite.SetupTest()
+}
+
+func TestMemoryTestSuite(t *testing.T) {
+	s := new(MemoryTestSuite)
+	s.StoreName = "memory"
+	suite.Run(t, s)
+}
+
+func (s *MemoryTestSuite) TestConfigValidate() {
+	tests := []struct {
+		description string
+		config      *metadata.MemoryConfig
+		expectedErr error
+	}{
+		{"empty config should be valid",
+			&metadata.MemoryConfig{}, nil},
+		{"negative max images should be invalid",
+			&metadata.MemoryConfig{MaxImages: -1}, metadata.ErrInvalidMaxImages},
+		{"config to use for tests should be valid",
+			s.MemoryConfig, nil},
+	}
+
+	for _, test := range tests {
+		s.Equal(test.expectedErr, test.config.Validate(), test.description)
+	}
+}
+
+func (s *MemoryTestSuite) TestInit() {
+	tests := []struct {
+		description string
+		configJSON  string
+		expectedErr bool
+	}{
+		{"bad json should fail",
+			"not actually json", true},
+		{"invalid config should fail",
+			`{"maxImages":-1}`, true},
+		{"empty config should succeed",
+			`{}`, false},
+		{"config to use for tests should succeed",
+			string(s.StoreConfig), false},
+	}
+
+	for _, test := range tests {
+		store := metadata.NewStore("memory")
+		config := []byte(test.configJSON)
+		err := store.Init(config)
+		if test.expectedErr {
+			s.Error(err, test.description)
+		} else {
+			s.NoError(err, test.description)
+		}
+	}
+}
+
+func (s *MemoryTestSuite) TestMaxImages() {
+	store := metadata.NewStore("memory")
+	config, _ := json.Marshal(&metadata.MemoryConfig{MaxImages: 10})
+	s.Require().NoError(store.Init(config))
+
+	var imageIDs []string
+	for i := 0; i < 10; i++ {
+		image := &metadata.Image{ID: metadata.NewID(), Type: "kvm"}
+		s.Require().NoError(store.Put(image), "images within the limit should be stored")
+		imageIDs = append(imageIDs, image.ID)
+	}
+
+	s.Equal(metadata.ErrStoreFull, store.Put(s.Image), "image over the limit should fail")
+	s.NoError(store.Put(&metadata.Image{ID: imageIDs[0], Type: "container"}), "existing images should be updatable")
+
+	s.NoError(store.Delete(imageIDs[0]))
+	s.NoError(store.Put(s.Image), "deleted image should free space")
+}
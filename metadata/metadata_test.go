@@ -3,9 +3,9 @@ package metadata_test
 import (
 	"testing"
 
-	log "github.com/Sirupsen/logrus"
 	"github.com/mistifyio/mistify-image-service/metadata"
 	"github.com/mistifyio/mistify-image-service/metadata/mocks"
+	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/suite"
 )
 
@@ -59,6 +59,36 @@ func (_m *Store) List(_a0 string) ([]*metadata.Image, error) {
 	return r0, r1
 }
 
+// Query mocked by mockery
+func (_m *Store) Query(_a0 *metadata.Query) ([]*metadata.Image, string, error) {
+	ret := _m.Called(_a0)
+
+	var r0 []*metadata.Image
+	if rf, ok := ret.Get(0).(func(*metadata.Query) []*metadata.Image); ok {
+		r0 = rf(_a0)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]*metadata.Image)
+		}
+	}
+
+	var r1 string
+	if rf, ok := ret.Get(1).(func(*metadata.Query) string); ok {
+		r1 = rf(_a0)
+	} else {
+		r1 = ret.Get(1).(string)
+	}
+
+	var r2 error
+	if rf, ok := ret.Get(2).(func(*metadata.Query) error); ok {
+		r2 = rf(_a0)
+	} else {
+		r2 = ret.Error(2)
+	}
+
+	return r0, r1, r2
+}
+
 // GetByID mocked by mockery
 func (_m *Store) GetByID(_a0 string) (*metadata.Image, error) {
 	ret := _m.Called(_a0)
@@ -105,6 +135,29 @@ func (_m *Store) GetBySource(_a0 string) (*metadata.Image, error) {
 	return r0, r1
 }
 
+// GetByDigest mocked by mockery
+func (_m *Store) GetByDigest(_a0 string) ([]*metadata.Image, error) {
+	ret := _m.Called(_a0)
+
+	var r0 []*metadata.Image
+	if rf, ok := ret.Get(0).(func(string) []*metadata.Image); ok {
+		r0 = rf(_a0)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]*metadata.Image)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(string) error); ok {
+		r1 = rf(_a0)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // Put mocked by mockery
 func (_m *Store) Put(_a0 *metadata.Image) error {
 	ret := _m.Called(_a0)
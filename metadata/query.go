@@ -0,0 +1,308 @@
+package metadata
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Sort fields for queries
+const (
+	SortID         = "id"
+	SortDownloaded = "downloaded"
+	SortSize       = "size"
+	SortComment    = "comment"
+)
+
+// ValidSortFields is a map of valid query sort fields for quick lookups
+var ValidSortFields = map[string]struct{}{
+	SortID:         {},
+	SortDownloaded: {},
+	SortSize:       {},
+	SortComment:    {},
+}
+
+// ErrInvalidSort is used when a query has an unknown sort field
+var ErrInvalidSort = errors.New("invalid sort field")
+
+// ErrInvalidLimit is used when a query has a negative limit
+var ErrInvalidLimit = errors.New("invalid limit")
+
+// ErrInvalidCursor is used when a query cursor can't be decoded or was
+// issued for a different sort
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+type (
+	// Query describes a filtered, sorted and paginated listing of images.
+	// Stores may push as much of the query down to the backend as they are
+	// able to, using Match, Compare and Page for the remainder.
+	Query struct {
+		Type         string
+		Status       string
+		SourcePrefix string
+		// DownloadedAfter and DownloadedBefore bound the download end time,
+		// inclusive and exclusive respectively. Images that have not
+		// finished downloading are excluded when either is set.
+		DownloadedAfter  time.Time
+		DownloadedBefore time.Time
+		// Sort is the field to order by, defaulting to SortID. Ties are
+		// always broken by image id so pages are stable.
+		Sort       string
+		Descending bool
+		// Limit is the maximum number of images to return. Zero means no
+		// limit.
+		Limit int
+		// Cursor is the opaque position returned with the previous page
+		Cursor string
+	}
+
+	// pageCollector gathers a page of query results from images scanned in
+	// any order, keeping only those that could still be on the page
+	pageCollector struct {
+		query  *Query
+		after  *Image
+		images []*Image
+	}
+
+	// queryCursor is the decoded form of a query cursor, holding the sort
+	// key of the last image on a page
+	queryCursor struct {
+		Sort       string    `json:"s"`
+		ID         string    `json:"i"`
+		Downloaded time.Time `json:"d,omitempty"`
+		Size       int64     `json:"z,omitempty"`
+		Comment    string    `json:"c,omitempty"`
+	}
+)
+
+// IsValidSortField checks whether a sort field is valid
+func IsValidSortField(field string) bool {
+	_, ok := ValidSortFields[field]
+	return ok
+}
+
+// Validate checks whether the query is valid
+func (q *Query) Validate() error {
+	if q.Sort != "" && !IsValidSortField(q.Sort) {
+		return ErrInvalidSort
+	}
+	if q.Limit < 0 {
+		return ErrInvalidLimit
+	}
+	if q.Cursor != "" {
+		if _, err := q.after(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Match checks whether an image satisfies the query filters
+func (q *Query) Match(image *Image) bool {
+	if q.Type != "" && image.Type != q.Type {
+		return false
+	}
+	if q.Status != "" && image.Status != q.Status {
+		return false
+	}
+	if q.SourcePrefix != "" && !strings.HasPrefix(image.Source, q.SourcePrefix) {
+		return false
+	}
+	if !q.DownloadedAfter.IsZero() || !q.DownloadedBefore.IsZero() {
+		if image.DownloadEnd.IsZero() {
+			return false
+		}
+		if !q.DownloadedAfter.IsZero() && image.DownloadEnd.Before(q.DownloadedAfter) {
+			return false
+		}
+		if !q.DownloadedBefore.IsZero() && !image.DownloadEnd.Before(q.DownloadedBefore) {
+			return false
+		}
+	}
+	return true
+}
+
+// Compare orders two images according to the query sort, returning a
+// negative number if a comes first, a positive number if b comes first, and
+// zero if they are the same image
+func (q *Query) Compare(a, b *Image) int {
+	c := compareField(q.sortField(), a, b)
+	if c == 0 {
+		c = strings.Compare(a.ID, b.ID)
+	}
+	if q.Descending {
+		return -c
+	}
+	return c
+}
+
+// Page sorts images that already satisfy the query filters, skips those up
+// to and including the cursor, and applies the limit. It returns the page
+// and the cursor for the next one, which is empty on the last page.
+func (q *Query) Page(images []*Image) ([]*Image, string, error) {
+	after, err := q.after()
+	if err != nil {
+		return nil, "", err
+	}
+
+	sort.Slice(images, func(i, j int) bool {
+		return q.Compare(images[i], images[j]) < 0
+	})
+
+	if after != nil {
+		start := sort.Search(len(images), func(i int) bool {
+			return q.Compare(images[i], after) > 0
+		})
+		images = images[start:]
+	}
+
+	if q.Limit == 0 || len(images) <= q.Limit {
+		return images, "", nil
+	}
+	images = images[:q.Limit]
+	return images, q.cursor(images[len(images)-1]), nil
+}
+
+// hasIndexedFilter checks whether the query filters on a field that stores
+// maintaining queryIndexes can look up
+func (q *Query) hasIndexedFilter() bool {
+	return q.Status != "" || q.SourcePrefix != "" ||
+		!q.DownloadedAfter.IsZero() || !q.DownloadedBefore.IsZero()
+}
+
+// newPageCollector creates a pageCollector for the query
+func (q *Query) newPageCollector() (*pageCollector, error) {
+	after, err := q.after()
+	if err != nil {
+		return nil, err
+	}
+	return &pageCollector{query: q, after: after}, nil
+}
+
+// wantsID checks whether an image with an id could be on the page, before the
+// image is read. Only queries sorted by id can rule images out this way.
+func (pc *pageCollector) wantsID(imageID string) bool {
+	if pc.query.sortField() != SortID {
+		return true
+	}
+	image := &Image{ID: imageID}
+	if pc.after != nil && pc.query.Compare(image, pc.after) <= 0 {
+		return false
+	}
+	return !pc.full() || pc.query.Compare(image, pc.images[len(pc.images)-1]) < 0
+}
+
+// add keeps an image if it matches the query filters and could be on the
+// page. One image beyond the limit is kept so Page knows whether there is a
+// next page.
+func (pc *pageCollector) add(image *Image) {
+	if !pc.query.Match(image) {
+		return
+	}
+	if pc.after != nil && pc.query.Compare(image, pc.after) <= 0 {
+		return
+	}
+
+	i := sort.Search(len(pc.images), func(i int) bool {
+		return pc.query.Compare(pc.images[i], image) > 0
+	})
+	if pc.query.Limit > 0 && i > pc.query.Limit {
+		return
+	}
+	pc.images = append(pc.images, nil)
+	copy(pc.images[i+1:], pc.images[i:])
+	pc.images[i] = image
+	if pc.query.Limit > 0 && len(pc.images) > pc.query.Limit+1 {
+		pc.images = pc.images[:pc.query.Limit+1]
+	}
+}
+
+// full checks whether the page and the image after it have been found, so
+// only images sorting earlier can still be added
+func (pc *pageCollector) full() bool {
+	return pc.query.Limit > 0 && len(pc.images) > pc.query.Limit
+}
+
+// page returns the collected page and the cursor for the next one
+func (pc *pageCollector) page() ([]*Image, string, error) {
+	return pc.query.Page(pc.images)
+}
+
+// sortField returns the effective sort field
+func (q *Query) sortField() string {
+	if q.Sort == "" {
+		return SortID
+	}
+	return q.Sort
+}
+
+// cursor encodes the position of an image within the query results
+func (q *Query) cursor(image *Image) string {
+	c := &queryCursor{
+		Sort: q.sortField(),
+		ID:   image.ID,
+	}
+	switch c.Sort {
+	case SortDownloaded:
+		c.Downloaded = image.DownloadEnd
+	case SortSize:
+		c.Size = image.Size
+	case SortComment:
+		c.Comment = image.Comment
+	}
+	// Marshalling a struct of basic types can't fail
+	cursorJSON, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(cursorJSON)
+}
+
+// after decodes the query cursor into an image holding only the sort key
+func (q *Query) after() (*Image, error) {
+	if q.Cursor == "" {
+		return nil, nil
+	}
+
+	cursorJSON, err := base64.RawURLEncoding.DecodeString(q.Cursor)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	c := &queryCursor{}
+	if err := json.Unmarshal(cursorJSON, c); err != nil {
+		return nil, ErrInvalidCursor
+	}
+	if c.Sort != q.sortField() || c.ID == "" {
+		return nil, ErrInvalidCursor
+	}
+
+	return &Image{
+		ID:          c.ID,
+		DownloadEnd: c.Downloaded,
+		Size:        c.Size,
+		Comment:     c.Comment,
+	}, nil
+}
+
+// compareField compares a single sort field of two images
+func compareField(field string, a, b *Image) int {
+	switch field {
+	case SortDownloaded:
+		switch {
+		case a.DownloadEnd.Before(b.DownloadEnd):
+			return -1
+		case a.DownloadEnd.After(b.DownloadEnd):
+			return 1
+		}
+	case SortSize:
+		switch {
+		case a.Size < b.Size:
+			return -1
+		case a.Size > b.Size:
+			return 1
+		}
+	case SortComment:
+		return strings.Compare(a.Comment, b.Comment)
+	}
+	return 0
+}
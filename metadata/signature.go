@@ -0,0 +1,14 @@
+package metadata
+
+import "errors"
+
+// Image signature statuses
+const (
+	SignatureUnsigned = "unsigned"
+	SignatureVerified = "verified"
+	SignatureInvalid  = "invalid"
+)
+
+// ErrSignatureInvalid is used when the signature of image data can't be
+// verified with any trusted key
+var ErrSignatureInvalid = errors.New("signature not verified by a trusted key")
@@ -1,7 +1,12 @@
 // Package metadata handles the storing and retrieval of image metadata.
 package metadata
 
-import "errors"
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+)
 
 // stores maps names to functions that generate a new Store of that type.
 // New Store types can register themselves, eliminating the need to hardcode
@@ -14,6 +19,13 @@ var stores = map[string]func() Store{}
 // does not exist
 var ErrNotFound = errors.New("image not found")
 
+// ErrInvalidID is used when an image id can't be stored by a Store
+var ErrInvalidID = errors.New("invalid image id")
+
+// ErrConflict is used by Stores that detect conflicting updates when an image
+// was modified by someone else since it was last read
+var ErrConflict = errors.New("image was modified concurrently")
+
 type (
 	// Store provides a common API for image storage backends
 	Store interface {
@@ -26,15 +38,41 @@ type (
 		// List retrieves a list of metadata for all available images,
 		// optionally filtered by type.
 		List(string) ([]*Image, error)
+		// Query retrieves a page of metadata for images matching a query,
+		// along with the cursor for the next page. The cursor is empty when
+		// there are no more results.
+		Query(*Query) ([]*Image, string, error)
 		// GetByID retrieves metadata for an image from the Store by ID
 		GetByID(string) (*Image, error)
 		// GetBySource retrieves metadata for an image from the Store by source
 		GetBySource(string) (*Image, error)
+		// GetByDigest retrieves metadata for the images from the Store whose
+		// data has a digest
+		GetByDigest(string) ([]*Image, error)
 		// Put stores metadata for an image form the Store
 		Put(*Image) error
 		// Delete removes metadata for an image from the Store
 		Delete(string) error
 	}
+
+	// Backuper is implemented by Stores that can write a consistent snapshot
+	// of their data while remaining online
+	Backuper interface {
+		Backup(io.Writer) error
+	}
+
+	// DownloadTracker is implemented by Stores that record the downloads in
+	// progress of each service sharing the store, so a service can tell
+	// which images another one is still downloading
+	DownloadTracker interface {
+		// Downloading checks whether an image is being downloaded by
+		// another service sharing the store
+		Downloading(string) (bool, error)
+		// WatchDownloads calls a function with the id of each image whose
+		// download record is removed, because its download finished or
+		// the service downloading it went away, until the context is done
+		WatchDownloads(context.Context, func(string))
+	}
 )
 
 // Register adds a new Store under a name
@@ -51,6 +89,12 @@ func List() []string {
 	return names
 }
 
+// validID checks whether an image id is a single path element, so that stores
+// building keys from paths can't resolve it to another key
+func validID(imageID string) bool {
+	return imageID != "" && imageID != "." && imageID != ".." && !strings.Contains(imageID, "/")
+}
+
 // NewStore creates a new instance of a Store from a name
 func NewStore(name string) Store {
 	newFunc, ok := stores[name]
@@ -0,0 +1,406 @@
+// Package storetest provides a conformance test suite for metadata.Store
+// implementations. A store registered with metadata.Register should pass it.
+//
+// Embed StoreSuite in a testify suite, set StoreName, and set StoreConfig
+// before calling StoreSuite.SetupTest. Config handling is specific to each
+// store, so TestConfigValidate and TestInit must be overridden.
+package storetest
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/mistifyio/mistify-image-service/metadata"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/suite"
+)
+
+// StoreSuite is the conformance test suite for a metadata.Store
+type StoreSuite struct {
+	suite.Suite
+	StoreName   string
+	StoreConfig []byte
+	Store       metadata.Store
+	Image       *metadata.Image
+}
+
+func (s *StoreSuite) SetupSuite() {
+	log.SetLevel(log.FatalLevel)
+}
+
+func (s *StoreSuite) SetupTest() {
+	s.Image = &metadata.Image{
+		ID:     metadata.NewID(),
+		Type:   "kvm",
+		Source: "http://localhost",
+	}
+	s.Store = metadata.NewStore(s.StoreName)
+	_ = s.Store.Init(s.StoreConfig)
+}
+
+func (s *StoreSuite) TestConfigValidate() {
+	// This is going to be unique to each store type
+	s.Fail("test suite does not define TestConfigValidate", s.StoreName)
+}
+
+func (s *StoreSuite) TestInit() {
+	// This is going to be unique to each store type based on the config
+	s.Fail("test suite does not define TestInit", s.StoreName)
+}
+
+func (s *StoreSuite) Put() {
+	s.NoError(s.Store.Put(s.Image), "complete image should be put")
+}
+
+func (s *StoreSuite) TestGetBySource() {
+	_ = s.Store.Put(s.Image)
+
+	// Image exists
+	image, err := s.Store.GetBySource(s.Image.Source)
+	s.NoError(err, "retrieving existing image should not fail")
+	s.NotNil(image, "image should be found")
+	s.Equal(s.Image.ID, image.ID, "image should be what we expect")
+
+	// Image doesn't exist
+	image, err = s.Store.GetBySource("foobar")
+	s.Equal(metadata.ErrNotFound, err, "image shouldn't be found")
+
+	// Source changed
+	changed := *s.Image
+	changed.Source = "http://localhost/changed"
+	s.NoError(s.Store.Put(&changed))
+	_, err = s.Store.GetBySource(s.Image.Source)
+	s.Equal(metadata.ErrNotFound, err, "image shouldn't be found by old source")
+	image, err = s.Store.GetBySource(changed.Source)
+	s.NoError(err, "image should be found by new source")
+	s.Equal(s.Image.ID, image.ID)
+
+	// Image deleted
+	s.NoError(s.Store.Delete(s.Image.ID))
+	_, err = s.Store.GetBySource(changed.Source)
+	s.Equal(metadata.ErrNotFound, err, "deleted image shouldn't be found")
+}
+
+func (s *StoreSuite) TestGetByDigest() {
+	digest := "0123456789abcdef"
+	first := &metadata.Image{ID: metadata.NewID(), Type: "kvm", Digest: digest}
+	second := &metadata.Image{ID: metadata.NewID(), Type: "kvm", Digest: digest}
+	other := &metadata.Image{ID: metadata.NewID(), Type: "kvm", Digest: "fedcba9876543210"}
+	for _, image := range []*metadata.Image{first, second, other} {
+		s.Require().NoError(s.Store.Put(image))
+	}
+
+	images, err := s.Store.GetByDigest(digest)
+	s.NoError(err)
+	s.ElementsMatch([]string{first.ID, second.ID}, ImageIDs(images), "images sharing the digest should be found")
+
+	s.NoError(s.Store.Delete(first.ID))
+	images, err = s.Store.GetByDigest(digest)
+	s.NoError(err)
+	s.Equal([]string{second.ID}, ImageIDs(images), "deleted image shouldn't be found")
+
+	images, err = s.Store.GetByDigest("foobar")
+	s.NoError(err)
+	s.Empty(images, "unknown digest should find nothing")
+}
+
+func (s *StoreSuite) TestGetByID() {
+	_ = s.Store.Put(s.Image)
+
+	// Image exists
+	image, err := s.Store.GetByID(s.Image.ID)
+	s.NoError(err, "retrieving existing image should not fail")
+	s.NotNil(image, "image should be found")
+	s.Equal(s.Image.ID, image.ID, "image should be what we expect")
+
+	// Image doesn't exist
+	image, err = s.Store.GetByID("foobar")
+	s.Equal(metadata.ErrNotFound, err, "image shouldn't be found")
+	s.Nil(image)
+
+	// Changes to a retrieved image shouldn't be stored until put
+	image, _ = s.Store.GetByID(s.Image.ID)
+	image.Comment = "changed"
+	image, err = s.Store.GetByID(s.Image.ID)
+	s.NoError(err)
+	s.Empty(image.Comment, "unsaved changes should not be stored")
+}
+
+func (s *StoreSuite) TestList() {
+	_ = s.Store.Put(s.Image)
+
+	images, err := s.Store.List("")
+	s.NoError(err, "listing all images shouldn't error")
+	s.NotNil(images)
+	s.Len(images, 1, "list should only contain the one image added")
+
+	var found bool
+	for _, image := range images {
+		if image.ID == s.Image.ID {
+			found = true
+			break
+		}
+	}
+	s.True(found, "image should be in list")
+}
+
+func (s *StoreSuite) TestQuery() {
+	now := time.Now().UTC().Truncate(time.Second)
+	queryImages := []*metadata.Image{
+		{ID: "a", Type: "kvm", Status: metadata.StatusComplete, Source: "http://one/a",
+			Size: 30, Comment: "c", DownloadEnd: now.Add(-2 * time.Hour)},
+		{ID: "b", Type: "kvm", Status: metadata.StatusComplete, Source: "http://two/b",
+			Size: 10, Comment: "a", DownloadEnd: now.Add(-1 * time.Hour)},
+		{ID: "c", Type: "container", Status: metadata.StatusError, Source: "http://one/c",
+			Size: 20, Comment: "b", DownloadEnd: now},
+		{ID: "d", Type: "kvm", Status: metadata.StatusQueued, Source: "http://one/d"},
+	}
+	for _, image := range queryImages {
+		s.Require().NoError(s.Store.Put(image))
+	}
+
+	tests := []struct {
+		description string
+		query       *metadata.Query
+		expectedIDs []string
+	}{
+		{"empty query should list all by id",
+			&metadata.Query{}, []string{"a", "b", "c", "d"}},
+		{"type should filter",
+			&metadata.Query{Type: "kvm"}, []string{"a", "b", "d"}},
+		{"status should filter",
+			&metadata.Query{Status: metadata.StatusComplete}, []string{"a", "b"}},
+		{"source prefix should filter",
+			&metadata.Query{SourcePrefix: "http://one/"}, []string{"a", "c", "d"}},
+		{"download range should filter",
+			&metadata.Query{DownloadedAfter: now.Add(-1 * time.Hour), DownloadedBefore: now},
+			[]string{"b"}},
+		{"downloaded after should exclude unfinished images",
+			&metadata.Query{DownloadedAfter: now.Add(-3 * time.Hour)}, []string{"a", "b", "c"}},
+		{"size sort should order",
+			&metadata.Query{Sort: metadata.SortSize}, []string{"d", "b", "c", "a"}},
+		{"comment sort should order descending",
+			&metadata.Query{Sort: metadata.SortComment, Descending: true}, []string{"a", "c", "b", "d"}},
+		{"downloaded sort should order",
+			&metadata.Query{Sort: metadata.SortDownloaded, Status: metadata.StatusComplete}, []string{"a", "b"}},
+	}
+
+	for _, test := range tests {
+		images, cursor, err := s.Store.Query(test.query)
+		s.NoError(err, test.description)
+		s.Empty(cursor, test.description)
+		s.Equal(test.expectedIDs, ImageIDs(images), test.description)
+	}
+
+	// Pages should cover all images in order
+	query := &metadata.Query{Sort: metadata.SortSize, Descending: true, Limit: 3}
+	images, cursor, err := s.Store.Query(query)
+	s.NoError(err)
+	s.Equal([]string{"a", "c", "b"}, ImageIDs(images))
+	s.NotEmpty(cursor, "first page should have a cursor")
+
+	query.Cursor = cursor
+	images, cursor, err = s.Store.Query(query)
+	s.NoError(err)
+	s.Equal([]string{"d"}, ImageIDs(images))
+	s.Empty(cursor, "last page should not have a cursor")
+
+	// Invalid queries
+	_, _, err = s.Store.Query(&metadata.Query{Sort: "foobar"})
+	s.Equal(metadata.ErrInvalidSort, err)
+	_, _, err = s.Store.Query(&metadata.Query{Limit: -1})
+	s.Equal(metadata.ErrInvalidLimit, err)
+	_, _, err = s.Store.Query(&metadata.Query{Cursor: "foobar"})
+	s.Equal(metadata.ErrInvalidCursor, err)
+	query.Sort = metadata.SortComment
+	_, _, err = s.Store.Query(query)
+	s.Equal(metadata.ErrInvalidCursor, err, "cursor should only be valid for its sort")
+
+	// Filtered pages should cover all matching images in order
+	filtered := &metadata.Query{SourcePrefix: "http://one/", Limit: 2}
+	images, cursor, err = s.Store.Query(filtered)
+	s.NoError(err)
+	s.Equal([]string{"a", "c"}, ImageIDs(images))
+	filtered.Cursor = cursor
+	images, cursor, err = s.Store.Query(filtered)
+	s.NoError(err)
+	s.Equal([]string{"d"}, ImageIDs(images))
+	s.Empty(cursor)
+
+	// Filters should follow updates
+	queryImages[3].Status = metadata.StatusComplete
+	queryImages[3].DownloadEnd = now
+	s.Require().NoError(s.Store.Put(queryImages[3]))
+	images, _, err = s.Store.Query(&metadata.Query{Status: metadata.StatusComplete})
+	s.NoError(err)
+	s.Equal([]string{"a", "b", "d"}, ImageIDs(images), "updated status should be queried")
+	images, _, err = s.Store.Query(&metadata.Query{DownloadedAfter: now})
+	s.NoError(err)
+	s.Equal([]string{"c", "d"}, ImageIDs(images), "updated download end should be queried")
+}
+
+func (s *StoreSuite) TestDelete() {
+	_ = s.Store.Put(s.Image)
+
+	s.NoError(s.Store.Delete(s.Image.ID), "deleting existing image shouldn't error")
+	image, _ := s.Store.GetByID(s.Image.ID)
+	s.Nil(image, "image should be deleted")
+
+	s.NoError(s.Store.Delete(s.Image.ID), "deleting missing image shouldn't error")
+}
+
+func (s *StoreSuite) TestNotFound() {
+	// Nothing has been stored yet, which some stores treat differently from a
+	// missing image
+	image, err := s.Store.GetByID(s.Image.ID)
+	s.Equal(metadata.ErrNotFound, err, "image shouldn't be found in an empty store")
+	s.Nil(image)
+	image, err = s.Store.GetBySource(s.Image.Source)
+	s.Equal(metadata.ErrNotFound, err, "image shouldn't be found in an empty store")
+	s.Nil(image)
+	images, err := s.Store.GetByDigest("0123456789abcdef")
+	s.NoError(err, "unknown digest shouldn't error")
+	s.Empty(images)
+	images, err = s.Store.List("")
+	s.NoError(err, "listing an empty store shouldn't error")
+	s.Empty(images)
+	s.NoError(s.Store.Delete(s.Image.ID), "deleting missing image shouldn't error")
+}
+
+func (s *StoreSuite) TestConcurrent() {
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				image := &metadata.Image{
+					ID:     metadata.NewID(),
+					Type:   "kvm",
+					Source: fmt.Sprintf("http://localhost/%d/%d", i, j),
+				}
+				s.NoError(s.Store.Put(image))
+				found, err := s.Store.GetByID(image.ID)
+				s.NoError(err)
+				if s.NotNil(found) {
+					s.Equal(image.Source, found.Source, "concurrent puts of different images should not interfere")
+				}
+				found, err = s.Store.GetBySource(image.Source)
+				s.NoError(err)
+				if s.NotNil(found) {
+					s.Equal(image.ID, found.ID, "concurrent puts should be indexed")
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	images, err := s.Store.List("")
+	s.NoError(err)
+	s.Len(images, 40, "all concurrently put images should be stored")
+}
+
+func (s *StoreSuite) TestPathTraversal() {
+	s.Require().NoError(s.Store.Put(s.Image))
+
+	// An id must either be rejected or be stored under exactly that id. It
+	// must never resolve to another image.
+	for _, imageID := range []string{
+		"../" + s.Image.ID,
+		"../images/" + s.Image.ID,
+		"x/../" + s.Image.ID,
+		"./" + s.Image.ID,
+		"/" + s.Image.ID,
+		s.Image.ID + "/metadata",
+		".",
+		"..",
+	} {
+		image := &metadata.Image{ID: imageID, Type: "container", Source: "http://localhost/traversal"}
+		if err := s.Store.Put(image); err == nil {
+			found, err := s.Store.GetByID(imageID)
+			s.NoError(err, imageID)
+			if s.NotNil(found, imageID) {
+				s.Equal(imageID, found.ID, imageID)
+				s.Equal(image.Type, found.Type, imageID)
+			}
+			s.NoError(s.Store.Delete(imageID), imageID)
+		}
+
+		found, err := s.Store.GetByID(s.Image.ID)
+		s.NoError(err, imageID)
+		if s.NotNil(found, imageID) {
+			s.Equal(s.Image.Type, found.Type, imageID+" should not resolve to another image")
+		}
+		s.NoError(s.Store.Delete(imageID), imageID)
+	}
+
+	image, err := s.Store.GetByID(s.Image.ID)
+	s.NoError(err, "deleting other ids should not remove the image")
+	s.NotNil(image)
+	images, err := s.Store.List("")
+	s.NoError(err)
+	s.Equal([]string{s.Image.ID}, ImageIDs(images), "no other images should be left behind")
+}
+
+func (s *StoreSuite) TestTokens() {
+	tokenStore, ok := s.Store.(metadata.TokenStore)
+	if !ok {
+		s.T().Skip("store does not support tokens")
+	}
+
+	token := &metadata.Token{
+		ID:        metadata.NewID(),
+		Name:      "test",
+		Hash:      metadata.HashToken("secret"),
+		CreatedAt: time.Now().UTC().Truncate(time.Second),
+	}
+	s.Require().NoError(tokenStore.PutToken(token))
+
+	found, err := tokenStore.GetToken(token.ID)
+	s.NoError(err, "retrieving existing token should not fail")
+	s.Equal(token, found, "token should be what we expect")
+
+	_, err = tokenStore.GetToken("foobar")
+	s.Equal(metadata.ErrTokenNotFound, err, "token shouldn't be found")
+
+	token.LastUsed = token.CreatedAt.Add(time.Minute)
+	s.NoError(tokenStore.PutToken(token), "token should be updated")
+	tokens, err := tokenStore.ListTokens()
+	s.NoError(err)
+	if s.Len(tokens, 1, "list should only contain the one token added") {
+		s.Equal(token, tokens[0], "updated token should be listed")
+	}
+
+	images, err := s.Store.List("")
+	s.NoError(err)
+	s.Empty(images, "tokens should not be listed as images")
+
+	token.LastUsed = token.CreatedAt.Add(2 * time.Minute)
+	s.NoError(tokenStore.TouchToken(token.ID, token.LastUsed), "token use should be recorded")
+	found, err = tokenStore.GetToken(token.ID)
+	s.NoError(err)
+	s.Equal(token, found, "only the last use should be updated")
+
+	s.NoError(tokenStore.DeleteToken(token.ID))
+	_, err = tokenStore.GetToken(token.ID)
+	s.Equal(metadata.ErrTokenNotFound, err, "deleted token shouldn't be found")
+	s.NoError(tokenStore.DeleteToken(token.ID), "deleting a missing token shouldn't error")
+	s.Equal(metadata.ErrTokenNotFound, tokenStore.TouchToken(token.ID, time.Now()), "use of a deleted token should not be recorded")
+	_, err = tokenStore.GetToken(token.ID)
+	s.Equal(metadata.ErrTokenNotFound, err, "recording a use should not store a deleted token again")
+}
+
+func (s *StoreSuite) TestShutdown() {
+	s.NoError(s.Store.Shutdown(), "shutdown shouldn't error")
+	s.NoError(s.Store.Shutdown(), "second shutdown shouldn't error")
+}
+
+// ImageIDs returns the ids of a list of images
+func ImageIDs(images []*metadata.Image) []string {
+	ids := make([]string, len(images))
+	for i, image := range images {
+		ids[i] = image.ID
+	}
+	return ids
+}
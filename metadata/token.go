@@ -0,0 +1,54 @@
+package metadata
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+// ErrTokenNotFound is used when an attempt is made to retrieve an api token,
+// but it does not exist
+var ErrTokenNotFound = errors.New("token not found")
+
+type (
+	// Token is an api token. Only the sha256 digest of the secret is stored,
+	// so the secret can't be recovered from the store.
+	Token struct {
+		ID        string    `json:"id"`
+		Name      string    `json:"name"`
+		Hash      string    `json:"hash,omitempty"`
+		CreatedAt time.Time `json:"created_at"`
+		// ExpiresAt is zero for a token that doesn't expire
+		ExpiresAt time.Time `json:"expires_at"`
+		LastUsed  time.Time `json:"last_used"`
+	}
+
+	// TokenStore is implemented by Stores that can hold api tokens
+	TokenStore interface {
+		// PutToken stores a token
+		PutToken(*Token) error
+		// GetToken retrieves a token by ID
+		GetToken(string) (*Token, error)
+		// ListTokens retrieves all tokens
+		ListTokens() ([]*Token, error)
+		// DeleteToken removes a token
+		DeleteToken(string) error
+		// TouchToken records the last use of a token, only if it still
+		// exists, so a use racing a revoke doesn't bring the token back.
+		// Returns ErrTokenNotFound if it doesn't exist.
+		TouchToken(string, time.Time) error
+	}
+)
+
+// HashToken returns the hex encoded sha256 digest of a token secret, as
+// stored in Token.Hash
+func HashToken(secret string) string {
+	digest := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(digest[:])
+}
+
+// Expired tests whether a token has expired as of a time
+func (token *Token) Expired(now time.Time) bool {
+	return !token.ExpiresAt.IsZero() && !now.Before(token.ExpiresAt)
+}
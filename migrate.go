@@ -0,0 +1,253 @@
+package imageservice
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"strconv"
+
+	"github.com/mistifyio/mistify-image-service/metadata"
+	log "github.com/sirupsen/logrus"
+)
+
+// Problems found by a migration
+const (
+	// MigrateMissingData is a complete image without data in the source image
+	// store
+	MigrateMissingData = "missing_data"
+	// MigrateDataMismatch is image data that doesn't match the image digest or
+	// size, either as read from the source or as stored at the destination
+	MigrateDataMismatch = "data_mismatch"
+	// MigrateMetadataMismatch is image metadata that differs from the source
+	// after being stored at the destination
+	MigrateMetadataMismatch = "metadata_mismatch"
+)
+
+type (
+	// MigrateIssue is an image that could not be migrated
+	MigrateIssue struct {
+		Problem  string `json:"problem"`
+		ImageID  string `json:"image_id"`
+		BlobID   string `json:"blob_id,omitempty"`
+		Expected string `json:"expected,omitempty"`
+		Actual   string `json:"actual,omitempty"`
+	}
+
+	// MigrateReport is the result of a migration
+	MigrateReport struct {
+		Images       int             `json:"images"`
+		Copied       int             `json:"copied"`
+		Skipped      int             `json:"skipped"`
+		Blobs        int             `json:"blobs"`
+		BlobsCopied  int             `json:"blobs_copied"`
+		BlobsSkipped int             `json:"blobs_skipped"`
+		Issues       []*MigrateIssue `json:"issues"`
+	}
+)
+
+// Migrate copies all image metadata from the metadata store of one context to
+// another. When both contexts have an image store, the data of complete
+// images in the default image store is copied first, so migrated metadata
+// never references missing data.
+//
+// Everything copied is read back and verified. Images already identical at
+// the destination are skipped, so an interrupted migration can be resumed by
+// running it again. Images with problems are reported and left out, and are
+// retried by the next run.
+func Migrate(from, to *Context) (*MigrateReport, error) {
+	report := &MigrateReport{
+		Issues: make([]*MigrateIssue, 0),
+	}
+
+	allImages, err := from.MetadataStore.List("")
+	if err != nil {
+		log.WithField("error", err).Error("failed to list images")
+		return nil, err
+	}
+	report.Images = len(allImages)
+
+	copyData := from.ImageStore != nil && to.ImageStore != nil
+	// Data can be shared by several images, so it is only copied once
+	blobIssues := make(map[string]*MigrateIssue)
+	for _, image := range allImages {
+		if copyData && image.Status == metadata.StatusComplete && imageStoreName(image) == DefaultImageStore {
+			blobID := image.BlobID()
+			issue, checked := blobIssues[blobID]
+			if !checked {
+				if issue, err = migrateData(from, to, image, report); err != nil {
+					return nil, err
+				}
+				blobIssues[blobID] = issue
+			}
+			if issue != nil {
+				imageIssue := *issue
+				imageIssue.ImageID = image.ID
+				addMigrateIssue(report, &imageIssue)
+				continue
+			}
+		}
+
+		if err := migrateImage(to, image, report); err != nil {
+			return nil, err
+		}
+	}
+
+	log.WithFields(log.Fields{
+		"images":      report.Images,
+		"copied":      report.Copied,
+		"blobs":       report.Blobs,
+		"blobsCopied": report.BlobsCopied,
+		"issues":      len(report.Issues),
+	}).Info("migration finished")
+	return report, nil
+}
+
+// migrateImage copies image metadata to the destination store unless it is
+// already there, and verifies it
+func migrateImage(to *Context, image *metadata.Image, report *MigrateReport) error {
+	value, err := json.Marshal(image)
+	if err != nil {
+		return err
+	}
+
+	existing, err := migratedImage(to, image.ID)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(value, existing) {
+		report.Skipped++
+		return nil
+	}
+
+	// Store a fresh copy, so nothing specific to the source store carries over
+	imageCopy := &metadata.Image{}
+	if err := json.Unmarshal(value, imageCopy); err != nil {
+		return err
+	}
+	if err := to.MetadataStore.Put(imageCopy); err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+			"image": image,
+		}).Error("failed to store migrated image")
+		return err
+	}
+
+	stored, err := migratedImage(to, image.ID)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(value, stored) {
+		addMigrateIssue(report, &MigrateIssue{
+			Problem:  MigrateMetadataMismatch,
+			ImageID:  image.ID,
+			Expected: string(value),
+			Actual:   string(stored),
+		})
+		return nil
+	}
+	report.Copied++
+	return nil
+}
+
+// migratedImage retrieves the image json from the destination store, or nil
+// if the image hasn't been migrated
+func migratedImage(to *Context, imageID string) ([]byte, error) {
+	image, err := to.MetadataStore.GetByID(imageID)
+	if err == metadata.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error":   err,
+			"imageID": imageID,
+		}).Error("failed to retrieve migrated image")
+		return nil, err
+	}
+	return json.Marshal(image)
+}
+
+// migrateData copies the data of a complete image to the destination image
+// store unless it is already there, returning an issue if it can't be copied
+// intact. The data is verified against the image digest while it is copied.
+func migrateData(from, to *Context, image *metadata.Image, report *MigrateReport) (*MigrateIssue, error) {
+	blobID := image.BlobID()
+	report.Blobs++
+
+	stat, err := to.ImageStore.Stat(blobID)
+	if err == nil && stat.Size() == image.Size {
+		report.BlobsSkipped++
+		return nil, nil
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if _, err := from.ImageStore.Stat(blobID); err != nil {
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+		return &MigrateIssue{
+			Problem: MigrateMissingData,
+			ImageID: image.ID,
+			BlobID:  blobID,
+		}, nil
+	}
+
+	// The destination only keeps complete data, so a failed copy leaves
+	// nothing to resume from and is started over by the next run
+	digester := metadata.NewHash(metadata.DigestType)
+	pr, pw := io.Pipe()
+	go func() {
+		_ = pw.CloseWithError(from.ImageStore.Get(blobID, pw))
+	}()
+	if err := to.ImageStore.Put(blobID, io.TeeReader(pr, digester)); err != nil {
+		_ = pr.CloseWithError(err)
+		log.WithFields(log.Fields{
+			"error":  err,
+			"image":  image,
+			"blobID": blobID,
+		}).Error("failed to copy image data")
+		return nil, err
+	}
+
+	issue := &MigrateIssue{
+		Problem: MigrateDataMismatch,
+		ImageID: image.ID,
+		BlobID:  blobID,
+	}
+	if digest := hex.EncodeToString(digester.Sum(nil)); image.Digest != "" && image.Digest != digest {
+		issue.Expected = image.Digest
+		issue.Actual = digest
+	} else {
+		stat, err := to.ImageStore.Stat(blobID)
+		if err != nil {
+			return nil, err
+		}
+		if stat.Size() == image.Size {
+			report.BlobsCopied++
+			return nil, nil
+		}
+		issue.Expected = strconv.FormatInt(image.Size, 10)
+		issue.Actual = strconv.FormatInt(stat.Size(), 10)
+	}
+
+	// Don't leave bad data for the next run to skip over
+	if err := to.ImageStore.Delete(blobID); err != nil {
+		return nil, err
+	}
+	return issue, nil
+}
+
+// addMigrateIssue logs and records an issue in a report
+func addMigrateIssue(report *MigrateReport, issue *MigrateIssue) {
+	log.WithFields(log.Fields{
+		"problem":  issue.Problem,
+		"imageID":  issue.ImageID,
+		"blobID":   issue.BlobID,
+		"expected": issue.Expected,
+		"actual":   issue.Actual,
+	}).Warn("migration found a problem")
+	report.Issues = append(report.Issues, issue)
+}
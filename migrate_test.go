@@ -0,0 +1,162 @@
+package imageservice_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+
+	"github.com/mistifyio/mistify-image-service"
+	"github.com/mistifyio/mistify-image-service/images"
+	"github.com/mistifyio/mistify-image-service/metadata"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/suite"
+)
+
+type MigrateTestSuite struct {
+	suite.Suite
+	From      *imageservice.Context
+	To        *imageservice.Context
+	ImageData []byte
+}
+
+func (s *MigrateTestSuite) SetupSuite() {
+	log.SetLevel(log.FatalLevel)
+	s.ImageData = []byte("testdatatestdatatestdata")
+}
+
+func (s *MigrateTestSuite) SetupTest() {
+	s.From = s.newContext()
+	s.To = s.newContext()
+}
+
+func TestMigrateTestSuite(t *testing.T) {
+	suite.Run(t, new(MigrateTestSuite))
+}
+
+func (s *MigrateTestSuite) TestMigrate() {
+	first := s.putImage(s.ImageData)
+	second := s.putImage(s.ImageData)
+	queued := &metadata.Image{ID: metadata.NewID(), Type: "kvm", Status: metadata.StatusQueued}
+	s.Require().NoError(s.From.MetadataStore.Put(queued))
+
+	report, err := imageservice.Migrate(s.From, s.To)
+	s.NoError(err)
+	s.Empty(report.Issues)
+	s.Equal(3, report.Images)
+	s.Equal(3, report.Copied)
+	s.Equal(1, report.Blobs, "identical images should share a blob")
+	s.Equal(1, report.BlobsCopied)
+
+	for _, image := range []*metadata.Image{first, second, queued} {
+		migrated, err := s.To.MetadataStore.GetByID(image.ID)
+		s.NoError(err, "image should be migrated")
+		if s.NotNil(migrated) {
+			s.Equal(image.Status, migrated.Status)
+			s.Equal(image.Digest, migrated.Digest)
+		}
+	}
+	out := &bytes.Buffer{}
+	s.NoError(s.To.ImageStore.Get(first.BlobID(), out))
+	s.Equal(s.ImageData, out.Bytes(), "image data should be migrated")
+}
+
+func (s *MigrateTestSuite) TestResume() {
+	first := s.putImage(s.ImageData)
+	_, err := imageservice.Migrate(s.From, s.To)
+	s.Require().NoError(err)
+
+	second := s.putImage([]byte("otherdata"))
+	first.Comment = "changed"
+	s.Require().NoError(s.From.MetadataStore.Put(first))
+
+	report, err := imageservice.Migrate(s.From, s.To)
+	s.NoError(err)
+	s.Empty(report.Issues)
+	s.Equal(2, report.Copied, "new and changed images should be copied")
+	s.Equal(0, report.Skipped)
+	s.Equal(1, report.BlobsCopied, "only new data should be copied")
+	s.Equal(1, report.BlobsSkipped)
+
+	migrated, err := s.To.MetadataStore.GetByID(first.ID)
+	s.NoError(err)
+	s.Equal("changed", migrated.Comment, "changes should be migrated")
+	_, err = s.To.ImageStore.Stat(second.BlobID())
+	s.NoError(err)
+
+	report, err = imageservice.Migrate(s.From, s.To)
+	s.NoError(err)
+	s.Equal(0, report.Copied, "migrated images should be skipped")
+	s.Equal(2, report.Skipped)
+	s.Equal(0, report.BlobsCopied, "migrated data should be skipped")
+}
+
+func (s *MigrateTestSuite) TestMetadataOnly() {
+	image := s.putImage(s.ImageData)
+	s.To.ImageStore = nil
+
+	report, err := imageservice.Migrate(s.From, s.To)
+	s.NoError(err)
+	s.Empty(report.Issues)
+	s.Equal(1, report.Copied)
+	s.Equal(0, report.Blobs, "data should not be copied without both image stores")
+
+	_, err = s.To.MetadataStore.GetByID(image.ID)
+	s.NoError(err)
+}
+
+func (s *MigrateTestSuite) TestMissingData() {
+	image := s.putImage(s.ImageData)
+	s.Require().NoError(s.From.ImageStore.Delete(image.BlobID()))
+
+	report, err := imageservice.Migrate(s.From, s.To)
+	s.NoError(err)
+	s.Require().Len(report.Issues, 1)
+	s.Equal(imageservice.MigrateMissingData, report.Issues[0].Problem)
+	s.Equal(image.ID, report.Issues[0].ImageID)
+
+	_, err = s.To.MetadataStore.GetByID(image.ID)
+	s.Equal(metadata.ErrNotFound, err, "image without data should not be migrated")
+}
+
+func (s *MigrateTestSuite) TestDataMismatch() {
+	image := s.putImage(s.ImageData)
+	s.Require().NoError(s.From.ImageStore.Put(image.BlobID(), bytes.NewReader([]byte("corruptdatacorruptdata!!"))))
+
+	report, err := imageservice.Migrate(s.From, s.To)
+	s.NoError(err)
+	s.Require().Len(report.Issues, 1)
+	s.Equal(imageservice.MigrateDataMismatch, report.Issues[0].Problem)
+	s.Equal(image.Digest, report.Issues[0].Expected)
+
+	_, err = s.To.ImageStore.Stat(image.BlobID())
+	s.Error(err, "corrupt data should not be left behind")
+	_, err = s.To.MetadataStore.GetByID(image.ID)
+	s.Equal(metadata.ErrNotFound, err, "image with corrupt data should not be migrated")
+}
+
+// newContext creates a context with empty memory stores
+func (s *MigrateTestSuite) newContext() *imageservice.Context {
+	ctx := &imageservice.Context{
+		ImageStore:    images.NewStore("memory"),
+		MetadataStore: metadata.NewStore("memory"),
+	}
+	s.Require().NoError(ctx.ImageStore.Init([]byte("{}")))
+	s.Require().NoError(ctx.MetadataStore.Init([]byte("{}")))
+	return ctx
+}
+
+// putImage stores a complete image and its data in the source stores
+func (s *MigrateTestSuite) putImage(data []byte) *metadata.Image {
+	sum := sha256.Sum256(data)
+	image := &metadata.Image{
+		ID:     metadata.NewID(),
+		Type:   "kvm",
+		Status: metadata.StatusComplete,
+		Size:   int64(len(data)),
+		Digest: hex.EncodeToString(sum[:]),
+	}
+	s.Require().NoError(s.From.ImageStore.Put(image.BlobID(), bytes.NewReader(data)))
+	s.Require().NoError(s.From.MetadataStore.Put(image))
+	return image
+}
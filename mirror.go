@@ -0,0 +1,345 @@
+package imageservice
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mistifyio/mistify-image-service/metadata"
+	logx "github.com/mistifyio/mistify-logrus-ext"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// mirrorPollInterval is the time between checks on the progress of an image
+// being mirrored
+const mirrorPollInterval = 100 * time.Millisecond
+
+type (
+	// Mirror resolves images missing here against upstream image services.
+	// A complete image found upstream is fetched through the Fetcher with the
+	// same id and metadata, and can be streamed to a client while it is being
+	// stored.
+	Mirror struct {
+		ctx    *Context
+		peers  []*ReplicationPeer
+		client *http.Client
+		// lock serializes starting fetches, so a missing image is only
+		// fetched once
+		lock sync.Mutex
+	}
+
+	// mirrorWriter writes image data to a client, counting the bytes written
+	// and keeping the first write error apart from image store errors
+	mirrorWriter struct {
+		out     io.Writer
+		written int64
+		err     error
+	}
+)
+
+// NewMirror creates a new Mirror for the configured peers. Mirroring is
+// disabled when there are none.
+func NewMirror(ctx *Context) (*Mirror, error) {
+	mirror := &Mirror{
+		ctx:    ctx,
+		client: &http.Client{},
+	}
+
+	var peers []*ReplicationPeer
+	// json errors would have been caught by viper when loading the file
+	peersJSON, _ := json.Marshal(viper.Get("mirrorPeers"))
+	if err := json.Unmarshal(peersJSON, &peers); err != nil {
+		log.WithFields(log.Fields{
+			"error":  err,
+			"config": string(peersJSON),
+		}).Error("invalid mirror peers config")
+		return nil, err
+	}
+
+	names := make(map[string]bool)
+	for _, peer := range peers {
+		err := peer.Validate()
+		if err == nil && names[peer.Name] {
+			err = errors.New("duplicate peer name")
+		}
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+				"peer":  peer.Name,
+				"url":   peer.URL,
+			}).Error("invalid mirror peer")
+			return nil, err
+		}
+		names[peer.Name] = true
+		mirror.peers = append(mirror.peers, peer)
+	}
+	return mirror, nil
+}
+
+// Enabled tests whether any peers are configured
+func (mirror *Mirror) Enabled() bool {
+	return len(mirror.peers) > 0
+}
+
+// IsMirroring tests whether an image is being fetched from a peer
+func (mirror *Mirror) IsMirroring(image *metadata.Image) bool {
+	if !mirror.Enabled() || image.Peer == "" {
+		return false
+	}
+	switch image.Status {
+	case metadata.StatusQueued, metadata.StatusPending, metadata.StatusDownloading:
+		return true
+	}
+	return false
+}
+
+// IsRetryable tests whether an image is a failed fetch from a peer, which is
+// fetched again the next time it is requested
+func (mirror *Mirror) IsRetryable(image *metadata.Image) bool {
+	if !mirror.Enabled() || image.Peer == "" {
+		return false
+	}
+	return image.Status == metadata.StatusError || image.Status == metadata.StatusCancelled
+}
+
+// Fetch looks for an image missing here on each peer in order, queueing a
+// fetch of the first complete copy found. Returns metadata.ErrNotFound if no
+// peer has it.
+func (mirror *Mirror) Fetch(imageID string) (*metadata.Image, error) {
+	for _, peer := range mirror.peers {
+		remote, err := mirror.lookup(peer, imageID)
+		if err != nil || remote == nil {
+			// Unreachable peers are logged and skipped
+			continue
+		}
+		return mirror.fetch(peer, remote)
+	}
+	return nil, metadata.ErrNotFound
+}
+
+// fetch queues a fetch of an image from a peer with the same id and
+// metadata, unless another request already did. A previous failed fetch is
+// removed first.
+func (mirror *Mirror) fetch(peer *ReplicationPeer, remote *metadata.Image) (*metadata.Image, error) {
+	mirror.lock.Lock()
+	defer mirror.lock.Unlock()
+
+	existing, err := mirror.ctx.MetadataStore.GetByID(remote.ID)
+	switch {
+	case err == nil && !mirror.IsRetryable(existing):
+		return existing, nil
+	case err == nil:
+		existing.Store = mirror.ctx.MetadataStore
+		if _, err := DeleteImage(mirror.ctx, existing); err != nil {
+			return nil, err
+		}
+	case err != metadata.ErrNotFound:
+		return nil, err
+	}
+
+	// Status, sizes, times and the image store are local to this service
+	image := &metadata.Image{
+		ID:               remote.ID,
+		Source:           remote.Source,
+		Type:             remote.Type,
+		Comment:          remote.Comment,
+		Priority:         remote.Priority,
+		ChecksumType:     remote.ChecksumType,
+		ExpectedChecksum: remote.Checksum,
+		Signature:        remote.Signature,
+		Peer:             peer.Name,
+		PeerSource:       peerURL(peer, "/images/"+url.PathEscape(remote.ID)+"/download"),
+	}
+	return mirror.ctx.Fetcher.Fetch(image)
+}
+
+// lookup retrieves a complete image from a peer, returning nil if the peer
+// doesn't have it
+func (mirror *Mirror) lookup(peer *ReplicationPeer, imageID string) (*metadata.Image, error) {
+	req, err := http.NewRequest("GET", peerURL(peer, "/images/"+url.PathEscape(imageID)), nil)
+	if err != nil {
+		return nil, err
+	}
+	peer.authorize(req)
+	resp, err := mirror.client.Do(req)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error":   err,
+			"peer":    peer.Name,
+			"imageID": imageID,
+		}).Error("failed to look up image on peer")
+		return nil, err
+	}
+	defer logx.LogReturnedErr(resp.Body.Close, nil, "failed to close peer response body")
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, nil
+	default:
+		err := errors.New("unexpected response status")
+		log.WithFields(log.Fields{
+			"error":      err,
+			"peer":       peer.Name,
+			"imageID":    imageID,
+			"statusCode": resp.StatusCode,
+		}).Error(err)
+		return nil, err
+	}
+
+	remote := &metadata.Image{}
+	if err := json.NewDecoder(resp.Body).Decode(remote); err != nil {
+		log.WithFields(log.Fields{
+			"error":   err,
+			"peer":    peer.Name,
+			"imageID": imageID,
+		}).Error("invalid image from peer")
+		return nil, err
+	}
+	if remote.ID != imageID || remote.Status != metadata.StatusComplete {
+		return nil, nil
+	}
+	return remote, nil
+}
+
+// Wait waits until an image being mirrored starts transferring or, with
+// complete, until it finishes, returning the current image. The wait stops
+// early if reqCtx is done.
+func (mirror *Mirror) Wait(reqCtx context.Context, image *metadata.Image, complete bool) (*metadata.Image, error) {
+	for {
+		current, err := mirror.ctx.MetadataStore.GetByID(image.ID)
+		if err != nil {
+			return nil, err
+		}
+		if !mirror.IsMirroring(current) || (!complete && current.Status == metadata.StatusDownloading) {
+			return current, nil
+		}
+
+		select {
+		case <-reqCtx.Done():
+			return nil, reqCtx.Err()
+		case <-time.After(mirrorPollInterval):
+		}
+	}
+}
+
+// Stream writes the data of an image being mirrored as it is stored,
+// finishing from the complete image. The data is the same however many fetch
+// attempts it takes, so a restarted transfer is picked up from what was
+// already written. Image stores that only keep appended data once the append
+// finishes, like the memory store, are streamed once the data is complete.
+func (mirror *Mirror) Stream(reqCtx context.Context, image *metadata.Image, out io.Writer) error {
+	mw := &mirrorWriter{out: out}
+	for {
+		current, err := mirror.ctx.MetadataStore.GetByID(image.ID)
+		if err != nil {
+			return err
+		}
+
+		switch current.Status {
+		case metadata.StatusComplete:
+			return mirror.streamComplete(current, mw)
+		case metadata.StatusDownloading:
+			if err := mirror.streamPartial(current, mw); mw.err != nil {
+				return mw.err
+			} else if err == nil {
+				continue
+			}
+			// The data may have just been moved out of staging or be
+			// starting over, so check again shortly
+		case metadata.StatusQueued, metadata.StatusPending:
+		default:
+			err := errors.New("mirrored image failed")
+			if current.Error != "" {
+				err = errors.New(current.Error)
+			}
+			return err
+		}
+
+		select {
+		case <-reqCtx.Done():
+			return reqCtx.Err()
+		case <-time.After(mirrorPollInterval):
+		}
+	}
+}
+
+// streamPartial writes the staged data of an image stored so far beyond what
+// was already written. Returns an error if there was no new data.
+func (mirror *Mirror) streamPartial(image *metadata.Image, mw *mirrorWriter) error {
+	imageStore, err := mirror.ctx.ImageStoreFor(image)
+	if err != nil {
+		return err
+	}
+	dataID := stagingID(image.ID)
+	stat, err := imageStore.Stat(dataID)
+	if err != nil {
+		return err
+	}
+	if stat.Size() <= mw.written {
+		return io.EOF
+	}
+	return imageStore.GetRange(dataID, mw, mw.written, stat.Size()-mw.written)
+}
+
+// streamComplete writes the rest of the data of a complete image
+func (mirror *Mirror) streamComplete(image *metadata.Image, mw *mirrorWriter) error {
+	content, err := mirror.ctx.Blobs.Open(image)
+	if err != nil {
+		return err
+	}
+	defer logx.LogReturnedErr(content.Close, log.Fields{
+		"image": image,
+	}, "failed to close image data reader")
+
+	if _, err := content.Seek(mw.written, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := io.Copy(mw, content); err != nil {
+		return err
+	}
+	return mw.err
+}
+
+// Write writes to the client, recording any error. The data is flushed to the
+// client right away when possible.
+func (mw *mirrorWriter) Write(p []byte) (int, error) {
+	n, err := mw.out.Write(p)
+	mw.written += int64(n)
+	if err != nil && mw.err == nil {
+		mw.err = err
+	}
+	if flusher, ok := mw.out.(http.Flusher); ok && err == nil {
+		flusher.Flush()
+	}
+	return n, err
+}
+
+// peerURL builds the url of a path on a peer
+func peerURL(peer *ReplicationPeer, path string) string {
+	return strings.TrimSuffix(peer.URL, "/") + path
+}
+
+// authorize adds the api token of a peer to a request, if one is configured
+func (peer *ReplicationPeer) authorize(req *http.Request) {
+	if peer.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+peer.Token)
+	}
+}
+
+// peer returns a configured peer by name, or nil
+func (mirror *Mirror) peer(name string) *ReplicationPeer {
+	for _, peer := range mirror.peers {
+		if peer.Name == name {
+			return peer
+		}
+	}
+	return nil
+}
@@ -0,0 +1,218 @@
+package imageservice_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/mistifyio/mistify-image-service"
+	"github.com/mistifyio/mistify-image-service/images"
+	"github.com/mistifyio/mistify-image-service/metadata"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/suite"
+	"github.com/tylerb/graceful"
+)
+
+type MirrorTestSuite struct {
+	suite.Suite
+	Context   *imageservice.Context
+	APIServer *graceful.Server
+	APIURL    string
+	Peer      *httptest.Server
+	Dir       string
+	ImageID   string
+	ImageData []byte
+	// PeerData is the data the peer serves for the image, which is
+	// ImageData unless a test changes it
+	PeerData []byte
+	// Held holds up peer downloads halfway through until closed
+	Held chan struct{}
+}
+
+func (s *MirrorTestSuite) SetupSuite() {
+	log.SetLevel(log.FatalLevel)
+	s.ImageID = metadata.NewID()
+	// Enough data that streaming doesn't depend on flushing the response
+	s.ImageData = bytes.Repeat([]byte("testdata"), 8192)
+	s.APIURL = "http://localhost:54323/images"
+	s.Peer = httptest.NewServer(http.HandlerFunc(s.servePeer))
+}
+
+func (s *MirrorTestSuite) SetupTest() {
+	s.PeerData = s.ImageData
+	s.Held = nil
+
+	// Data appended to a filesystem store can be read before the transfer
+	// finishes, unlike with the memory store
+	s.Dir, _ = ioutil.TempDir("", "mirrorTest-")
+	viper.Set("imageStoreType", "fs")
+	viper.Set("imageStoreConfig", &images.FSConfig{Dir: s.Dir})
+	viper.Set("metadataStoreType", "memory")
+	viper.Set("metadataStoreConfig", &metadata.MemoryConfig{})
+	viper.Set("fetchRetries", 0)
+	viper.Set("mirrorPeers", []map[string]interface{}{
+		{"name": "upstream", "url": s.Peer.URL},
+	})
+
+	ctx, err := imageservice.NewContext()
+	s.Require().NoError(err)
+	s.Context = ctx
+	s.APIServer = imageservice.Run(ctx, 54323)
+	time.Sleep(100 * time.Millisecond)
+}
+
+func (s *MirrorTestSuite) TearDownTest() {
+	viper.Set("fetchRetries", nil)
+	viper.Set("mirrorPeers", nil)
+
+	stopChan := s.APIServer.StopChan()
+	s.APIServer.Stop(5 * time.Second)
+	<-stopChan
+	s.NoError(os.RemoveAll(s.Dir))
+}
+
+func (s *MirrorTestSuite) TearDownSuite() {
+	s.Peer.Close()
+}
+
+func TestMirrorTestSuite(t *testing.T) {
+	suite.Run(t, new(MirrorTestSuite))
+}
+
+func (s *MirrorTestSuite) TestGetImage() {
+	resp, err := http.Get(s.APIURL + "/" + s.ImageID)
+	s.Require().NoError(err)
+	s.Equal(http.StatusOK, resp.StatusCode)
+	image, err := unmarshalImageResp(resp)
+	s.Require().NoError(err)
+	s.Equal(s.ImageID, image.ID, "image should be mirrored with the same id")
+	s.Equal("upstream", image.Peer)
+	s.Equal("http://example.com/image", image.Source, "original source should be kept")
+	s.Equal(s.Peer.URL+"/images/"+s.ImageID+"/download", image.PeerSource)
+	s.Equal("kvm", image.Type)
+
+	image = s.waitForImage()
+	s.Equal(metadata.StatusComplete, image.Status)
+	s.EqualValues(len(s.ImageData), image.Size)
+
+	resp, err = http.Get(s.APIURL + "/asdf")
+	s.Require().NoError(err)
+	s.Equal(http.StatusNotFound, resp.StatusCode, "image missing upstream should not be found")
+	resp, err = http.Get(s.APIURL + "/asdf/download")
+	s.Require().NoError(err)
+	s.Equal(http.StatusNotFound, resp.StatusCode)
+}
+
+func (s *MirrorTestSuite) TestDownload() {
+	s.Held = make(chan struct{})
+
+	resp, err := http.Get(s.APIURL + "/" + s.ImageID + "/download")
+	s.Require().NoError(err)
+	defer func() { _ = resp.Body.Close() }()
+	s.Equal(http.StatusOK, resp.StatusCode)
+	s.EqualValues(len(s.ImageData), resp.ContentLength)
+
+	half := make([]byte, len(s.ImageData)/2)
+	_, err = io.ReadFull(resp.Body, half)
+	s.NoError(err)
+	s.Equal(s.ImageData[:len(half)], half, "data should be streamed while it is stored")
+
+	close(s.Held)
+	rest, err := ioutil.ReadAll(resp.Body)
+	s.NoError(err)
+	s.Equal(s.ImageData[len(half):], rest)
+
+	image := s.waitForImage()
+	s.Equal(metadata.StatusComplete, image.Status)
+	s.Equal("upstream", image.Peer)
+}
+
+func (s *MirrorTestSuite) TestDownloadRange() {
+	req, _ := http.NewRequest("GET", s.APIURL+"/"+s.ImageID+"/download", nil)
+	req.Header.Set("Range", "bytes=4-11")
+	resp, err := http.DefaultClient.Do(req)
+	s.Require().NoError(err)
+	defer func() { _ = resp.Body.Close() }()
+
+	s.Equal(http.StatusPartialContent, resp.StatusCode, "range should be served from the complete image")
+	data, err := ioutil.ReadAll(resp.Body)
+	s.NoError(err)
+	s.Equal(s.ImageData[4:12], data)
+}
+
+func (s *MirrorTestSuite) TestFailedFetch() {
+	s.PeerData = bytes.ToUpper(s.ImageData)
+
+	resp, err := http.Get(s.APIURL + "/" + s.ImageID + "/download")
+	s.Require().NoError(err)
+	if resp.StatusCode == http.StatusOK {
+		data, err := ioutil.ReadAll(resp.Body)
+		s.False(err == nil && len(data) == len(s.PeerData), "corrupt data should not be served in full")
+	}
+	_ = resp.Body.Close()
+
+	image := s.waitForImage()
+	s.Equal(metadata.StatusError, image.Status)
+
+	// The image is fetched again the next time it is requested
+	s.PeerData = s.ImageData
+	resp, err = http.Get(s.APIURL + "/" + s.ImageID + "/download")
+	s.Require().NoError(err)
+	defer func() { _ = resp.Body.Close() }()
+	data, err := ioutil.ReadAll(resp.Body)
+	s.NoError(err)
+	s.Equal(s.ImageData, data)
+}
+
+// waitForImage waits for the mirrored image to finish
+func (s *MirrorTestSuite) waitForImage() *metadata.Image {
+	for i := 0; i < 100; i++ {
+		image, err := s.Context.MetadataStore.GetByID(s.ImageID)
+		s.Require().NoError(err)
+		if !s.Context.Mirror.IsMirroring(image) {
+			return image
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	s.FailNow("mirrored image did not finish")
+	return nil
+}
+
+// servePeer serves the image the way an upstream image service does, holding
+// downloads halfway through while Held is open
+func (s *MirrorTestSuite) servePeer(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/images/" + s.ImageID:
+		checksum := sha256.Sum256(s.ImageData)
+		_ = json.NewEncoder(w).Encode(&metadata.Image{
+			ID:           s.ImageID,
+			Source:       "http://example.com/image",
+			Type:         "kvm",
+			Status:       metadata.StatusComplete,
+			Size:         int64(len(s.ImageData)),
+			ChecksumType: "sha256",
+			Checksum:     hex.EncodeToString(checksum[:]),
+		})
+	case "/images/" + s.ImageID + "/download":
+		data := s.PeerData
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		_, _ = w.Write(data[:len(data)/2])
+		w.(http.Flusher).Flush()
+		if s.Held != nil {
+			<-s.Held
+		}
+		_, _ = w.Write(data[len(data)/2:])
+	default:
+		http.NotFound(w, r)
+	}
+}
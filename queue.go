@@ -0,0 +1,149 @@
+package imageservice
+
+import (
+	"context"
+	"net/url"
+	"sync"
+
+	"github.com/mistifyio/mistify-image-service/metadata"
+)
+
+type (
+	// fetchQueue orders queued images for fetching by priority, then by the
+	// time they were queued, and tracks running fetches to enforce the
+	// concurrency limits. The queue itself is an in-memory view; queued status
+	// is persisted in the metadata store so it can be rebuilt on startup.
+	fetchQueue struct {
+		lock   sync.Mutex
+		cond   *sync.Cond
+		images []*metadata.Image
+		active map[string]*activeFetch
+		hosts  map[string]int
+	}
+
+	// activeFetch is a running fetch, which can be cancelled through its
+	// context
+	activeFetch struct {
+		image  *metadata.Image
+		ctx    context.Context
+		cancel context.CancelFunc
+		// done is closed when the fetch has finished and its final status
+		// has been saved
+		done chan struct{}
+	}
+)
+
+// newFetchQueue creates a new fetchQueue
+func newFetchQueue() *fetchQueue {
+	queue := &fetchQueue{
+		active: make(map[string]*activeFetch),
+		hosts:  make(map[string]int),
+	}
+	queue.cond = sync.NewCond(&queue.lock)
+	return queue
+}
+
+// push adds an image to the queue
+func (queue *fetchQueue) push(image *metadata.Image) {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+
+	// Insert after any images that should go first
+	i := 0
+	for ; i < len(queue.images); i++ {
+		if queuedBefore(image, queue.images[i]) {
+			break
+		}
+	}
+	queue.images = append(queue.images, nil)
+	copy(queue.images[i+1:], queue.images[i:])
+	queue.images[i] = image
+
+	queue.cond.Broadcast()
+}
+
+// next blocks until an image can be fetched within the concurrency limits,
+// then removes it from the queue and starts tracking it as an active fetch. A
+// limit of zero means no limit.
+func (queue *fetchQueue) next(fetcher *Fetcher) *activeFetch {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+
+	for {
+		if fetcher.Concurrency <= 0 || len(queue.active) < fetcher.Concurrency {
+			for i, image := range queue.images {
+				host := sourceHost(image)
+				if fetcher.HostConcurrency > 0 && queue.hosts[host] >= fetcher.HostConcurrency {
+					continue
+				}
+
+				queue.images = append(queue.images[:i], queue.images[i+1:]...)
+				queue.hosts[host]++
+
+				fetch := &activeFetch{
+					image: image,
+					done:  make(chan struct{}),
+				}
+				fetch.ctx, fetch.cancel = context.WithCancel(context.Background())
+				queue.active[image.ID] = fetch
+				return fetch
+			}
+		}
+		queue.cond.Wait()
+	}
+}
+
+// done marks an active fetch as finished
+func (queue *fetchQueue) done(fetch *activeFetch) {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+
+	fetch.cancel()
+	close(fetch.done)
+
+	host := sourceHost(fetch.image)
+	delete(queue.active, fetch.image.ID)
+	queue.hosts[host]--
+	if queue.hosts[host] <= 0 {
+		delete(queue.hosts, host)
+	}
+	queue.cond.Broadcast()
+}
+
+// cancel removes an image from the queue, returning it, or cancels its active
+// fetch, returning the fetch. Both are nil if the image is neither queued nor
+// being fetched.
+func (queue *fetchQueue) cancel(imageID string) (*metadata.Image, *activeFetch) {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+
+	for i, image := range queue.images {
+		if image.ID == imageID {
+			queue.images = append(queue.images[:i], queue.images[i+1:]...)
+			return image, nil
+		}
+	}
+
+	if fetch, ok := queue.active[imageID]; ok {
+		fetch.cancel()
+		return nil, fetch
+	}
+	return nil, nil
+}
+
+// queuedBefore tests whether an image should be fetched before another
+func queuedBefore(a, b *metadata.Image) bool {
+	if a.Priority != b.Priority {
+		return a.Priority > b.Priority
+	}
+	return a.QueuedAt.Before(b.QueuedAt)
+}
+
+// sourceHost returns the host an image is fetched from
+func sourceHost(image *metadata.Image) string {
+	source, err := url.Parse(image.FetchURL())
+	if err != nil {
+		return ""
+	}
+	return source.Host
+}
@@ -0,0 +1,287 @@
+package imageservice_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mistifyio/mistify-image-service"
+	"github.com/mistifyio/mistify-image-service/images"
+	"github.com/mistifyio/mistify-image-service/metadata"
+	"github.com/pborman/uuid"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/suite"
+)
+
+type QueueTestSuite struct {
+	suite.Suite
+	Context      *imageservice.Context
+	ImageData    []byte
+	StoreDir     string
+	FetchServers []*httptest.Server
+	// Gate holds each fetch request partway through the image data until a
+	// value is sent or it is closed
+	Gate         chan struct{}
+	Requests     []string
+	RequestsLock sync.Mutex
+}
+
+func (s *QueueTestSuite) SetupSuite() {
+	log.SetLevel(log.FatalLevel)
+	s.ImageData = []byte("testdatatestdatatestdata")
+
+	// Two servers, so fetches can come from different hosts
+	for i := 0; i < 2; i++ {
+		s.FetchServers = append(s.FetchServers, httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			s.RequestsLock.Lock()
+			s.Requests = append(s.Requests, r.URL.Path)
+			gate := s.Gate
+			s.RequestsLock.Unlock()
+
+			half := len(s.ImageData) / 2
+			w.Header().Set("Content-Length", strconv.Itoa(len(s.ImageData)))
+			_, _ = w.Write(s.ImageData[:half])
+			w.(http.Flusher).Flush()
+
+			select {
+			case <-gate:
+				_, _ = w.Write(s.ImageData[half:])
+			case <-r.Context().Done():
+			}
+		})))
+	}
+}
+
+func (s *QueueTestSuite) SetupTest() {
+	s.Gate = make(chan struct{})
+	s.Requests = nil
+
+	s.StoreDir, _ = ioutil.TempDir("", "queueTest-"+uuid.New())
+	// Images Store Setup
+	imageStoreConfig := &images.FSConfig{
+		Dir: s.StoreDir,
+	}
+	viper.Set("imageStoreType", "fs")
+	viper.Set("imageStoreConfig", imageStoreConfig)
+
+	// Metadata Store Setup
+	metadataStoreConfig := &metadata.KViteConfig{
+		Filename: filepath.Join(s.StoreDir, "kvite.db"),
+		Table:    "test",
+	}
+	viper.Set("metadataStoreType", "kvite")
+	viper.Set("metadataStoreConfig", metadataStoreConfig)
+
+	// Set up context
+	ctx, err := imageservice.NewContext()
+	s.Require().NoError(err)
+	s.Context = ctx
+}
+
+func (s *QueueTestSuite) TearDownTest() {
+	close(s.Gate)
+	s.NoError(os.RemoveAll(s.StoreDir))
+}
+
+func (s *QueueTestSuite) TearDownSuite() {
+	for _, server := range s.FetchServers {
+		server.Close()
+	}
+}
+
+func TestQueueTestSuite(t *testing.T) {
+	suite.Run(t, new(QueueTestSuite))
+}
+
+func (s *QueueTestSuite) TestConcurrency() {
+	s.Context.Fetcher.Concurrency = 1
+	s.Context.Fetcher.HostConcurrency = 0
+
+	first := s.fetch(0, "/first", 0)
+	second := s.fetch(1, "/second", 0)
+
+	s.waitForRequests(1)
+	s.Equal([]string{"/first"}, s.requests(), "only one fetch should run")
+	s.Equal(metadata.StatusQueued, s.getImage(second.ID).Status, "second fetch should wait in the queue")
+
+	s.Gate <- struct{}{}
+	s.waitForRequests(2)
+	s.Equal([]string{"/first", "/second"}, s.requests(), "second fetch should run after the first")
+	s.Gate <- struct{}{}
+
+	s.Equal(metadata.StatusComplete, s.waitForFetch(first.ID).Status)
+	s.Equal(metadata.StatusComplete, s.waitForFetch(second.ID).Status)
+}
+
+func (s *QueueTestSuite) TestHostConcurrency() {
+	s.Context.Fetcher.Concurrency = 3
+	s.Context.Fetcher.HostConcurrency = 1
+
+	_ = s.fetch(0, "/first", 0)
+	second := s.fetch(0, "/second", 0)
+	_ = s.fetch(1, "/other", 0)
+
+	s.waitForRequests(2)
+	s.ElementsMatch([]string{"/first", "/other"}, s.requests(), "fetches from different hosts should run")
+	s.Equal(metadata.StatusQueued, s.getImage(second.ID).Status, "second fetch from the same host should wait")
+
+	s.Gate <- struct{}{}
+	s.Gate <- struct{}{}
+	s.waitForRequests(3)
+	s.Gate <- struct{}{}
+	s.Equal(metadata.StatusComplete, s.waitForFetch(second.ID).Status)
+}
+
+func (s *QueueTestSuite) TestPriority() {
+	s.Context.Fetcher.Concurrency = 1
+
+	_ = s.fetch(0, "/first", 0)
+	s.waitForRequests(1)
+	_ = s.fetch(0, "/low", 0)
+	_ = s.fetch(0, "/lower", -1)
+	_ = s.fetch(0, "/high", 10)
+	_ = s.fetch(0, "/low-later", 0)
+
+	for i := 2; i <= 5; i++ {
+		s.Gate <- struct{}{}
+		s.waitForRequests(i)
+	}
+	s.Equal([]string{"/first", "/high", "/low", "/low-later", "/lower"}, s.requests(), "queue should be ordered by priority then time")
+	s.Gate <- struct{}{}
+}
+
+func (s *QueueTestSuite) TestRestore() {
+	// Simulate an image left queued by a previous run
+	image := &metadata.Image{
+		ID:       metadata.NewID(),
+		Type:     "kvm",
+		Source:   s.FetchServers[0].URL + "/restored",
+		Status:   metadata.StatusQueued,
+		QueuedAt: time.Now(),
+	}
+	s.Require().NoError(s.Context.MetadataStore.Put(image))
+
+	ctx, err := imageservice.NewContext()
+	s.Require().NoError(err)
+	s.Context = ctx
+
+	s.waitForRequests(1)
+	s.Equal([]string{"/restored"}, s.requests(), "queued image should be fetched")
+	s.Gate <- struct{}{}
+	s.Equal(metadata.StatusComplete, s.waitForFetch(image.ID).Status)
+}
+
+func (s *QueueTestSuite) TestCancelQueued() {
+	s.Context.Fetcher.Concurrency = 1
+
+	first := s.fetch(0, "/first", 0)
+	second := s.fetch(0, "/second", 0)
+	s.waitForRequests(1)
+
+	image, err := s.Context.Fetcher.Cancel(second.ID)
+	s.NoError(err)
+	s.Equal(metadata.StatusCancelled, image.Status)
+	s.Equal(metadata.StatusCancelled, s.getImage(second.ID).Status, "cancelled status should be saved")
+
+	s.Gate <- struct{}{}
+	s.Equal(metadata.StatusComplete, s.waitForFetch(first.ID).Status)
+	s.waitForRequests(1)
+	s.Equal([]string{"/first"}, s.requests(), "cancelled image should not be fetched")
+}
+
+func (s *QueueTestSuite) TestCancelRunning() {
+	image := s.fetch(0, "/running", 0)
+	s.waitForRequests(1)
+
+	// Wait for the partial data to arrive
+	for i := 0; i < 100; i++ {
+		if stat, err := s.Context.ImageStore.Stat(image.ID); err == nil && stat.Size() > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	image, err := s.Context.Fetcher.Cancel(image.ID)
+	s.NoError(err)
+	s.Equal(metadata.StatusCancelled, image.Status)
+	s.Equal(metadata.StatusCancelled, s.getImage(image.ID).Status, "cancelled status should be saved")
+	_, err = s.Context.ImageStore.Stat(image.ID)
+	s.Error(err, "partial data should be removed")
+
+	// Cancelling frees the slot for other fetches
+	s.Context.Fetcher.Concurrency = 1
+	next := s.fetch(0, "/next", 0)
+	s.waitForRequests(2)
+	s.Gate <- struct{}{}
+	s.Equal(metadata.StatusComplete, s.waitForFetch(next.ID).Status)
+}
+
+func (s *QueueTestSuite) TestCancelFinished() {
+	image := s.fetch(0, "/finished", 0)
+	s.waitForRequests(1)
+	s.Gate <- struct{}{}
+	s.Equal(metadata.StatusComplete, s.waitForFetch(image.ID).Status)
+
+	_, err := s.Context.Fetcher.Cancel(image.ID)
+	s.Equal(imageservice.ErrNotCancellable, err, "finished image should not be cancellable")
+	_, err = s.Context.Fetcher.Cancel(metadata.NewID())
+	s.Equal(imageservice.ErrNotCancellable, err, "unknown image should not be cancellable")
+}
+
+// fetch queues a fetch of a path from one of the fetch servers
+func (s *QueueTestSuite) fetch(server int, path string, priority int) *metadata.Image {
+	image, err := s.Context.Fetcher.Fetch(&metadata.Image{
+		ID:       metadata.NewID(),
+		Type:     "kvm",
+		Source:   s.FetchServers[server].URL + path,
+		Priority: priority,
+	})
+	s.Require().NoError(err)
+	s.Require().Equal(metadata.StatusQueued, image.Status)
+	return image
+}
+
+// requests returns a copy of the paths requested so far
+func (s *QueueTestSuite) requests() []string {
+	s.RequestsLock.Lock()
+	defer s.RequestsLock.Unlock()
+	return append([]string{}, s.Requests...)
+}
+
+// waitForRequests polls until the fetch servers have received a number of
+// requests
+func (s *QueueTestSuite) waitForRequests(count int) {
+	for i := 0; i < 100 && len(s.requests()) < count; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	// Give any unexpected extra requests a chance to arrive
+	time.Sleep(50 * time.Millisecond)
+	s.Require().Len(s.requests(), count)
+}
+
+// getImage retrieves image metadata
+func (s *QueueTestSuite) getImage(imageID string) *metadata.Image {
+	image, err := s.Context.MetadataStore.GetByID(imageID)
+	s.Require().NoError(err)
+	return image
+}
+
+// waitForFetch polls until an image fetch completes or errors
+func (s *QueueTestSuite) waitForFetch(imageID string) *metadata.Image {
+	var image *metadata.Image
+	for i := 0; i < 300; i++ {
+		image = s.getImage(imageID)
+		if image.Status == metadata.StatusComplete || image.Status == metadata.StatusError {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return image
+}
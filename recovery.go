@@ -0,0 +1,173 @@
+package imageservice
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/mistifyio/mistify-image-service/metadata"
+	log "github.com/sirupsen/logrus"
+)
+
+// Recovery modes for fetches interrupted by a restart
+const (
+	// RecoveryRequeue queues the fetch again from the image source
+	RecoveryRequeue = "requeue"
+	// RecoveryError marks the image with the error status
+	RecoveryError = "error"
+)
+
+// ErrInterrupted is recorded on images whose transfer was interrupted by a
+// restart and not requeued
+var ErrInterrupted = errors.New("transfer interrupted by restart")
+
+// remoteDownloads holds images that another service sharing the metadata store
+// was downloading when this one started. They are left to that service, and
+// only recovered if their download records are removed while they are still
+// unfinished, such as when that service went away.
+type remoteDownloads struct {
+	fetcher  *Fetcher
+	tracker  metadata.DownloadTracker
+	lock     sync.Mutex
+	imageIDs map[string]struct{}
+}
+
+// isValidRecoveryMode tests whether the recovery mode is valid
+func isValidRecoveryMode(mode string) bool {
+	return mode == RecoveryRequeue || mode == RecoveryError
+}
+
+// recoverImage reconciles an image left pending or downloading by a previous
+// run, whose transfer is no longer running. Partial image data is removed. A
+// fetch is requeued or marked as failed, depending on the recovery mode, while
+// an interrupted upload can only be marked as failed. An image whose data was
+// already committed is marked complete.
+func (fetcher *Fetcher) recoverImage(image *metadata.Image) error {
+	logFields := log.Fields{
+		"image":        image,
+		"recoveryMode": fetcher.RecoveryMode,
+	}
+
+	// Data is only committed after it has been verified, so only the final
+	// status is missing
+	if image.Digest != "" {
+		if fetcher.isCommitted(image) {
+			if err := image.SetFinished(nil); err != nil {
+				logFields["error"] = err
+				log.WithFields(logFields).Error("failed to finish recovered image")
+				return err
+			}
+			log.WithFields(logFields).Info("recovered committed image")
+			return nil
+		}
+		// The digest doesn't refer to data of this transfer, so the image
+		// must not keep the blob it names
+		log.WithFields(logFields).Warning("recovered image digest has no matching data")
+		image.Digest = ""
+	}
+
+	if err := fetcher.removeData(image); err != nil {
+		logFields["error"] = err
+		log.WithFields(logFields).Error("failed to remove partial image data")
+		return err
+	}
+	image.Size = 0
+	image.ExpectedSize = 0
+
+	var err error
+	if image.FetchURL() != "" && fetcher.RecoveryMode == RecoveryRequeue {
+		if err = image.SetQueued(); err == nil {
+			fetcher.queue.push(image)
+		}
+	} else {
+		err = image.SetFinished(ErrInterrupted)
+	}
+	if err != nil {
+		logFields["error"] = err
+		log.WithFields(logFields).Error("failed to recover interrupted image")
+		return err
+	}
+
+	log.WithFields(logFields).Info("recovered interrupted image")
+	return nil
+}
+
+// isCommitted tests whether the data of an image left pending or downloading
+// was committed, meaning it is stored under the image digest with the size
+// recorded when the transfer finished
+func (fetcher *Fetcher) isCommitted(image *metadata.Image) bool {
+	imageStore, err := fetcher.ctx.ImageStoreFor(image)
+	if err != nil {
+		return false
+	}
+	stat, err := imageStore.Stat(image.BlobID())
+	return err == nil && stat.Size() == image.Size
+}
+
+// watchRemoteDownloads starts watching for removed download records, if the
+// metadata store keeps them. Returns nil otherwise.
+func (fetcher *Fetcher) watchRemoteDownloads() *remoteDownloads {
+	tracker, ok := fetcher.ctx.MetadataStore.(metadata.DownloadTracker)
+	if !ok {
+		return nil
+	}
+
+	remote := &remoteDownloads{
+		fetcher:  fetcher,
+		tracker:  tracker,
+		imageIDs: make(map[string]struct{}),
+	}
+	// The watch lasts as long as the metadata store
+	tracker.WatchDownloads(context.Background(), remote.removed)
+	return remote
+}
+
+// leave checks whether an image left pending or downloading is being
+// downloaded by another service and, if so, leaves it to that service until
+// its download record is removed. The image is awaited before checking, so
+// the removal can't be missed.
+func (remote *remoteDownloads) leave(image *metadata.Image) (bool, error) {
+	remote.lock.Lock()
+	remote.imageIDs[image.ID] = struct{}{}
+	remote.lock.Unlock()
+
+	downloading, err := remote.tracker.Downloading(image.ID)
+	if err != nil {
+		return false, err
+	}
+	if downloading {
+		log.WithField("image", image).Info("leaving image downloaded by another service")
+		return true, nil
+	}
+	// The record may have been removed and the image recovered already
+	return !remote.take(image.ID), nil
+}
+
+// removed recovers an awaited image whose download record was removed, if it
+// is still unfinished
+func (remote *remoteDownloads) removed(imageID string) {
+	if !remote.take(imageID) {
+		return
+	}
+
+	ctx := remote.fetcher.ctx
+	image, err := ctx.MetadataStore.GetByID(imageID)
+	if err != nil {
+		return
+	}
+	if image.Status != metadata.StatusPending && image.Status != metadata.StatusDownloading {
+		return
+	}
+	image.Store = ctx.MetadataStore
+	_ = remote.fetcher.recoverImage(image)
+}
+
+// take stops awaiting an image, returning whether it was awaited
+func (remote *remoteDownloads) take(imageID string) bool {
+	remote.lock.Lock()
+	defer remote.lock.Unlock()
+
+	_, ok := remote.imageIDs[imageID]
+	delete(remote.imageIDs, imageID)
+	return ok
+}
@@ -0,0 +1,305 @@
+package imageservice_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mistifyio/mistify-image-service"
+	"github.com/mistifyio/mistify-image-service/images"
+	"github.com/mistifyio/mistify-image-service/metadata"
+	"github.com/pborman/uuid"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/suite"
+)
+
+type RecoveryTestSuite struct {
+	suite.Suite
+	Context     *imageservice.Context
+	ImageData   []byte
+	ImageDigest string
+	FetchServer *httptest.Server
+	StoreDir    string
+}
+
+// trackedKVite is a kvite metadata store whose downloads by other services are
+// simulated by a downloadTracker
+type trackedKVite struct {
+	metadata.KVite
+	*downloadTracker
+}
+
+// downloadTracker simulates the download records of other services
+type downloadTracker struct {
+	lock        sync.Mutex
+	downloading map[string]bool
+	watchers    []func(string)
+}
+
+var remoteTracker = &downloadTracker{}
+
+func init() {
+	metadata.Register("trackedkvite", func() metadata.Store {
+		return &trackedKVite{downloadTracker: remoteTracker}
+	})
+}
+
+func (dt *downloadTracker) Downloading(imageID string) (bool, error) {
+	dt.lock.Lock()
+	defer dt.lock.Unlock()
+	return dt.downloading[imageID], nil
+}
+
+func (dt *downloadTracker) WatchDownloads(ctx context.Context, removed func(string)) {
+	dt.lock.Lock()
+	defer dt.lock.Unlock()
+	dt.watchers = append(dt.watchers, removed)
+}
+
+// reset clears the downloads and watchers, marking images as downloading
+func (dt *downloadTracker) reset(imageIDs ...string) {
+	dt.lock.Lock()
+	defer dt.lock.Unlock()
+	dt.downloading = make(map[string]bool)
+	dt.watchers = nil
+	for _, imageID := range imageIDs {
+		dt.downloading[imageID] = true
+	}
+}
+
+// remove removes the download record of an image, notifying the watchers
+func (dt *downloadTracker) remove(imageID string) {
+	dt.lock.Lock()
+	delete(dt.downloading, imageID)
+	watchers := dt.watchers
+	dt.lock.Unlock()
+
+	for _, removed := range watchers {
+		removed(imageID)
+	}
+}
+
+func (s *RecoveryTestSuite) SetupSuite() {
+	log.SetLevel(log.FatalLevel)
+
+	s.ImageData = []byte("testdatatestdatatestdata")
+	digest := sha256.Sum256(s.ImageData)
+	s.ImageDigest = hex.EncodeToString(digest[:])
+
+	s.FetchServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(s.ImageData)
+	}))
+}
+
+func (s *RecoveryTestSuite) SetupTest() {
+	s.StoreDir, _ = ioutil.TempDir("", "recoveryTest-"+uuid.New())
+	// Images Store Setup
+	imageStoreConfig := &images.FSConfig{
+		Dir: s.StoreDir,
+	}
+	viper.Set("imageStoreType", "fs")
+	viper.Set("imageStoreConfig", imageStoreConfig)
+
+	// Metadata Store Setup
+	metadataStoreConfig := &metadata.KViteConfig{
+		Filename: filepath.Join(s.StoreDir, "kvite.db"),
+		Table:    "test",
+	}
+	viper.Set("metadataStoreType", "kvite")
+	viper.Set("metadataStoreConfig", metadataStoreConfig)
+
+	// Set up context
+	ctx, err := imageservice.NewContext()
+	s.Require().NoError(err)
+	s.Context = ctx
+}
+
+func (s *RecoveryTestSuite) TearDownTest() {
+	viper.Set("fetchRecoveryMode", imageservice.RecoveryRequeue)
+	s.NoError(os.RemoveAll(s.StoreDir))
+}
+
+func (s *RecoveryTestSuite) TearDownSuite() {
+	s.FetchServer.Close()
+}
+
+func TestRecoveryTestSuite(t *testing.T) {
+	suite.Run(t, new(RecoveryTestSuite))
+}
+
+func (s *RecoveryTestSuite) TestRequeue() {
+	fetch := s.interruptedImage(s.FetchServer.URL+"/fetch", metadata.StatusDownloading)
+	pending := s.interruptedImage(s.FetchServer.URL+"/pending", metadata.StatusPending)
+	upload := s.interruptedImage("", metadata.StatusDownloading)
+
+	s.restart()
+
+	for _, image := range []*metadata.Image{fetch, pending} {
+		image = s.waitForFetch(image.ID)
+		s.Equal(metadata.StatusComplete, image.Status, "interrupted fetch should be requeued")
+		s.Equal(s.ImageDigest, image.Digest, "only the refetched data should be stored")
+		_, err := s.Context.ImageStore.Stat(image.ID)
+		s.Error(err, "partial data should be removed")
+	}
+
+	image := s.getImage(upload.ID)
+	s.Equal(metadata.StatusError, image.Status, "interrupted upload can't be requeued")
+	s.Equal(imageservice.ErrInterrupted.Error(), image.Error)
+	_, err := s.Context.ImageStore.Stat(upload.ID)
+	s.Error(err, "partial data should be removed")
+}
+
+func (s *RecoveryTestSuite) TestError() {
+	viper.Set("fetchRecoveryMode", imageservice.RecoveryError)
+	fetch := s.interruptedImage(s.FetchServer.URL+"/fetch", metadata.StatusDownloading)
+
+	s.restart()
+
+	image := s.getImage(fetch.ID)
+	s.Equal(metadata.StatusError, image.Status, "interrupted fetch should fail")
+	s.Equal(imageservice.ErrInterrupted.Error(), image.Error)
+	s.Zero(image.Size)
+	_, err := s.Context.ImageStore.Stat(fetch.ID)
+	s.Error(err, "partial data should be removed")
+}
+
+func (s *RecoveryTestSuite) TestCommitted() {
+	// Simulate a restart after the data was committed, but before the final
+	// status was saved
+	image := &metadata.Image{
+		ID:     metadata.NewID(),
+		Type:   "kvm",
+		Source: s.FetchServer.URL + "/committed",
+		Status: metadata.StatusDownloading,
+		Size:   int64(len(s.ImageData)),
+		Digest: s.ImageDigest,
+	}
+	s.Require().NoError(s.Context.ImageStore.Put(s.ImageDigest, bytes.NewReader(s.ImageData)))
+	s.Require().NoError(s.Context.MetadataStore.Put(image))
+
+	s.restart()
+
+	image = s.getImage(image.ID)
+	s.Equal(metadata.StatusComplete, image.Status, "committed image should be complete")
+	s.EqualValues(len(s.ImageData), image.Size)
+	_, err := s.Context.ImageStore.Stat(s.ImageDigest)
+	s.NoError(err, "committed data should be kept")
+}
+
+func (s *RecoveryTestSuite) TestUncommittedDigest() {
+	// A digest without matching data was never committed
+	missing := &metadata.Image{
+		ID:     metadata.NewID(),
+		Type:   "kvm",
+		Source: s.FetchServer.URL + "/missing",
+		Status: metadata.StatusDownloading,
+		Size:   int64(len(s.ImageData)),
+		Digest: "0123456789abcdef",
+	}
+	s.Require().NoError(s.Context.MetadataStore.Put(missing))
+
+	// Data under the digest with another size belongs to another image
+	other := []byte("otherdata")
+	otherDigest := sha256.Sum256(other)
+	mismatched := &metadata.Image{
+		ID:     metadata.NewID(),
+		Type:   "kvm",
+		Source: s.FetchServer.URL + "/mismatched",
+		Status: metadata.StatusDownloading,
+		Size:   int64(len(s.ImageData)),
+		Digest: hex.EncodeToString(otherDigest[:]),
+	}
+	s.Require().NoError(s.Context.ImageStore.Put(mismatched.Digest, bytes.NewReader(other)))
+	s.Require().NoError(s.Context.MetadataStore.Put(mismatched))
+
+	s.restart()
+
+	for _, image := range []*metadata.Image{missing, mismatched} {
+		image = s.waitForFetch(image.ID)
+		s.Equal(metadata.StatusComplete, image.Status, "uncommitted image should be requeued")
+		s.Equal(s.ImageDigest, image.Digest, "only the refetched data should be referenced")
+	}
+	_, err := s.Context.ImageStore.Stat(mismatched.Digest)
+	s.NoError(err, "data of another image should be kept")
+}
+
+func (s *RecoveryTestSuite) TestRemoteDownload() {
+	remote := s.interruptedImage(s.FetchServer.URL+"/remote", metadata.StatusDownloading)
+	local := s.interruptedImage(s.FetchServer.URL+"/local", metadata.StatusDownloading)
+	remoteTracker.reset(remote.ID)
+	viper.Set("metadataStoreType", "trackedkvite")
+
+	s.restart()
+
+	image := s.waitForFetch(local.ID)
+	s.Equal(metadata.StatusComplete, image.Status, "interrupted fetch should be requeued")
+	image = s.getImage(remote.ID)
+	s.Equal(metadata.StatusDownloading, image.Status, "download by another service should be left alone")
+	_, err := s.Context.ImageStore.Stat(remote.ID)
+	s.NoError(err, "data of another service's download should be kept")
+
+	// The other service goes away
+	remoteTracker.remove(remote.ID)
+	image = s.waitForFetch(remote.ID)
+	s.Equal(metadata.StatusComplete, image.Status, "fetch should be requeued once its download record is removed")
+	s.Equal(s.ImageDigest, image.Digest)
+}
+
+func (s *RecoveryTestSuite) TestInvalidMode() {
+	viper.Set("fetchRecoveryMode", "asdf")
+	_, err := imageservice.NewContext()
+	s.Error(err, "invalid recovery mode should fail")
+}
+
+// interruptedImage simulates an image whose transfer was interrupted, with
+// partial data stored
+func (s *RecoveryTestSuite) interruptedImage(source, status string) *metadata.Image {
+	image := &metadata.Image{
+		ID:           metadata.NewID(),
+		Type:         "kvm",
+		Source:       source,
+		Status:       status,
+		Size:         int64(len(s.ImageData) / 2),
+		ExpectedSize: int64(len(s.ImageData)),
+	}
+	s.Require().NoError(s.Context.ImageStore.Put(image.ID, bytes.NewReader(s.ImageData[:image.Size])))
+	s.Require().NoError(s.Context.MetadataStore.Put(image))
+	return image
+}
+
+// restart creates a new context from the same stores
+func (s *RecoveryTestSuite) restart() {
+	ctx, err := imageservice.NewContext()
+	s.Require().NoError(err)
+	s.Context = ctx
+}
+
+// getImage retrieves image metadata
+func (s *RecoveryTestSuite) getImage(imageID string) *metadata.Image {
+	image, err := s.Context.MetadataStore.GetByID(imageID)
+	s.Require().NoError(err)
+	return image
+}
+
+// waitForFetch polls until an image fetch completes or errors
+func (s *RecoveryTestSuite) waitForFetch(imageID string) *metadata.Image {
+	var image *metadata.Image
+	for i := 0; i < 300; i++ {
+		image = s.getImage(imageID)
+		if image.Status == metadata.StatusComplete || image.Status == metadata.StatusError {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return image
+}
@@ -0,0 +1,265 @@
+package imageservice
+
+import (
+	"encoding/hex"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mistifyio/mistify-image-service/metadata"
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrRelocationRunning is used when a relocation is requested while another
+// is still running
+var ErrRelocationRunning = errors.New("relocation already running")
+
+// ErrSizeMismatch is used when copied image data does not match the image size
+var ErrSizeMismatch = errors.New("size mismatch")
+
+type (
+	// RelocateRequest selects the images whose data is moved to another image
+	// store
+	RelocateRequest struct {
+		// Store is the name of the image store to move the data to
+		Store string `json:"store"`
+		// ImageIDs limits the relocation to specific images. When empty, all
+		// complete images are relocated.
+		ImageIDs []string `json:"image_ids"`
+	}
+
+	// RelocateStatus is the progress of a relocation
+	RelocateStatus struct {
+		Store      string           `json:"store"`
+		Running    bool             `json:"running"`
+		Total      int              `json:"total"`
+		Moved      int              `json:"moved"`
+		Skipped    int              `json:"skipped"`
+		Failed     int              `json:"failed"`
+		Errors     []*RelocateError `json:"errors"`
+		StartedAt  time.Time        `json:"started_at"`
+		FinishedAt time.Time        `json:"finished_at"`
+	}
+
+	// RelocateError is an image whose data could not be relocated
+	RelocateError struct {
+		ImageID string `json:"image_id"`
+		Error   string `json:"error"`
+	}
+
+	// Relocator moves image data between image stores in the background while
+	// the service keeps running. Data is copied and verified before the image
+	// is switched to the new copy, so downloads are served from one complete
+	// copy or the other throughout.
+	Relocator struct {
+		ctx    *Context
+		lock   sync.Mutex
+		status *RelocateStatus
+	}
+)
+
+// NewRelocator creates a new Relocator
+func NewRelocator(ctx *Context) *Relocator {
+	return &Relocator{
+		ctx: ctx,
+	}
+}
+
+// Start begins relocating image data in the background. Only one relocation
+// runs at a time.
+func (relocator *Relocator) Start(req *RelocateRequest) (*RelocateStatus, error) {
+	if _, err := relocator.ctx.GetImageStore(req.Store); err != nil {
+		return nil, err
+	}
+	if req.Store == "" {
+		req.Store = DefaultImageStore
+	}
+
+	relocator.lock.Lock()
+	defer relocator.lock.Unlock()
+
+	if relocator.status != nil && relocator.status.Running {
+		return nil, ErrRelocationRunning
+	}
+	relocator.status = &RelocateStatus{
+		Store:     req.Store,
+		Running:   true,
+		Total:     len(req.ImageIDs),
+		Errors:    make([]*RelocateError, 0),
+		StartedAt: time.Now(),
+	}
+	go relocator.run(req)
+
+	return relocator.statusCopy(), nil
+}
+
+// Status returns the progress of the current or most recent relocation, or nil
+// if none has run
+func (relocator *Relocator) Status() *RelocateStatus {
+	relocator.lock.Lock()
+	defer relocator.lock.Unlock()
+
+	return relocator.statusCopy()
+}
+
+// statusCopy copies the status, so it can be used without the lock. The lock
+// must be held.
+func (relocator *Relocator) statusCopy() *RelocateStatus {
+	if relocator.status == nil {
+		return nil
+	}
+	status := *relocator.status
+	status.Errors = append([]*RelocateError{}, relocator.status.Errors...)
+	return &status
+}
+
+// run relocates the requested images, recording progress in the status
+func (relocator *Relocator) run(req *RelocateRequest) {
+	defer func() {
+		relocator.lock.Lock()
+		defer relocator.lock.Unlock()
+		relocator.status.Running = false
+		relocator.status.FinishedAt = time.Now()
+
+		log.WithFields(log.Fields{
+			"store":   relocator.status.Store,
+			"moved":   relocator.status.Moved,
+			"skipped": relocator.status.Skipped,
+			"failed":  relocator.status.Failed,
+		}).Info("relocation finished")
+	}()
+
+	imageIDs := req.ImageIDs
+	if len(imageIDs) == 0 {
+		allImages, err := relocator.ctx.MetadataStore.List("")
+		if err != nil {
+			log.WithField("error", err).Error("failed to list images for relocation")
+			relocator.record("", false, err)
+			return
+		}
+		for _, image := range allImages {
+			if image.Status == metadata.StatusComplete {
+				imageIDs = append(imageIDs, image.ID)
+			}
+		}
+		relocator.lock.Lock()
+		relocator.status.Total = len(imageIDs)
+		relocator.lock.Unlock()
+	}
+
+	for _, imageID := range imageIDs {
+		moved, err := relocator.relocateImage(imageID, req.Store)
+		relocator.record(imageID, moved, err)
+	}
+}
+
+// record records the result of relocating an image in the status
+func (relocator *Relocator) record(imageID string, moved bool, err error) {
+	relocator.lock.Lock()
+	defer relocator.lock.Unlock()
+
+	switch {
+	case err != nil:
+		relocator.status.Failed++
+		relocator.status.Errors = append(relocator.status.Errors, &RelocateError{
+			ImageID: imageID,
+			Error:   err.Error(),
+		})
+	case moved:
+		relocator.status.Moved++
+	default:
+		relocator.status.Skipped++
+	}
+}
+
+// relocateImage moves the data of a complete image to a named image store,
+// returning whether it was moved. Images that aren't complete or are already
+// in the store are skipped.
+func (relocator *Relocator) relocateImage(imageID, storeName string) (bool, error) {
+	image, err := relocator.ctx.MetadataStore.GetByID(imageID)
+	if err != nil {
+		return false, err
+	}
+	if image.Status != metadata.StatusComplete || imageStoreName(image) == storeName {
+		return false, nil
+	}
+
+	// Keep the copy from being taken for unreferenced data until the image
+	// points at it
+	blobs := relocator.ctx.Blobs
+	blobs.pin(image, storeName)
+	defer blobs.unpin(image, storeName)
+
+	if err := relocator.copyData(image, storeName); err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+			"image": image,
+			"store": storeName,
+		}).Error("failed to copy image data for relocation")
+		blobs.lock.Lock()
+		defer blobs.lock.Unlock()
+		_ = blobs.removeUnreferenced(image, storeName)
+		return false, err
+	}
+
+	if err := blobs.Relocate(image, storeName); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// copyData copies the data of an image to a named image store, verifying the
+// size, digest and checksum of the copy. Data already in the store, shared
+// with another image, is used as is.
+func (relocator *Relocator) copyData(image *metadata.Image, storeName string) error {
+	source, err := relocator.ctx.ImageStoreFor(image)
+	if err != nil {
+		return err
+	}
+	target, err := relocator.ctx.GetImageStore(storeName)
+	if err != nil {
+		return err
+	}
+
+	blobID := image.BlobID()
+	if stat, err := target.Stat(blobID); err == nil && stat.Size() == image.Size && image.Digest != "" {
+		return nil
+	}
+
+	progress := &byteCounter{}
+	digester := metadata.NewHash(metadata.DigestType)
+	hashWriters := []io.Writer{digester, progress}
+	hasher := metadata.NewHash(image.ChecksumType)
+	if hasher != nil {
+		hashWriters = append(hashWriters, hasher)
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		_ = pw.CloseWithError(source.Get(blobID, pw))
+	}()
+	if err := target.Put(blobID, io.TeeReader(pr, io.MultiWriter(hashWriters...))); err != nil {
+		_ = pr.CloseWithError(err)
+		return err
+	}
+
+	if progress.Count() != image.Size {
+		return ErrSizeMismatch
+	}
+	if image.Digest != "" && hex.EncodeToString(digester.Sum(nil)) != image.Digest {
+		return metadata.ErrChecksumMismatch
+	}
+	if hasher != nil && image.Checksum != "" && !strings.EqualFold(hex.EncodeToString(hasher.Sum(nil)), image.Checksum) {
+		return metadata.ErrChecksumMismatch
+	}
+	stat, err := target.Stat(blobID)
+	if err != nil {
+		return err
+	}
+	if stat.Size() != image.Size {
+		return ErrSizeMismatch
+	}
+	return nil
+}
@@ -0,0 +1,183 @@
+package imageservice_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/mistifyio/mistify-image-service"
+	"github.com/mistifyio/mistify-image-service/images"
+	"github.com/mistifyio/mistify-image-service/metadata"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/suite"
+)
+
+type RelocateTestSuite struct {
+	suite.Suite
+	Context   *imageservice.Context
+	Bulk      images.Store
+	ImageData []byte
+}
+
+func (s *RelocateTestSuite) SetupSuite() {
+	log.SetLevel(log.FatalLevel)
+	s.ImageData = []byte("testdatatestdatatestdata")
+}
+
+func (s *RelocateTestSuite) SetupTest() {
+	viper.Set("imageStoreType", "memory")
+	viper.Set("imageStoreConfig", &images.MemoryConfig{})
+	viper.Set("imageStores", []map[string]interface{}{
+		{"name": "bulk", "type": "memory", "config": map[string]interface{}{}},
+	})
+	viper.Set("metadataStoreType", "memory")
+	viper.Set("metadataStoreConfig", &metadata.MemoryConfig{})
+
+	ctx, err := imageservice.NewContext()
+	s.Require().NoError(err)
+	s.Context = ctx
+
+	s.Bulk, err = ctx.GetImageStore("bulk")
+	s.Require().NoError(err)
+}
+
+func (s *RelocateTestSuite) TearDownTest() {
+	viper.Set("imageStores", nil)
+}
+
+func TestRelocateTestSuite(t *testing.T) {
+	suite.Run(t, new(RelocateTestSuite))
+}
+
+func (s *RelocateTestSuite) TestImageStores() {
+	s.Equal([]string{imageservice.DefaultImageStore, "bulk"}, s.Context.ImageStoreNames())
+
+	store, err := s.Context.GetImageStore("")
+	s.NoError(err)
+	s.Equal(s.Context.ImageStore, store, "empty name should be the default store")
+
+	_, err = s.Context.GetImageStore("asdf")
+	s.Equal(imageservice.ErrUnknownImageStore, err)
+	_, err = s.Context.Relocator.Start(&imageservice.RelocateRequest{Store: "asdf"})
+	s.Equal(imageservice.ErrUnknownImageStore, err)
+}
+
+func (s *RelocateTestSuite) TestRelocate() {
+	first := s.receiveImage(s.ImageData)
+	second := s.receiveImage(s.ImageData)
+	other := s.receiveImage([]byte("otherdata"))
+
+	status := s.relocate(&imageservice.RelocateRequest{Store: "bulk"})
+	s.Equal(3, status.Total)
+	s.Equal(3, status.Moved)
+	s.Equal(0, status.Failed)
+	s.Empty(status.Errors)
+
+	for _, image := range []*metadata.Image{first, second, other} {
+		relocated, err := s.Context.MetadataStore.GetByID(image.ID)
+		s.Require().NoError(err)
+		s.Equal("bulk", relocated.ImageStore, "image should record its store")
+
+		_, err = s.Context.ImageStore.Stat(image.BlobID())
+		s.Error(err, "data should be removed from the original store")
+		s.Equal(image.Size, s.download(image), "data should be served from the new store")
+	}
+	s.Len(s.blobIDs(s.Bulk), 2, "shared data should still be shared")
+
+	status = s.relocate(&imageservice.RelocateRequest{Store: "bulk"})
+	s.Equal(3, status.Skipped, "images already in the store should be skipped")
+
+	status = s.relocate(&imageservice.RelocateRequest{ImageIDs: []string{first.ID}})
+	s.Equal(1, status.Moved)
+	relocated, err := s.Context.MetadataStore.GetByID(first.ID)
+	s.Require().NoError(err)
+	s.Equal("", relocated.ImageStore, "default store should not be recorded")
+	_, err = s.Bulk.Stat(first.BlobID())
+	s.NoError(err, "data shared with another image should be kept")
+	_, err = s.Context.ImageStore.Stat(first.BlobID())
+	s.NoError(err)
+}
+
+func (s *RelocateTestSuite) TestRelocateDuringDownload() {
+	image := s.receiveImage(s.ImageData)
+
+	reader, err := s.Context.Blobs.Open(image)
+	s.Require().NoError(err)
+
+	status := s.relocate(&imageservice.RelocateRequest{Store: "bulk"})
+	s.Equal(1, status.Moved)
+
+	_, err = s.Context.ImageStore.Stat(image.BlobID())
+	s.NoError(err, "data should be kept while it is being read")
+	data, err := ioutil.ReadAll(reader)
+	s.NoError(err)
+	s.Equal(s.ImageData, data, "download should complete from the original store")
+	s.NoError(reader.Close())
+
+	_, err = s.Context.ImageStore.Stat(image.BlobID())
+	s.Error(err, "data should be removed once the download is done")
+	s.Equal(image.Size, s.download(image))
+}
+
+func (s *RelocateTestSuite) TestCorruptData() {
+	image := s.receiveImage(s.ImageData)
+	s.Require().NoError(s.Context.ImageStore.Put(image.BlobID(), bytes.NewReader([]byte("corruptdatacorruptdata!!"))))
+
+	status := s.relocate(&imageservice.RelocateRequest{Store: "bulk"})
+	s.Equal(1, status.Failed)
+	s.Require().Len(status.Errors, 1)
+	s.Equal(image.ID, status.Errors[0].ImageID)
+
+	current, err := s.Context.MetadataStore.GetByID(image.ID)
+	s.Require().NoError(err)
+	s.Equal("", current.ImageStore, "image should stay in its store")
+	s.Empty(s.blobIDs(s.Bulk), "bad copy should be removed")
+}
+
+// relocate runs a relocation and waits for it to finish
+func (s *RelocateTestSuite) relocate(req *imageservice.RelocateRequest) *imageservice.RelocateStatus {
+	_, err := s.Context.Relocator.Start(req)
+	s.Require().NoError(err)
+
+	for i := 0; i < 100; i++ {
+		status := s.Context.Relocator.Status()
+		if !status.Running {
+			return status
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	s.FailNow("relocation did not finish")
+	return nil
+}
+
+// receiveImage stores data as a new image
+func (s *RelocateTestSuite) receiveImage(data []byte) *metadata.Image {
+	req, _ := http.NewRequest("PUT", "http://localhost", bytes.NewReader(data))
+	req.Header.Add("X-Image-Type", "kvm")
+
+	image, err := s.Context.Fetcher.Receive(req)
+	s.Require().NoError(err)
+	return image
+}
+
+// download reads the data of an image the way the download handler does,
+// returning the number of bytes read
+func (s *RelocateTestSuite) download(image *metadata.Image) int64 {
+	reader, err := s.Context.Blobs.Open(image)
+	s.Require().NoError(err)
+	defer func() { s.NoError(reader.Close()) }()
+
+	data, err := ioutil.ReadAll(reader)
+	s.NoError(err)
+	return int64(len(data))
+}
+
+// blobIDs lists the blobs in an image store
+func (s *RelocateTestSuite) blobIDs(store images.Store) []string {
+	blobIDs, err := store.List()
+	s.Require().NoError(err)
+	return blobIDs
+}
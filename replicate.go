@@ -0,0 +1,458 @@
+package imageservice
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mistifyio/mistify-image-service/metadata"
+	logx "github.com/mistifyio/mistify-logrus-ext"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// defaultReplicationInterval is the time between syncs with a peer, used when
+// not configured
+const defaultReplicationInterval = 1 * time.Minute
+
+// replicationPageSize is the number of images listed per request to a peer
+const replicationPageSize = 100
+
+// ErrUnknownPeer is used when a peer name isn't configured
+var ErrUnknownPeer = errors.New("unknown peer")
+
+type (
+	// ReplicationPeer configures an upstream image service to replicate or
+	// mirror images from
+	ReplicationPeer struct {
+		Name string
+		URL  string
+		// Token is an api token secret sent to the peer, for peers that
+		// require auth
+		Token string
+	}
+
+	// PeerStatus is the replication status of a peer. The counts and errors
+	// are from the most recent sync. Pulled counts the pulls it queued, and
+	// Failed includes earlier pulls found failed, which are queued again.
+	PeerStatus struct {
+		Name        string              `json:"name"`
+		URL         string              `json:"url"`
+		Syncing     bool                `json:"syncing"`
+		LastSync    time.Time           `json:"last_sync"`
+		LastSuccess time.Time           `json:"last_success"`
+		LastError   string              `json:"last_error"`
+		Images      int                 `json:"images"`
+		Pulled      int                 `json:"pulled"`
+		Deleted     int                 `json:"deleted"`
+		Failed      int                 `json:"failed"`
+		Errors      []*ReplicationError `json:"errors"`
+	}
+
+	// ReplicationError is an image that could not be replicated
+	ReplicationError struct {
+		ImageID string `json:"image_id"`
+		Error   string `json:"error"`
+	}
+
+	// Replicator follows upstream image services, pulling their complete
+	// images with the same id and metadata, and removing replicated images
+	// once they are removed upstream. Each peer is polled in the background.
+	Replicator struct {
+		ctx *Context
+		// Interval is the time between syncs with each peer
+		Interval time.Duration
+		peers    map[string]*replicationPeer
+		client   *http.Client
+		stop     chan struct{}
+		stopOnce sync.Once
+	}
+
+	// replicationPeer is a peer with its replication state
+	replicationPeer struct {
+		config  *ReplicationPeer
+		trigger chan struct{}
+		// syncLock serializes syncs with the peer
+		syncLock sync.Mutex
+		lock     sync.Mutex
+		status   *PeerStatus
+	}
+)
+
+// Validate ensures the peer is usable
+func (peer *ReplicationPeer) Validate() error {
+	if peer.Name == "" {
+		return errors.New("missing peer name")
+	}
+	if peer.URL == "" {
+		return errors.New("missing peer url")
+	}
+	if _, err := url.Parse(peer.URL); err != nil {
+		return err
+	}
+	return nil
+}
+
+// NewReplicator creates a new Replicator for the configured peers
+func NewReplicator(ctx *Context) (*Replicator, error) {
+	replicator := &Replicator{
+		ctx:      ctx,
+		Interval: defaultReplicationInterval,
+		peers:    make(map[string]*replicationPeer),
+		client:   &http.Client{},
+		stop:     make(chan struct{}),
+	}
+	if viper.IsSet("replicationInterval") {
+		replicator.Interval = viper.GetDuration("replicationInterval")
+	}
+
+	var peers []*ReplicationPeer
+	// json errors would have been caught by viper when loading the file
+	peersJSON, _ := json.Marshal(viper.Get("replicationPeers"))
+	if err := json.Unmarshal(peersJSON, &peers); err != nil {
+		log.WithFields(log.Fields{
+			"error":  err,
+			"config": string(peersJSON),
+		}).Error("invalid replication peers config")
+		return nil, err
+	}
+	for _, peer := range peers {
+		if err := replicator.AddPeer(peer); err != nil {
+			return nil, err
+		}
+	}
+	return replicator, nil
+}
+
+// AddPeer adds an upstream image service to replicate from. Peers should be
+// added before Start.
+func (replicator *Replicator) AddPeer(peer *ReplicationPeer) error {
+	err := peer.Validate()
+	if _, exists := replicator.peers[peer.Name]; err == nil && exists {
+		err = errors.New("duplicate peer name")
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+			"peer":  peer.Name,
+			"url":   peer.URL,
+		}).Error("invalid replication peer")
+		return err
+	}
+
+	replicator.peers[peer.Name] = &replicationPeer{
+		config:  peer,
+		trigger: make(chan struct{}, 1),
+		status: &PeerStatus{
+			Name:   peer.Name,
+			URL:    peer.URL,
+			Errors: make([]*ReplicationError, 0),
+		},
+	}
+	return nil
+}
+
+// Start begins polling each peer, starting with an immediate sync
+func (replicator *Replicator) Start() {
+	for _, peer := range replicator.peers {
+		go replicator.follow(peer)
+	}
+}
+
+// Stop stops polling the peers. Syncs in progress are finished.
+func (replicator *Replicator) Stop() {
+	replicator.stopOnce.Do(func() {
+		close(replicator.stop)
+	})
+}
+
+// Status returns the replication status of each peer, ordered by name
+func (replicator *Replicator) Status() []*PeerStatus {
+	statuses := make([]*PeerStatus, 0, len(replicator.peers))
+	for _, name := range replicator.peerNames() {
+		statuses = append(statuses, replicator.peers[name].statusCopy())
+	}
+	return statuses
+}
+
+// Trigger starts a sync with a peer in the background, without waiting for
+// the poll interval
+func (replicator *Replicator) Trigger(name string) (*PeerStatus, error) {
+	peer, ok := replicator.peers[name]
+	if !ok {
+		return nil, ErrUnknownPeer
+	}
+
+	select {
+	case peer.trigger <- struct{}{}:
+	default:
+		// A sync is already pending
+	}
+	return peer.statusCopy(), nil
+}
+
+// Sync syncs with a peer and waits for it to finish, returning the resulting
+// status
+func (replicator *Replicator) Sync(name string) (*PeerStatus, error) {
+	peer, ok := replicator.peers[name]
+	if !ok {
+		return nil, ErrUnknownPeer
+	}
+	return replicator.sync(peer), nil
+}
+
+// follow syncs with a peer on every interval or trigger until stopped
+func (replicator *Replicator) follow(peer *replicationPeer) {
+	for {
+		replicator.sync(peer)
+
+		select {
+		case <-replicator.stop:
+			return
+		case <-peer.trigger:
+		case <-time.After(replicator.Interval):
+		}
+	}
+}
+
+// sync queues pulls of new complete images from a peer and removes replicated images
+// the peer no longer has
+func (replicator *Replicator) sync(peer *replicationPeer) *PeerStatus {
+	peer.syncLock.Lock()
+	defer peer.syncLock.Unlock()
+
+	status := &PeerStatus{
+		Name:        peer.config.Name,
+		URL:         peer.config.URL,
+		LastSync:    time.Now(),
+		LastSuccess: peer.statusCopy().LastSuccess,
+		Errors:      make([]*ReplicationError, 0),
+	}
+	peer.lock.Lock()
+	peer.status.Syncing = true
+	peer.lock.Unlock()
+
+	err := replicator.syncImages(peer.config, status)
+	if err != nil {
+		status.LastError = err.Error()
+		log.WithFields(log.Fields{
+			"error": err,
+			"peer":  peer.config.Name,
+		}).Error("failed to sync with peer")
+	} else {
+		status.LastSuccess = status.LastSync
+	}
+
+	peer.lock.Lock()
+	defer peer.lock.Unlock()
+	peer.status = status
+	return peer.statusCopyLocked()
+}
+
+// syncImages replicates the images of a peer, recording the results in the
+// status. Pulls are queued with the Fetcher; those that fail are recorded and
+// retried by the next sync. An error is only returned when the peer can't be
+// listed.
+func (replicator *Replicator) syncImages(peer *ReplicationPeer, status *PeerStatus) error {
+	remoteImages, err := replicator.listImages(peer)
+	if err != nil {
+		return err
+	}
+
+	allImages, err := replicator.ctx.MetadataStore.List("")
+	if err != nil {
+		return err
+	}
+	localImages := make(map[string]*metadata.Image, len(allImages))
+	for _, image := range allImages {
+		localImages[image.ID] = image
+	}
+
+	remoteIDs := make(map[string]bool, len(remoteImages))
+	for _, remote := range remoteImages {
+		remoteIDs[remote.ID] = true
+		if remote.Status != metadata.StatusComplete {
+			continue
+		}
+		status.Images++
+
+		local, exists := localImages[remote.ID]
+		failed := exists && (local.Status == metadata.StatusError || local.Status == metadata.StatusCancelled)
+		if exists && (local.Peer != peer.Name || !failed) {
+			// Already replicated or being pulled, or an image of our own
+			continue
+		}
+		if exists {
+			// The previous pull failed and is retried
+			status.Failed++
+			status.Errors = append(status.Errors, &ReplicationError{
+				ImageID: remote.ID,
+				Error:   local.Error,
+			})
+		}
+		if err := replicator.pullImage(peer, remote, local); err != nil {
+			status.Failed++
+			status.Errors = append(status.Errors, &ReplicationError{
+				ImageID: remote.ID,
+				Error:   err.Error(),
+			})
+			continue
+		}
+		status.Pulled++
+	}
+
+	// Images removed upstream are removed here too, but only once the whole
+	// listing has been retrieved
+	for _, local := range allImages {
+		if local.Peer != peer.Name || remoteIDs[local.ID] {
+			continue
+		}
+		local.Store = replicator.ctx.MetadataStore
+		if _, err := DeleteImage(replicator.ctx, local); err != nil {
+			status.Failed++
+			status.Errors = append(status.Errors, &ReplicationError{
+				ImageID: local.ID,
+				Error:   err.Error(),
+			})
+			continue
+		}
+		status.Deleted++
+	}
+
+	log.WithFields(log.Fields{
+		"peer":    peer.Name,
+		"images":  status.Images,
+		"pulled":  status.Pulled,
+		"deleted": status.Deleted,
+		"failed":  status.Failed,
+	}).Info("synced with peer")
+	return nil
+}
+
+// listImages retrieves all images of a peer, a page at a time
+func (replicator *Replicator) listImages(peer *ReplicationPeer) ([]*metadata.Image, error) {
+	var allImages []*metadata.Image
+	cursor := ""
+	for {
+		values := url.Values{}
+		values.Set("limit", strconv.Itoa(replicationPageSize))
+		if cursor != "" {
+			values.Set("cursor", cursor)
+		}
+		resp, err := replicator.get(peer, "/images?"+values.Encode())
+		if err != nil {
+			return nil, err
+		}
+
+		var page []*metadata.Image
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		logx.LogReturnedErr(resp.Body.Close, nil, "failed to close peer response body")
+		if err != nil {
+			return nil, err
+		}
+		allImages = append(allImages, page...)
+
+		cursor = resp.Header.Get("X-Next-Cursor")
+		if cursor == "" {
+			return allImages, nil
+		}
+	}
+}
+
+// pullImage queues a fetch of a complete image from a peer with the same id
+// and metadata. A previous failed attempt, if any, is removed first. The data
+// is verified against the peer's checksum.
+func (replicator *Replicator) pullImage(peer *ReplicationPeer, remote, previous *metadata.Image) error {
+	if previous != nil {
+		previous.Store = replicator.ctx.MetadataStore
+		if _, err := DeleteImage(replicator.ctx, previous); err != nil {
+			return err
+		}
+	}
+
+	// Status, sizes, times and the image store are local to this service
+	image := &metadata.Image{
+		ID:               remote.ID,
+		Source:           remote.Source,
+		Type:             remote.Type,
+		Comment:          remote.Comment,
+		Priority:         remote.Priority,
+		ChecksumType:     remote.ChecksumType,
+		ExpectedChecksum: remote.Checksum,
+		Signature:        remote.Signature,
+		Peer:             peer.Name,
+		PeerSource:       peerURL(peer, "/images/"+url.PathEscape(remote.ID)+"/download"),
+	}
+	if _, err := replicator.ctx.Fetcher.Fetch(image); err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+			"peer":  peer.Name,
+			"image": image,
+		}).Error("failed to queue image pull from peer")
+		return err
+	}
+	return nil
+}
+
+// get sends a GET request to a peer, returning the response if successful.
+// The response body must be closed by the caller.
+func (replicator *Replicator) get(peer *ReplicationPeer, path string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", peerURL(peer, path), nil)
+	if err != nil {
+		return nil, err
+	}
+	peer.authorize(req)
+	resp, err := replicator.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		logx.LogReturnedErr(resp.Body.Close, nil, "failed to close peer response body")
+		err := errors.New("unexpected response status")
+		log.WithFields(log.Fields{
+			"error":      err,
+			"peer":       peer.Name,
+			"path":       path,
+			"statusCode": resp.StatusCode,
+		}).Error(err)
+		return nil, err
+	}
+	return resp, nil
+}
+
+// peer returns a configured peer by name, or nil
+func (replicator *Replicator) peer(name string) *ReplicationPeer {
+	if peer, ok := replicator.peers[name]; ok {
+		return peer.config
+	}
+	return nil
+}
+
+// peerNames returns the names of the peers, sorted
+func (replicator *Replicator) peerNames() []string {
+	names := make([]string, 0, len(replicator.peers))
+	for name := range replicator.peers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// statusCopy copies the status of a peer, so it can be used without the lock
+func (peer *replicationPeer) statusCopy() *PeerStatus {
+	peer.lock.Lock()
+	defer peer.lock.Unlock()
+	return peer.statusCopyLocked()
+}
+
+// statusCopyLocked copies the status of a peer. The lock must be held.
+func (peer *replicationPeer) statusCopyLocked() *PeerStatus {
+	status := *peer.status
+	status.Errors = append([]*ReplicationError{}, peer.status.Errors...)
+	return &status
+}
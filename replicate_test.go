@@ -0,0 +1,275 @@
+package imageservice_test
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/mistifyio/mistify-image-service"
+	"github.com/mistifyio/mistify-image-service/images"
+	"github.com/mistifyio/mistify-image-service/metadata"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/suite"
+	"github.com/tylerb/graceful"
+)
+
+type ReplicateTestSuite struct {
+	suite.Suite
+	Upstream   *imageservice.Context
+	Downstream *imageservice.Context
+	APIServer  *graceful.Server
+	Port       int
+	ImageData  []byte
+}
+
+func (s *ReplicateTestSuite) SetupSuite() {
+	log.SetLevel(log.FatalLevel)
+	s.ImageData = []byte("testdatatestdatatestdata")
+	s.Port = 54322
+}
+
+func (s *ReplicateTestSuite) SetupTest() {
+	viper.Set("imageStoreType", "memory")
+	viper.Set("imageStoreConfig", &images.MemoryConfig{})
+	viper.Set("metadataStoreType", "memory")
+	viper.Set("metadataStoreConfig", &metadata.MemoryConfig{})
+
+	var err error
+	s.Upstream, err = imageservice.NewContext()
+	s.Require().NoError(err)
+	s.APIServer = imageservice.Run(s.Upstream, s.Port)
+	time.Sleep(100 * time.Millisecond)
+
+	// Syncs are run by the tests rather than on an interval
+	viper.Set("replicationInterval", "1h")
+	viper.Set("replicationPeers", []map[string]interface{}{
+		{"name": "upstream", "url": fmt.Sprintf("http://localhost:%d", s.Port)},
+	})
+	s.Downstream, err = imageservice.NewContext()
+	s.Require().NoError(err)
+
+	// Wait for the initial sync so it doesn't pick up images added by tests
+	for i := 0; i < 100; i++ {
+		if !s.Downstream.Replicator.Status()[0].LastSync.IsZero() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	s.FailNow("initial sync did not finish")
+}
+
+func (s *ReplicateTestSuite) TearDownTest() {
+	s.Downstream.Replicator.Stop()
+	viper.Set("replicationInterval", nil)
+	viper.Set("replicationPeers", nil)
+
+	stopChan := s.APIServer.StopChan()
+	s.APIServer.Stop(5 * time.Second)
+	<-stopChan
+}
+
+func TestReplicateTestSuite(t *testing.T) {
+	suite.Run(t, new(ReplicateTestSuite))
+}
+
+func (s *ReplicateTestSuite) TestPeers() {
+	_, err := s.Downstream.Replicator.Sync("asdf")
+	s.Equal(imageservice.ErrUnknownPeer, err)
+	_, err = s.Downstream.Replicator.Trigger("asdf")
+	s.Equal(imageservice.ErrUnknownPeer, err)
+
+	tests := []struct {
+		description string
+		peer        *imageservice.ReplicationPeer
+		expectedErr bool
+	}{
+		{"missing name should fail",
+			&imageservice.ReplicationPeer{URL: "http://localhost"}, true},
+		{"missing url should fail",
+			&imageservice.ReplicationPeer{Name: "other"}, true},
+		{"duplicate name should fail",
+			&imageservice.ReplicationPeer{Name: "upstream", URL: "http://localhost"}, true},
+		{"new peer should succeed",
+			&imageservice.ReplicationPeer{Name: "other", URL: "http://localhost"}, false},
+	}
+
+	for _, test := range tests {
+		err := s.Downstream.Replicator.AddPeer(test.peer)
+		if test.expectedErr {
+			s.Error(err, test.description)
+		} else {
+			s.NoError(err, test.description)
+		}
+	}
+
+	statuses := s.Downstream.Replicator.Status()
+	s.Require().Len(statuses, 2)
+	s.Equal("other", statuses[0].Name, "statuses should be ordered by name")
+	s.Equal("upstream", statuses[1].Name)
+}
+
+func (s *ReplicateTestSuite) TestSync() {
+	first := s.receiveImage(s.Upstream, s.ImageData)
+	second := s.receiveImage(s.Upstream, []byte("otherdata"))
+	local := s.receiveImage(s.Downstream, s.ImageData)
+
+	status := s.sync()
+	s.Equal(2, status.Images)
+	s.Equal(2, status.Pulled)
+	s.Equal(0, status.Failed)
+	s.Empty(status.LastError)
+	s.Equal(status.LastSync, status.LastSuccess)
+
+	status = s.sync()
+	s.Equal(0, status.Pulled, "queued pulls should not be queued again")
+
+	for _, image := range []*metadata.Image{first, second} {
+		replicated := s.waitForFetch(image.ID)
+		s.Equal("upstream", replicated.Peer)
+		s.Equal(image.Source, replicated.Source, "original source should be kept")
+		s.Equal(fmt.Sprintf("http://localhost:%d/images/%s/download", s.Port, image.ID), replicated.PeerSource,
+			"image should be fetched from the peer")
+		s.Equal(metadata.StatusComplete, replicated.Status)
+		s.Equal(image.Type, replicated.Type)
+		s.Equal(image.Digest, replicated.Digest)
+		s.Equal(image.Size, replicated.Size)
+	}
+
+	status = s.sync()
+	s.Equal(0, status.Pulled, "replicated images should not be pulled again")
+
+	_, err := imageservice.DeleteImage(s.Upstream, first)
+	s.Require().NoError(err)
+	status = s.sync()
+	s.Equal(1, status.Deleted)
+	_, err = s.Downstream.MetadataStore.GetByID(first.ID)
+	s.Equal(metadata.ErrNotFound, err, "image removed upstream should be removed")
+	_, err = s.Downstream.MetadataStore.GetByID(second.ID)
+	s.NoError(err)
+	_, err = s.Downstream.MetadataStore.GetByID(local.ID)
+	s.NoError(err, "images of our own should be kept")
+}
+
+func (s *ReplicateTestSuite) TestSource() {
+	image := s.receiveImage(s.Upstream, s.ImageData)
+	image.Source = "http://example.com/image"
+	s.Require().NoError(s.Upstream.MetadataStore.Put(image))
+
+	s.sync()
+	replicated := s.waitForFetch(image.ID)
+	s.Equal(metadata.StatusComplete, replicated.Status)
+	s.Equal(image.Source, replicated.Source, "original source should be kept")
+
+	fetched, err := s.Downstream.Fetcher.Fetch(&metadata.Image{Source: image.Source, Type: "kvm"})
+	s.NoError(err)
+	s.Equal(image.ID, fetched.ID, "fetch of the original source should find the replicated image")
+}
+
+func (s *ReplicateTestSuite) TestCorruptData() {
+	image := s.receiveImage(s.Upstream, s.ImageData)
+	s.Require().NoError(s.Upstream.ImageStore.Put(image.BlobID(), bytes.NewReader([]byte("corruptdatacorruptdata!!"))))
+
+	status := s.sync()
+	s.Equal(1, status.Pulled)
+	replicated := s.waitForFetch(image.ID)
+	s.Equal(metadata.StatusError, replicated.Status, "failed pull should be recorded")
+
+	// The next sync reports and retries the image
+	s.Require().NoError(s.Upstream.ImageStore.Put(image.BlobID(), bytes.NewReader(s.ImageData)))
+	status = s.sync()
+	s.Equal(1, status.Failed)
+	s.Require().Len(status.Errors, 1)
+	s.Equal(image.ID, status.Errors[0].ImageID)
+	s.Equal(replicated.Error, status.Errors[0].Error)
+	s.Equal(1, status.Pulled)
+	replicated = s.waitForFetch(image.ID)
+	s.Equal(metadata.StatusComplete, replicated.Status)
+}
+
+func (s *ReplicateTestSuite) TestUnreachablePeer() {
+	stopChan := s.APIServer.StopChan()
+	s.APIServer.Stop(5 * time.Second)
+	<-stopChan
+	// Restart a server for teardown to stop
+	defer func() {
+		s.APIServer = imageservice.Run(s.Upstream, s.Port)
+		time.Sleep(100 * time.Millisecond)
+	}()
+
+	status := s.sync()
+	s.NotEmpty(status.LastError)
+	s.True(status.LastSuccess.Before(status.LastSync))
+}
+
+func (s *ReplicateTestSuite) TestToken() {
+	// The upstream service is fronted by a proxy requiring a token
+	upstreamURL, _ := url.Parse(fmt.Sprintf("http://localhost:%d", s.Port))
+	proxy := httputil.NewSingleHostReverseProxy(upstreamURL)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer foo.bar" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		proxy.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	s.Require().NoError(s.Downstream.Replicator.AddPeer(&imageservice.ReplicationPeer{
+		Name: "untokened",
+		URL:  server.URL,
+	}))
+	s.Require().NoError(s.Downstream.Replicator.AddPeer(&imageservice.ReplicationPeer{
+		Name:  "tokened",
+		URL:   server.URL,
+		Token: "foo.bar",
+	}))
+	image := s.receiveImage(s.Upstream, s.ImageData)
+
+	status, err := s.Downstream.Replicator.Sync("untokened")
+	s.Require().NoError(err)
+	s.NotEmpty(status.LastError, "peer without the token should be refused")
+
+	status, err = s.Downstream.Replicator.Sync("tokened")
+	s.Require().NoError(err)
+	s.Empty(status.LastError)
+	s.Equal(1, status.Pulled)
+	replicated := s.waitForFetch(image.ID)
+	s.Equal(metadata.StatusComplete, replicated.Status, "pull should send the peer token")
+}
+
+// sync syncs with the upstream peer
+func (s *ReplicateTestSuite) sync() *imageservice.PeerStatus {
+	status, err := s.Downstream.Replicator.Sync("upstream")
+	s.Require().NoError(err)
+	return status
+}
+
+// receiveImage stores data as a new image
+func (s *ReplicateTestSuite) receiveImage(ctx *imageservice.Context, data []byte) *metadata.Image {
+	req, _ := http.NewRequest("PUT", "http://localhost", bytes.NewReader(data))
+	req.Header.Add("X-Image-Type", "kvm")
+
+	image, err := ctx.Fetcher.Receive(req)
+	s.Require().NoError(err)
+	return image
+}
+
+// waitForFetch polls until a pulled image fetch completes or errors
+func (s *ReplicateTestSuite) waitForFetch(imageID string) *metadata.Image {
+	var image *metadata.Image
+	for i := 0; i < 300; i++ {
+		image, _ = s.Downstream.MetadataStore.GetByID(imageID)
+		if image != nil && (image.Status == metadata.StatusComplete || image.Status == metadata.StatusError) {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	s.Require().NotNil(image)
+	return image
+}
@@ -0,0 +1,96 @@
+package imageservice
+
+import (
+	"errors"
+
+	"github.com/mistifyio/mistify-image-service/metadata"
+	log "github.com/sirupsen/logrus"
+)
+
+// ImageStoreRoute selects the image store for new images that match it. An
+// image matches when its type is one of Types, if any are given, and its
+// expected size is within MinSize and MaxSize, if given. Routes with a size
+// limit don't match images of unknown size.
+type ImageStoreRoute struct {
+	Store   string
+	Types   []string
+	MinSize int64
+	MaxSize int64
+}
+
+// Validate ensures the route is usable
+func (route *ImageStoreRoute) Validate() error {
+	if route.Store == "" {
+		return errors.New("missing route store")
+	}
+	for _, imageType := range route.Types {
+		if !metadata.IsValidImageType(imageType) {
+			return errors.New("invalid route image type")
+		}
+	}
+	if route.MinSize < 0 || route.MaxSize < 0 {
+		return errors.New("invalid route size")
+	}
+	if route.MaxSize > 0 && route.MinSize > route.MaxSize {
+		return errors.New("route minSize greater than maxSize")
+	}
+	return nil
+}
+
+// Matches tests whether an image of an expected size, -1 if unknown, is
+// routed by the route
+func (route *ImageStoreRoute) Matches(image *metadata.Image, size int64) bool {
+	if len(route.Types) > 0 {
+		matched := false
+		for _, imageType := range route.Types {
+			if imageType == image.Type {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	if route.MinSize > 0 || route.MaxSize > 0 {
+		if size < 0 || size < route.MinSize {
+			return false
+		}
+		if route.MaxSize > 0 && size > route.MaxSize {
+			return false
+		}
+	}
+	return true
+}
+
+// AddImageStoreRoute adds a route after any existing routes of the context.
+// The route store must already be configured.
+func (ctx *Context) AddImageStoreRoute(route *ImageStoreRoute) error {
+	err := route.Validate()
+	if err == nil {
+		_, err = ctx.GetImageStore(route.Store)
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+			"route": route,
+		}).Error("invalid image store route")
+		return err
+	}
+
+	ctx.ImageStoreRoutes = append(ctx.ImageStoreRoutes, route)
+	return nil
+}
+
+// RouteImage returns the name of the image store for a new image of an
+// expected size, -1 if unknown. The first matching route is used, falling back
+// to the default image store.
+func (ctx *Context) RouteImage(image *metadata.Image, size int64) string {
+	for _, route := range ctx.ImageStoreRoutes {
+		if route.Matches(image, size) {
+			return route.Store
+		}
+	}
+	return DefaultImageStore
+}
@@ -0,0 +1,187 @@
+package imageservice_test
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mistifyio/mistify-image-service"
+	"github.com/mistifyio/mistify-image-service/images"
+	"github.com/mistifyio/mistify-image-service/metadata"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/suite"
+)
+
+type RouteTestSuite struct {
+	suite.Suite
+	Context *imageservice.Context
+}
+
+func (s *RouteTestSuite) SetupSuite() {
+	log.SetLevel(log.FatalLevel)
+}
+
+func (s *RouteTestSuite) SetupTest() {
+	viper.Set("imageStoreType", "memory")
+	viper.Set("imageStoreConfig", &images.MemoryConfig{})
+	viper.Set("imageStores", []map[string]interface{}{
+		{"name": "ssd", "type": "memory", "config": map[string]interface{}{}},
+		{"name": "bulk", "type": "memory", "config": map[string]interface{}{}},
+	})
+	viper.Set("imageStoreRoutes", []map[string]interface{}{
+		{"store": "ssd", "types": []string{"container"}},
+		{"store": "bulk", "minSize": 16},
+	})
+	viper.Set("metadataStoreType", "memory")
+	viper.Set("metadataStoreConfig", &metadata.MemoryConfig{})
+
+	ctx, err := imageservice.NewContext()
+	s.Require().NoError(err)
+	s.Context = ctx
+}
+
+func (s *RouteTestSuite) TearDownTest() {
+	viper.Set("imageStores", nil)
+	viper.Set("imageStoreRoutes", nil)
+}
+
+func TestRouteTestSuite(t *testing.T) {
+	suite.Run(t, new(RouteTestSuite))
+}
+
+func (s *RouteTestSuite) TestRouteMatches() {
+	kvm := &metadata.Image{Type: "kvm"}
+	container := &metadata.Image{Type: "container"}
+
+	tests := []struct {
+		description string
+		route       *imageservice.ImageStoreRoute
+		image       *metadata.Image
+		size        int64
+		expected    bool
+	}{
+		{"empty route should match anything", &imageservice.ImageStoreRoute{}, kvm, -1, true},
+		{"matching type should match", &imageservice.ImageStoreRoute{Types: []string{"kvm"}}, kvm, 10, true},
+		{"other type should not match", &imageservice.ImageStoreRoute{Types: []string{"kvm"}}, container, 10, false},
+		{"size within limits should match", &imageservice.ImageStoreRoute{MinSize: 10, MaxSize: 20}, kvm, 20, true},
+		{"size below minimum should not match", &imageservice.ImageStoreRoute{MinSize: 10}, kvm, 9, false},
+		{"size above maximum should not match", &imageservice.ImageStoreRoute{MaxSize: 20}, kvm, 21, false},
+		{"unknown size should not match size limits", &imageservice.ImageStoreRoute{MaxSize: 20}, kvm, -1, false},
+	}
+
+	for _, test := range tests {
+		s.Equal(test.expected, test.route.Matches(test.image, test.size), test.description)
+	}
+}
+
+func (s *RouteTestSuite) TestRouteValidate() {
+	tests := []struct {
+		description string
+		route       *imageservice.ImageStoreRoute
+		expectedErr bool
+	}{
+		{"missing store should fail", &imageservice.ImageStoreRoute{}, true},
+		{"invalid type should fail", &imageservice.ImageStoreRoute{Store: "ssd", Types: []string{"asdf"}}, true},
+		{"negative size should fail", &imageservice.ImageStoreRoute{Store: "ssd", MinSize: -1}, true},
+		{"inverted sizes should fail", &imageservice.ImageStoreRoute{Store: "ssd", MinSize: 2, MaxSize: 1}, true},
+		{"valid route should succeed", &imageservice.ImageStoreRoute{Store: "ssd", Types: []string{"kvm"}, MaxSize: 1}, false},
+	}
+
+	for _, test := range tests {
+		err := test.route.Validate()
+		if test.expectedErr {
+			s.Error(err, test.description)
+		} else {
+			s.NoError(err, test.description)
+		}
+	}
+
+	s.Equal(imageservice.ErrUnknownImageStore, s.Context.AddImageStoreRoute(&imageservice.ImageStoreRoute{Store: "asdf"}))
+}
+
+func (s *RouteTestSuite) TestReceive() {
+	tests := []struct {
+		description   string
+		imageType     string
+		imageStore    string
+		data          []byte
+		expectedStore string
+	}{
+		{"type route should be used", "container", "", []byte("small"), "ssd"},
+		{"first matching route should be used", "container", "", []byte("largelargelargelarge"), "ssd"},
+		{"size route should be used", "kvm", "", []byte("largelargelargelarge"), "bulk"},
+		{"unrouted image should use default", "kvm", "", []byte("small"), ""},
+		{"requested store should be used", "kvm", "ssd", []byte("largelargelargelarge"), "ssd"},
+		{"requested default should be used", "container", "default", []byte("small"), ""},
+	}
+
+	for _, test := range tests {
+		req, _ := http.NewRequest("PUT", "http://localhost", bytes.NewReader(test.data))
+		req.Header.Add("X-Image-Type", test.imageType)
+		req.Header.Add("X-Image-Store", test.imageStore)
+
+		image, err := s.Context.Fetcher.Receive(req)
+		s.Require().NoError(err, test.description)
+		s.Equal(test.expectedStore, image.ImageStore, test.description)
+
+		store, err := s.Context.GetImageStore(test.expectedStore)
+		s.Require().NoError(err)
+		out := &bytes.Buffer{}
+		s.NoError(store.Get(image.BlobID(), out), test.description)
+		s.Equal(test.data, out.Bytes(), test.description)
+	}
+
+	req, _ := http.NewRequest("PUT", "http://localhost", bytes.NewReader([]byte("small")))
+	req.Header.Add("X-Image-Type", "kvm")
+	req.Header.Add("X-Image-Store", "asdf")
+	_, err := s.Context.Fetcher.Receive(req)
+	s.Equal(imageservice.ErrUnknownImageStore, err, "unknown store should fail")
+}
+
+func (s *RouteTestSuite) TestFetch() {
+	data := []byte("largelargelargelarge")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(data)
+	}))
+	defer server.Close()
+
+	// Download details copied from elsewhere, such as a peer, should not
+	// keep the image from being routed
+	image, err := s.Context.Fetcher.Fetch(&metadata.Image{
+		ID:            metadata.NewID(),
+		Source:        server.URL,
+		Type:          "kvm",
+		DownloadStart: time.Now().Add(-time.Hour),
+		Attempts:      3,
+	})
+	s.Require().NoError(err)
+	s.True(image.DownloadStart.IsZero(), "download start should be cleared")
+	s.Zero(image.Attempts, "attempts should be cleared")
+
+	for i := 0; i < 100 && image.Status != metadata.StatusComplete; i++ {
+		time.Sleep(10 * time.Millisecond)
+		image, err = s.Context.MetadataStore.GetByID(image.ID)
+		s.Require().NoError(err)
+	}
+	s.Equal(metadata.StatusComplete, image.Status)
+	s.Equal("bulk", image.ImageStore, "size route should be used")
+	s.Equal(1, image.Attempts)
+}
+
+func (s *RouteTestSuite) TestRelease() {
+	req, _ := http.NewRequest("PUT", "http://localhost", bytes.NewReader([]byte("small")))
+	req.Header.Add("X-Image-Type", "container")
+	image, err := s.Context.Fetcher.Receive(req)
+	s.Require().NoError(err)
+
+	s.Require().NoError(s.Context.MetadataStore.Delete(image.ID))
+	s.NoError(s.Context.Blobs.Release(image))
+
+	store, err := s.Context.GetImageStore("ssd")
+	s.Require().NoError(err)
+	_, err = store.Stat(image.BlobID())
+	s.Error(err, "data should be removed from the image store")
+}
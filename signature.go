@@ -0,0 +1,264 @@
+package imageservice
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/mistifyio/mistify-image-service/images"
+	"github.com/mistifyio/mistify-image-service/metadata"
+	logx "github.com/mistifyio/mistify-logrus-ext"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/openpgp"
+)
+
+// Trusted key types
+const (
+	KeyTypeEd25519 = "ed25519"
+	KeyTypeOpenPGP = "openpgp"
+)
+
+// maxSignatureSize limits the size of a detached signature fetched from a
+// signature url
+const maxSignatureSize = 64 * 1024
+
+// ErrUnsignedImage is used when a download of an image without a verified
+// signature is refused
+var ErrUnsignedImage = errors.New("image signature not verified")
+
+type (
+	// TrustedKey configures a public key trusted to sign images. An ed25519
+	// key is the base64 encoded public key, and an openpgp key is an armored
+	// public key block.
+	TrustedKey struct {
+		Name string
+		Type string
+		Key  string
+	}
+
+	// Verifier verifies detached signatures of image data with the trusted
+	// keys. An ed25519 signature is of the raw sha256 digest of the data, and
+	// an openpgp signature, binary or armored, is of the data itself.
+	Verifier struct {
+		// RequireSigned refuses downloads of images without a verified
+		// signature
+		RequireSigned bool
+		ed25519Keys   []*ed25519Key
+		openpgpKeys   openpgp.EntityList
+		// openpgpNames maps openpgp key ids to the trusted key names
+		openpgpNames map[uint64]string
+		client       *http.Client
+	}
+
+	// ed25519Key is a trusted ed25519 public key
+	ed25519Key struct {
+		name string
+		key  ed25519.PublicKey
+	}
+)
+
+// NewVerifier creates a new Verifier for the configured trusted keys
+func NewVerifier() (*Verifier, error) {
+	verifier := &Verifier{
+		RequireSigned: viper.GetBool("requireSignedImages"),
+		openpgpNames:  make(map[uint64]string),
+		client:        &http.Client{},
+	}
+
+	var keys []*TrustedKey
+	// json errors would have been caught by viper when loading the file
+	keysJSON, _ := json.Marshal(viper.Get("trustedKeys"))
+	if err := json.Unmarshal(keysJSON, &keys); err != nil {
+		log.WithFields(log.Fields{
+			"error":  err,
+			"config": string(keysJSON),
+		}).Error("invalid trusted keys config")
+		return nil, err
+	}
+	for _, key := range keys {
+		if err := verifier.AddKey(key); err != nil {
+			return nil, err
+		}
+	}
+	return verifier, nil
+}
+
+// AddKey adds a trusted public key
+func (verifier *Verifier) AddKey(key *TrustedKey) error {
+	var err error
+	switch {
+	case key.Name == "":
+		err = errors.New("missing key name")
+	case key.Type == KeyTypeEd25519:
+		err = verifier.addEd25519Key(key)
+	case key.Type == KeyTypeOpenPGP:
+		err = verifier.addOpenPGPKey(key)
+	default:
+		err = errors.New("invalid key type")
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+			"name":  key.Name,
+			"type":  key.Type,
+		}).Error("invalid trusted key")
+		return err
+	}
+	return nil
+}
+
+// addEd25519Key adds a base64 encoded ed25519 public key
+func (verifier *Verifier) addEd25519Key(key *TrustedKey) error {
+	publicKey, err := base64.StdEncoding.DecodeString(key.Key)
+	if err != nil {
+		return err
+	}
+	if len(publicKey) != ed25519.PublicKeySize {
+		return errors.New("invalid ed25519 public key size")
+	}
+	verifier.ed25519Keys = append(verifier.ed25519Keys, &ed25519Key{
+		name: key.Name,
+		key:  ed25519.PublicKey(publicKey),
+	})
+	return nil
+}
+
+// addOpenPGPKey adds the keys of an armored openpgp public key block
+func (verifier *Verifier) addOpenPGPKey(key *TrustedKey) error {
+	entities, err := openpgp.ReadArmoredKeyRing(strings.NewReader(key.Key))
+	if err != nil {
+		return err
+	}
+	for _, entity := range entities {
+		verifier.openpgpNames[entity.PrimaryKey.KeyId] = key.Name
+	}
+	verifier.openpgpKeys = append(verifier.openpgpKeys, entities...)
+	return nil
+}
+
+// Verify verifies the signature of newly transferred image data, stored in the
+// image store under the image id, recording the result on the image. The
+// signature is retrieved from the image signature url if it wasn't provided.
+// An image without a signature is recorded as unsigned.
+func (verifier *Verifier) Verify(image *metadata.Image, digest string, imageStore images.Store) error {
+	if image.Signature == "" && image.SignatureURL != "" {
+		signature, err := verifier.fetchSignature(image)
+		if err != nil {
+			return err
+		}
+		image.Signature = base64.StdEncoding.EncodeToString(signature)
+	}
+	if image.Signature == "" {
+		image.SignatureStatus = metadata.SignatureUnsigned
+		image.Signer = ""
+		return nil
+	}
+
+	signer, err := verifier.check(image, digest, imageStore)
+	if err != nil {
+		image.SignatureStatus = metadata.SignatureInvalid
+		image.Signer = ""
+		log.WithFields(log.Fields{
+			"error": err,
+			"image": image,
+		}).Error(metadata.ErrSignatureInvalid)
+		return metadata.ErrSignatureInvalid
+	}
+	image.SignatureStatus = metadata.SignatureVerified
+	image.Signer = signer
+	return nil
+}
+
+// check verifies the signature of image data with the trusted keys, returning
+// the name of the key that made it
+func (verifier *Verifier) check(image *metadata.Image, digest string, imageStore images.Store) (string, error) {
+	signature, err := base64.StdEncoding.DecodeString(image.Signature)
+	if err != nil {
+		return "", err
+	}
+
+	if len(signature) == ed25519.SignatureSize {
+		digestBytes, err := hex.DecodeString(digest)
+		if err != nil {
+			return "", err
+		}
+		for _, key := range verifier.ed25519Keys {
+			if ed25519.Verify(key.key, digestBytes, signature) {
+				return key.name, nil
+			}
+		}
+		return "", metadata.ErrSignatureInvalid
+	}
+
+	if len(verifier.openpgpKeys) == 0 {
+		return "", metadata.ErrSignatureInvalid
+	}
+	// Stream the data from the image store through the signature check
+	data, dataWriter := io.Pipe()
+	go func() {
+		_ = dataWriter.CloseWithError(imageStore.Get(image.ID, dataWriter))
+	}()
+	defer logx.LogReturnedErr(data.Close, nil, "failed to close image data pipe")
+
+	check := openpgp.CheckDetachedSignature
+	if bytes.HasPrefix(bytes.TrimSpace(signature), []byte("-----BEGIN")) {
+		check = openpgp.CheckArmoredDetachedSignature
+	}
+	entity, err := check(verifier.openpgpKeys, data, bytes.NewReader(signature))
+	if err != nil {
+		return "", err
+	}
+	return verifier.openpgpNames[entity.PrimaryKey.KeyId], nil
+}
+
+// fetchSignature retrieves the detached signature of an image from its
+// signature url
+func (verifier *Verifier) fetchSignature(image *metadata.Image) ([]byte, error) {
+	resp, err := verifier.client.Get(image.SignatureURL)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+			"image": image,
+		}).Error("failed to fetch signature")
+		return nil, err
+	}
+	defer logx.LogReturnedErr(resp.Body.Close, nil, "failed to close response body")
+
+	if resp.StatusCode != http.StatusOK {
+		err := errors.New("unexpected signature response status")
+		log.WithFields(log.Fields{
+			"error":      err,
+			"image":      image,
+			"statusCode": resp.StatusCode,
+		}).Error(err)
+		return nil, err
+	}
+
+	signature, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxSignatureSize+1))
+	if err == nil && len(signature) > maxSignatureSize {
+		err = errors.New("signature too large")
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+			"image": image,
+		}).Error("failed to read signature")
+		return nil, err
+	}
+	return signature, nil
+}
+
+// IsValidSignature tests whether a signature provided with an image is valid
+// base64
+func IsValidSignature(signature string) bool {
+	_, err := base64.StdEncoding.DecodeString(signature)
+	return err == nil
+}
@@ -0,0 +1,289 @@
+package imageservice_test
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mistifyio/mistify-image-service"
+	"github.com/mistifyio/mistify-image-service/images"
+	"github.com/mistifyio/mistify-image-service/metadata"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/suite"
+	"github.com/tylerb/graceful"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+type SignatureTestSuite struct {
+	suite.Suite
+	Context       *imageservice.Context
+	APIServer     *graceful.Server
+	APIURL        string
+	ImageData     []byte
+	Ed25519Key    ed25519.PrivateKey
+	OpenPGPKey    *openpgp.Entity
+	UntrustedKey  *openpgp.Entity
+	TrustedKeys   []map[string]interface{}
+	RequireSigned bool
+}
+
+func (s *SignatureTestSuite) SetupSuite() {
+	log.SetLevel(log.FatalLevel)
+	s.ImageData = []byte("testdatatestdatatestdata")
+	s.APIURL = "http://localhost:54324/images"
+
+	var err error
+	_, s.Ed25519Key, err = ed25519.GenerateKey(rand.Reader)
+	s.Require().NoError(err)
+	s.OpenPGPKey, err = openpgp.NewEntity("signer", "", "signer@example.com", nil)
+	s.Require().NoError(err)
+	s.UntrustedKey, err = openpgp.NewEntity("untrusted", "", "untrusted@example.com", nil)
+	s.Require().NoError(err)
+
+	armored := &bytes.Buffer{}
+	w, err := armor.Encode(armored, openpgp.PublicKeyType, nil)
+	s.Require().NoError(err)
+	s.Require().NoError(s.OpenPGPKey.Serialize(w))
+	s.Require().NoError(w.Close())
+
+	s.TrustedKeys = []map[string]interface{}{
+		{
+			"name": "edkey",
+			"type": imageservice.KeyTypeEd25519,
+			"key":  base64.StdEncoding.EncodeToString(s.Ed25519Key.Public().(ed25519.PublicKey)),
+		},
+		{
+			"name": "pgpkey",
+			"type": imageservice.KeyTypeOpenPGP,
+			"key":  armored.String(),
+		},
+	}
+}
+
+func (s *SignatureTestSuite) SetupTest() {
+	s.RequireSigned = false
+	s.newContext()
+}
+
+func (s *SignatureTestSuite) TearDownTest() {
+	viper.Set("trustedKeys", nil)
+	viper.Set("requireSignedImages", nil)
+	viper.Set("fetchRetries", nil)
+	s.stopServer()
+}
+
+func TestSignatureTestSuite(t *testing.T) {
+	suite.Run(t, new(SignatureTestSuite))
+}
+
+func (s *SignatureTestSuite) TestAddKey() {
+	tests := []struct {
+		description string
+		key         *imageservice.TrustedKey
+		expectedErr bool
+	}{
+		{"missing name should fail",
+			&imageservice.TrustedKey{Type: imageservice.KeyTypeEd25519, Key: s.TrustedKeys[0]["key"].(string)}, true},
+		{"invalid type should fail",
+			&imageservice.TrustedKey{Name: "foo", Type: "asdf", Key: "asdf"}, true},
+		{"invalid ed25519 key should fail",
+			&imageservice.TrustedKey{Name: "foo", Type: imageservice.KeyTypeEd25519, Key: "asdf"}, true},
+		{"short ed25519 key should fail",
+			&imageservice.TrustedKey{Name: "foo", Type: imageservice.KeyTypeEd25519, Key: "YXNkZg=="}, true},
+		{"invalid openpgp key should fail",
+			&imageservice.TrustedKey{Name: "foo", Type: imageservice.KeyTypeOpenPGP, Key: "asdf"}, true},
+		{"ed25519 key should succeed",
+			&imageservice.TrustedKey{Name: "foo", Type: imageservice.KeyTypeEd25519, Key: s.TrustedKeys[0]["key"].(string)}, false},
+		{"openpgp key should succeed",
+			&imageservice.TrustedKey{Name: "foo", Type: imageservice.KeyTypeOpenPGP, Key: s.TrustedKeys[1]["key"].(string)}, false},
+	}
+
+	for _, test := range tests {
+		err := s.Context.Verifier.AddKey(test.key)
+		if test.expectedErr {
+			s.Error(err, test.description)
+		} else {
+			s.NoError(err, test.description)
+		}
+	}
+}
+
+func (s *SignatureTestSuite) TestReceive() {
+	digest := sha256.Sum256(s.ImageData)
+	tests := []struct {
+		description    string
+		signature      []byte
+		expectedErr    error
+		expectedStatus string
+		expectedSigner string
+	}{
+		{"unsigned image should be unsigned",
+			nil, nil, metadata.SignatureUnsigned, ""},
+		{"ed25519 signature should be verified",
+			ed25519.Sign(s.Ed25519Key, digest[:]), nil, metadata.SignatureVerified, "edkey"},
+		{"ed25519 signature of other data should fail",
+			ed25519.Sign(s.Ed25519Key, []byte("otherdata")), metadata.ErrSignatureInvalid, metadata.SignatureInvalid, ""},
+		{"openpgp signature should be verified",
+			s.pgpSign(s.OpenPGPKey, s.ImageData, false), nil, metadata.SignatureVerified, "pgpkey"},
+		{"armored openpgp signature should be verified",
+			s.pgpSign(s.OpenPGPKey, s.ImageData, true), nil, metadata.SignatureVerified, "pgpkey"},
+		{"openpgp signature of other data should fail",
+			s.pgpSign(s.OpenPGPKey, []byte("otherdata"), false), metadata.ErrSignatureInvalid, metadata.SignatureInvalid, ""},
+		{"openpgp signature by an untrusted key should fail",
+			s.pgpSign(s.UntrustedKey, s.ImageData, false), metadata.ErrSignatureInvalid, metadata.SignatureInvalid, ""},
+	}
+
+	for _, test := range tests {
+		req, _ := http.NewRequest("PUT", "http://localhost", bytes.NewReader(s.ImageData))
+		req.Header.Add("X-Image-Type", "kvm")
+		if test.signature != nil {
+			req.Header.Add("X-Image-Signature", base64.StdEncoding.EncodeToString(test.signature))
+		}
+
+		image, err := s.Context.Fetcher.Receive(req)
+		s.Equal(test.expectedErr, err, test.description)
+		s.Equal(test.expectedStatus, image.SignatureStatus, test.description)
+		s.Equal(test.expectedSigner, image.Signer, test.description)
+		if test.expectedErr != nil {
+			s.Equal(metadata.StatusError, image.Status, test.description)
+			_, err := s.Context.ImageStore.Stat(image.ID)
+			s.Error(err, "data that fails verification should be removed")
+		}
+	}
+}
+
+func (s *SignatureTestSuite) TestFetch() {
+	signature := s.pgpSign(s.OpenPGPKey, s.ImageData, true)
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/image":
+			_, _ = w.Write(s.ImageData)
+		case "/image.asc":
+			_, _ = w.Write(signature)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer source.Close()
+
+	signed := s.fetch(&metadata.Image{
+		Source:          source.URL + "/image",
+		Type:            "kvm",
+		SignatureURL:    source.URL + "/image.asc",
+		SignatureStatus: metadata.SignatureVerified,
+	})
+	s.Equal(metadata.StatusComplete, signed.Status)
+	s.Equal(metadata.SignatureVerified, signed.SignatureStatus)
+	s.Equal("pgpkey", signed.Signer)
+	s.Equal(base64.StdEncoding.EncodeToString(signature), signed.Signature, "signature should be kept")
+
+	missing := s.fetch(&metadata.Image{
+		Source:          source.URL + "/image?missing",
+		Type:            "kvm",
+		SignatureURL:    source.URL + "/missing.asc",
+		SignatureStatus: metadata.SignatureVerified,
+	})
+	s.Equal(metadata.StatusError, missing.Status, "missing signature should fail")
+	s.Empty(missing.SignatureStatus, "signature status should not be taken from the request")
+}
+
+func (s *SignatureTestSuite) TestRequireSigned() {
+	s.RequireSigned = true
+	s.newContext()
+
+	digest := sha256.Sum256(s.ImageData)
+	signed := s.receiveImage(ed25519.Sign(s.Ed25519Key, digest[:]))
+	unsigned := s.receiveImage(nil)
+
+	resp, err := http.Get(s.APIURL + "/" + signed.ID + "/download")
+	s.Require().NoError(err)
+	_ = resp.Body.Close()
+	s.Equal(http.StatusOK, resp.StatusCode)
+
+	resp, err = http.Get(s.APIURL + "/" + unsigned.ID + "/download")
+	s.Require().NoError(err)
+	_ = resp.Body.Close()
+	s.Equal(http.StatusForbidden, resp.StatusCode, "unsigned image download should be refused")
+}
+
+// newContext creates a context with the trusted keys and starts an API server
+// for it, replacing any existing one
+func (s *SignatureTestSuite) newContext() {
+	s.stopServer()
+
+	viper.Set("imageStoreType", "memory")
+	viper.Set("imageStoreConfig", &images.MemoryConfig{})
+	viper.Set("metadataStoreType", "memory")
+	viper.Set("metadataStoreConfig", &metadata.MemoryConfig{})
+	viper.Set("trustedKeys", s.TrustedKeys)
+	viper.Set("requireSignedImages", s.RequireSigned)
+	viper.Set("fetchRetries", 0)
+
+	ctx, err := imageservice.NewContext()
+	s.Require().NoError(err)
+	s.Context = ctx
+	s.APIServer = imageservice.Run(ctx, 54324)
+	time.Sleep(100 * time.Millisecond)
+}
+
+// stopServer stops the API server, if running
+func (s *SignatureTestSuite) stopServer() {
+	if s.APIServer == nil {
+		return
+	}
+	stopChan := s.APIServer.StopChan()
+	s.APIServer.Stop(5 * time.Second)
+	<-stopChan
+	s.APIServer = nil
+}
+
+// receiveImage stores the image data as a new image with a signature
+func (s *SignatureTestSuite) receiveImage(signature []byte) *metadata.Image {
+	req, _ := http.NewRequest("PUT", "http://localhost", bytes.NewReader(s.ImageData))
+	req.Header.Add("X-Image-Type", "kvm")
+	if signature != nil {
+		req.Header.Add("X-Image-Signature", base64.StdEncoding.EncodeToString(signature))
+	}
+
+	image, err := s.Context.Fetcher.Receive(req)
+	s.Require().NoError(err)
+	return image
+}
+
+// fetch fetches an image and waits for it to finish
+func (s *SignatureTestSuite) fetch(image *metadata.Image) *metadata.Image {
+	image.ID = metadata.NewID()
+	_, err := s.Context.Fetcher.Fetch(image)
+	s.Require().NoError(err)
+
+	for i := 0; i < 100; i++ {
+		current, err := s.Context.MetadataStore.GetByID(image.ID)
+		s.Require().NoError(err)
+		switch current.Status {
+		case metadata.StatusComplete, metadata.StatusError:
+			return current
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	s.FailNow("fetch did not finish")
+	return nil
+}
+
+// pgpSign makes a detached openpgp signature of data
+func (s *SignatureTestSuite) pgpSign(signer *openpgp.Entity, data []byte, armored bool) []byte {
+	signature := &bytes.Buffer{}
+	sign := openpgp.DetachSign
+	if armored {
+		sign = openpgp.ArmoredDetachSign
+	}
+	s.Require().NoError(sign(signature, signer, bytes.NewReader(data), nil))
+	return signature.Bytes()
+}
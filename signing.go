@@ -0,0 +1,174 @@
+package imageservice
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/mistifyio/mistify-image-service/metadata"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// SigningAlgorithm is the algorithm of the service signing key
+const SigningAlgorithm = KeyTypeEd25519
+
+// ErrSigningDisabled is used when no service signing key is configured
+var ErrSigningDisabled = errors.New("image signing not configured")
+
+type (
+	// Signer signs the digest of stored image data with the service signing
+	// key, so clients can verify downloads came from this service. Like an
+	// ed25519 trusted key, the signature is of the raw sha256 digest.
+	Signer struct {
+		key ed25519.PrivateKey
+		// KeyID identifies the signing key, as the hex encoded start of the
+		// sha256 digest of the public key
+		KeyID string
+	}
+
+	// ImageSignature is the service signature of the data of an image
+	ImageSignature struct {
+		ImageID   string `json:"image_id"`
+		Digest    string `json:"digest"`
+		Algorithm string `json:"algorithm"`
+		KeyID     string `json:"key_id"`
+		Signature string `json:"signature"`
+	}
+
+	// SigningKey is the public half of the service signing key
+	SigningKey struct {
+		Algorithm string `json:"algorithm"`
+		KeyID     string `json:"key_id"`
+		PublicKey string `json:"public_key"`
+	}
+)
+
+// NewSigner creates a new Signer for the configured signing key, either the
+// base64 encoded ed25519 seed or private key. Signing is disabled without one.
+func NewSigner() (*Signer, error) {
+	signer := &Signer{}
+
+	encodedKey := viper.GetString("signingKey")
+	if encodedKey == "" {
+		return signer, nil
+	}
+
+	key, err := base64.StdEncoding.DecodeString(encodedKey)
+	if err == nil {
+		switch len(key) {
+		case ed25519.SeedSize:
+			signer.key = ed25519.NewKeyFromSeed(key)
+		case ed25519.PrivateKeySize:
+			signer.key = ed25519.PrivateKey(key)
+		default:
+			err = errors.New("invalid signing key size")
+		}
+	}
+	if err != nil {
+		log.WithField("error", err).Error("invalid signing key")
+		return nil, err
+	}
+
+	publicDigest := sha256.Sum256(signer.key.Public().(ed25519.PublicKey))
+	signer.KeyID = hex.EncodeToString(publicDigest[:8])
+	return signer, nil
+}
+
+// Enabled tests whether a signing key is configured
+func (signer *Signer) Enabled() bool {
+	return signer.key != nil
+}
+
+// Sign records the service signature of newly transferred image data on the
+// image. Nothing is recorded when signing is disabled.
+func (signer *Signer) Sign(image *metadata.Image, digest string) error {
+	if !signer.Enabled() {
+		return nil
+	}
+
+	signature, err := signer.sign(digest)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error":  err,
+			"image":  image,
+			"digest": digest,
+		}).Error("failed to sign image")
+		return err
+	}
+	image.ServiceSignature = signature
+	image.ServiceKeyID = signer.KeyID
+	return nil
+}
+
+// ImageSignature returns the service signature of a complete image. Images
+// stored before the current signing key was configured are signed on request.
+func (signer *Signer) ImageSignature(image *metadata.Image) (*ImageSignature, error) {
+	if !signer.Enabled() {
+		return nil, ErrSigningDisabled
+	}
+
+	signature := image.ServiceSignature
+	if image.ServiceKeyID != signer.KeyID {
+		var err error
+		if signature, err = signer.sign(image.Digest); err != nil {
+			return nil, err
+		}
+	}
+	return &ImageSignature{
+		ImageID:   image.ID,
+		Digest:    image.Digest,
+		Algorithm: SigningAlgorithm,
+		KeyID:     signer.KeyID,
+		Signature: signature,
+	}, nil
+}
+
+// PublicKey returns the public half of the signing key
+func (signer *Signer) PublicKey() (*SigningKey, error) {
+	if !signer.Enabled() {
+		return nil, ErrSigningDisabled
+	}
+	return &SigningKey{
+		Algorithm: SigningAlgorithm,
+		KeyID:     signer.KeyID,
+		PublicKey: base64.StdEncoding.EncodeToString(signer.key.Public().(ed25519.PublicKey)),
+	}, nil
+}
+
+// sign signs a hex encoded digest, returning the base64 encoded signature
+func (signer *Signer) sign(digest string) (string, error) {
+	digestBytes, err := hex.DecodeString(digest)
+	if err != nil {
+		return "", err
+	}
+	if len(digestBytes) != sha256.Size {
+		return "", errors.New("invalid digest")
+	}
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(signer.key, digestBytes)), nil
+}
+
+// RegisterWellKnownRoutes registers the routes and handlers for well-known
+// service information
+func RegisterWellKnownRoutes(prefix string, router *mux.Router) {
+	sub := router.PathPrefix(prefix).Subrouter()
+	sub.HandleFunc("/mistify-image-service/signing-key", signingKeyHandler).Methods("GET")
+}
+
+// signingKeyHandler publishes the public key that image signatures can be
+// verified with
+func signingKeyHandler(w http.ResponseWriter, r *http.Request) {
+	hr := HTTPResponse{w}
+	ctx := GetContext(r)
+
+	key, err := ctx.Signer.PublicKey()
+	if err != nil {
+		hr.JSONError(http.StatusNotFound, err)
+		return
+	}
+	hr.JSON(http.StatusOK, key)
+}
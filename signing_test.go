@@ -0,0 +1,201 @@
+package imageservice_test
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/mistifyio/mistify-image-service"
+	"github.com/mistifyio/mistify-image-service/images"
+	"github.com/mistifyio/mistify-image-service/metadata"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/suite"
+	"github.com/tylerb/graceful"
+)
+
+type SigningTestSuite struct {
+	suite.Suite
+	Context    *imageservice.Context
+	APIServer  *graceful.Server
+	APIURL     string
+	ImageData  []byte
+	SigningKey ed25519.PrivateKey
+}
+
+func (s *SigningTestSuite) SetupSuite() {
+	log.SetLevel(log.FatalLevel)
+	s.ImageData = []byte("testdatatestdatatestdata")
+	s.APIURL = "http://localhost:54325"
+
+	var err error
+	_, s.SigningKey, err = ed25519.GenerateKey(rand.Reader)
+	s.Require().NoError(err)
+}
+
+func (s *SigningTestSuite) SetupTest() {
+	s.newContext(base64.StdEncoding.EncodeToString(s.SigningKey.Seed()))
+}
+
+func (s *SigningTestSuite) TearDownTest() {
+	viper.Set("signingKey", nil)
+	s.stopServer()
+}
+
+func TestSigningTestSuite(t *testing.T) {
+	suite.Run(t, new(SigningTestSuite))
+}
+
+func (s *SigningTestSuite) TestNewSigner() {
+	tests := []struct {
+		description string
+		key         string
+		expectedErr bool
+		enabled     bool
+	}{
+		{"no key should disable signing",
+			"", false, false},
+		{"invalid base64 should fail",
+			"asdf!", true, false},
+		{"invalid key size should fail",
+			"YXNkZg==", true, false},
+		{"seed should succeed",
+			base64.StdEncoding.EncodeToString(s.SigningKey.Seed()), false, true},
+		{"private key should succeed",
+			base64.StdEncoding.EncodeToString(s.SigningKey), false, true},
+	}
+
+	for _, test := range tests {
+		viper.Set("signingKey", test.key)
+		signer, err := imageservice.NewSigner()
+		if test.expectedErr {
+			s.Error(err, test.description)
+			continue
+		}
+		s.NoError(err, test.description)
+		s.Equal(test.enabled, signer.Enabled(), test.description)
+	}
+}
+
+func (s *SigningTestSuite) TestSign() {
+	image := s.receiveImage()
+	s.Equal(s.Context.Signer.KeyID, image.ServiceKeyID)
+
+	signature, err := base64.StdEncoding.DecodeString(image.ServiceSignature)
+	s.Require().NoError(err)
+	digest := sha256.Sum256(s.ImageData)
+	s.True(ed25519.Verify(s.SigningKey.Public().(ed25519.PublicKey), digest[:], signature),
+		"signature should be of the image digest")
+}
+
+func (s *SigningTestSuite) TestVerifyDownload() {
+	image := s.receiveImage()
+
+	// Verify the download end to end, the way a client would
+	key := &imageservice.SigningKey{}
+	s.Equal(http.StatusOK, s.getJSON("/.well-known/mistify-image-service/signing-key", key))
+	s.Equal(imageservice.SigningAlgorithm, key.Algorithm)
+	publicKey, err := base64.StdEncoding.DecodeString(key.PublicKey)
+	s.Require().NoError(err)
+
+	imageSignature := &imageservice.ImageSignature{}
+	s.Equal(http.StatusOK, s.getJSON("/images/"+image.ID+"/signature", imageSignature))
+	s.Equal(key.KeyID, imageSignature.KeyID)
+
+	resp, err := http.Get(s.APIURL + "/images/" + image.ID + "/download")
+	s.Require().NoError(err)
+	data, err := ioutil.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	s.Require().NoError(err)
+
+	digest := sha256.Sum256(data)
+	s.Equal(hex.EncodeToString(digest[:]), imageSignature.Digest)
+	signature, err := base64.StdEncoding.DecodeString(imageSignature.Signature)
+	s.Require().NoError(err)
+	s.True(ed25519.Verify(ed25519.PublicKey(publicKey), digest[:], signature), "download should verify")
+
+	s.Equal(http.StatusNotFound, s.getJSON("/images/asdf/signature", &struct{}{}))
+}
+
+func (s *SigningTestSuite) TestUnsigned() {
+	s.newContext("")
+	image := s.receiveImage()
+	s.Empty(image.ServiceSignature)
+
+	s.Equal(http.StatusNotFound, s.getJSON("/.well-known/mistify-image-service/signing-key", &struct{}{}))
+	s.Equal(http.StatusNotFound, s.getJSON("/images/"+image.ID+"/signature", &struct{}{}))
+
+	// Images stored before signing was configured are signed on request
+	_, newKey, err := ed25519.GenerateKey(rand.Reader)
+	s.Require().NoError(err)
+	viper.Set("signingKey", base64.StdEncoding.EncodeToString(newKey.Seed()))
+	s.Context.Signer, err = imageservice.NewSigner()
+	s.Require().NoError(err)
+
+	imageSignature, err := s.Context.Signer.ImageSignature(image)
+	s.Require().NoError(err)
+	signature, err := base64.StdEncoding.DecodeString(imageSignature.Signature)
+	s.Require().NoError(err)
+	digest := sha256.Sum256(s.ImageData)
+	s.True(ed25519.Verify(newKey.Public().(ed25519.PublicKey), digest[:], signature))
+}
+
+// newContext creates a context with a signing key and starts an API server for
+// it, replacing any existing one
+func (s *SigningTestSuite) newContext(signingKey string) {
+	s.stopServer()
+
+	viper.Set("imageStoreType", "memory")
+	viper.Set("imageStoreConfig", &images.MemoryConfig{})
+	viper.Set("metadataStoreType", "memory")
+	viper.Set("metadataStoreConfig", &metadata.MemoryConfig{})
+	viper.Set("signingKey", signingKey)
+
+	ctx, err := imageservice.NewContext()
+	s.Require().NoError(err)
+	s.Context = ctx
+	s.APIServer = imageservice.Run(ctx, 54325)
+	time.Sleep(100 * time.Millisecond)
+}
+
+// stopServer stops the API server, if running
+func (s *SigningTestSuite) stopServer() {
+	if s.APIServer == nil {
+		return
+	}
+	stopChan := s.APIServer.StopChan()
+	s.APIServer.Stop(5 * time.Second)
+	<-stopChan
+	s.APIServer = nil
+}
+
+// receiveImage stores the image data as a new image
+func (s *SigningTestSuite) receiveImage() *metadata.Image {
+	req, _ := http.NewRequest("PUT", "http://localhost", bytes.NewReader(s.ImageData))
+	req.Header.Add("X-Image-Type", "kvm")
+
+	image, err := s.Context.Fetcher.Receive(req)
+	s.Require().NoError(err)
+	return image
+}
+
+// getJSON retrieves a path from the API server, decoding a successful
+// response, and returns the response status
+func (s *SigningTestSuite) getJSON(path string, out interface{}) int {
+	resp, err := http.Get(s.APIURL + path)
+	s.Require().NoError(err)
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode == http.StatusOK {
+		s.NoError(json.NewDecoder(resp.Body).Decode(out))
+	}
+	return resp.StatusCode
+}